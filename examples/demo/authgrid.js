@@ -24,13 +24,36 @@ class AuthgridClient {
       // Determine key type based on algorithm
       const keyType = keypair.privateKey.algorithm.name === 'Ed25519' ? 'ed25519' : 'ecdsa';
 
+      // Request a registration challenge
+      const challengeResponse = await fetch(`${this.apiUrl}/register/challenge`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({
+          public_key: publicKey,
+          key_type: keyType
+        })
+      });
+
+      if (!challengeResponse.ok) {
+        const error = await challengeResponse.json();
+        throw new Error(error.error || 'Registration challenge failed');
+      }
+
+      const { challenge } = await challengeResponse.json();
+
+      // Prove we hold the private key
+      const statement = `authgrid-register\n${challenge}\n${keyType}\n${publicKey}`;
+      const signature = await this.signBytes(new TextEncoder().encode(statement), keypair.privateKey);
+
       // Send registration request
       const response = await fetch(`${this.apiUrl}/register`, {
         method: 'POST',
         headers: { 'Content-Type': 'application/json' },
         body: JSON.stringify({
           public_key: publicKey,
-          key_type: keyType
+          key_type: keyType,
+          challenge,
+          signature
         })
       });
 
@@ -59,7 +82,7 @@ class AuthgridClient {
   /**
    * Authenticate with a handle
    * @param {string} handle - The user's handle
-   * @returns {Promise<{token: string, expiresAt: string}>}
+   * @returns {Promise<{token: string, expiresAt: string, refreshToken: string, refreshExpiresAt: string}>}
    */
   async authenticate(handle) {
     try {
@@ -81,10 +104,12 @@ class AuthgridClient {
         throw new Error(error.error || 'Challenge request failed');
       }
 
-      const { challenge } = await challengeResponse.json();
+      const { challenge, issued_at: issuedAt } = await challengeResponse.json();
 
-      // Sign challenge
-      const signature = await this.signChallenge(challenge, keypair.privateKey);
+      // Sign the login payload, bound to the server we are talking to
+      const origin = new URL(this.apiUrl).origin;
+      const payload = this.loginPayload(origin, handle, challenge, issuedAt);
+      const signature = await this.signBytes(new TextEncoder().encode(payload), keypair.privateKey);
 
       // Verify signature
       const verifyResponse = await fetch(`${this.apiUrl}/verify`, {
@@ -93,7 +118,8 @@ class AuthgridClient {
         body: JSON.stringify({
           handle,
           challenge,
-          signature
+          signature,
+          origin
         })
       });
 
@@ -107,6 +133,8 @@ class AuthgridClient {
       return {
         token: data.token,
         expiresAt: data.expires_at,
+        refreshToken: data.refresh_token,
+        refreshExpiresAt: data.refresh_expires_at,
         verified: data.verified
       };
     } catch (error) {
@@ -115,6 +143,34 @@ class AuthgridClient {
     }
   }
 
+  /**
+   * Exchange a refresh token for a new access token.
+   * The refresh token is single-use: always keep the one returned here.
+   * @param {string} refreshToken - Refresh token from authenticate() or a previous refresh
+   * @returns {Promise<{token: string, expiresAt: string, refreshToken: string, refreshExpiresAt: string}>}
+   */
+  async refresh(refreshToken) {
+    const response = await fetch(`${this.apiUrl}/token/refresh`, {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify({ refresh_token: refreshToken })
+    });
+
+    if (!response.ok) {
+      const error = await response.json();
+      throw new Error(error.error || 'Token refresh failed');
+    }
+
+    const data = await response.json();
+
+    return {
+      token: data.token,
+      expiresAt: data.expires_at,
+      refreshToken: data.refresh_token,
+      refreshExpiresAt: data.refresh_expires_at
+    };
+  }
+
   /**
    * Generate Ed25519 keypair
    * @private
@@ -158,12 +214,19 @@ class AuthgridClient {
   }
 
   /**
-   * Sign challenge with private key
+   * Build the versioned login payload (authgrid-login-v1)
    * @private
    */
-  async signChallenge(challengeBase64, privateKey) {
-    const challengeBytes = this.base64ToArrayBuffer(challengeBase64);
+  loginPayload(origin, handle, challenge, issuedAt) {
+    const issuedAtSeconds = Math.floor(Date.parse(issuedAt) / 1000);
+    return `authgrid-login-v1\n${origin}\n${handle}\n${challenge}\n${issuedAtSeconds}`;
+  }
 
+  /**
+   * Sign bytes with private key
+   * @private
+   */
+  async signBytes(bytes, privateKey) {
     // Determine algorithm based on key type
     const keyAlgorithm = privateKey.algorithm.name;
     let signature;
@@ -172,7 +235,7 @@ class AuthgridClient {
       signature = await crypto.subtle.sign(
         'Ed25519',
         privateKey,
-        challengeBytes
+        bytes
       );
     } else if (keyAlgorithm === 'ECDSA') {
       signature = await crypto.subtle.sign(
@@ -181,7 +244,7 @@ class AuthgridClient {
           hash: { name: 'SHA-256' }
         },
         privateKey,
-        challengeBytes
+        bytes
       );
     } else {
       throw new Error('Unsupported key algorithm');
@@ -51,6 +51,28 @@ app.get('/api/session', (req, res) => {
   }
 });
 
+// Registration challenge endpoint (proxy to Authgrid API)
+app.post('/api/register/challenge', async (req, res) => {
+  try {
+    const response = await fetch(`${AUTHGRID_API}/register/challenge`, {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify(req.body)
+    });
+
+    const data = await response.json();
+
+    if (!response.ok) {
+      return res.status(response.status).json(data);
+    }
+
+    res.json(data);
+  } catch (error) {
+    console.error('Registration challenge error:', error);
+    res.status(500).json({ error: 'Registration challenge failed' });
+  }
+});
+
 // Register endpoint (proxy to Authgrid API)
 app.post('/api/register', async (req, res) => {
   try {
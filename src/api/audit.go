@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Audit event types
+const (
+	auditRegister          = "register"
+	auditLogin             = "login"
+	auditLoginLocked       = "login.locked"
+	auditLockout           = "lockout"
+	auditLogout            = "logout"
+	auditSessionRevoke     = "session.revoke"
+	auditRefreshReuse      = "refresh.reuse"
+	auditKeyAdd            = "key.add"
+	auditKeyRemove         = "key.remove"
+	auditKeyRotate         = "key.rotate"
+	auditRecoveryKeys      = "recovery_keys.add"
+	auditRecoveryKeyRemove = "recovery_keys.remove"
+	auditRecover           = "recover"
+	auditGuardiansSet      = "guardians.set"
+	auditSocialRecovery    = "social_recovery.start"
+	auditSocialApprove     = "social_recovery.approve"
+	auditSocialCancel      = "social_recovery.cancel"
+	auditSocialRecovered   = "social_recovery.complete"
+)
+
+// Audit outcomes
+const (
+	outcomeSuccess = "success"
+	outcomeFailure = "failure"
+)
+
+// auditGenesisHash is the previous hash of the first event
+var auditGenesisHash = strings.Repeat("0", 64)
+
+// auditEvent is one entry of the audit log. Each entry's hash covers its
+// fields and the previous entry's hash, so editing or deleting an entry
+// breaks every hash after it.
+type auditEvent struct {
+	Seq       int64     `json:"seq"`
+	Time      time.Time `json:"time"`
+	Type      string    `json:"type"`
+	Handle    string    `json:"handle,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Outcome   string    `json:"outcome"`
+	Reason    string    `json:"reason,omitempty"`
+	PrevHash  string    `json:"prev_hash"`
+	Hash      string    `json:"hash"`
+}
+
+// auditQuery filters audit events. Results are in sequence order, starting
+// after AfterSeq.
+type auditQuery struct {
+	Handle   string
+	Type     string
+	Since    time.Time
+	Until    time.Time
+	AfterSeq int64
+	Limit    int
+}
+
+// computeHash returns the hash of the event chained to prevHash. Time is
+// hashed at microsecond precision, which every backend preserves.
+func (e *auditEvent) computeHash(prevHash string) string {
+	fields, _ := json.Marshal([]string{
+		prevHash,
+		strconv.FormatInt(e.Seq, 10),
+		e.Time.UTC().Truncate(time.Microsecond).Format(time.RFC3339Nano),
+		e.Type, e.Handle, e.IP, e.UserAgent, e.Outcome, e.Reason,
+	})
+	sum := sha256.Sum256(fields)
+	return hex.EncodeToString(sum[:])
+}
+
+// chain sets the sequence number and hashes of an event appended after
+// the event with sequence prevSeq and hash prevHash
+func (e *auditEvent) chain(prevSeq int64, prevHash string) {
+	e.Seq = prevSeq + 1
+	e.Time = e.Time.UTC().Truncate(time.Microsecond)
+	e.PrevHash = prevHash
+	e.Hash = e.computeHash(prevHash)
+}
+
+// recordAudit appends an event about handle for a request. A failure to
+// write the audit log is logged but doesn't fail the request.
+func recordAudit(r *http.Request, eventType, handle, outcome, reason string) {
+	if store == nil {
+		return
+	}
+	ev := &auditEvent{
+		Time:      time.Now(),
+		Type:      eventType,
+		Handle:    handle,
+		IP:        clientIP(r),
+		UserAgent: r.UserAgent(),
+		Outcome:   outcome,
+		Reason:    reason,
+	}
+	if err := store.AppendAuditEvent(r.Context(), ev); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to write audit event", "type", eventType, "handle_hash", handleHash(handle), "error", err)
+	}
+}
+
+// requireAdmin only lets requests bearing AUTHGRID_ADMIN_TOKEN through
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		adminToken := currentConfig().Auth.AdminToken
+		if adminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			respondError(w, http.StatusUnauthorized, "Admin token required")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// auditEventsHandler lists audit events for admins
+func auditEventsHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	q := auditQuery{
+		Handle: params.Get("handle"),
+		Type:   params.Get("type"),
+		Limit:  100,
+	}
+
+	var err error
+	if v := params.Get("after"); v != "" {
+		if q.AfterSeq, err = strconv.ParseInt(v, 10, 64); err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid after")
+			return
+		}
+	}
+	if v := params.Get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit < 1 || q.Limit > 1000 {
+			respondError(w, http.StatusBadRequest, "Limit must be between 1 and 1000")
+			return
+		}
+	}
+	if v := params.Get("since"); v != "" {
+		if q.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid since, want RFC 3339")
+			return
+		}
+	}
+	if v := params.Get("until"); v != "" {
+		if q.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid until, want RFC 3339")
+			return
+		}
+	}
+
+	events, err := store.AuditEvents(r.Context(), q)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	resp := map[string]interface{}{"events": events}
+	if len(events) == q.Limit {
+		resp["next_after"] = events[len(events)-1].Seq
+	}
+	respondJSON(w, http.StatusOK, resp)
+}
+
+// auditCheckpointType is the JWS type of signed audit checkpoints
+const auditCheckpointType = "authgrid-audit-checkpoint"
+
+// auditCheckpoint pins the head of the audit log: event Seq had hash Hash
+// when the checkpoint was issued. Kept outside the database, it shows
+// events that were cut off the end of the log, which the chain alone can't.
+type auditCheckpoint struct {
+	Issuer   string `json:"iss"`
+	IssuedAt int64  `json:"iat"`
+	Seq      int64  `json:"seq"`
+	Hash     string `json:"hash"`
+}
+
+// auditHeadHandler returns the head of the audit log and a checkpoint of
+// it signed with the token signing key, for admins to store elsewhere
+func auditHeadHandler(w http.ResponseWriter, r *http.Request) {
+	seq, hash, err := store.AuditHead(r.Context())
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	checkpoint, err := signJWS(tokenKeys, auditCheckpointType, auditCheckpoint{
+		Issuer:   tokenIssuer(),
+		IssuedAt: time.Now().Unix(),
+		Seq:      seq,
+		Hash:     hash,
+	})
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to sign checkpoint")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"seq":        seq,
+		"hash":       hash,
+		"checkpoint": checkpoint,
+	})
+}
+
+// openAuditCheckpoint checks the signature of a checkpoint from
+// auditHeadHandler against the keys of kr and returns what it pins
+func openAuditCheckpoint(kr *keyRing, checkpoint string) (*auditCheckpoint, error) {
+	var cp auditCheckpoint
+	if err := openJWS(kr, strings.TrimSpace(checkpoint), auditCheckpointType, &cp); err != nil {
+		return nil, fmt.Errorf("invalid checkpoint: %w", err)
+	}
+	return &cp, nil
+}
+
+// verifyAuditChain walks the whole audit log and returns the number of
+// events checked, or an error naming the first event that doesn't chain.
+// With a checkpoint, the log must also still hold the event it pins,
+// unchanged.
+func verifyAuditChain(ctx context.Context, s Store, pin *auditCheckpoint) (int, error) {
+	prevSeq, prevHash := int64(0), auditGenesisHash
+	var checked int
+	for {
+		events, err := s.AuditEvents(ctx, auditQuery{AfterSeq: prevSeq, Limit: 1000})
+		if err != nil {
+			return checked, err
+		}
+		for _, e := range events {
+			switch {
+			case e.Seq != prevSeq+1:
+				return checked, fmt.Errorf("events %d to %d are missing", prevSeq+1, e.Seq-1)
+			case e.PrevHash != prevHash:
+				return checked, fmt.Errorf("event %d does not chain to event %d", e.Seq, prevSeq)
+			case e.computeHash(prevHash) != e.Hash:
+				return checked, fmt.Errorf("event %d was modified", e.Seq)
+			case pin != nil && e.Seq == pin.Seq && e.Hash != pin.Hash:
+				return checked, fmt.Errorf("event %d differs from the checkpoint", e.Seq)
+			}
+			prevSeq, prevHash = e.Seq, e.Hash
+			checked++
+		}
+		if len(events) < 1000 {
+			if pin != nil && prevSeq < pin.Seq {
+				return checked, fmt.Errorf("events %d to %d are missing from the end of the log", prevSeq+1, pin.Seq)
+			}
+			return checked, nil
+		}
+	}
+}
+
+// runAuditCommand implements `authgrid-api audit verify [checkpoint-file]`
+func runAuditCommand(args []string) {
+	if len(args) < 1 || len(args) > 2 || args[0] != "verify" {
+		log.Fatal("usage: authgrid-api audit verify [checkpoint-file]")
+	}
+
+	cfg, err := loadConfig(os.Getenv("AUTHGRID_CONFIG"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var pin *auditCheckpoint
+	if len(args) == 2 {
+		data, err := os.ReadFile(args[1])
+		if err != nil {
+			log.Fatal(err)
+		}
+		// Any key still on disk may have signed the checkpoint, however
+		// long ago it was superseded
+		kr, err := loadKeyRing(cfg.Tokens.KeysDir, cfg.Tokens.Alg, "", time.Duration(math.MaxInt64), false)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if pin, err = openAuditCheckpoint(kr, string(data)); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	s, err := openStore(cfg.Database.URL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	checked, err := verifyAuditChain(context.Background(), s, pin)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Audit log tampered after %d intact events: %v\n", checked, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Audit log intact: %d events\n", checked)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAuditChain(t *testing.T) {
+	for _, backend := range []string{"memory", "sqlite", "postgres"} {
+		t.Run(backend, func(t *testing.T) {
+			setupTestStore(t, backend)
+			setTestConfig(t, func(c *Config) { c.Auth.AdminToken = "test-admin-token" })
+
+			handle, privateKey := registerTestUser(t)
+			bad := signedLogin(t, handle, privateKey)
+			bad.Signature = bad.Signature[:4] + "AAAA" + bad.Signature[8:]
+			if code := doJSON(t, verifyHandler, bad, nil); code != http.StatusUnauthorized {
+				t.Fatalf("Bad signature returned %d, want 401", code)
+			}
+			if code := doJSON(t, verifyHandler, signedLogin(t, handle, privateKey), nil); code != http.StatusOK {
+				t.Fatalf("Login returned %d, want 200", code)
+			}
+
+			// Admins can list the handle's events
+			h := requireAdmin(auditEventsHandler)
+			req := httptest.NewRequest("GET", "/admin/audit?handle="+handle, nil)
+			rec := httptest.NewRecorder()
+			h(rec, req)
+			if rec.Code != http.StatusUnauthorized {
+				t.Fatalf("Audit query without a token returned %d, want 401", rec.Code)
+			}
+			req.Header.Set("Authorization", "Bearer test-admin-token")
+			rec = httptest.NewRecorder()
+			h(rec, req)
+			var resp struct {
+				Events []auditEvent `json:"events"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusOK {
+				t.Fatalf("Audit query returned %d %q", rec.Code, rec.Body.String())
+			}
+			want := []struct{ typ, outcome string }{
+				{auditRegister, outcomeSuccess},
+				{auditLogin, outcomeFailure},
+				{auditLogin, outcomeSuccess},
+			}
+			if len(resp.Events) != len(want) {
+				t.Fatalf("Got %d events, want %d", len(resp.Events), len(want))
+			}
+			for i, e := range resp.Events {
+				if e.Type != want[i].typ || e.Outcome != want[i].outcome || e.IP != "192.0.2.1" {
+					t.Errorf("Event %d is %s %s from %s, want %s %s", i, e.Type, e.Outcome, e.IP, want[i].typ, want[i].outcome)
+				}
+			}
+
+			if n, err := verifyAuditChain(context.Background(), store, nil); err != nil || n != len(want) {
+				t.Fatalf("verifyAuditChain = %d, %v; want %d, nil", n, err, len(want))
+			}
+
+			// Rewriting history breaks the chain
+			switch s := store.(type) {
+			case *memoryStore:
+				s.audit[1].Outcome = outcomeSuccess
+			case *sqliteStore:
+				s.db.Exec("UPDATE audit_events SET outcome = 'success' WHERE seq = 2")
+			case *postgresStore:
+				s.db.Exec("UPDATE audit_events SET outcome = 'success' WHERE seq = 2")
+			}
+			if _, err := verifyAuditChain(context.Background(), store, nil); err == nil {
+				t.Error("verifyAuditChain accepted a modified event")
+			}
+		})
+	}
+}
+
+// auditReasons returns the reasons of handle's audit events of one type and
+// outcome
+func auditReasons(t *testing.T, handle, eventType, outcome string) []string {
+	t.Helper()
+	events, err := store.AuditEvents(context.Background(), auditQuery{Handle: handle, Type: eventType, Limit: 1000})
+	if err != nil {
+		t.Fatalf("Failed to read audit events: %v", err)
+	}
+	var reasons []string
+	for _, ev := range events {
+		if ev.Outcome == outcome {
+			reasons = append(reasons, ev.Reason)
+		}
+	}
+	return reasons
+}
+
+func TestAuditCheckpoint(t *testing.T) {
+	for _, backend := range []string{"memory", "sqlite", "postgres"} {
+		t.Run(backend, func(t *testing.T) {
+			setupTestStore(t, backend)
+			setTestConfig(t, func(c *Config) { c.Auth.AdminToken = "test-admin-token" })
+			handle, privateKey := registerTestUser(t)
+			token := loginToken(t, handle, privateKey)
+
+			req := httptest.NewRequest("GET", "/admin/audit/head", nil)
+			req.Header.Set("Authorization", "Bearer test-admin-token")
+			rec := httptest.NewRecorder()
+			requireAdmin(auditHeadHandler)(rec, req)
+			var head struct {
+				Seq        int64  `json:"seq"`
+				Hash       string `json:"hash"`
+				Checkpoint string `json:"checkpoint"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &head); err != nil || rec.Code != http.StatusOK {
+				t.Fatalf("/admin/audit/head returned %d %q", rec.Code, rec.Body.String())
+			}
+			if head.Seq != 2 {
+				t.Fatalf("Head is event %d, want 2", head.Seq)
+			}
+			pin, err := openAuditCheckpoint(tokenKeys, head.Checkpoint)
+			if err != nil {
+				t.Fatalf("openAuditCheckpoint: %v", err)
+			}
+			if pin.Seq != head.Seq || pin.Hash != head.Hash {
+				t.Fatalf("Checkpoint pins %d %s, want %d %s", pin.Seq, pin.Hash, head.Seq, head.Hash)
+			}
+
+			// Only checkpoints this server signed are accepted
+			parts := strings.Split(head.Checkpoint, ".")
+			forged, _ := json.Marshal(auditCheckpoint{Issuer: pin.Issuer, IssuedAt: pin.IssuedAt, Seq: 1, Hash: pin.Hash})
+			parts[1] = base64.RawURLEncoding.EncodeToString(forged)
+			if _, err := openAuditCheckpoint(tokenKeys, strings.Join(parts, ".")); err == nil {
+				t.Error("openAuditCheckpoint accepted a forged checkpoint")
+			}
+			if _, err := openAuditCheckpoint(tokenKeys, token); err == nil {
+				t.Error("openAuditCheckpoint accepted an access token")
+			}
+
+			// Events after the checkpoint are fine
+			loginToken(t, handle, privateKey)
+			if n, err := verifyAuditChain(context.Background(), store, pin); err != nil || n != 3 {
+				t.Fatalf("verifyAuditChain = %d, %v; want 3, nil", n, err)
+			}
+
+			// Cutting the end off the log still chains, but not to the checkpoint
+			switch s := store.(type) {
+			case *memoryStore:
+				s.audit = s.audit[:pin.Seq-1]
+			case *sqliteStore:
+				s.db.Exec("DELETE FROM audit_events WHERE seq >= ?", pin.Seq)
+			case *postgresStore:
+				s.db.Exec("DELETE FROM audit_events WHERE seq >= $1", pin.Seq)
+			}
+			if _, err := verifyAuditChain(context.Background(), store, nil); err != nil {
+				t.Fatalf("verifyAuditChain without a checkpoint = %v, want nil", err)
+			}
+			if _, err := verifyAuditChain(context.Background(), store, pin); err == nil {
+				t.Error("verifyAuditChain accepted a log truncated before its checkpoint")
+			}
+		})
+	}
+}
+
+func TestRecoveryChangesAudited(t *testing.T) {
+	for _, backend := range []string{"memory", "sqlite", "postgres"} {
+		t.Run(backend, func(t *testing.T) {
+			setupTestStore(t, backend)
+			u := setupGuardians(t, 1, 1)
+			_, strangerKey := newTestKey(t)
+			sign := func(message []byte) string {
+				return base64.StdEncoding.EncodeToString(ed25519.Sign(strangerKey, message))
+			}
+
+			recoveryKey, _ := addTestRecoveryKey(t, u.handle, u.key)
+			challenge := newChallenge(t, u.handle)
+			keys := []RecoveryKeyInput{{PublicKey: recoveryKey.PublicKey, KeyType: "ed25519"}}
+			doJSON(t, addRecoveryKeysHandler, AddRecoveryKeysRequest{
+				Handle:       u.handle,
+				Challenge:    challenge,
+				Signature:    sign(addRecoveryKeysStatement(challenge, keys)),
+				RecoveryKeys: keys,
+			}, nil)
+
+			token := loginToken(t, u.handle, u.key)
+			for i := 0; i < 2; i++ {
+				doAuthed(t, token, map[string]string{"id": recoveryKey.ID}, removeRecoveryKeyHandler, nil)
+			}
+
+			challenge = newChallenge(t, u.handle)
+			doJSON(t, setGuardiansHandler, SetGuardiansRequest{
+				Handle:    u.handle,
+				Challenge: challenge,
+				Signature: sign(setGuardiansStatement(u.handle, challenge, 0, nil)),
+			}, nil)
+
+			publicKey, _ := newTestKey(t)
+			challenge = newChallenge(t, u.handle)
+			doJSON(t, startSocialRecoveryHandler, StartSocialRecoveryRequest{
+				Handle:    u.handle,
+				Challenge: challenge,
+				PublicKey: publicKey,
+				KeyType:   "ed25519",
+				Signature: sign(socialRecoveryStatement(u.handle, challenge, "ed25519", publicKey)),
+			}, nil)
+
+			rec, _ := startRecovery(t, u.handle)
+			challenge = newChallenge(t, u.guardians[0])
+			doJSONVars(t, "192.0.2.1:1234", map[string]string{"id": rec.ID}, approveSocialRecoveryHandler, ApproveSocialRecoveryRequest{
+				Guardian:  u.guardians[0],
+				Challenge: challenge,
+				Signature: sign(approveRecoveryStatement(rec, challenge)),
+			}, nil)
+			challenge = newChallenge(t, u.handle)
+			doJSONVars(t, "192.0.2.1:1234", map[string]string{"id": rec.ID}, cancelSocialRecoveryHandler, CancelSocialRecoveryRequest{
+				Challenge: challenge,
+				Signature: sign(cancelRecoveryStatement(rec.ID, challenge)),
+			}, nil)
+
+			for _, tt := range []struct {
+				eventType string
+				outcome   string
+				want      int
+			}{
+				{auditRecoveryKeys, outcomeSuccess, 1},
+				{auditRecoveryKeys, outcomeFailure, 1},
+				{auditRecoveryKeyRemove, outcomeSuccess, 1},
+				{auditRecoveryKeyRemove, outcomeFailure, 1},
+				{auditGuardiansSet, outcomeFailure, 1},
+				{auditSocialRecovery, outcomeFailure, 1},
+				{auditSocialApprove, outcomeFailure, 1},
+				{auditSocialCancel, outcomeFailure, 1},
+			} {
+				if got := auditReasons(t, u.handle, tt.eventType, tt.outcome); len(got) != tt.want {
+					t.Errorf("%d %s %s events, want %d: %q", len(got), tt.eventType, tt.outcome, tt.want, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// sealer, when set, switches challenges to sealed mode: they are verified
+// with a MAC instead of being stored, and only their IDs are remembered
+// once redeemed. Set from AUTHGRID_CHALLENGE_MODE=sealed.
+var sealer *challengeSealer
+
+// issuedChallenge is an outstanding challenge found by checkChallenge
+type issuedChallenge struct {
+	ID        string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// storeChallenge generates a challenge for a handle. In database mode it is
+// saved to the store; in sealed mode nothing is written.
+func storeChallenge(ctx context.Context, handle string) (*ChallengeResponse, error) {
+	// Whole seconds, since clients sign the issue time as a Unix timestamp
+	issuedAt := time.Now().UTC().Truncate(time.Second)
+	ch := &ChallengeResponse{
+		IssuedAt:  issuedAt,
+		ExpiresAt: issuedAt.Add(currentConfig().Tokens.ChallengeTTL),
+	}
+
+	if sealer != nil {
+		challenge, err := sealer.seal(handle, ch.IssuedAt, ch.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+		ch.Challenge = challenge
+		return ch, nil
+	}
+
+	challenge, err := generateChallenge()
+	if err != nil {
+		return nil, err
+	}
+	ch.Challenge = challenge
+
+	if err := store.SaveChallenge(ctx, handle, ch); err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+// checkChallenge looks up an outstanding challenge for a handle. If it is
+// missing, expired or already used an error response is written and false
+// is returned.
+func checkChallenge(w http.ResponseWriter, r *http.Request, handle, challenge string) (*issuedChallenge, bool) {
+	if sealer != nil {
+		ch, err := sealer.open(handle, challenge)
+		if err == errChallengeExpired {
+			respondError(w, http.StatusBadRequest, "Challenge expired")
+			return nil, false
+		}
+		if err != nil {
+			respondError(w, http.StatusNotFound, "Challenge not found")
+			return nil, false
+		}
+		return ch, true
+	}
+
+	ch, used, err := store.FindChallenge(r.Context(), handle, challenge)
+	if err == errNotFound {
+		respondError(w, http.StatusNotFound, "Challenge not found")
+		return nil, false
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database error")
+		return nil, false
+	}
+
+	// Check if challenge is expired
+	if time.Now().After(ch.ExpiresAt) {
+		respondError(w, http.StatusBadRequest, "Challenge expired")
+		return nil, false
+	}
+
+	// Check if challenge was already used
+	if used {
+		respondError(w, http.StatusBadRequest, "Challenge already used")
+		return nil, false
+	}
+
+	return ch, true
+}
+
+// discardChallenge uses up a challenge a request failed with, so the
+// request can't be retried with it
+func discardChallenge(r *http.Request, ch *issuedChallenge) {
+	if err := store.RedeemChallenge(r.Context(), ch); err != nil && err != errChallengeUsed {
+		slog.WarnContext(r.Context(), "Failed to discard challenge", "error", err)
+	}
+}
+
+// consumeChallenge marks a challenge as redeemed in Postgres. It returns
+// false if it had already been redeemed. Pass the transaction the
+// redemption belongs to so the mark is rolled back with it.
+//
+// checkChallenge's used check is only an early exit: this conditional
+// update is what makes redemption single-use. Of two concurrent requests
+// the second blocks on the row lock and then matches no row.
+func consumeChallenge(ctx context.Context, ex execer, ch *issuedChallenge) (bool, error) {
+	if sealer != nil {
+		return sealer.replay.consume(ctx, ex, ch.ID, ch.ExpiresAt)
+	}
+
+	var id string
+	err := ex.QueryRowContext(ctx, "UPDATE challenges SET used = TRUE WHERE id = $1 AND used = FALSE RETURNING id", ch.ID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Sealed challenge layout, base64 encoded:
+// version (1) | id (16) | issued at (8) | expires at (8) | HMAC-SHA256 (32)
+const (
+	sealedChallengeVersion = 1
+	sealedIDSize           = 16
+	sealedBodySize         = 1 + sealedIDSize + 8 + 8
+	sealedChallengeSize    = sealedBodySize + sha256.Size
+)
+
+var (
+	errChallengeInvalid = errors.New("invalid challenge")
+	errChallengeExpired = errors.New("challenge expired")
+)
+
+// challengeSealer issues and verifies sealed challenges
+type challengeSealer struct {
+	key    []byte
+	replay replayCache
+}
+
+// newChallengeSealer creates a sealer from a base64 key. With no key a
+// random one is generated, which only works with a single replica.
+func newChallengeSealer(key string, replay replayCache) (*challengeSealer, error) {
+	var keyBytes []byte
+	if key == "" {
+		slog.Warn("AUTHGRID_CHALLENGE_KEY not set, using a random key; sealed challenges won't work across replicas or restarts")
+		keyBytes = make([]byte, 32)
+		if _, err := rand.Read(keyBytes); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		keyBytes, err = base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid AUTHGRID_CHALLENGE_KEY: %w", err)
+		}
+		if len(keyBytes) < 32 {
+			return nil, fmt.Errorf("AUTHGRID_CHALLENGE_KEY must be at least 32 bytes")
+		}
+	}
+	return &challengeSealer{key: keyBytes, replay: replay}, nil
+}
+
+// mac authenticates a challenge body together with the handle it was
+// issued for, so it cannot be redeemed for another handle
+func (s *challengeSealer) mac(body []byte, handle string) []byte {
+	m := hmac.New(sha256.New, s.key)
+	m.Write([]byte("authgrid-challenge-v1\n"))
+	m.Write(body)
+	m.Write([]byte(handle))
+	return m.Sum(nil)
+}
+
+// seal issues a challenge for handle
+func (s *challengeSealer) seal(handle string, issuedAt, expiresAt time.Time) (string, error) {
+	body := make([]byte, sealedBodySize, sealedChallengeSize)
+	body[0] = sealedChallengeVersion
+	if _, err := rand.Read(body[1 : 1+sealedIDSize]); err != nil {
+		return "", err
+	}
+	binary.BigEndian.PutUint64(body[1+sealedIDSize:], uint64(issuedAt.Unix()))
+	binary.BigEndian.PutUint64(body[1+sealedIDSize+8:], uint64(expiresAt.Unix()))
+
+	return base64.StdEncoding.EncodeToString(append(body, s.mac(body, handle)...)), nil
+}
+
+// open verifies a sealed challenge for handle without any lookup
+func (s *challengeSealer) open(handle, challenge string) (*issuedChallenge, error) {
+	raw, err := base64.StdEncoding.DecodeString(challenge)
+	if err != nil || len(raw) != sealedChallengeSize || raw[0] != sealedChallengeVersion {
+		return nil, errChallengeInvalid
+	}
+
+	body, sum := raw[:sealedBodySize], raw[sealedBodySize:]
+	if !hmac.Equal(sum, s.mac(body, handle)) {
+		return nil, errChallengeInvalid
+	}
+
+	ch := &issuedChallenge{
+		ID:        hex.EncodeToString(body[1 : 1+sealedIDSize]),
+		IssuedAt:  time.Unix(int64(binary.BigEndian.Uint64(body[1+sealedIDSize:])), 0).UTC(),
+		ExpiresAt: time.Unix(int64(binary.BigEndian.Uint64(body[1+sealedIDSize+8:])), 0).UTC(),
+	}
+	if time.Now().After(ch.ExpiresAt) {
+		return nil, errChallengeExpired
+	}
+	return ch, nil
+}
+
+// replayCache remembers redeemed sealed challenges until they expire
+type replayCache interface {
+	// consume records id and returns false if it was already recorded
+	consume(ctx context.Context, ex execer, id string, expiresAt time.Time) (bool, error)
+}
+
+// memoryReplayCache is a replayCache for a single replica
+type memoryReplayCache struct {
+	mu        sync.Mutex
+	used      map[string]time.Time
+	lastPrune time.Time
+}
+
+func newMemoryReplayCache() *memoryReplayCache {
+	return &memoryReplayCache{used: make(map[string]time.Time)}
+}
+
+func (c *memoryReplayCache) consume(_ context.Context, _ execer, id string, expiresAt time.Time) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.lastPrune) > time.Minute {
+		for usedID, exp := range c.used {
+			if now.After(exp) {
+				delete(c.used, usedID)
+			}
+		}
+		c.lastPrune = now
+	}
+
+	if _, ok := c.used[id]; ok {
+		return false, nil
+	}
+	c.used[id] = expiresAt
+	return true, nil
+}
+
+// postgresReplayCache is a replayCache shared by all replicas through the
+// used_challenges table
+type postgresReplayCache struct {
+	db        *sql.DB
+	mu        sync.Mutex
+	lastPrune time.Time
+}
+
+func (c *postgresReplayCache) consume(ctx context.Context, ex execer, id string, expiresAt time.Time) (bool, error) {
+	c.mu.Lock()
+	prune := time.Since(c.lastPrune) > time.Minute
+	if prune {
+		c.lastPrune = time.Now()
+	}
+	c.mu.Unlock()
+
+	if prune {
+		if _, err := c.db.ExecContext(ctx, "DELETE FROM used_challenges WHERE expires_at < NOW()"); err != nil {
+			slog.Error("Failed to prune used challenges", "error", err)
+		}
+	}
+
+	result, err := ex.ExecContext(ctx, `
+		INSERT INTO used_challenges (id, expires_at) VALUES ($1, $2)
+		ON CONFLICT (id) DO NOTHING
+	`, id, expiresAt)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
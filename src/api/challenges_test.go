@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestSealer(t *testing.T) *challengeSealer {
+	t.Helper()
+	s, err := newChallengeSealer("", newMemoryReplayCache())
+	if err != nil {
+		t.Fatalf("newChallengeSealer failed: %v", err)
+	}
+	return s
+}
+
+func TestSealedChallengeRoundTrip(t *testing.T) {
+	s := newTestSealer(t)
+	issuedAt := time.Now().UTC().Truncate(time.Second)
+
+	challenge, err := s.seal("abc123def4@authgrid.net", issuedAt, issuedAt.Add(currentConfig().Tokens.ChallengeTTL))
+	if err != nil {
+		t.Fatalf("seal failed: %v", err)
+	}
+
+	ch, err := s.open("abc123def4@authgrid.net", challenge)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	if !ch.IssuedAt.Equal(issuedAt) {
+		t.Errorf("IssuedAt = %v, want %v", ch.IssuedAt, issuedAt)
+	}
+	if !ch.ExpiresAt.Equal(issuedAt.Add(currentConfig().Tokens.ChallengeTTL)) {
+		t.Errorf("ExpiresAt = %v, want %v", ch.ExpiresAt, issuedAt.Add(currentConfig().Tokens.ChallengeTTL))
+	}
+
+	other, _ := s.seal("abc123def4@authgrid.net", issuedAt, issuedAt.Add(currentConfig().Tokens.ChallengeTTL))
+	if other == challenge {
+		t.Error("Two sealed challenges are identical")
+	}
+}
+
+func TestSealedChallengeRejected(t *testing.T) {
+	s := newTestSealer(t)
+	now := time.Now().UTC()
+
+	challenge, err := s.seal("abc123def4@authgrid.net", now, now.Add(currentConfig().Tokens.ChallengeTTL))
+	if err != nil {
+		t.Fatalf("seal failed: %v", err)
+	}
+
+	if _, err := s.open("other@authgrid.net", challenge); err != errChallengeInvalid {
+		t.Errorf("Challenge for another handle: err = %v, want %v", err, errChallengeInvalid)
+	}
+
+	// Flip a character in the body
+	tampered := []byte(challenge)
+	if tampered[10] == 'A' {
+		tampered[10] = 'B'
+	} else {
+		tampered[10] = 'A'
+	}
+	if _, err := s.open("abc123def4@authgrid.net", string(tampered)); err != errChallengeInvalid {
+		t.Errorf("Tampered challenge: err = %v, want %v", err, errChallengeInvalid)
+	}
+
+	// A different key doesn't accept it
+	if _, err := newTestSealer(t).open("abc123def4@authgrid.net", challenge); err != errChallengeInvalid {
+		t.Errorf("Challenge under another key: err = %v, want %v", err, errChallengeInvalid)
+	}
+
+	expired, _ := s.seal("abc123def4@authgrid.net", now.Add(-time.Hour), now.Add(-time.Minute))
+	if _, err := s.open("abc123def4@authgrid.net", expired); err != errChallengeExpired {
+		t.Errorf("Expired challenge: err = %v, want %v", err, errChallengeExpired)
+	}
+}
+
+func TestNewChallengeSealerKey(t *testing.T) {
+	if _, err := newChallengeSealer("c2hvcnQ=", newMemoryReplayCache()); err == nil || !strings.Contains(err.Error(), "32 bytes") {
+		t.Errorf("Expected short key to be rejected, got %v", err)
+	}
+	if _, err := newChallengeSealer("not base64!", newMemoryReplayCache()); err == nil {
+		t.Error("Expected invalid key to be rejected")
+	}
+}
+
+func TestMemoryReplayCacheSingleUse(t *testing.T) {
+	c := newMemoryReplayCache()
+	expiresAt := time.Now().Add(currentConfig().Tokens.ChallengeTTL)
+
+	ok, err := c.consume(context.Background(), nil, "id1", expiresAt)
+	if err != nil || !ok {
+		t.Fatalf("First consume = %v, %v; want true", ok, err)
+	}
+	ok, err = c.consume(context.Background(), nil, "id1", expiresAt)
+	if err != nil || ok {
+		t.Errorf("Second consume = %v, %v; want false", ok, err)
+	}
+	ok, err = c.consume(context.Background(), nil, "id2", expiresAt)
+	if err != nil || !ok {
+		t.Errorf("Consume of another ID = %v, %v; want true", ok, err)
+	}
+}
+
+func TestMemoryReplayCacheConcurrent(t *testing.T) {
+	c := newMemoryReplayCache()
+	expiresAt := time.Now().Add(currentConfig().Tokens.ChallengeTTL)
+
+	const attempts = 50
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	consumed := 0
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := c.consume(context.Background(), nil, "id1", expiresAt)
+			if err != nil {
+				t.Errorf("consume failed: %v", err)
+				return
+			}
+			if ok {
+				mu.Lock()
+				consumed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if consumed != 1 {
+		t.Errorf("Challenge consumed %d times, want 1", consumed)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// setTestConfig makes the defaults, changed by fn, the active configuration
+// for the rest of the test
+func setTestConfig(t *testing.T, fn func(*Config)) {
+	t.Helper()
+	c := defaultConfig()
+	fn(c)
+	saved := activeConfig.Swap(c)
+	t.Cleanup(func() { activeConfig.Store(saved) })
+}
+
+// writeTestConfig writes a config file and returns its path
+func writeTestConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "authgrid.yaml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeTestConfig(t, `
+server:
+  port: "9000"
+  cors_origins: [https://app.example.com]
+tokens:
+  access_token_ttl: 5m
+stripe:
+  secret_key: sk_from_file
+`)
+	keyFile := filepath.Join(t.TempDir(), "resend")
+	os.WriteFile(keyFile, []byte("re_from_secret_file\n"), 0600)
+	t.Setenv("PORT", "9100")
+	t.Setenv("AUTHGRID_RATE_LIMITS", "ip=10/1m, /verify:handle=5/30s")
+	t.Setenv("RESEND_API_KEY_FILE", keyFile)
+
+	c, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+	if c.Server.Port != "9100" {
+		t.Errorf("Port = %q, want the environment to override the file", c.Server.Port)
+	}
+	if len(c.Server.CORSOrigins) != 1 || c.Server.CORSOrigins[0] != "https://app.example.com" {
+		t.Errorf("CORSOrigins = %v", c.Server.CORSOrigins)
+	}
+	if c.Tokens.AccessTokenTTL != 5*time.Minute || c.Tokens.RefreshTokenTTL != 30*24*time.Hour {
+		t.Errorf("Token TTLs = %v, %v", c.Tokens.AccessTokenTTL, c.Tokens.RefreshTokenTTL)
+	}
+	if len(c.RateLimits.Policies) != 2 || c.RateLimits.Policies[1] != "/verify:handle=5/30s" {
+		t.Errorf("Policies = %q", c.RateLimits.Policies)
+	}
+	if c.Stripe.SecretKey != "sk_from_file" || c.Email.ResendAPIKey != "re_from_secret_file" {
+		t.Errorf("Secrets = %q, %q", c.Stripe.SecretKey, c.Email.ResendAPIKey)
+	}
+
+	// A secret set twice is ambiguous
+	t.Setenv("RESEND_API_KEY", "re_direct")
+	if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), "RESEND_API_KEY_FILE") {
+		t.Errorf("Setting a secret and its file gave %v", err)
+	}
+	t.Setenv("RESEND_API_KEY", "")
+
+	// Every problem is reported, with where to fix it
+	if _, err := loadConfig(writeTestConfig(t, "server:\n  prot: 80\n")); err == nil {
+		t.Error("loadConfig accepted an unknown key")
+	}
+	t.Setenv("AUTHGRID_CHALLENGE_MODE", "cookie")
+	t.Setenv("AUTHGRID_LOCKOUT_THRESHOLD", "0")
+	t.Setenv("AUTHGRID_TLS_CERT_FILE", "tls.crt")
+	_, err = loadConfig("")
+	if err == nil {
+		t.Fatal("loadConfig accepted an invalid configuration")
+	}
+	for _, want := range []string{
+		"challenges.mode (AUTHGRID_CHALLENGE_MODE)",
+		"lockout.threshold (AUTHGRID_LOCKOUT_THRESHOLD)",
+		"server.tls_cert_file (AUTHGRID_TLS_CERT_FILE)",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Error %q doesn't mention %s", err, want)
+		}
+	}
+}
+
+func TestConfigRedacted(t *testing.T) {
+	c := defaultConfig()
+	c.Stripe.SecretKey = "sk_live_secret"
+	c.Database.URL = "postgres://authgrid:hunter2@db/authgrid"
+	out, err := yaml.Marshal(c.redacted())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"sk_live_secret", "hunter2"} {
+		if strings.Contains(string(out), secret) {
+			t.Errorf("Printed config contains %q:\n%s", secret, out)
+		}
+	}
+	if !strings.Contains(string(out), "access_token_ttl: 15m0s") {
+		t.Errorf("Printed config doesn't show durations as strings:\n%s", out)
+	}
+	if c.Stripe.SecretKey != "sk_live_secret" {
+		t.Error("redacted changed the original configuration")
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	setTestConfig(t, func(c *Config) {})
+	path := writeTestConfig(t, `
+server:
+  port: "9000"
+tokens:
+  challenge_ttl: 2m
+logging:
+  level: debug
+`)
+	if err := reloadConfig(path); err != nil {
+		t.Fatalf("reloadConfig failed: %v", err)
+	}
+	c := currentConfig()
+	if c.Tokens.ChallengeTTL != 2*time.Minute || c.Logging.Level != "debug" {
+		t.Errorf("Reloadable settings not applied: %v, %q", c.Tokens.ChallengeTTL, c.Logging.Level)
+	}
+	if c.Server.Port != "8080" {
+		t.Errorf("Port = %q after reload, want it kept until restart", c.Server.Port)
+	}
+	logLevel.Set(0)
+
+	// An invalid file leaves the configuration alone
+	if err := reloadConfig(writeTestConfig(t, "tokens:\n  challenge_ttl: -1m\n")); err == nil {
+		t.Error("reloadConfig accepted an invalid configuration")
+	}
+	if currentConfig() != c {
+		t.Error("A failed reload replaced the configuration")
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/ecdsa"
 	"crypto/ed25519"
 	"crypto/rand"
@@ -11,6 +12,9 @@ import (
 	"encoding/hex"
 	"fmt"
 	"math/big"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // generateHandle creates a unique handle from a public key
@@ -22,10 +26,7 @@ func generateHandle(publicKey []byte) string {
 	// Take first 10 characters of hex encoding for the identifier
 	identifier := hex.EncodeToString(hash[:])[:10]
 
-	// Get domain from environment or use default
-	domain := getEnv("AUTHGRID_DOMAIN", "authgrid.net")
-
-	return fmt.Sprintf("%s@%s", identifier, domain)
+	return fmt.Sprintf("%s@%s", identifier, currentConfig().Auth.Domain)
 }
 
 // generateChallenge creates a cryptographically random challenge
@@ -38,23 +39,50 @@ func generateChallenge() (string, error) {
 	return base64.StdEncoding.EncodeToString(bytes), nil
 }
 
-// generateToken creates a simple token for authenticated sessions
-// In production, use proper JWT with signing
-func generateToken(handle string) (string, error) {
-	// For MVP, generate a random token
-	// TODO: Replace with proper JWT implementation
-	bytes := make([]byte, 32)
-	if _, err := rand.Read(bytes); err != nil {
-		return "", err
+// validatePublicKey checks the key type and decodes a base64 public key.
+// Errors are suitable for returning to the client.
+func validatePublicKey(publicKey, keyType string) ([]byte, error) {
+	// Validate key type
+	if keyType != "ed25519" && keyType != "ecdsa" && keyType != keyTypeWebAuthn {
+		return nil, fmt.Errorf("Only ed25519, ecdsa and webauthn key types are supported")
+	}
+
+	// Decode public key
+	publicKeyBytes, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid public key encoding")
 	}
 
-	// Include handle in token (simplified approach)
-	tokenData := append([]byte(handle+":"), bytes...)
-	return base64.StdEncoding.EncodeToString(tokenData), nil
+	// Validate public key length based on key type
+	if keyType == "ed25519" {
+		// Ed25519 raw public keys are 32 bytes
+		if len(publicKeyBytes) != ed25519.PublicKeySize && len(publicKeyBytes) < 30 {
+			return nil, fmt.Errorf("Invalid Ed25519 public key length")
+		}
+	} else if keyType == "ecdsa" {
+		// ECDSA P-256 public keys in SPKI format are ~91 bytes
+		// We accept keys between 60-120 bytes for ECDSA
+		if len(publicKeyBytes) < 60 || len(publicKeyBytes) > 120 {
+			return nil, fmt.Errorf("Invalid ECDSA public key length")
+		}
+	} else if keyType == keyTypeWebAuthn {
+		// Attested credential data with a supported COSE key, and nothing more
+		if _, rest, err := parseAttestedCredential(publicKeyBytes); err != nil || len(rest) != 0 {
+			return nil, fmt.Errorf("Invalid WebAuthn credential")
+		}
+	}
+
+	return publicKeyBytes, nil
 }
 
 // verifySignature verifies a signature using the appropriate algorithm
-func verifySignature(publicKeyStr string, keyType string, message []byte, signature []byte) (bool, error) {
+func verifySignature(ctx context.Context, publicKeyStr string, keyType string, message []byte, signature []byte) (valid bool, err error) {
+	_, span := tracer.Start(ctx, "verifySignature", trace.WithAttributes(attribute.String("authgrid.key_type", keyType)))
+	defer func() {
+		span.SetAttributes(attribute.Bool("authgrid.signature_valid", valid))
+		endSpan(span, err)
+	}()
+
 	publicKeyBytes, err := base64.StdEncoding.DecodeString(publicKeyStr)
 	if err != nil {
 		return false, fmt.Errorf("invalid public key encoding: %w", err)
@@ -111,6 +139,10 @@ func verifySignature(publicKeyStr string, keyType string, message []byte, signat
 		// Verify the signature
 		return ecdsa.Verify(ecdsaKey, hash[:], sig.R, sig.S), nil
 
+	case keyTypeWebAuthn:
+		valid, _, err := verifyWebAuthnAssertion(publicKeyBytes, message, signature)
+		return valid, err
+
 	default:
 		return false, fmt.Errorf("unsupported key type: %s", keyType)
 	}
@@ -1,15 +1,18 @@
 package main
 
 import (
+	"context"
 	"crypto/ed25519"
 	"crypto/rand"
 	"encoding/base64"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestGenerateHandle(t *testing.T) {
 	// Generate a test public key
-	_, publicKey, err := ed25519.GenerateKey(rand.Reader)
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
 	if err != nil {
 		t.Fatalf("Failed to generate key: %v", err)
 	}
@@ -36,7 +39,7 @@ func TestGenerateHandle(t *testing.T) {
 
 func TestGenerateHandleDeterministic(t *testing.T) {
 	// Same public key should always generate same handle
-	_, publicKey, _ := ed25519.GenerateKey(rand.Reader)
+	publicKey, _, _ := ed25519.GenerateKey(rand.Reader)
 
 	handle1 := generateHandle(publicKey)
 	handle2 := generateHandle(publicKey)
@@ -82,20 +85,27 @@ func TestGenerateChallengeUnique(t *testing.T) {
 }
 
 func TestGenerateToken(t *testing.T) {
+	setupTestKeys(t, algEdDSA)
+
 	handle := "test@authgrid.net"
-	token, err := generateToken(handle)
+	token, err := generateToken(handle, "ed25519", time.Now().Add(time.Hour))
 	if err != nil {
 		t.Fatalf("Failed to generate token: %v", err)
 	}
 
-	// Should be base64 encoded
-	_, err = base64.StdEncoding.DecodeString(token)
-	if err != nil {
-		t.Fatalf("Token is not valid base64: %v", err)
+	// Should be three base64url encoded parts
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("Token has %d parts, want 3", len(parts))
+	}
+	for _, part := range parts {
+		if _, err := base64.RawURLEncoding.DecodeString(part); err != nil {
+			t.Fatalf("Token part is not valid base64url: %v", err)
+		}
 	}
 
 	// Should be unique
-	token2, _ := generateToken(handle)
+	token2, _ := generateToken(handle, "ed25519", time.Now().Add(time.Hour))
 	if token == token2 {
 		t.Errorf("Tokens should be unique")
 	}
@@ -103,7 +113,7 @@ func TestGenerateToken(t *testing.T) {
 
 func TestVerifySignatureEd25519(t *testing.T) {
 	// Generate Ed25519 keypair
-	privateKey, publicKey, err := ed25519.GenerateKey(rand.Reader)
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
 	if err != nil {
 		t.Fatalf("Failed to generate key: %v", err)
 	}
@@ -118,7 +128,7 @@ func TestVerifySignatureEd25519(t *testing.T) {
 	publicKeyStr := base64.StdEncoding.EncodeToString(publicKey)
 
 	// Verify signature
-	valid, err := verifySignature(publicKeyStr, "ed25519", message, signature)
+	valid, err := verifySignature(context.Background(), publicKeyStr, "ed25519", message, signature)
 	if err != nil {
 		t.Fatalf("Verification failed: %v", err)
 	}
@@ -130,7 +140,7 @@ func TestVerifySignatureEd25519(t *testing.T) {
 
 func TestVerifySignatureEd25519Invalid(t *testing.T) {
 	// Generate Ed25519 keypair
-	_, publicKey, err := ed25519.GenerateKey(rand.Reader)
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
 	if err != nil {
 		t.Fatalf("Failed to generate key: %v", err)
 	}
@@ -146,7 +156,7 @@ func TestVerifySignatureEd25519Invalid(t *testing.T) {
 	publicKeyStr := base64.StdEncoding.EncodeToString(publicKey)
 
 	// Verify signature (should fail)
-	valid, err := verifySignature(publicKeyStr, "ed25519", message, invalidSignature)
+	valid, err := verifySignature(context.Background(), publicKeyStr, "ed25519", message, invalidSignature)
 	if err != nil {
 		t.Fatalf("Verification error: %v", err)
 	}
@@ -158,7 +168,7 @@ func TestVerifySignatureEd25519Invalid(t *testing.T) {
 
 func TestVerifySignatureWrongMessage(t *testing.T) {
 	// Generate Ed25519 keypair
-	privateKey, publicKey, err := ed25519.GenerateKey(rand.Reader)
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
 	if err != nil {
 		t.Fatalf("Failed to generate key: %v", err)
 	}
@@ -174,7 +184,7 @@ func TestVerifySignatureWrongMessage(t *testing.T) {
 	publicKeyStr := base64.StdEncoding.EncodeToString(publicKey)
 
 	// Verify with wrong message (should fail)
-	valid, err := verifySignature(publicKeyStr, "ed25519", differentMessage, signature)
+	valid, err := verifySignature(context.Background(), publicKeyStr, "ed25519", differentMessage, signature)
 	if err != nil {
 		t.Fatalf("Verification error: %v", err)
 	}
@@ -2,11 +2,11 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
-	"os"
 )
 
 // ResendEmail represents an email to send via Resend API
@@ -18,18 +18,18 @@ type ResendEmail struct {
 }
 
 // sendWelcomeEmail sends a welcome email to new customers
-func sendWelcomeEmail(customerEmail, customerName, subscriptionID string) error {
-	apiKey := os.Getenv("RESEND_API_KEY")
+func sendWelcomeEmail(ctx context.Context, customerEmail, customerName, subscriptionID string) error {
+	cfg := currentConfig().Email
+	apiKey := cfg.ResendAPIKey
 	if apiKey == "" {
-		log.Println("WARNING: RESEND_API_KEY not set - email not sent")
+		slog.WarnContext(ctx, "RESEND_API_KEY not set, email not sent")
 		return fmt.Errorf("email service not configured")
 	}
 
-	// Create welcome email
-	// Using Resend's onboarding domain temporarily (works immediately)
-	// After domain verification in Resend, switch to: "Authgrid <hello@authgrid.net>"
+	// Create welcome email. The sender defaults to Resend's onboarding
+	// domain, which works without verifying a domain of our own.
 	email := ResendEmail{
-		From:    "Authgrid <onboarding@resend.dev>",
+		From:    cfg.From,
 		To:      []string{customerEmail},
 		Subject: "🎉 Welcome to Authgrid!",
 		HTML:    generateWelcomeEmailHTML(customerName, subscriptionID),
@@ -41,7 +41,7 @@ func sendWelcomeEmail(customerEmail, customerName, subscriptionID string) error
 		return fmt.Errorf("failed to marshal email: %w", err)
 	}
 
-	req, err := http.NewRequest("POST", "https://api.resend.com/emails", bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, "POST", "https://api.resend.com/emails", bytes.NewBuffer(jsonData))
 	if err != nil {
 		return fmt.Errorf("failed to create request: %w", err)
 	}
@@ -49,8 +49,7 @@ func sendWelcomeEmail(customerEmail, customerName, subscriptionID string) error
 	req.Header.Set("Authorization", "Bearer "+apiKey)
 	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := tracedHTTPClient.Do(req)
 	if err != nil {
 		return fmt.Errorf("failed to send email: %w", err)
 	}
@@ -60,7 +59,7 @@ func sendWelcomeEmail(customerEmail, customerName, subscriptionID string) error
 		return fmt.Errorf("email send failed with status: %d", resp.StatusCode)
 	}
 
-	log.Printf("✅ Welcome email sent to: %s", customerEmail)
+	slog.InfoContext(ctx, "Welcome email sent", "to", customerEmail)
 	return nil
 }
 
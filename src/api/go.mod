@@ -3,10 +3,18 @@ module github.com/Kelsidavis/authgrid
 go 1.21
 
 require (
+	github.com/fxamacker/cbor/v2 v2.7.0
 	github.com/gorilla/mux v1.8.1
 	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v1.14.22
+	github.com/prometheus/client_golang v1.19.0
 	github.com/rs/cors v1.10.1
 	github.com/stripe/stripe-go/v76 v76.16.0
+	go.opentelemetry.io/otel v1.28.0
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.28.0
+	go.opentelemetry.io/otel/exporters/stdout/stdouttrace v1.28.0
+	go.opentelemetry.io/otel/sdk v1.28.0
+	go.opentelemetry.io/otel/trace v1.28.0
 	golang.org/x/crypto v0.18.0
-	golang.org/x/time v0.5.0
+	gopkg.in/yaml.v3 v3.0.1
 )
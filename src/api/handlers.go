@@ -1,22 +1,45 @@
 package main
 
 import (
-	"crypto/ed25519"
-	"database/sql"
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 )
 
-// RegisterRequest represents a registration request
-type RegisterRequest struct {
+// RegisterChallengeRequest asks for a challenge to register a public key
+type RegisterChallengeRequest struct {
 	PublicKey string `json:"public_key"` // base64 encoded
 	KeyType   string `json:"key_type"`   // "ed25519"
 }
 
+// RegisterChallengeResponse carries the challenge the key being registered
+// must sign, and the handle it will get
+type RegisterChallengeResponse struct {
+	Handle    string    `json:"handle"`
+	Challenge string    `json:"challenge"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// RegisterRequest represents a registration request. Signature is made by
+// the key being registered over registrationStatement.
+type RegisterRequest struct {
+	PublicKey string `json:"public_key"`     // base64 encoded
+	KeyType   string `json:"key_type"`       // "ed25519"
+	Name      string `json:"name,omitempty"` // device name for the key
+	Challenge string `json:"challenge"`      // from /register/challenge
+	Signature string `json:"signature"`
+
+	// Optional offline keys that can later recover the handle
+	RecoveryKeys []RecoveryKeyInput `json:"recovery_keys,omitempty"`
+}
+
 // RegisterResponse represents a registration response
 type RegisterResponse struct {
 	Handle    string    `json:"handle"`
@@ -32,7 +55,12 @@ type ChallengeRequest struct {
 // ChallengeResponse represents a challenge response
 type ChallengeResponse struct {
 	Challenge string    `json:"challenge"`
+	IssuedAt  time.Time `json:"issued_at"`
 	ExpiresAt time.Time `json:"expires_at"`
+
+	// Base64url credential IDs of the handle's webauthn keys, for
+	// allowCredentials. Only set on /challenge responses.
+	WebAuthnCredentials []string `json:"webauthn_credentials,omitempty"`
 }
 
 // VerifyRequest represents a verification request
@@ -40,16 +68,66 @@ type VerifyRequest struct {
 	Handle    string `json:"handle"`
 	Challenge string `json:"challenge"`
 	Signature string `json:"signature"`
+	Origin    string `json:"origin"`              // server origin the client signed for
+	KeyID     string `json:"key_id,omitempty"`    // key that signed; any active key if empty
+	ClientID  string `json:"client_id,omitempty"` // relying party the login is for
+	Scope     string `json:"scope,omitempty"`
 }
 
 // VerifyResponse represents a verification response
 type VerifyResponse struct {
-	Verified  bool      `json:"verified"`
-	Token     string    `json:"token,omitempty"`
-	ExpiresAt time.Time `json:"expires_at,omitempty"`
+	Verified         bool      `json:"verified"`
+	Token            string    `json:"token,omitempty"`
+	ExpiresAt        time.Time `json:"expires_at,omitempty"`
+	RefreshToken     string    `json:"refresh_token,omitempty"`
+	RefreshExpiresAt time.Time `json:"refresh_expires_at,omitempty"`
+	SessionID        string    `json:"session_id,omitempty"`
+}
+
+// registrationStatement is the message the key being registered signs to
+// prove it is held by the caller. It covers the recovery keys registered
+// with it, so they can't be added in transit.
+func registrationStatement(challenge, keyType, publicKey string, recoveryKeys []RecoveryKeyInput) []byte {
+	statement := "authgrid-register\n" + challenge + "\n" + keyType + "\n" + publicKey
+	for _, k := range recoveryKeys {
+		statement += "\n" + k.KeyType + "\n" + k.PublicKey
+	}
+	return []byte(statement)
+}
+
+// registerChallengeHandler issues a challenge for registering a public key.
+// It is stored against the handle the key will get.
+func registerChallengeHandler(w http.ResponseWriter, r *http.Request) {
+	var req RegisterChallengeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	setKeyType(w, req.KeyType)
+	publicKeyBytes, err := validatePublicKey(req.PublicKey, req.KeyType)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	handle := generateHandle(publicKeyBytes)
+
+	ch, err := storeChallenge(r.Context(), handle)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to store challenge")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, RegisterChallengeResponse{
+		Handle:    handle,
+		Challenge: ch.Challenge,
+		ExpiresAt: ch.ExpiresAt,
+	})
 }
 
-// registerHandler handles user registration
+// registerHandler handles user registration. The caller must sign a
+// registration challenge with the key being registered.
 func registerHandler(w http.ResponseWriter, r *http.Request) {
 	var req RegisterRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -57,71 +135,97 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Validate key type
-	if req.KeyType != "ed25519" && req.KeyType != "ecdsa" {
-		respondError(w, http.StatusBadRequest, "Only ed25519 and ecdsa key types are supported")
+	if req.Challenge == "" || req.Signature == "" {
+		respondError(w, http.StatusBadRequest, "Challenge and signature are required")
 		return
 	}
 
-	// Decode public key
-	publicKeyBytes, err := base64.StdEncoding.DecodeString(req.PublicKey)
+	setKeyType(w, req.KeyType)
+	publicKeyBytes, err := validatePublicKey(req.PublicKey, req.KeyType)
 	if err != nil {
-		respondError(w, http.StatusBadRequest, "Invalid public key encoding")
+		respondError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	// Validate public key length based on key type
-	if req.KeyType == "ed25519" {
-		// Ed25519 raw public keys are 32 bytes
-		if len(publicKeyBytes) != ed25519.PublicKeySize && len(publicKeyBytes) < 30 {
-			respondError(w, http.StatusBadRequest, "Invalid Ed25519 public key length")
-			return
-		}
-	} else if req.KeyType == "ecdsa" {
-		// ECDSA P-256 public keys in SPKI format are ~91 bytes
-		// We accept keys between 60-120 bytes for ECDSA
-		if len(publicKeyBytes) < 60 || len(publicKeyBytes) > 120 {
-			respondError(w, http.StatusBadRequest, "Invalid ECDSA public key length")
-			return
-		}
+	if err := validateRecoveryKeys(req.RecoveryKeys); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid recovery key: "+err.Error())
+		return
 	}
 
 	// Generate handle from public key
 	handle := generateHandle(publicKeyBytes)
 
-	// Check if handle already exists
-	var exists bool
-	err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE handle = $1)", handle).Scan(&exists)
-	if err != nil {
-		respondError(w, http.StatusInternalServerError, "Database error")
+	ch, ok := checkChallenge(w, r, handle, req.Challenge)
+	if !ok {
 		return
 	}
-	if exists {
-		respondError(w, http.StatusConflict, "Handle already exists")
+
+	signatureBytes, err := base64.StdEncoding.DecodeString(req.Signature)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid signature encoding")
 		return
 	}
 
-	// Insert user into database
-	var id string
-	var createdAt time.Time
-	err = db.QueryRow(`
-		INSERT INTO users (handle, public_key, key_type, created_at)
-		VALUES ($1, $2, $3, NOW())
-		RETURNING id, created_at
-	`, handle, req.PublicKey, req.KeyType).Scan(&id, &createdAt)
+	// Proof of possession: only the private key holder can register it
+	statement := registrationStatement(req.Challenge, req.KeyType, req.PublicKey, req.RecoveryKeys)
+	valid, err := verifySignature(r.Context(), req.PublicKey, req.KeyType, statement, signatureBytes)
+	if err != nil || !valid {
+		recordAudit(r, auditRegister, handle, outcomeFailure, "invalid signature")
+		respondError(w, http.StatusUnauthorized, "Invalid signature")
+		return
+	}
 
-	if err != nil {
-		respondError(w, http.StatusInternalServerError, "Failed to create user")
+	key := &UserKey{
+		Name:      req.Name,
+		PublicKey: req.PublicKey,
+		KeyType:   req.KeyType,
+	}
+	user, ok := createUser(w, r, ch, handle, key, req.RecoveryKeys)
+	if !ok {
 		return
 	}
 
 	respondJSON(w, http.StatusCreated, RegisterResponse{
 		Handle:    handle,
-		ID:        id,
-		CreatedAt: createdAt,
+		ID:        user.ID,
+		CreatedAt: user.CreatedAt,
 	})
 }
 
+// createUser redeems a registration challenge and creates the handle with
+// key as its first key. If that fails an error response is written and
+// false is returned.
+func createUser(w http.ResponseWriter, r *http.Request, ch *issuedChallenge, handle string, key *UserKey, recoveryKeys []RecoveryKeyInput) (*User, bool) {
+	user := &User{
+		Handle:    handle,
+		PublicKey: key.PublicKey,
+		KeyType:   key.KeyType,
+	}
+	err := store.CreateUser(r.Context(), ch, user, key, recoveryKeys)
+	switch err {
+	case nil:
+	case errHandleExists:
+		recordAudit(r, auditRegister, handle, outcomeFailure, "handle already exists")
+		respondError(w, http.StatusConflict, "Handle already exists")
+		return nil, false
+	case errKeyRegistered:
+		// A key added as a device of another identity can't start its own
+		recordAudit(r, auditRegister, handle, outcomeFailure, "public key already registered")
+		respondError(w, http.StatusConflict, "Public key already registered")
+		return nil, false
+	case errChallengeUsed:
+		recordAudit(r, auditRegister, handle, outcomeFailure, "challenge already used")
+		respondError(w, http.StatusBadRequest, "Challenge already used")
+		return nil, false
+	default:
+		respondError(w, http.StatusInternalServerError, "Failed to create user")
+		return nil, false
+	}
+
+	recordAudit(r, auditRegister, handle, outcomeSuccess, "")
+	return user, true
+}
+
 // challengeHandler generates an authentication challenge
 func challengeHandler(w http.ResponseWriter, r *http.Request) {
 	var req ChallengeRequest
@@ -135,42 +239,92 @@ func challengeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !checkLockout(w, r, req.Handle) {
+		return
+	}
+
 	// Check if user exists
-	var exists bool
-	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE handle = $1)", req.Handle).Scan(&exists)
+	user, err := store.UserByHandle(r.Context(), req.Handle)
+	if err == errNotFound {
+		respondError(w, http.StatusNotFound, "Handle not found")
+		return
+	}
 	if err != nil {
 		respondError(w, http.StatusInternalServerError, "Database error")
 		return
 	}
-	if !exists {
-		respondError(w, http.StatusNotFound, "Handle not found")
+
+	ch, err := storeChallenge(r.Context(), req.Handle)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to store challenge")
 		return
 	}
 
-	// Generate challenge
-	challenge, err := generateChallenge()
+	// Passkeys need their credential IDs to be offered to the browser
+	keys, err := store.ActiveKeys(r.Context(), user.ID)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, "Failed to generate challenge")
+		respondError(w, http.StatusInternalServerError, "Database error")
 		return
 	}
+	ch.WebAuthnCredentials = webauthnCredentialIDs(keys)
 
-	expiresAt := time.Now().Add(5 * time.Minute)
+	respondJSON(w, http.StatusOK, ch)
+}
 
-	// Store challenge in database
-	_, err = db.Exec(`
-		INSERT INTO challenges (handle, challenge, created_at, expires_at, used)
-		VALUES ($1, $2, NOW(), $3, FALSE)
-	`, req.Handle, challenge, expiresAt)
+// loginPayloadVersion tags the login signing payload. Bump it if the format
+// changes.
+const loginPayloadVersion = "authgrid-login-v1"
+
+// signingOrigins are the server origins login signatures may be bound to.
+// Loaded from AUTHGRID_ORIGINS, defaulting to the token issuer.
+var signingOrigins []string
+
+// loginPayload is the message a key signs to log in. Clients never sign the
+// bare challenge bytes: the version tag separates these signatures from any
+// other protocol, and the origin binds them to the server the client meant
+// to talk to.
+func loginPayload(origin, handle, challenge string, issuedAt time.Time) []byte {
+	return []byte(loginPayloadVersion + "\n" + origin + "\n" + handle + "\n" + challenge + "\n" +
+		strconv.FormatInt(issuedAt.Unix(), 10))
+}
 
-	if err != nil {
-		respondError(w, http.StatusInternalServerError, "Failed to store challenge")
-		return
+// normalizeOrigin reduces a URL to its scheme://host[:port] origin
+func normalizeOrigin(value string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(value))
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return "", fmt.Errorf("invalid origin %q", value)
 	}
+	return strings.ToLower(u.Scheme + "://" + u.Host), nil
+}
 
-	respondJSON(w, http.StatusOK, ChallengeResponse{
-		Challenge: challenge,
-		ExpiresAt: expiresAt,
-	})
+// parseOrigins parses a comma-separated list of origins
+func parseOrigins(value string) ([]string, error) {
+	var origins []string
+	for _, o := range strings.Split(value, ",") {
+		if strings.TrimSpace(o) == "" {
+			continue
+		}
+		origin, err := normalizeOrigin(o)
+		if err != nil {
+			return nil, err
+		}
+		origins = append(origins, origin)
+	}
+	return origins, nil
+}
+
+// allowedOrigin returns the normalized origin if signatures may be bound to it
+func allowedOrigin(value string) (string, bool) {
+	origin, err := normalizeOrigin(value)
+	if err != nil {
+		return "", false
+	}
+	for _, o := range signingOrigins {
+		if o == origin {
+			return origin, true
+		}
+	}
+	return "", false
 }
 
 // verifyHandler verifies a signed challenge
@@ -182,36 +336,27 @@ func verifyHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate input
-	if req.Handle == "" || req.Challenge == "" || req.Signature == "" {
-		respondError(w, http.StatusBadRequest, "Handle, challenge, and signature are required")
+	if req.Handle == "" || req.Challenge == "" || req.Signature == "" || req.Origin == "" {
+		respondError(w, http.StatusBadRequest, "Handle, challenge, signature, and origin are required")
 		return
 	}
 
-	// Get user's public key and key type
-	var publicKeyStr string
-	var keyType string
-	err := db.QueryRow("SELECT public_key, key_type FROM users WHERE handle = $1", req.Handle).Scan(&publicKeyStr, &keyType)
-	if err == sql.ErrNoRows {
-		respondError(w, http.StatusNotFound, "Handle not found")
+	if !checkLockout(w, r, req.Handle) {
 		return
 	}
-	if err != nil {
-		respondError(w, http.StatusInternalServerError, "Database error")
+
+	// A signature made for another server (e.g. a phishing relay) is useless here
+	origin, ok := allowedOrigin(req.Origin)
+	if !ok {
+		recordAudit(r, auditLogin, req.Handle, outcomeFailure, "origin "+req.Origin+" not allowed")
+		respondError(w, http.StatusUnauthorized, "Signature is bound to a different origin")
 		return
 	}
 
-	// Check if challenge exists and is valid
-	var challengeID string
-	var expiresAt time.Time
-	var used bool
-	err = db.QueryRow(`
-		SELECT id, expires_at, used
-		FROM challenges
-		WHERE handle = $1 AND challenge = $2
-	`, req.Handle, req.Challenge).Scan(&challengeID, &expiresAt, &used)
-
-	if err == sql.ErrNoRows {
-		respondError(w, http.StatusNotFound, "Challenge not found")
+	// Look up the user
+	user, err := store.UserByHandle(r.Context(), req.Handle)
+	if err == errNotFound {
+		respondError(w, http.StatusNotFound, "Handle not found")
 		return
 	}
 	if err != nil {
@@ -219,22 +364,9 @@ func verifyHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check if challenge is expired
-	if time.Now().After(expiresAt) {
-		respondError(w, http.StatusBadRequest, "Challenge expired")
-		return
-	}
-
-	// Check if challenge was already used
-	if used {
-		respondError(w, http.StatusBadRequest, "Challenge already used")
-		return
-	}
-
-	// Decode challenge and signature
-	challengeBytes, err := base64.StdEncoding.DecodeString(req.Challenge)
-	if err != nil {
-		respondError(w, http.StatusBadRequest, "Invalid challenge encoding")
+	// Check if challenge exists and is valid
+	ch, ok := checkChallenge(w, r, req.Handle, req.Challenge)
+	if !ok {
 		return
 	}
 
@@ -244,44 +376,55 @@ func verifyHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Verify signature based on key type
-	valid, err := verifySignature(publicKeyStr, keyType, challengeBytes, signatureBytes)
+	// Verify signature against the user's active keys
+	payload := loginPayload(origin, req.Handle, req.Challenge, ch.IssuedAt)
+	key, err := findSigningKey(r.Context(), user.ID, req.KeyID, payload, signatureBytes)
+	if err == errSignCountRegressed {
+		recordAudit(r, auditLogin, req.Handle, outcomeFailure, "sign count regressed")
+		respondLoginFailure(w, r, ch, req.Handle, "Authenticator signature counter went backwards")
+		return
+	}
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, "Signature verification error: "+err.Error())
+		respondError(w, http.StatusInternalServerError, "Database error")
 		return
 	}
-	if !valid {
-		respondError(w, http.StatusUnauthorized, "Invalid signature")
+	if key == nil {
+		recordAudit(r, auditLogin, req.Handle, outcomeFailure, "invalid signature")
+		respondLoginFailure(w, r, ch, req.Handle, "Invalid signature")
 		return
 	}
+	setKeyType(w, key.KeyType)
 
-	// Mark challenge as used
-	_, err = db.Exec("UPDATE challenges SET used = TRUE WHERE id = $1", challengeID)
+	// Issue a short-lived signed access token
+	tokenExpiry := time.Now().Add(currentConfig().Tokens.AccessTokenTTL)
+	token, err := generateToken(req.Handle, key.KeyType, tokenExpiry)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, "Failed to mark challenge as used")
+		respondError(w, http.StatusInternalServerError, "Failed to generate token")
 		return
 	}
 
-	// Update last login time
-	_, err = db.Exec("UPDATE users SET last_login = NOW() WHERE handle = $1", req.Handle)
-	if err != nil {
-		// Non-critical error, log but continue
-		// In production, use proper logging
+	// Redeem the challenge and record the session in one step, so a token
+	// is only handed out to the request that used the challenge
+	sess, err := createSession(ch, user.ID, key.ID, token, req.ClientID, req.Scope, r)
+	if err == errChallengeUsed {
+		recordAudit(r, auditLogin, req.Handle, outcomeFailure, "challenge already used")
+		respondError(w, http.StatusBadRequest, "Challenge already used")
+		return
 	}
-
-	// Generate token (simplified - in production use proper JWT)
-	token, err := generateToken(req.Handle)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, "Failed to generate token")
+		respondError(w, http.StatusInternalServerError, "Failed to create session")
 		return
 	}
-
-	tokenExpiry := time.Now().Add(24 * time.Hour)
+	recordLoginSuccess(r, req.Handle)
+	recordAudit(r, auditLogin, req.Handle, outcomeSuccess, "key "+key.ID)
 
 	respondJSON(w, http.StatusOK, VerifyResponse{
-		Verified:  true,
-		Token:     token,
-		ExpiresAt: tokenExpiry,
+		Verified:         true,
+		Token:            token,
+		ExpiresAt:        tokenExpiry,
+		RefreshToken:     sess.RefreshToken,
+		RefreshExpiresAt: sess.RefreshExpiresAt,
+		SessionID:        sess.ID,
 	})
 }
 
@@ -290,15 +433,8 @@ func getUserHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	handle := vars["handle"]
 
-	var publicKey string
-	var createdAt time.Time
-	err := db.QueryRow(`
-		SELECT public_key, created_at
-		FROM users
-		WHERE handle = $1
-	`, handle).Scan(&publicKey, &createdAt)
-
-	if err == sql.ErrNoRows {
+	user, err := store.UserByHandle(r.Context(), handle)
+	if err == errNotFound {
 		respondError(w, http.StatusNotFound, "Handle not found")
 		return
 	}
@@ -307,9 +443,16 @@ func getUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	keys, err := store.ActiveKeys(r.Context(), user.ID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
 	respondJSON(w, http.StatusOK, map[string]interface{}{
 		"handle":     handle,
-		"public_key": publicKey,
-		"created_at": createdAt,
+		"public_key": user.PublicKey,
+		"created_at": user.CreatedAt,
+		"keys":       keys,
 	})
 }
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func TestLoginPayloadBindsOrigin(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	publicKeyStr := base64.StdEncoding.EncodeToString(publicKey)
+
+	issuedAt := time.Unix(1700000000, 0)
+	payload := loginPayload("https://evil.example", "abc123def4@authgrid.net", "Y2hhbGxlbmdl", issuedAt)
+	signature := ed25519.Sign(privateKey, payload)
+
+	// The same signature must not verify for another origin
+	other := loginPayload("https://authgrid.net", "abc123def4@authgrid.net", "Y2hhbGxlbmdl", issuedAt)
+	valid, err := verifySignature(context.Background(), publicKeyStr, "ed25519", other, signature)
+	if err != nil {
+		t.Fatalf("Verification error: %v", err)
+	}
+	if valid {
+		t.Errorf("Signature for one origin verified for another")
+	}
+
+	// Nor as a signature over the bare challenge
+	challenge, _ := base64.StdEncoding.DecodeString("Y2hhbGxlbmdl")
+	valid, err = verifySignature(context.Background(), publicKeyStr, "ed25519", challenge, signature)
+	if err != nil {
+		t.Fatalf("Verification error: %v", err)
+	}
+	if valid {
+		t.Errorf("Login signature verified as a raw challenge signature")
+	}
+}
+
+func TestAllowedOrigin(t *testing.T) {
+	origins, err := parseOrigins("https://authgrid.net, http://localhost:8080/")
+	if err != nil {
+		t.Fatalf("parseOrigins failed: %v", err)
+	}
+	signingOrigins = origins
+	defer func() { signingOrigins = nil }()
+
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"https://authgrid.net", true},
+		{"HTTPS://AUTHGRID.NET/", true},
+		{"http://localhost:8080", true},
+		{"http://authgrid.net", false},
+		{"https://authgrid.net.evil.example", false},
+		{"authgrid.net", false},
+	}
+	for _, tt := range tests {
+		if _, got := allowedOrigin(tt.origin); got != tt.want {
+			t.Errorf("allowedOrigin(%q) = %v, want %v", tt.origin, got, tt.want)
+		}
+	}
+
+	if _, err := parseOrigins("not a url"); err == nil {
+		t.Error("Expected error for invalid origin")
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// IntrospectionResponse is an RFC 7662 token introspection response
+type IntrospectionResponse struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Username  string `json:"username,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	Exp       int64  `json:"exp,omitempty"`
+	Iat       int64  `json:"iat,omitempty"`
+	Sub       string `json:"sub,omitempty"`
+	Iss       string `json:"iss,omitempty"`
+	Jti       string `json:"jti,omitempty"`
+}
+
+// parseIntrospectionClients parses a comma-separated list of id:secret pairs
+func parseIntrospectionClients(value string) (map[string]string, error) {
+	clients := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		id, secret, ok := strings.Cut(pair, ":")
+		if !ok || id == "" || secret == "" {
+			return nil, fmt.Errorf("invalid introspection client entry %q, want id:secret", pair)
+		}
+		clients[id] = secret
+	}
+	return clients, nil
+}
+
+// authenticateClient checks relying-party credentials sent with HTTP Basic
+// auth or as client_id/client_secret form parameters
+func authenticateClient(r *http.Request) (string, bool) {
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if id == "" {
+		return "", false
+	}
+
+	// Validated at load, so the current setting always parses
+	clients, _ := parseIntrospectionClients(currentConfig().Auth.IntrospectionClients)
+	expected, known := clients[id]
+	if !known {
+		// Compare anyway so unknown IDs take as long as wrong secrets
+		expected = "\x00"
+	}
+	match := subtle.ConstantTimeCompare([]byte(secret), []byte(expected)) == 1
+	return id, known && match
+}
+
+// introspectHandler reports whether an access or refresh token is currently
+// active (RFC 7662). Revoked and expired sessions report active: false, as do
+// tokens issued for a different client_id than the caller's.
+func introspectHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	clientID, ok := authenticateClient(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="authgrid"`)
+		respondError(w, http.StatusUnauthorized, "Invalid client credentials")
+		return
+	}
+
+	token := r.PostForm.Get("token")
+	if token == "" {
+		respondError(w, http.StatusBadRequest, "Token is required")
+		return
+	}
+
+	// The response must never be cached (RFC 7662 section 4)
+	w.Header().Set("Cache-Control", "no-store")
+
+	lookups := []func(context.Context, string, string) (*IntrospectionResponse, error){introspectAccessToken, introspectRefreshToken}
+	if r.PostForm.Get("token_type_hint") == "refresh_token" {
+		lookups[0], lookups[1] = lookups[1], lookups[0]
+	}
+
+	for _, lookup := range lookups {
+		resp, err := lookup(r.Context(), token, clientID)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "Database error")
+			return
+		}
+		if resp != nil {
+			respondJSON(w, http.StatusOK, resp)
+			return
+		}
+	}
+
+	respondJSON(w, http.StatusOK, IntrospectionResponse{Active: false})
+}
+
+// introspectAccessToken returns the state of a JWT access token, or nil if
+// the token is not an active access token issued to the caller
+func introspectAccessToken(ctx context.Context, token, caller string) (*IntrospectionResponse, error) {
+	claims, err := verifyToken(token)
+	if err != nil {
+		return nil, nil
+	}
+
+	clientID, scope, err := store.AccessTokenClient(ctx, hashToken(token))
+	if err == errNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Another relying party's token is reported as inactive, so one client
+	// can't learn about sessions it wasn't party to
+	if clientID != caller {
+		return nil, nil
+	}
+
+	return &IntrospectionResponse{
+		Active:    true,
+		Scope:     scope,
+		ClientID:  clientID,
+		Username:  claims.Subject,
+		TokenType: "Bearer",
+		Exp:       claims.ExpiresAt,
+		Iat:       claims.IssuedAt,
+		Sub:       claims.Subject,
+		Iss:       claims.Issuer,
+		Jti:       claims.ID,
+	}, nil
+}
+
+// introspectRefreshToken returns the state of a refresh token, or nil if the
+// token is not an active refresh token issued to the caller
+func introspectRefreshToken(ctx context.Context, token, caller string) (*IntrospectionResponse, error) {
+	st, err := store.RefreshTokenStatus(ctx, hashToken(token))
+	if err == errNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if st.ClientID != caller {
+		return nil, nil
+	}
+
+	return &IntrospectionResponse{
+		Active:    true,
+		Scope:     st.Scope,
+		ClientID:  st.ClientID,
+		Username:  st.Handle,
+		TokenType: "refresh_token",
+		Exp:       st.ExpiresAt.Unix(),
+		Iat:       st.CreatedAt.Unix(),
+		Sub:       st.Handle,
+		Iss:       tokenIssuer(),
+	}, nil
+}
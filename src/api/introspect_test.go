@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// introspect posts an introspection request with the client's Basic
+// credentials, if any
+func introspect(t *testing.T, clientID, secret string, form url.Values) (int, IntrospectionResponse) {
+	t.Helper()
+	req := httptest.NewRequest("POST", "/introspect", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if clientID != "" {
+		req.SetBasicAuth(clientID, secret)
+	}
+	rec := httptest.NewRecorder()
+	introspectHandler(rec, req)
+
+	var resp IntrospectionResponse
+	if rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("Invalid JSON response: %v", err)
+		}
+	}
+	return rec.Code, resp
+}
+
+func TestIntrospect(t *testing.T) {
+	for _, backend := range []string{"memory", "sqlite", "postgres"} {
+		t.Run(backend, func(t *testing.T) {
+			setupTestStore(t, backend)
+			setTestConfig(t, func(c *Config) { c.Auth.IntrospectionClients = "rp:s3cret,other:0ther" })
+			handle, privateKey := registerTestUser(t)
+
+			login := func() VerifyRequest {
+				req := signedLogin(t, handle, privateKey)
+				req.ClientID = "rp"
+				return req
+			}
+
+			var first VerifyResponse
+			if code := doJSON(t, verifyHandler, login(), &first); code != http.StatusOK {
+				t.Fatalf("/verify returned %d", code)
+			}
+			var refreshed TokenResponse
+			if code := doJSON(t, refreshHandler, RefreshRequest{RefreshToken: first.RefreshToken}, &refreshed); code != http.StatusOK {
+				t.Fatalf("/token/refresh returned %d", code)
+			}
+
+			// A second session, whose tokens are replayed after it is revoked
+			var revoked VerifyResponse
+			if code := doJSON(t, verifyHandler, login(), &revoked); code != http.StatusOK {
+				t.Fatalf("/verify returned %d", code)
+			}
+			if code := doJSON(t, refreshHandler, RefreshRequest{RefreshToken: revoked.RefreshToken}, nil); code != http.StatusOK {
+				t.Fatalf("/token/refresh returned %d", code)
+			}
+			if code := doJSON(t, refreshHandler, RefreshRequest{RefreshToken: revoked.RefreshToken}, nil); code != http.StatusUnauthorized {
+				t.Fatalf("Reused refresh token returned %d, want 401", code)
+			}
+
+			// A session whose login named no relying party
+			var unbound VerifyResponse
+			if code := doJSON(t, verifyHandler, signedLogin(t, handle, privateKey), &unbound); code != http.StatusOK {
+				t.Fatalf("/verify returned %d", code)
+			}
+
+			tampered := refreshed.Token[:len(refreshed.Token)-4] + "AAAA"
+			for _, tt := range []struct {
+				name          string
+				clientID      string
+				secret        string
+				token         string
+				hint          string
+				wantCode      int
+				wantActive    bool
+				wantTokenType string
+			}{
+				{name: "no client credentials", token: refreshed.Token, wantCode: http.StatusUnauthorized},
+				{name: "wrong client secret", clientID: "rp", secret: "0ther", token: refreshed.Token, wantCode: http.StatusUnauthorized},
+				{name: "unknown client", clientID: "evil", secret: "s3cret", token: refreshed.Token, wantCode: http.StatusUnauthorized},
+				{name: "no token", clientID: "rp", secret: "s3cret", wantCode: http.StatusBadRequest},
+				{name: "bad token signature", clientID: "rp", secret: "s3cret", token: tampered, wantCode: http.StatusOK},
+				{name: "unknown token", clientID: "rp", secret: "s3cret", token: "not-a-token", wantCode: http.StatusOK},
+				{name: "replaced access token", clientID: "rp", secret: "s3cret", token: first.Token, wantCode: http.StatusOK},
+				{name: "redeemed refresh token", clientID: "rp", secret: "s3cret", token: first.RefreshToken, hint: "refresh_token", wantCode: http.StatusOK},
+				{name: "access token of a revoked session", clientID: "rp", secret: "s3cret", token: revoked.Token, wantCode: http.StatusOK},
+				{name: "active access token", clientID: "rp", secret: "s3cret", token: refreshed.Token, wantCode: http.StatusOK, wantActive: true, wantTokenType: "Bearer"},
+				{name: "active access token for another client", clientID: "other", secret: "0ther", token: refreshed.Token, wantCode: http.StatusOK},
+				{name: "active refresh token for another client", clientID: "other", secret: "0ther", token: refreshed.RefreshToken, hint: "refresh_token", wantCode: http.StatusOK},
+				{name: "access token with no client", clientID: "rp", secret: "s3cret", token: unbound.Token, wantCode: http.StatusOK},
+				{name: "refresh token with no client", clientID: "rp", secret: "s3cret", token: unbound.RefreshToken, wantCode: http.StatusOK},
+				{name: "active refresh token", clientID: "rp", secret: "s3cret", token: refreshed.RefreshToken, hint: "refresh_token", wantCode: http.StatusOK, wantActive: true, wantTokenType: "refresh_token"},
+				{name: "active refresh token without hint", clientID: "rp", secret: "s3cret", token: refreshed.RefreshToken, wantCode: http.StatusOK, wantActive: true, wantTokenType: "refresh_token"},
+			} {
+				t.Run(tt.name, func(t *testing.T) {
+					form := url.Values{}
+					if tt.token != "" {
+						form.Set("token", tt.token)
+					}
+					if tt.hint != "" {
+						form.Set("token_type_hint", tt.hint)
+					}
+					code, resp := introspect(t, tt.clientID, tt.secret, form)
+					if code != tt.wantCode {
+						t.Fatalf("/introspect returned %d, want %d", code, tt.wantCode)
+					}
+					if resp.Active != tt.wantActive {
+						t.Errorf("Token active = %v, want %v", resp.Active, tt.wantActive)
+					}
+					if resp.TokenType != tt.wantTokenType {
+						t.Errorf("Token type = %q, want %q", resp.TokenType, tt.wantTokenType)
+					}
+					if tt.wantActive && resp.Sub != handle {
+						t.Errorf("Token belongs to %q, want %q", resp.Sub, handle)
+					}
+					if tt.wantActive && resp.ClientID != tt.clientID {
+						t.Errorf("Token client = %q, want %q", resp.ClientID, tt.clientID)
+					}
+				})
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// janitor periodically deletes expired challenges and sessions
+var janitor *storeJanitor
+
+// storeJanitor purges a Store in batches on an interval
+type storeJanitor struct {
+	store      Store
+	interval   time.Duration
+	retention  time.Duration // how long expired rows are kept
+	batch      int
+	maxBatches int // per run, so one run can't hold the store for long
+
+	mu    sync.Mutex
+	stats janitorStats
+
+	done    chan struct{} // closed by stop
+	stopped chan struct{} // closed when the loop has exited
+}
+
+// janitorStats describes the last janitor run, for the health endpoint
+type janitorStats struct {
+	LastRun          *time.Time `json:"last_run,omitempty"`
+	DurationMs       int64      `json:"duration_ms"`
+	ChallengesPurged int        `json:"challenges_purged"`
+	SessionsPurged   int        `json:"sessions_purged"`
+	SkippedLocked    bool       `json:"skipped_locked,omitempty"`
+	Error            string     `json:"error,omitempty"`
+	TotalRuns        int        `json:"total_runs"`
+	TotalChallenges  int        `json:"total_challenges_purged"`
+	TotalSessions    int        `json:"total_sessions_purged"`
+	IntervalSeconds  int64      `json:"interval_seconds"`
+	RetentionSeconds int64      `json:"retention_seconds"`
+}
+
+func newStoreJanitor(s Store, interval, retention time.Duration, batch int) *storeJanitor {
+	return &storeJanitor{
+		store:      s,
+		interval:   interval,
+		retention:  retention,
+		batch:      batch,
+		maxBatches: 100,
+	}
+}
+
+// run purges until a batch comes back short, another replica holds the
+// lock, or maxBatches batches have been deleted
+func (j *storeJanitor) run() {
+	ctx, span := tracer.Start(context.Background(), "janitor.run")
+	start := time.Now()
+	cutoff := start.Add(-j.retention)
+
+	var challenges, sessions int
+	var locked bool
+	var err error
+	defer func() { endSpan(span, err) }()
+	for i := 0; i < j.maxBatches; i++ {
+		var c, s int
+		c, s, err = j.store.PurgeExpired(ctx, cutoff, j.batch)
+		if err == errLocked {
+			locked, err = true, nil
+			break
+		}
+		if err != nil {
+			break
+		}
+		challenges += c
+		sessions += s
+		if c < j.batch && s < j.batch {
+			break
+		}
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.stats.LastRun = &start
+	j.stats.DurationMs = time.Since(start).Milliseconds()
+	j.stats.ChallengesPurged = challenges
+	j.stats.SessionsPurged = sessions
+	j.stats.SkippedLocked = locked
+	j.stats.Error = ""
+	if err != nil {
+		j.stats.Error = err.Error()
+		slog.Error("Janitor failed", "error", err)
+	}
+	j.stats.TotalRuns++
+	j.stats.TotalChallenges += challenges
+	j.stats.TotalSessions += sessions
+}
+
+// start runs the janitor every interval until stop is called
+func (j *storeJanitor) start() {
+	j.done = make(chan struct{})
+	j.stopped = make(chan struct{})
+	go func() {
+		defer close(j.stopped)
+		ticker := time.NewTicker(j.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				j.run()
+			case <-j.done:
+				return
+			}
+		}
+	}()
+}
+
+// stop stops a started janitor, waiting for a run in progress to finish
+func (j *storeJanitor) stop() {
+	close(j.done)
+	<-j.stopped
+}
+
+// snapshot returns a copy of the last run's stats
+func (j *storeJanitor) snapshot() janitorStats {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	stats := j.stats
+	stats.IntervalSeconds = int64(j.interval.Seconds())
+	stats.RetentionSeconds = int64(j.retention.Seconds())
+	return stats
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestJanitorPurgesExpired(t *testing.T) {
+	for _, backend := range []string{"memory", "sqlite", "postgres"} {
+		t.Run(backend, func(t *testing.T) {
+			setupTestStore(t, backend)
+			handle, privateKey := registerTestUser(t)
+
+			past := time.Now().Add(-2 * time.Hour)
+			for _, c := range []string{"old1", "old2", "old3"} {
+				if err := store.SaveChallenge(context.Background(), handle, &ChallengeResponse{Challenge: c, IssuedAt: past, ExpiresAt: past.Add(currentConfig().Tokens.ChallengeTTL)}); err != nil {
+					t.Fatalf("SaveChallenge failed: %v", err)
+				}
+			}
+
+			var kept, revoked VerifyResponse
+			doJSON(t, verifyHandler, signedLogin(t, handle, privateKey), &kept)
+			doJSON(t, verifyHandler, signedLogin(t, handle, privateKey), &revoked)
+			user, _ := store.UserByHandle(context.Background(), handle)
+			sessions, _ := store.ListSessions(context.Background(), user.ID)
+			if len(sessions) != 2 {
+				t.Fatalf("Got %d sessions, want 2", len(sessions))
+			}
+			if err := store.RevokeSession(context.Background(), user.ID, sessions[0].ID); err != nil {
+				t.Fatalf("RevokeSession failed: %v", err)
+			}
+
+			// A negative retention purges revoked sessions right away
+			j := newStoreJanitor(store, time.Minute, -time.Second, 2)
+			j.run()
+			stats := j.snapshot()
+			if stats.Error != "" {
+				t.Fatalf("Janitor failed: %s", stats.Error)
+			}
+			if stats.ChallengesPurged != 3 || stats.SessionsPurged != 1 {
+				t.Errorf("Purged %d challenges and %d sessions, want 3 and 1", stats.ChallengesPurged, stats.SessionsPurged)
+			}
+
+			if _, _, err := store.FindChallenge(context.Background(), handle, "old1"); err != errNotFound {
+				t.Errorf("Expired challenge survived: %v", err)
+			}
+			if sessions, _ := store.ListSessions(context.Background(), user.ID); len(sessions) != 1 {
+				t.Errorf("Got %d sessions after purge, want 1", len(sessions))
+			}
+		})
+	}
+}
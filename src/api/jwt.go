@@ -0,0 +1,562 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Supported token signing algorithms (JWS "alg" values)
+const (
+	algEdDSA = "EdDSA"
+	algES256 = "ES256"
+)
+
+// keyCreatedHeader is the PEM header recording when a signing key was
+// generated, which orders keys in the ring
+const keyCreatedHeader = "Created"
+
+// TokenClaims is the payload of an access token issued by /verify
+type TokenClaims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"` // the user's handle
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	ID        string `json:"jti"`
+	KeyType   string `json:"key_type"` // key type the user authenticated with
+}
+
+type tokenHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Typ string `json:"typ"`
+}
+
+// signingKey is a server key used to sign access tokens
+type signingKey struct {
+	kid       string
+	alg       string
+	signer    crypto.Signer
+	createdAt time.Time
+}
+
+// keyRing holds the token signing keys loaded from disk.
+//
+// Every <kid>.pem file in the directory is a PKCS#8 private key. Keys are
+// ordered by the Created header written into the file when the key was
+// generated, never by file times, which copying or restoring the directory
+// changes. The newest key for the configured algorithm signs new tokens
+// unless a kid is pinned.
+// Each superseded key stays published in the JWKS for the grace period after
+// it was superseded, so tokens it signed keep validating, and then drops out
+// on its own. Keys newer than the active one are published straight away so
+// they can be pre-distributed.
+type keyRing struct {
+	dir      string
+	alg      string
+	pinned   string
+	grace    time.Duration
+	generate bool // create a key if none exists; only safe with one replica
+
+	mu         sync.RWMutex
+	active     *signingKey
+	keys       map[string]*signingKey
+	superseded map[string]time.Time // kid -> when a newer key replaced it
+}
+
+var tokenKeys *keyRing
+
+// loadKeyRing reads the signing keys in dir. If none exists for the
+// requested algorithm a first key is generated when generate is set, and
+// loading fails otherwise: replicas that each generated their own key would
+// reject each other's tokens.
+func loadKeyRing(dir, alg, pinned string, grace time.Duration, generate bool) (*keyRing, error) {
+	if alg != algEdDSA && alg != algES256 {
+		return nil, fmt.Errorf("unsupported token signing algorithm: %s", alg)
+	}
+
+	kr := &keyRing{
+		dir:      dir,
+		alg:      alg,
+		pinned:   pinned,
+		grace:    grace,
+		generate: generate,
+	}
+	if err := kr.reload(); err != nil {
+		return nil, err
+	}
+	return kr, nil
+}
+
+// reload rescans the key directory, picking up added and removed keys
+func (kr *keyRing) reload() error {
+	if err := os.MkdirAll(kr.dir, 0700); err != nil {
+		return fmt.Errorf("failed to create key directory: %w", err)
+	}
+
+	entries, err := os.ReadDir(kr.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read key directory: %w", err)
+	}
+
+	var loaded []*signingKey
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".pem") {
+			continue
+		}
+		key, err := readSigningKey(filepath.Join(kr.dir, entry.Name()))
+		if err != nil {
+			return fmt.Errorf("failed to load signing key %s: %w", entry.Name(), err)
+		}
+		loaded = append(loaded, key)
+	}
+
+	// Keys without a Created header, e.g. from openssl, sort before every
+	// stamped key. Two of them can't be told apart, so one must be pinned.
+	if kr.pinned == "" {
+		var unstamped []string
+		for _, key := range loaded {
+			if key.alg == kr.alg && key.createdAt.IsZero() {
+				unstamped = append(unstamped, key.kid)
+			}
+		}
+		if len(unstamped) > 1 {
+			return fmt.Errorf("signing keys %s have no Created header; pin one with AUTHGRID_JWT_ACTIVE_KID", strings.Join(unstamped, ", "))
+		}
+	}
+
+	var active *signingKey
+	for _, key := range loaded {
+		if kr.pinned != "" {
+			if key.kid == kr.pinned {
+				active = key
+			}
+			continue
+		}
+		if key.alg == kr.alg && (active == nil || key.createdAt.After(active.createdAt)) {
+			active = key
+		}
+	}
+
+	if active == nil {
+		if kr.pinned != "" {
+			return fmt.Errorf("pinned signing key %q not found in %s", kr.pinned, kr.dir)
+		}
+		if !kr.generate {
+			return fmt.Errorf("no %s signing key in %s; provision the same key to every replica", kr.alg, kr.dir)
+		}
+		active, err = generateSigningKey(kr.dir, kr.alg)
+		if err != nil {
+			return err
+		}
+		slog.Info("Generated new token signing key", "alg", active.alg, "kid", active.kid)
+		loaded = append(loaded, active)
+	}
+
+	sort.Slice(loaded, func(i, j int) bool {
+		if !loaded[i].createdAt.Equal(loaded[j].createdAt) {
+			return loaded[i].createdAt.Before(loaded[j].createdAt)
+		}
+		return loaded[i].kid < loaded[j].kid
+	})
+
+	kr.mu.RLock()
+	previous, tracked := kr.keys, kr.superseded
+	kr.mu.RUnlock()
+
+	now := time.Now()
+	keys := make(map[string]*signingKey)
+	superseded := make(map[string]time.Time)
+	for i, key := range loaded {
+		if key == active || key.createdAt.After(active.createdAt) {
+			keys[key.kid] = key
+			continue
+		}
+
+		// A key is superseded once, when a newer key takes over. A key this
+		// ring published until now was superseded just now. One found
+		// already superseded at startup was replaced when the next newer
+		// key was created, or just now if that key has no Created header.
+		since, ok := tracked[key.kid]
+		if !ok {
+			since = active.createdAt
+			if _, published := previous[key.kid]; published {
+				since = now
+			} else if i+1 < len(loaded) {
+				since = loaded[i+1].createdAt
+			}
+			if since.IsZero() {
+				since = now
+			}
+		}
+		superseded[key.kid] = since
+		if now.Sub(since) < kr.grace {
+			keys[key.kid] = key
+		}
+	}
+
+	kr.mu.Lock()
+	kr.active = active
+	kr.keys = keys
+	kr.superseded = superseded
+	kr.mu.Unlock()
+	return nil
+}
+
+// watch periodically reloads the key directory so rotated keys are picked up
+// without a restart
+func (kr *keyRing) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := kr.reload(); err != nil {
+			slog.Error("Failed to reload token signing keys", "error", err)
+		}
+	}
+}
+
+func (kr *keyRing) signingKey() *signingKey {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.active
+}
+
+func (kr *keyRing) lookup(kid string) (*signingKey, bool) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	key, ok := kr.keys[kid]
+	return key, ok
+}
+
+// readSigningKey parses a PEM-encoded private key file. Its creation time
+// comes from the Created header and is zero without one.
+func readSigningKey(path string) (*signingKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+
+	var createdAt time.Time
+	if created, ok := block.Headers[keyCreatedHeader]; ok {
+		if createdAt, err = time.Parse(time.RFC3339, created); err != nil {
+			return nil, fmt.Errorf("invalid %s header: %w", keyCreatedHeader, err)
+		}
+	}
+
+	var parsed interface{}
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		parsed, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type: %s", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key := &signingKey{
+		kid:       strings.TrimSuffix(filepath.Base(path), ".pem"),
+		createdAt: createdAt,
+	}
+	switch k := parsed.(type) {
+	case ed25519.PrivateKey:
+		key.alg = algEdDSA
+		key.signer = k
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("ECDSA signing keys must use P-256")
+		}
+		key.alg = algES256
+		key.signer = k
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", parsed)
+	}
+	return key, nil
+}
+
+// generateSigningKey creates a new private key and writes it to dir
+func generateSigningKey(dir, alg string) (*signingKey, error) {
+	var signer crypto.Signer
+	var err error
+	switch alg {
+	case algEdDSA:
+		_, signer, err = ed25519.GenerateKey(rand.Reader)
+	case algES256:
+		signer, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate signing key: %w", err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(signer)
+	if err != nil {
+		return nil, err
+	}
+	spki, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	// Derive the kid from the public key so it is stable across restarts
+	sum := sha256.Sum256(spki)
+	kid := base64.RawURLEncoding.EncodeToString(sum[:])[:16]
+
+	createdAt := time.Now().UTC()
+	path := filepath.Join(dir, kid+".pem")
+	data := pem.EncodeToMemory(&pem.Block{
+		Type:    "PRIVATE KEY",
+		Headers: map[string]string{keyCreatedHeader: createdAt.Format(time.RFC3339Nano)},
+		Bytes:   der,
+	})
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return nil, fmt.Errorf("failed to write signing key: %w", err)
+	}
+
+	return &signingKey{
+		kid:       kid,
+		alg:       alg,
+		signer:    signer,
+		createdAt: createdAt,
+	}, nil
+}
+
+// runKeysCommand implements `authgrid-api keys generate`, which adds a key
+// to the key directory for the next rotation
+func runKeysCommand(args []string) {
+	if len(args) != 1 || args[0] != "generate" {
+		log.Fatal("usage: authgrid-api keys generate")
+	}
+	cfg, err := loadConfig(os.Getenv("AUTHGRID_CONFIG"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.Tokens.Alg != algEdDSA && cfg.Tokens.Alg != algES256 {
+		log.Fatalf("unsupported token signing algorithm: %s", cfg.Tokens.Alg)
+	}
+	if err := os.MkdirAll(cfg.Tokens.KeysDir, 0700); err != nil {
+		log.Fatal(err)
+	}
+	key, err := generateSigningKey(cfg.Tokens.KeysDir, cfg.Tokens.Alg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(key.kid)
+}
+
+// sign produces a JWS signature over the signing input
+func (k *signingKey) sign(input []byte) ([]byte, error) {
+	switch k.alg {
+	case algEdDSA:
+		return k.signer.Sign(rand.Reader, input, crypto.Hash(0))
+	case algES256:
+		hash := sha256.Sum256(input)
+		r, s, err := ecdsa.Sign(rand.Reader, k.signer.(*ecdsa.PrivateKey), hash[:])
+		if err != nil {
+			return nil, err
+		}
+		// JWS uses the fixed-width R || S encoding, not DER
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+		return sig, nil
+	default:
+		return nil, fmt.Errorf("unsupported algorithm: %s", k.alg)
+	}
+}
+
+// verify checks a JWS signature made by this key
+func (k *signingKey) verify(input, sig []byte) bool {
+	switch pub := k.signer.Public().(type) {
+	case ed25519.PublicKey:
+		return ed25519.Verify(pub, input, sig)
+	case *ecdsa.PublicKey:
+		if len(sig) != 64 {
+			return false
+		}
+		hash := sha256.Sum256(input)
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(pub, hash[:], r, s)
+	default:
+		return false
+	}
+}
+
+// jwk returns the public half of the key as a JSON Web Key
+func (k *signingKey) jwk() map[string]string {
+	jwk := map[string]string{
+		"kid": k.kid,
+		"alg": k.alg,
+		"use": "sig",
+	}
+	switch pub := k.signer.Public().(type) {
+	case ed25519.PublicKey:
+		jwk["kty"] = "OKP"
+		jwk["crv"] = "Ed25519"
+		jwk["x"] = base64.RawURLEncoding.EncodeToString(pub)
+	case *ecdsa.PublicKey:
+		x := make([]byte, 32)
+		y := make([]byte, 32)
+		pub.X.FillBytes(x)
+		pub.Y.FillBytes(y)
+		jwk["kty"] = "EC"
+		jwk["crv"] = "P-256"
+		jwk["x"] = base64.RawURLEncoding.EncodeToString(x)
+		jwk["y"] = base64.RawURLEncoding.EncodeToString(y)
+	}
+	return jwk
+}
+
+// tokenIssuer returns the "iss" claim for issued tokens
+func tokenIssuer() string {
+	cfg := currentConfig()
+	if cfg.Auth.Issuer != "" {
+		return cfg.Auth.Issuer
+	}
+	return "https://" + cfg.Auth.Domain
+}
+
+// generateToken mints a signed JWT access token for an authenticated handle
+func generateToken(handle, keyType string, expiresAt time.Time) (string, error) {
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+
+	return signJWS(tokenKeys, "JWT", TokenClaims{
+		Issuer:    tokenIssuer(),
+		Subject:   handle,
+		IssuedAt:  time.Now().Unix(),
+		ExpiresAt: expiresAt.Unix(),
+		ID:        base64.RawURLEncoding.EncodeToString(jti),
+		KeyType:   keyType,
+	})
+}
+
+// signJWS signs claims with the active key of kr as a compact JWS whose
+// header has type typ
+func signJWS(kr *keyRing, typ string, claims interface{}) (string, error) {
+	key := kr.signingKey()
+
+	header, err := json.Marshal(tokenHeader{Alg: key.alg, Kid: key.kid, Typ: typ})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sig, err := key.sign([]byte(input))
+	if err != nil {
+		return "", fmt.Errorf("failed to sign token: %w", err)
+	}
+
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// openJWS checks that token is a compact JWS of type typ signed by a key of
+// kr and decodes its payload into claims. A token of another type is
+// refused, so an access token can't stand in for anything else and the
+// other way round.
+func openJWS(kr *keyRing, token, typ string, claims interface{}) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errors.New("malformed token")
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return errors.New("malformed token header")
+	}
+	var header tokenHeader
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return errors.New("malformed token header")
+	}
+	if header.Typ != typ {
+		return errors.New("unexpected token type")
+	}
+
+	key, ok := kr.lookup(header.Kid)
+	if !ok {
+		return errors.New("unknown signing key")
+	}
+	if header.Alg != key.alg {
+		return errors.New("token algorithm mismatch")
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return errors.New("malformed token signature")
+	}
+	if !key.verify([]byte(parts[0]+"."+parts[1]), sig) {
+		return errors.New("invalid token signature")
+	}
+
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return errors.New("malformed token claims")
+	}
+	if err := json.Unmarshal(claimsJSON, claims); err != nil {
+		return errors.New("malformed token claims")
+	}
+	return nil
+}
+
+// verifyToken checks a token's signature, issuer and expiry and returns its claims
+func verifyToken(token string) (*TokenClaims, error) {
+	var claims TokenClaims
+	if err := openJWS(tokenKeys, token, "JWT", &claims); err != nil {
+		return nil, err
+	}
+
+	if claims.Issuer != tokenIssuer() {
+		return nil, errors.New("unexpected token issuer")
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return nil, errors.New("token expired")
+	}
+
+	return &claims, nil
+}
+
+// jwksHandler publishes the public token signing keys
+func jwksHandler(w http.ResponseWriter, r *http.Request) {
+	tokenKeys.mu.RLock()
+	keys := make([]map[string]string, 0, len(tokenKeys.keys))
+	for _, key := range tokenKeys.keys {
+		keys = append(keys, key.jwk())
+	}
+	tokenKeys.mu.RUnlock()
+	sort.Slice(keys, func(i, j int) bool { return keys[i]["kid"] < keys[j]["kid"] })
+
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": keys,
+	})
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setupTestKeys points the global key ring at a fresh temporary directory
+func setupTestKeys(t *testing.T, alg string) string {
+	t.Helper()
+	dir := t.TempDir()
+	kr, err := loadKeyRing(dir, alg, "", time.Hour, true)
+	if err != nil {
+		t.Fatalf("Failed to load key ring: %v", err)
+	}
+	tokenKeys = kr
+	return dir
+}
+
+// setKeyCreated rewrites the Created header of a key file
+func setKeyCreated(t *testing.T, dir, kid string, created time.Time) {
+	t.Helper()
+	path := filepath.Join(dir, kid+".pem")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read key: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		t.Fatalf("No PEM block in %s", path)
+	}
+	if created.IsZero() {
+		block.Headers = nil
+	} else {
+		block.Headers = map[string]string{keyCreatedHeader: created.UTC().Format(time.RFC3339Nano)}
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+}
+
+func TestGenerateSignedToken(t *testing.T) {
+	for _, alg := range []string{algEdDSA, algES256} {
+		t.Run(alg, func(t *testing.T) {
+			setupTestKeys(t, alg)
+
+			handle := "test@authgrid.net"
+			token, err := generateToken(handle, "ed25519", time.Now().Add(time.Hour))
+			if err != nil {
+				t.Fatalf("Failed to generate token: %v", err)
+			}
+
+			claims, err := verifyToken(token)
+			if err != nil {
+				t.Fatalf("Failed to verify token: %v", err)
+			}
+			if claims.Subject != handle {
+				t.Errorf("Wrong subject: got %s, want %s", claims.Subject, handle)
+			}
+			if claims.KeyType != "ed25519" {
+				t.Errorf("Wrong key type: got %s", claims.KeyType)
+			}
+
+			header, _ := base64.RawURLEncoding.DecodeString(strings.Split(token, ".")[0])
+			if !strings.Contains(string(header), `"alg":"`+alg+`"`) {
+				t.Errorf("Header has wrong alg: %s", header)
+			}
+
+			// Should be unique
+			token2, _ := generateToken(handle, "ed25519", time.Now().Add(time.Hour))
+			claims2, _ := verifyToken(token2)
+			if claims.ID == claims2.ID {
+				t.Errorf("Token IDs should be unique")
+			}
+		})
+	}
+}
+
+func TestVerifyTokenRejectsTampering(t *testing.T) {
+	setupTestKeys(t, algEdDSA)
+
+	token, err := generateToken("alice@authgrid.net", "ed25519", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Failed to generate token: %v", err)
+	}
+
+	// Swap in a payload claiming a different subject
+	parts := strings.Split(token, ".")
+	forged, _ := json.Marshal(TokenClaims{
+		Issuer:    tokenIssuer(),
+		Subject:   "mallory@authgrid.net",
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+	})
+	parts[1] = base64.RawURLEncoding.EncodeToString(forged)
+
+	if _, err := verifyToken(strings.Join(parts, ".")); err == nil {
+		t.Errorf("Tampered token accepted")
+	}
+}
+
+func TestVerifyTokenExpired(t *testing.T) {
+	setupTestKeys(t, algEdDSA)
+
+	token, err := generateToken("alice@authgrid.net", "ed25519", time.Now().Add(-time.Second))
+	if err != nil {
+		t.Fatalf("Failed to generate token: %v", err)
+	}
+
+	if _, err := verifyToken(token); err == nil {
+		t.Errorf("Expired token accepted")
+	}
+}
+
+func TestKeyRotationGracePeriod(t *testing.T) {
+	dir := setupTestKeys(t, algEdDSA)
+
+	oldToken, err := generateToken("alice@authgrid.net", "ed25519", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Failed to generate token: %v", err)
+	}
+	oldKid := tokenKeys.signingKey().kid
+
+	// Backdate the existing key and drop in a new one
+	setKeyCreated(t, dir, oldKid, time.Now().Add(-2*time.Hour))
+	if _, err := generateSigningKey(dir, algEdDSA); err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	if err := tokenKeys.reload(); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+
+	if tokenKeys.signingKey().kid == oldKid {
+		t.Fatalf("Newest key was not activated")
+	}
+	if _, err := verifyToken(oldToken); err != nil {
+		t.Errorf("Token from retired key rejected during grace period: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	jwksHandler(rec, httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil))
+	var jwks struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	json.NewDecoder(rec.Body).Decode(&jwks)
+	if len(jwks.Keys) != 2 {
+		t.Errorf("JWKS should publish both keys during grace, got %d", len(jwks.Keys))
+	}
+
+	// Once the grace period has elapsed the old key is dropped
+	tokenKeys.grace = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	if err := tokenKeys.reload(); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+	if _, err := verifyToken(oldToken); err == nil {
+		t.Errorf("Token from retired key accepted after grace period")
+	}
+}
+
+func TestSupersededKeysExpireOneAtATime(t *testing.T) {
+	dir := setupTestKeys(t, algEdDSA)
+	generation := 0
+	newKey := func() string {
+		t.Helper()
+		token, err := generateToken("alice@authgrid.net", "ed25519", time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatalf("Failed to generate token: %v", err)
+		}
+		key, err := generateSigningKey(dir, algEdDSA)
+		if err != nil {
+			t.Fatalf("Failed to generate key: %v", err)
+		}
+		generation++
+		setKeyCreated(t, dir, key.kid, time.Now().Add(time.Duration(generation)*time.Second))
+		if err := tokenKeys.reload(); err != nil {
+			t.Fatalf("Failed to reload: %v", err)
+		}
+		return token
+	}
+	kid := func(token string) string {
+		header, _ := base64.RawURLEncoding.DecodeString(strings.Split(token, ".")[0])
+		var h tokenHeader
+		json.Unmarshal(header, &h)
+		return h.Kid
+	}
+	backdate := func(token string, d time.Duration) {
+		tokenKeys.mu.Lock()
+		tokenKeys.superseded[kid(token)] = time.Now().Add(-d)
+		tokenKeys.mu.Unlock()
+	}
+
+	// Three generations of keys, each superseded at its own time
+	first := newKey()
+	backdate(first, 30*time.Minute)
+	second := newKey()
+	if _, err := verifyToken(first); err != nil {
+		t.Errorf("Token from the first key rejected within its grace period: %v", err)
+	}
+
+	// The first key's grace period ends while the second's goes on
+	backdate(first, 2*time.Hour)
+	if err := tokenKeys.reload(); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+	if _, err := verifyToken(first); err == nil {
+		t.Error("Token from the first key accepted after its grace period")
+	}
+	if _, err := verifyToken(second); err != nil {
+		t.Errorf("Token from the second key rejected within its grace period: %v", err)
+	}
+
+	// Touching an expired key's file doesn't publish it again
+	touched := tokenKeys.signingKey().createdAt.Add(-time.Millisecond)
+	os.Chtimes(filepath.Join(dir, kid(first)+".pem"), touched, touched)
+	if err := tokenKeys.reload(); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+	if _, err := verifyToken(first); err == nil {
+		t.Error("Touching the first key's file published it again")
+	}
+}
+
+func TestKeyRingWithoutGeneration(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := loadKeyRing(dir, algEdDSA, "", time.Hour, false); err == nil {
+		t.Fatal("Loaded an empty key directory without generating a key")
+	}
+
+	key, err := generateSigningKey(dir, algEdDSA)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	kr, err := loadKeyRing(dir, algEdDSA, "", time.Hour, false)
+	if err != nil {
+		t.Fatalf("Failed to load provisioned key: %v", err)
+	}
+	if kr.signingKey().kid != key.kid {
+		t.Errorf("Active key is %s, want the provisioned %s", kr.signingKey().kid, key.kid)
+	}
+}
+
+func TestKeyOrderIgnoresFileTimes(t *testing.T) {
+	dir := setupTestKeys(t, algEdDSA)
+	older := tokenKeys.signingKey().kid
+	setKeyCreated(t, dir, older, time.Now().Add(-time.Hour))
+	newer, err := generateSigningKey(dir, algEdDSA)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	// Copy the directory newest key first, as a restore might, and make
+	// the older key's file the most recently modified
+	copied := t.TempDir()
+	for i, kid := range []string{newer.kid, older} {
+		data, err := os.ReadFile(filepath.Join(dir, kid+".pem"))
+		if err != nil {
+			t.Fatalf("Failed to read key: %v", err)
+		}
+		path := filepath.Join(copied, kid+".pem")
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatalf("Failed to copy key: %v", err)
+		}
+		modified := time.Now().Add(time.Duration(i) * time.Hour)
+		os.Chtimes(path, modified, modified)
+	}
+
+	kr, err := loadKeyRing(copied, algEdDSA, "", time.Hour, false)
+	if err != nil {
+		t.Fatalf("Failed to load copied keys: %v", err)
+	}
+	if kr.signingKey().kid != newer.kid {
+		t.Errorf("Active key is %s after copying, want %s", kr.signingKey().kid, newer.kid)
+	}
+}
+
+func TestKeysWithoutCreatedHeader(t *testing.T) {
+	dir := setupTestKeys(t, algEdDSA)
+	legacy := tokenKeys.signingKey().kid
+	setKeyCreated(t, dir, legacy, time.Time{})
+
+	// A stamped key is newer than one without a Created header
+	stamped, err := generateSigningKey(dir, algEdDSA)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	kr, err := loadKeyRing(dir, algEdDSA, "", time.Hour, false)
+	if err != nil {
+		t.Fatalf("Failed to load keys: %v", err)
+	}
+	if kr.signingKey().kid != stamped.kid {
+		t.Errorf("Active key is %s, want the stamped %s", kr.signingKey().kid, stamped.kid)
+	}
+	if _, ok := kr.lookup(legacy); !ok {
+		t.Error("Key without a Created header was not published during its grace period")
+	}
+
+	// Two keys without one can't be ordered unless one is pinned
+	setKeyCreated(t, dir, stamped.kid, time.Time{})
+	if _, err := loadKeyRing(dir, algEdDSA, "", time.Hour, false); err == nil {
+		t.Fatal("Loaded two keys without a Created header and no pinned kid")
+	}
+	kr, err = loadKeyRing(dir, algEdDSA, legacy, time.Hour, false)
+	if err != nil {
+		t.Fatalf("Failed to load keys with a pinned kid: %v", err)
+	}
+	if kr.signingKey().kid != legacy {
+		t.Errorf("Active key is %s, want the pinned %s", kr.signingKey().kid, legacy)
+	}
+	if _, ok := kr.lookup(stamped.kid); !ok {
+		t.Error("Unpinned key was not published during its grace period")
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// UserKey is a public key (device) that can authenticate as a user
+type UserKey struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	PublicKey  string     `json:"public_key"`
+	KeyType    string     `json:"key_type"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// AddKeyRequest represents a request to add a device key to a handle.
+// Signature is made by an existing key over addKeyStatement, and
+// NewSignature by the new key over the same statement.
+type AddKeyRequest struct {
+	Handle       string `json:"handle"`
+	Challenge    string `json:"challenge"`
+	Signature    string `json:"signature"`
+	KeyID        string `json:"key_id,omitempty"` // existing key that signed
+	PublicKey    string `json:"public_key"`       // new key, base64 encoded
+	KeyType      string `json:"key_type"`
+	Name         string `json:"name"`
+	NewSignature string `json:"new_signature"`
+}
+
+// addKeyStatement is the message an existing key signs to authorize a new
+// one, and the new key signs to prove it is held by the same party. It binds
+// a fresh challenge to the exact key being added.
+func addKeyStatement(challenge, keyType, publicKey string) []byte {
+	return []byte("authgrid-add-key\n" + challenge + "\n" + keyType + "\n" + publicKey)
+}
+
+// findSigningKey returns the active key of a user that produced signature
+// over message, or nil if none did. If keyID is set only that key is tried.
+// A webauthn key's signature counter is advanced, returning
+// errSignCountRegressed if it didn't go up.
+func findSigningKey(ctx context.Context, userID, keyID string, message, signature []byte) (*UserKey, error) {
+	keys, err := store.ActiveKeys(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range keys {
+		if keyID != "" && keys[i].ID != keyID {
+			continue
+		}
+		// A signature from one key type won't parse for another; that is a
+		// mismatch, not a server error
+		valid, err := verifySignature(ctx, keys[i].PublicKey, keys[i].KeyType, message, signature)
+		if err == nil && valid {
+			if keys[i].KeyType == keyTypeWebAuthn {
+				if err := advanceSignCount(ctx, &keys[i], signature); err != nil {
+					return nil, err
+				}
+			}
+			return &keys[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// addKeyHandler adds a device key to a handle, authorized by a signature
+// from one of its existing keys over a fresh challenge
+func addKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var req AddKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if req.Handle == "" || req.Challenge == "" || req.Signature == "" || req.NewSignature == "" {
+		respondError(w, http.StatusBadRequest, "Handle, challenge, and both signatures are required")
+		return
+	}
+
+	if !checkLockout(w, r, req.Handle) {
+		return
+	}
+
+	if _, err := validatePublicKey(req.PublicKey, req.KeyType); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	user, err := store.UserByHandle(r.Context(), req.Handle)
+	if err == errNotFound {
+		respondError(w, http.StatusNotFound, "Handle not found")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	ch, ok := checkChallenge(w, r, req.Handle, req.Challenge)
+	if !ok {
+		return
+	}
+
+	signatureBytes, err := base64.StdEncoding.DecodeString(req.Signature)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid signature encoding")
+		return
+	}
+	newSignature, err := base64.StdEncoding.DecodeString(req.NewSignature)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid signature encoding")
+		return
+	}
+
+	statement := addKeyStatement(req.Challenge, req.KeyType, req.PublicKey)
+	signer, err := findSigningKey(r.Context(), user.ID, req.KeyID, statement, signatureBytes)
+	if err == errSignCountRegressed {
+		recordAudit(r, auditKeyAdd, req.Handle, outcomeFailure, "sign count regressed")
+		respondLoginFailure(w, r, ch, req.Handle, "Authenticator signature counter went backwards")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if signer == nil {
+		recordAudit(r, auditKeyAdd, req.Handle, outcomeFailure, "invalid signature")
+		respondLoginFailure(w, r, ch, req.Handle, "Invalid signature")
+		return
+	}
+
+	// The new key proves it is held by whoever is adding it, so a handle
+	// can't be made to claim someone else's public key
+	valid, err := verifySignature(r.Context(), req.PublicKey, req.KeyType, statement, newSignature)
+	if err != nil || !valid {
+		recordAudit(r, auditKeyAdd, req.Handle, outcomeFailure, "invalid new key signature")
+		respondLoginFailure(w, r, ch, req.Handle, "Invalid new key signature")
+		return
+	}
+
+	key := UserKey{
+		Name:      req.Name,
+		PublicKey: req.PublicKey,
+		KeyType:   req.KeyType,
+	}
+	err = store.AddKey(r.Context(), ch, user.ID, &key)
+	switch err {
+	case nil:
+	case errKeyRegistered:
+		respondError(w, http.StatusConflict, "Public key already registered")
+		return
+	case errChallengeUsed:
+		respondError(w, http.StatusBadRequest, "Challenge already used")
+		return
+	default:
+		respondError(w, http.StatusInternalServerError, "Failed to add key")
+		return
+	}
+	recordLoginSuccess(r, req.Handle)
+	recordAudit(r, auditKeyAdd, req.Handle, outcomeSuccess, "key "+key.ID+" signed by "+signer.ID)
+
+	respondJSON(w, http.StatusCreated, key)
+}
+
+// listKeysHandler returns the caller's active keys
+func listKeysHandler(w http.ResponseWriter, r *http.Request) {
+	sess := currentSession(r)
+
+	keys, err := store.ActiveKeys(r.Context(), sess.UserID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": keys,
+	})
+}
+
+// removeKeyHandler removes one of the caller's keys and revokes the sessions
+// that were opened with it. The last remaining key cannot be removed.
+func removeKeyHandler(w http.ResponseWriter, r *http.Request) {
+	sess := currentSession(r)
+	id := mux.Vars(r)["id"]
+
+	err := store.RemoveKey(r.Context(), sess.UserID, id)
+	if err == errNotFound {
+		respondError(w, http.StatusNotFound, "Key not found")
+		return
+	}
+	if err == errLastKey {
+		respondError(w, http.StatusConflict, "Cannot remove the last key")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to remove key")
+		return
+	}
+	recordAudit(r, auditKeyRemove, sess.Handle, outcomeSuccess, "key "+id)
+
+	respondJSON(w, http.StatusOK, map[string]bool{"removed": true})
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestAddKeyProofOfPossession(t *testing.T) {
+	for _, backend := range []string{"memory", "sqlite", "postgres"} {
+		t.Run(backend, func(t *testing.T) {
+			setupTestStore(t, backend)
+			handle, deviceKey := registerTestUser(t)
+			publicKey, newKey := newTestKey(t)
+			_, otherKey := newTestKey(t)
+
+			sign := func(key ed25519.PrivateKey, msg []byte) string {
+				return base64.StdEncoding.EncodeToString(ed25519.Sign(key, msg))
+			}
+			for _, tt := range []struct {
+				name         string
+				newSignature func(statement []byte) string
+				want         int
+			}{
+				{"no new key signature", func([]byte) string { return "" }, http.StatusBadRequest},
+				{"signed by another key", func(s []byte) string { return sign(otherKey, s) }, http.StatusUnauthorized},
+				{"signed over another statement", func([]byte) string { return sign(newKey, []byte("authgrid-add-key")) }, http.StatusUnauthorized},
+				{"signed by the new key", func(s []byte) string { return sign(newKey, s) }, http.StatusCreated},
+			} {
+				t.Run(tt.name, func(t *testing.T) {
+					challenge := newChallenge(t, handle)
+					statement := addKeyStatement(challenge, "ed25519", publicKey)
+					code := doJSON(t, addKeyHandler, AddKeyRequest{
+						Handle:       handle,
+						Challenge:    challenge,
+						Signature:    sign(deviceKey, statement),
+						PublicKey:    publicKey,
+						KeyType:      "ed25519",
+						NewSignature: tt.newSignature(statement),
+					}, nil)
+					if code != tt.want {
+						t.Errorf("/keys returned %d, want %d", code, tt.want)
+					}
+				})
+			}
+
+			if code := doJSON(t, verifyHandler, signedLogin(t, handle, newKey), nil); code != http.StatusOK {
+				t.Errorf("Login with the added key returned %d, want 200", code)
+			}
+		})
+	}
+}
+
+// addTestKey adds a fresh Ed25519 key to handle, authorized by signer
+func addTestKey(t *testing.T, handle string, signer ed25519.PrivateKey) (UserKey, ed25519.PrivateKey) {
+	t.Helper()
+	publicKey, newKey := newTestKey(t)
+	challenge := newChallenge(t, handle)
+	statement := addKeyStatement(challenge, "ed25519", publicKey)
+	var key UserKey
+	code := doJSON(t, addKeyHandler, AddKeyRequest{
+		Handle:       handle,
+		Challenge:    challenge,
+		Signature:    base64.StdEncoding.EncodeToString(ed25519.Sign(signer, statement)),
+		PublicKey:    publicKey,
+		KeyType:      "ed25519",
+		NewSignature: base64.StdEncoding.EncodeToString(ed25519.Sign(newKey, statement)),
+	}, &key)
+	if code != http.StatusCreated {
+		t.Fatalf("/keys returned %d", code)
+	}
+	return key, newKey
+}
+
+func TestAddKeyLockout(t *testing.T) {
+	setupTestStore(t, "memory")
+	lockout = &loginLockout{
+		policy:  lockoutPolicy{Threshold: 2, Base: time.Minute, Max: time.Hour, Reset: time.Hour},
+		tracker: newMemoryFailureTracker(),
+	}
+	t.Cleanup(func() { lockout = nil })
+
+	handle, ownerKey := registerTestUser(t)
+	_, attackerKey := newTestKey(t)
+	publicKey, newKey := newTestKey(t)
+	addKey := func(challenge string) int {
+		statement := addKeyStatement(challenge, "ed25519", publicKey)
+		return doJSONFrom(t, "203.0.113.66:1", addKeyHandler, AddKeyRequest{
+			Handle:       handle,
+			Challenge:    challenge,
+			Signature:    base64.StdEncoding.EncodeToString(ed25519.Sign(attackerKey, statement)),
+			PublicKey:    publicKey,
+			KeyType:      "ed25519",
+			NewSignature: base64.StdEncoding.EncodeToString(ed25519.Sign(newKey, statement)),
+		}, nil)
+	}
+
+	// Guessing an existing key counts as a failed login
+	if code := addKey(newChallenge(t, handle)); code != http.StatusUnauthorized {
+		t.Fatalf("Adding a key without an existing one returned %d, want 401", code)
+	}
+	if code := addKey(newChallenge(t, handle)); code != http.StatusTooManyRequests {
+		t.Fatalf("Adding a key that locked the handle returned %d, want 429", code)
+	}
+	if code := addKey("x"); code != http.StatusTooManyRequests {
+		t.Errorf("Adding a key from a locked out address returned %d, want 429", code)
+	}
+
+	// The owner still adds keys, which clears the handle's failures
+	addTestKey(t, handle, ownerKey)
+	if code := addKey(newChallenge(t, handle)); code != http.StatusTooManyRequests {
+		t.Errorf("Locked out address returned %d after the owner added a key, want 429", code)
+	}
+	if code := doJSONFrom(t, "198.51.100.7:1", verifyHandler, signedLogin(t, handle, attackerKey), nil); code != http.StatusUnauthorized {
+		t.Errorf("Bad login after the owner added a key returned %d, want 401", code)
+	}
+}
+
+func TestAddKey(t *testing.T) {
+	for _, backend := range []string{"memory", "sqlite", "postgres"} {
+		t.Run(backend, func(t *testing.T) {
+			setupTestStore(t, backend)
+			handle, ownerKey := registerTestUser(t)
+			otherHandle, otherKey := registerTestUser(t)
+			_, strangerKey := newTestKey(t)
+
+			// A challenge that has already authorized a key
+			usedChallenge := newChallenge(t, handle)
+			usedPublic, usedKey := newTestKey(t)
+			usedStatement := addKeyStatement(usedChallenge, "ed25519", usedPublic)
+			code := doJSON(t, addKeyHandler, AddKeyRequest{
+				Handle:       handle,
+				Challenge:    usedChallenge,
+				Signature:    base64.StdEncoding.EncodeToString(ed25519.Sign(ownerKey, usedStatement)),
+				PublicKey:    usedPublic,
+				KeyType:      "ed25519",
+				NewSignature: base64.StdEncoding.EncodeToString(ed25519.Sign(usedKey, usedStatement)),
+			}, nil)
+			if code != http.StatusCreated {
+				t.Fatalf("/keys returned %d", code)
+			}
+
+			for _, tt := range []struct {
+				name      string
+				challenge func() string
+				signer    ed25519.PrivateKey
+				statement func(challenge, publicKey string) []byte // what signer signs; addKeyStatement if nil
+				want      int
+			}{
+				{name: "signed by an unregistered key", signer: strangerKey, want: http.StatusUnauthorized},
+				{name: "signed by another handle's key", signer: otherKey, want: http.StatusUnauthorized},
+				{
+					name:      "signed over another key",
+					signer:    ownerKey,
+					statement: func(challenge, _ string) []byte { return addKeyStatement(challenge, "ed25519", usedPublic) },
+					want:      http.StatusUnauthorized,
+				},
+				{name: "challenge issued to another handle", challenge: func() string { return newChallenge(t, otherHandle) }, signer: ownerKey, want: http.StatusNotFound},
+				{name: "replayed challenge", challenge: func() string { return usedChallenge }, signer: ownerKey, want: http.StatusBadRequest},
+				{name: "signed by the handle's key", signer: ownerKey, want: http.StatusCreated},
+			} {
+				t.Run(tt.name, func(t *testing.T) {
+					challenge := newChallenge(t, handle)
+					if tt.challenge != nil {
+						challenge = tt.challenge()
+					}
+					publicKey, newKey := newTestKey(t)
+					statement := addKeyStatement(challenge, "ed25519", publicKey)
+					signed := statement
+					if tt.statement != nil {
+						signed = tt.statement(challenge, publicKey)
+					}
+					code := doJSON(t, addKeyHandler, AddKeyRequest{
+						Handle:       handle,
+						Challenge:    challenge,
+						Signature:    base64.StdEncoding.EncodeToString(ed25519.Sign(tt.signer, signed)),
+						PublicKey:    publicKey,
+						KeyType:      "ed25519",
+						NewSignature: base64.StdEncoding.EncodeToString(ed25519.Sign(newKey, statement)),
+					}, nil)
+					if code != tt.want {
+						t.Fatalf("/keys returned %d, want %d", code, tt.want)
+					}
+
+					want := http.StatusUnauthorized
+					if tt.want == http.StatusCreated {
+						want = http.StatusOK
+					}
+					if code := doJSON(t, verifyHandler, signedLogin(t, handle, newKey), nil); code != want {
+						t.Errorf("Login with the new key returned %d, want %d", code, want)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestRemoveKey(t *testing.T) {
+	for _, backend := range []string{"memory", "sqlite", "postgres"} {
+		t.Run(backend, func(t *testing.T) {
+			setupTestStore(t, backend)
+			handle, ownerKey := registerTestUser(t)
+			secondKey, secondPrivate := addTestKey(t, handle, ownerKey)
+			otherHandle, otherKey := registerTestUser(t)
+
+			ownerToken := loginToken(t, handle, ownerKey)
+			secondToken := loginToken(t, handle, secondPrivate)
+			otherToken := loginToken(t, otherHandle, otherKey)
+
+			var listed struct {
+				Keys []UserKey `json:"keys"`
+			}
+			if code := doAuthed(t, ownerToken, nil, listKeysHandler, &listed); code != http.StatusOK || len(listed.Keys) != 2 {
+				t.Fatalf("/keys returned %d with %d keys", code, len(listed.Keys))
+			}
+			ownerKeyID := listed.Keys[0].ID
+			if ownerKeyID == secondKey.ID {
+				ownerKeyID = listed.Keys[1].ID
+			}
+
+			// The cases run in order; the last key can only be refused once the
+			// second is gone
+			for _, tt := range []struct {
+				name  string
+				token string
+				keyID string
+				want  int
+			}{
+				{name: "tampered token", token: ownerToken[:len(ownerToken)-4] + "AAAA", keyID: secondKey.ID, want: http.StatusUnauthorized},
+				{name: "another handle's key", token: otherToken, keyID: secondKey.ID, want: http.StatusNotFound},
+				{name: "unknown key", token: ownerToken, keyID: "00000000-0000-0000-0000-000000000000", want: http.StatusNotFound},
+				{name: "own key", token: ownerToken, keyID: secondKey.ID, want: http.StatusOK},
+				{name: "already removed key", token: ownerToken, keyID: secondKey.ID, want: http.StatusNotFound},
+				{name: "last key", token: ownerToken, keyID: ownerKeyID, want: http.StatusConflict},
+			} {
+				t.Run(tt.name, func(t *testing.T) {
+					if code := doAuthed(t, tt.token, map[string]string{"id": tt.keyID}, removeKeyHandler, nil); code != tt.want {
+						t.Errorf("DELETE /keys/{id} returned %d, want %d", code, tt.want)
+					}
+				})
+			}
+
+			// Sessions opened with the removed key end with it
+			if code := doAuthed(t, secondToken, nil, listKeysHandler, nil); code != http.StatusUnauthorized {
+				t.Errorf("Session of the removed key returned %d, want 401", code)
+			}
+			if code := doJSON(t, verifyHandler, signedLogin(t, handle, secondPrivate), nil); code != http.StatusUnauthorized {
+				t.Errorf("Login with the removed key returned %d, want 401", code)
+			}
+		})
+	}
+}
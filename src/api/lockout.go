@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// lockout tracks failed verifications; nil disables lockouts
+var lockout *loginLockout
+
+// lockoutPolicy decides how long a key is locked after repeated failures.
+// From the Threshold-th consecutive failure on, each failure locks the key
+// for Base, doubling every time up to Max. Failures older than Reset are
+// forgotten.
+type lockoutPolicy struct {
+	Threshold int
+	Base      time.Duration
+	Max       time.Duration
+	Reset     time.Duration
+}
+
+// lockDuration is how long the failures-th consecutive failure locks for
+func (p lockoutPolicy) lockDuration(failures int) time.Duration {
+	if failures < p.Threshold {
+		return 0
+	}
+	d := p.Base
+	for i := p.Threshold; i < failures && d < p.Max; i++ {
+		d *= 2
+	}
+	if d > p.Max {
+		d = p.Max
+	}
+	return d
+}
+
+// failureState is the failure history of one key
+type failureState struct {
+	Failures    int
+	LockedUntil time.Time
+}
+
+// failureTracker stores failure counts per key
+type failureTracker interface {
+	// record counts a failure against key and returns its new state
+	record(ctx context.Context, key string, policy lockoutPolicy) (failureState, error)
+	// state returns the current state of key; forgotten keys are zero
+	state(ctx context.Context, key string, policy lockoutPolicy) (failureState, error)
+	// clear forgets keys
+	clear(ctx context.Context, keys ...string) error
+}
+
+// memoryFailureTracker keeps failures in process; each replica has its own
+type memoryFailureTracker struct {
+	mu        sync.Mutex
+	failures  map[string]*memoryFailures
+	lastPrune time.Time
+}
+
+type memoryFailures struct {
+	failureState
+	last time.Time
+}
+
+func newMemoryFailureTracker() *memoryFailureTracker {
+	return &memoryFailureTracker{failures: make(map[string]*memoryFailures), lastPrune: time.Now()}
+}
+
+func (t *memoryFailureTracker) record(ctx context.Context, key string, policy lockoutPolicy) (failureState, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(t.lastPrune) > time.Minute {
+		for k, f := range t.failures {
+			if now.Sub(f.last) > policy.Reset && now.After(f.LockedUntil) {
+				delete(t.failures, k)
+			}
+		}
+		t.lastPrune = now
+	}
+
+	f, ok := t.failures[key]
+	if !ok || now.Sub(f.last) > policy.Reset {
+		f = &memoryFailures{}
+		t.failures[key] = f
+	}
+	f.Failures++
+	f.last = now
+	if d := policy.lockDuration(f.Failures); d > 0 {
+		f.LockedUntil = now.Add(d)
+	}
+	return f.failureState, nil
+}
+
+func (t *memoryFailureTracker) state(ctx context.Context, key string, policy lockoutPolicy) (failureState, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	f, ok := t.failures[key]
+	if !ok || time.Since(f.last) > policy.Reset && time.Now().After(f.LockedUntil) {
+		return failureState{}, nil
+	}
+	return f.failureState, nil
+}
+
+func (t *memoryFailureTracker) clear(ctx context.Context, keys ...string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, k := range keys {
+		delete(t.failures, k)
+	}
+	return nil
+}
+
+// postgresFailureTracker keeps failures in login_failures so lockouts hold
+// across replicas
+type postgresFailureTracker struct {
+	db        *sql.DB
+	mu        sync.Mutex
+	lastPrune time.Time
+}
+
+func (t *postgresFailureTracker) record(ctx context.Context, key string, policy lockoutPolicy) (failureState, error) {
+	t.mu.Lock()
+	prune := time.Since(t.lastPrune) > time.Minute
+	if prune {
+		t.lastPrune = time.Now()
+	}
+	t.mu.Unlock()
+
+	if prune {
+		_, err := t.db.ExecContext(ctx, `
+			DELETE FROM login_failures
+			WHERE last_failure_at < $1 AND (locked_until IS NULL OR locked_until < NOW())
+		`, time.Now().Add(-policy.Reset))
+		if err != nil {
+			slog.Error("Failed to prune login failures", "error", err)
+		}
+	}
+
+	var st failureState
+	err := t.db.QueryRowContext(ctx, `
+		INSERT INTO login_failures (key, failures, last_failure_at)
+		VALUES ($1, 1, NOW())
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE WHEN login_failures.last_failure_at < $2
+			                THEN 1 ELSE login_failures.failures + 1 END,
+			last_failure_at = NOW()
+		RETURNING failures
+	`, key, time.Now().Add(-policy.Reset)).Scan(&st.Failures)
+	if err != nil {
+		return st, err
+	}
+
+	if d := policy.lockDuration(st.Failures); d > 0 {
+		st.LockedUntil = time.Now().Add(d)
+		if _, err := t.db.ExecContext(ctx, "UPDATE login_failures SET locked_until = $1 WHERE key = $2", st.LockedUntil, key); err != nil {
+			return st, err
+		}
+	}
+	return st, nil
+}
+
+func (t *postgresFailureTracker) state(ctx context.Context, key string, policy lockoutPolicy) (failureState, error) {
+	var st failureState
+	var lockedUntil *time.Time
+	err := t.db.QueryRowContext(ctx, `
+		SELECT failures, locked_until
+		FROM login_failures
+		WHERE key = $1 AND (last_failure_at >= $2 OR locked_until > NOW())
+	`, key, time.Now().Add(-policy.Reset)).Scan(&st.Failures, &lockedUntil)
+	if err == sql.ErrNoRows {
+		return failureState{}, nil
+	}
+	if err != nil {
+		return st, err
+	}
+	if lockedUntil != nil {
+		st.LockedUntil = *lockedUntil
+	}
+	return st, nil
+}
+
+func (t *postgresFailureTracker) clear(ctx context.Context, keys ...string) error {
+	for _, k := range keys {
+		if _, err := t.db.ExecContext(ctx, "DELETE FROM login_failures WHERE key = $1", k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loginLockout applies a lockout policy to handles and client addresses.
+//
+// A locked client address can't request challenges or verify at all. A
+// locked handle only refuses requests that fail: an attacker spreading
+// guesses over many addresses still locks it, but can't keep its owner
+// out, whose valid signature gets through and clears the lock.
+type loginLockout struct {
+	policy  lockoutPolicy
+	tracker failureTracker
+}
+
+func handleFailureKey(handle string) string { return "handle:" + handle }
+func sourceFailureKey(ip string) string     { return "ip:" + ip }
+
+// lockedUntil returns until when key is locked, or the zero time if it
+// isn't
+func (l *loginLockout) lockedUntil(ctx context.Context, key string) (time.Time, error) {
+	st, err := l.tracker.state(ctx, key, l.policy)
+	if err != nil || !st.LockedUntil.After(time.Now()) {
+		return time.Time{}, err
+	}
+	return st.LockedUntil, nil
+}
+
+// fail records a failed verification of handle from ip and returns the
+// keys it locked, described for the audit log
+func (l *loginLockout) fail(ctx context.Context, handle, ip string) ([]string, error) {
+	var locked []string
+	for _, key := range []string{handleFailureKey(handle), sourceFailureKey(ip)} {
+		st, err := l.tracker.record(ctx, key, l.policy)
+		if err != nil {
+			return locked, err
+		}
+		if st.Failures >= l.policy.Threshold {
+			locked = append(locked, fmt.Sprintf("%s locked until %s after %d failures",
+				key, st.LockedUntil.UTC().Format(time.RFC3339), st.Failures))
+		}
+	}
+	return locked, nil
+}
+
+// succeed clears the failures of handle and ip after a successful login
+func (l *loginLockout) succeed(ctx context.Context, handle, ip string) error {
+	return l.tracker.clear(ctx, handleFailureKey(handle), sourceFailureKey(ip))
+}
+
+// checkLockout refuses a request for handle if its client address is
+// locked out. It returns false after writing the response. A locked handle
+// is only enforced once a signature fails, by respondLoginFailure.
+func checkLockout(w http.ResponseWriter, r *http.Request, handle string) bool {
+	if lockout == nil {
+		return true
+	}
+	until, err := lockout.lockedUntil(r.Context(), sourceFailureKey(clientIP(r)))
+	if err != nil {
+		// Like rate limiting, lockouts fail open
+		slog.ErrorContext(r.Context(), "Lockout check failed", "error", err)
+		return true
+	}
+	if until.IsZero() {
+		return true
+	}
+	respondLocked(w, r, handle, until)
+	return false
+}
+
+// respondLocked refuses a request for handle that is locked out until until
+func respondLocked(w http.ResponseWriter, r *http.Request, handle string, until time.Time) {
+	lockoutRejections.Inc()
+	recordAudit(r, auditLoginLocked, handle, outcomeFailure, "locked until "+until.UTC().Format(time.RFC3339))
+
+	retry := int(time.Until(until).Seconds() + 0.999)
+	if retry < 1 {
+		retry = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retry))
+	respondError(w, http.StatusTooManyRequests, fmt.Sprintf("Too many failed attempts; try again in %d seconds", retry))
+}
+
+// respondLoginFailure answers a request for handle whose signature didn't
+// verify. It uses up the challenge so the request can't be retried with it
+// and counts the failure. While the handle is locked the answer is 429,
+// otherwise 401 with message.
+func respondLoginFailure(w http.ResponseWriter, r *http.Request, ch *issuedChallenge, handle, message string) {
+	discardChallenge(r, ch)
+	recordLoginFailure(r, handle)
+	if lockout != nil {
+		until, err := lockout.lockedUntil(r.Context(), handleFailureKey(handle))
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Lockout check failed", "error", err)
+		} else if !until.IsZero() {
+			respondLocked(w, r, handle, until)
+			return
+		}
+	}
+	respondError(w, http.StatusUnauthorized, message)
+}
+
+// recordLoginFailure counts a failed verification of handle
+func recordLoginFailure(r *http.Request, handle string) {
+	if lockout == nil {
+		return
+	}
+	locked, err := lockout.fail(r.Context(), handle, clientIP(r))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to record failed verification", "error", err)
+	}
+	for _, reason := range locked {
+		recordAudit(r, auditLockout, handle, outcomeFailure, reason)
+	}
+}
+
+// recordLoginSuccess clears the lockout state of handle and its client
+func recordLoginSuccess(r *http.Request, handle string) {
+	if lockout == nil {
+		return
+	}
+	if err := lockout.succeed(r.Context(), handle, clientIP(r)); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to clear failed verifications", "error", err)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestLockDuration(t *testing.T) {
+	p := lockoutPolicy{Threshold: 3, Base: time.Minute, Max: 10 * time.Minute}
+	want := []time.Duration{0, 0, 0, time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 10 * time.Minute, 10 * time.Minute}
+	for failures, d := range want {
+		if got := p.lockDuration(failures); got != d {
+			t.Errorf("lockDuration(%d) = %v, want %v", failures, got, d)
+		}
+	}
+}
+
+func TestLockoutClearedByLogin(t *testing.T) {
+	setupTestStore(t, "memory")
+	lockout = &loginLockout{
+		policy:  lockoutPolicy{Threshold: 2, Base: time.Hour, Max: time.Hour, Reset: time.Hour},
+		tracker: newMemoryFailureTracker(),
+	}
+	t.Cleanup(func() { lockout = nil })
+
+	handle, privateKey := registerTestUser(t)
+
+	// An attacker keeps failing from one address, locking it and the handle
+	attacker := func(req *VerifyRequest) int {
+		return doJSONFrom(t, "203.0.113.66:1", verifyHandler, req, nil)
+	}
+	for i, want := range []int{http.StatusUnauthorized, http.StatusTooManyRequests} {
+		bad := signedLogin(t, handle, privateKey)
+		bad.Signature = bad.Signature[:4] + "AAAA" + bad.Signature[8:]
+		if code := attacker(&bad); code != want {
+			t.Fatalf("Bad signature %d returned %d, want %d", i, code, want)
+		}
+	}
+	if code := attacker(&VerifyRequest{Handle: handle, Challenge: "x", Signature: "x", Origin: "https://authgrid.net"}); code != http.StatusTooManyRequests {
+		t.Fatalf("Locked out address returned %d, want 429", code)
+	}
+	if code := doJSONFrom(t, "203.0.113.66:1", challengeHandler, ChallengeRequest{Handle: handle}, nil); code != http.StatusTooManyRequests {
+		t.Fatalf("Locked out address got a challenge: %d", code)
+	}
+
+	// While the handle is still locked the owner logs in, which clears it
+	if code := doJSON(t, verifyHandler, signedLogin(t, handle, privateKey), nil); code != http.StatusOK {
+		t.Fatalf("Owner login during the lock returned %d, want 200", code)
+	}
+	if st, _ := lockout.tracker.state(context.Background(), handleFailureKey(handle), lockout.policy); st.Failures != 0 {
+		t.Errorf("Handle still has %d failures after login", st.Failures)
+	}
+
+	// The attacker's address stays locked
+	if code := doJSONFrom(t, "203.0.113.66:1", challengeHandler, ChallengeRequest{Handle: handle}, nil); code != http.StatusTooManyRequests {
+		t.Errorf("Locked out address got a challenge after the owner's login: %d", code)
+	}
+}
+
+func TestHandleLockoutAcrossAddresses(t *testing.T) {
+	setupTestStore(t, "memory")
+	lockout = &loginLockout{
+		policy:  lockoutPolicy{Threshold: 3, Base: time.Minute, Max: time.Hour, Reset: time.Hour},
+		tracker: newMemoryFailureTracker(),
+	}
+	t.Cleanup(func() { lockout = nil })
+
+	handle, privateKey := registerTestUser(t)
+	badLogin := func() VerifyRequest {
+		bad := signedLogin(t, handle, privateKey)
+		bad.Signature = bad.Signature[:4] + "AAAA" + bad.Signature[8:]
+		return bad
+	}
+
+	// Each guess comes from a new address, so no address is locked, but the
+	// third locks the handle
+	for i, want := range []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests} {
+		addr := fmt.Sprintf("203.0.113.%d:1", i+1)
+		if code := doJSONFrom(t, addr, verifyHandler, badLogin(), nil); code != want {
+			t.Fatalf("Bad signature from %s returned %d, want %d", addr, code, want)
+		}
+	}
+
+	// Every address can still get challenges, but failing from any of them,
+	// including ones that never failed, is refused
+	for _, addr := range []string{"203.0.113.1:1", "198.51.100.7:1"} {
+		if code := doJSONFrom(t, addr, challengeHandler, ChallengeRequest{Handle: handle}, nil); code != http.StatusOK {
+			t.Errorf("/challenge from %s returned %d, want 200", addr, code)
+		}
+		if code := doJSONFrom(t, addr, verifyHandler, badLogin(), nil); code != http.StatusTooManyRequests {
+			t.Errorf("Bad signature from %s returned %d, want 429", addr, code)
+		}
+	}
+
+	// A failed verification uses up its challenge, so even the owner's
+	// signature over it is refused
+	good := signedLogin(t, handle, privateKey)
+	bad := good
+	bad.Signature = bad.Signature[:4] + "AAAA" + bad.Signature[8:]
+	doJSONFrom(t, "198.51.100.7:1", verifyHandler, bad, nil)
+	if code := doJSON(t, verifyHandler, good, nil); code != http.StatusBadRequest {
+		t.Errorf("Retrying a failed challenge returned %d, want 400", code)
+	}
+
+	// The owner's key still logs in
+	if code := doJSONFrom(t, "198.51.100.7:1", verifyHandler, signedLogin(t, handle, privateKey), nil); code != http.StatusOK {
+		t.Errorf("Owner login during the lock returned %d, want 200", code)
+	}
+
+	// Other handles are unaffected
+	other, otherKey := registerTestUser(t)
+	if code := doJSONFrom(t, "198.51.100.7:1", verifyHandler, signedLogin(t, other, otherKey), nil); code != http.StatusOK {
+		t.Errorf("Login to another handle returned %d, want 200", code)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const requestInfoKey contextKey = "request"
+
+// requestInfo is what the request log line reports about a request beyond
+// its status. Handlers that learn the handle fill it in.
+type requestInfo struct {
+	ID     string
+	Handle string
+}
+
+// logLevel is the minimum level logged, changeable on configuration reload
+var logLevel = new(slog.LevelVar)
+
+// setupLogging makes slog.Default write level and above to w as "json" or
+// "text", tagging records logged with a request's context with its request
+// and trace IDs
+func setupLogging(w io.Writer, level, format string) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level %q, want debug, info, warn or error", level)
+	}
+	logLevel.Set(lvl)
+	opts := &slog.HandlerOptions{Level: logLevel}
+
+	var h slog.Handler
+	switch format {
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	case "text":
+		h = slog.NewTextHandler(w, opts)
+	default:
+		return fmt.Errorf("invalid log format %q, want json or text", format)
+	}
+	slog.SetDefault(slog.New(requestIDHandler{h}))
+	return nil
+}
+
+// fatal logs msg at error level and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// requestIDHandler adds the request and trace IDs from the context to each
+// record
+type requestIDHandler struct {
+	slog.Handler
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, rec slog.Record) error {
+	if info := requestInfoFrom(ctx); info != nil {
+		rec.AddAttrs(slog.String("request_id", info.ID))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		rec.AddAttrs(slog.String("trace_id", sc.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, rec)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{h.Handler.WithGroup(name)}
+}
+
+// requestInfoFrom returns the info attached by requestLogMiddleware
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey).(*requestInfo)
+	return info
+}
+
+// setRequestHandle records the handle a request acted for, for its log line
+func setRequestHandle(r *http.Request, handle string) {
+	if info := requestInfoFrom(r.Context()); info != nil {
+		info.Handle = handle
+	}
+}
+
+// handleHash identifies a handle in logs without writing it out
+func handleHash(handle string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(handle)))
+	return hex.EncodeToString(sum[:8])
+}
+
+// validRequestID accepts client-supplied request IDs that are safe to log
+// and echo back
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.:", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// statusWriter remembers the status code written
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// requestLogMiddleware gives each request an ID, taken from X-Request-ID
+// when the client sent a usable one, echoes it in X-Request-ID and logs a
+// line per request once it is done
+func requestLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		info := &requestInfo{ID: r.Header.Get("X-Request-ID")}
+		if !validRequestID(info.ID) {
+			info.ID = newRequestID()
+		}
+		info.Handle = mux.Vars(r)["handle"]
+		if info.Handle == "" && r.Method != "GET" {
+			info.Handle = requestHandle(r)
+		}
+		w.Header().Set("X-Request-ID", info.ID)
+
+		route := r.URL.Path
+		if current := mux.CurrentRoute(r); current != nil {
+			if tpl, err := current.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+
+		ctx := context.WithValue(r.Context(), requestInfoKey, info)
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(ctx))
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+
+		level := slog.LevelInfo
+		switch {
+		case sw.status >= 500:
+			level = slog.LevelError
+		case route == "/health" || route == "/livez" || route == "/readyz" || route == "/metrics":
+			level = slog.LevelDebug
+		}
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("route", route),
+			slog.Int("status", sw.status),
+			slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.String("ip", clientIP(r)),
+		}
+		if info.Handle != "" {
+			attrs = append(attrs, slog.String("handle_hash", handleHash(info.Handle)))
+		}
+		slog.LogAttrs(ctx, level, "request", attrs...)
+	})
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRequestLog(t *testing.T) {
+	setupTestStore(t, "memory")
+
+	// setupLogging also redirects the log package; put both back afterwards
+	var logs bytes.Buffer
+	defer log.SetFlags(log.Flags())
+	defer log.SetOutput(log.Writer())
+	defer slog.SetDefault(slog.Default())
+	if err := setupLogging(&logs, "info", "json"); err != nil {
+		t.Fatal(err)
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/challenge", challengeHandler).Methods("POST")
+	r.Use(requestLogMiddleware, metricsMiddleware)
+
+	challenge := func(requestID string) (*httptest.ResponseRecorder, map[string]string) {
+		req := httptest.NewRequest("POST", "/challenge", strings.NewReader(`{"handle":"nobody@authgrid.net"}`))
+		req.Header.Set("X-Request-ID", requestID)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		var body map[string]string
+		json.Unmarshal(rec.Body.Bytes(), &body)
+		return rec, body
+	}
+
+	// A client's request ID is echoed and included in error bodies
+	rec, body := challenge("support-ticket-42")
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("Unknown handle returned %d, want 404", rec.Code)
+	}
+	if got := rec.Header().Get("X-Request-ID"); got != "support-ticket-42" {
+		t.Errorf("X-Request-ID = %q, want the client's", got)
+	}
+	if body["request_id"] != "support-ticket-42" {
+		t.Errorf("Error body %v lacks the request ID", body)
+	}
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(logs.Bytes(), &line); err != nil {
+		t.Fatalf("Request log %q is not one JSON line: %v", logs.String(), err)
+	}
+	want := map[string]interface{}{
+		"msg":         "request",
+		"request_id":  "support-ticket-42",
+		"route":       "/challenge",
+		"status":      float64(404),
+		"handle_hash": handleHash("nobody@authgrid.net"),
+	}
+	for k, v := range want {
+		if line[k] != v {
+			t.Errorf("Log field %s = %v, want %v", k, line[k], v)
+		}
+	}
+	if strings.Contains(logs.String(), "nobody@authgrid.net") {
+		t.Error("Request log contains the handle in the clear")
+	}
+
+	// Unusable IDs are replaced
+	rec, _ = challenge("bad id\nwith newline")
+	if got := rec.Header().Get("X-Request-ID"); len(got) != 32 {
+		t.Errorf("X-Request-ID = %q, want a generated ID", got)
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics, served on /metrics with the Go runtime and process
+// collectors of the default registry
+var (
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "authgrid_http_request_duration_seconds",
+		Help:    "Time to handle an HTTP request, by route template, method and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	authAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "authgrid_auth_attempts_total",
+		Help: "Register, challenge and verify requests, by outcome, key type and error reason.",
+	}, []string{"endpoint", "outcome", "key_type", "reason"})
+
+	storeDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "authgrid_store_duration_seconds",
+		Help:    "Time spent in storage backend calls, by operation and result.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"operation", "result"})
+
+	rateLimitRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "authgrid_rate_limit_rejections_total",
+		Help: "Requests rejected by rate limiting, by route template and scope.",
+	}, []string{"route", "scope"})
+
+	lockoutRejections = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "authgrid_lockout_rejections_total",
+		Help: "Challenge and verify requests refused because of a lockout.",
+	})
+
+	stripeWebhookEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "authgrid_stripe_webhook_events_total",
+		Help: "Verified Stripe webhook events, by event type.",
+	}, []string{"type"})
+
+	emailsSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "authgrid_emails_total",
+		Help: "Emails sent, by template and result.",
+	}, []string{"template", "result"})
+)
+
+// authEndpoints names the routes counted in authgrid_auth_attempts_total
+var authEndpoints = map[string]string{
+	"/register/challenge": "register_challenge",
+	"/register":           "register",
+	"/challenge":          "challenge",
+	"/verify":             "verify",
+
+	"/webauthn/register/challenge": "webauthn_register_challenge",
+	"/webauthn/register":           "webauthn_register",
+}
+
+// metricsWriter records what a handler responded with, for the metrics
+// middleware
+type metricsWriter struct {
+	statusWriter
+	reason  string
+	keyType string
+}
+
+// setErrorReason labels the request's metrics with the error it failed
+// with. Details after a colon or semicolon, such as retry delays, are
+// dropped so the label stays low-cardinality.
+func setErrorReason(w http.ResponseWriter, message string) {
+	if mw, ok := w.(*metricsWriter); ok {
+		if i := strings.IndexAny(message, ":;"); i >= 0 {
+			message = message[:i]
+		}
+		mw.reason = message
+	}
+}
+
+// setKeyType labels the request's metrics with the key type it used
+func setKeyType(w http.ResponseWriter, keyType string) {
+	if mw, ok := w.(*metricsWriter); ok {
+		switch keyType {
+		case "ed25519", "ecdsa", keyTypeWebAuthn:
+			mw.keyType = keyType
+		default:
+			mw.keyType = "other"
+		}
+	}
+}
+
+// metricsMiddleware times every routed request and counts the outcomes of
+// the authentication endpoints
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := r.URL.Path
+		if current := mux.CurrentRoute(r); current != nil {
+			if tpl, err := current.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+
+		start := time.Now()
+		mw := &metricsWriter{statusWriter: statusWriter{ResponseWriter: w}}
+		next.ServeHTTP(mw, r)
+		if mw.status == 0 {
+			mw.status = http.StatusOK
+		}
+		httpRequestDuration.WithLabelValues(route, r.Method, strconv.Itoa(mw.status)).Observe(time.Since(start).Seconds())
+
+		if endpoint, ok := authEndpoints[route]; ok {
+			outcome := outcomeSuccess
+			if mw.status >= 400 {
+				outcome = outcomeFailure
+			}
+			keyType := mw.keyType
+			if keyType == "" {
+				keyType = "unknown"
+			}
+			authAttempts.WithLabelValues(endpoint, outcome, keyType, mw.reason).Inc()
+		}
+	})
+}
+
+// observeStore records the duration of a storage call started at start
+func observeStore(operation string, start time.Time, err error) {
+	result := "ok"
+	switch err {
+	case nil:
+	case errNotFound, errHandleExists, errKeyRegistered, errChallengeUsed, errLastKey,
+		errSessionRevoked, errRefreshReused, errRefreshExpired, errLocked, errSignCountRegressed,
+		errRecoveryKeyUsed, errRecoveryClosed, errRecoveryWaiting:
+		result = "rejected"
+	default:
+		result = "error"
+	}
+	storeDuration.WithLabelValues(operation, result).Observe(time.Since(start).Seconds())
+}
+
+// instrumentedStore times every call to the Store it wraps
+type instrumentedStore struct {
+	Store
+}
+
+func (s instrumentedStore) CreateUser(ctx context.Context, ch *issuedChallenge, user *User, key *UserKey, recoveryKeys []RecoveryKeyInput) (err error) {
+	defer func(start time.Time) { observeStore("create_user", start, err) }(time.Now())
+	return s.Store.CreateUser(ctx, ch, user, key, recoveryKeys)
+}
+
+func (s instrumentedStore) UserByHandle(ctx context.Context, handle string) (u *User, err error) {
+	defer func(start time.Time) { observeStore("user_by_handle", start, err) }(time.Now())
+	return s.Store.UserByHandle(ctx, handle)
+}
+
+func (s instrumentedStore) ActiveKeys(ctx context.Context, userID string) (keys []UserKey, err error) {
+	defer func(start time.Time) { observeStore("active_keys", start, err) }(time.Now())
+	return s.Store.ActiveKeys(ctx, userID)
+}
+
+func (s instrumentedStore) KeyRegistered(ctx context.Context, publicKey string) (ok bool, err error) {
+	defer func(start time.Time) { observeStore("key_registered", start, err) }(time.Now())
+	return s.Store.KeyRegistered(ctx, publicKey)
+}
+
+func (s instrumentedStore) AddKey(ctx context.Context, ch *issuedChallenge, userID string, key *UserKey) (err error) {
+	defer func(start time.Time) { observeStore("add_key", start, err) }(time.Now())
+	return s.Store.AddKey(ctx, ch, userID, key)
+}
+
+func (s instrumentedStore) RemoveKey(ctx context.Context, userID, keyID string) (err error) {
+	defer func(start time.Time) { observeStore("remove_key", start, err) }(time.Now())
+	return s.Store.RemoveKey(ctx, userID, keyID)
+}
+
+func (s instrumentedStore) AdvanceSignCount(ctx context.Context, keyID string, count uint32) (err error) {
+	defer func(start time.Time) { observeStore("advance_sign_count", start, err) }(time.Now())
+	return s.Store.AdvanceSignCount(ctx, keyID, count)
+}
+
+func (s instrumentedStore) RotateKey(ctx context.Context, ch *issuedChallenge, userID string, rot keyRotation, newKey *UserKey) (err error) {
+	defer func(start time.Time) { observeStore("rotate_key", start, err) }(time.Now())
+	return s.Store.RotateKey(ctx, ch, userID, rot, newKey)
+}
+
+func (s instrumentedStore) KeyRotations(ctx context.Context, handle string) (rotations []KeyRotation, err error) {
+	defer func(start time.Time) { observeStore("key_rotations", start, err) }(time.Now())
+	return s.Store.KeyRotations(ctx, handle)
+}
+
+func (s instrumentedStore) AddRecoveryKeys(ctx context.Context, ch *issuedChallenge, userID string, keys []RecoveryKeyInput) (added []RecoveryKey, err error) {
+	defer func(start time.Time) { observeStore("add_recovery_keys", start, err) }(time.Now())
+	return s.Store.AddRecoveryKeys(ctx, ch, userID, keys)
+}
+
+func (s instrumentedStore) RecoveryKeys(ctx context.Context, userID string) (keys []RecoveryKey, err error) {
+	defer func(start time.Time) { observeStore("recovery_keys", start, err) }(time.Now())
+	return s.Store.RecoveryKeys(ctx, userID)
+}
+
+func (s instrumentedStore) RemoveRecoveryKey(ctx context.Context, userID, recoveryKeyID string) (err error) {
+	defer func(start time.Time) { observeStore("remove_recovery_key", start, err) }(time.Now())
+	return s.Store.RemoveRecoveryKey(ctx, userID, recoveryKeyID)
+}
+
+func (s instrumentedStore) Recover(ctx context.Context, ch *issuedChallenge, userID, recoveryKeyID string, key *UserKey) (err error) {
+	defer func(start time.Time) { observeStore("recover", start, err) }(time.Now())
+	return s.Store.Recover(ctx, ch, userID, recoveryKeyID, key)
+}
+
+func (s instrumentedStore) SetGuardians(ctx context.Context, ch *issuedChallenge, userID string, guardianIDs []string, threshold int) (err error) {
+	defer func(start time.Time) { observeStore("set_guardians", start, err) }(time.Now())
+	return s.Store.SetGuardians(ctx, ch, userID, guardianIDs, threshold)
+}
+
+func (s instrumentedStore) Guardians(ctx context.Context, userID string) (guardians []string, threshold int, err error) {
+	defer func(start time.Time) { observeStore("guardians", start, err) }(time.Now())
+	return s.Store.Guardians(ctx, userID)
+}
+
+func (s instrumentedStore) CreateSocialRecovery(ctx context.Context, ch *issuedChallenge, rec *SocialRecovery) (err error) {
+	defer func(start time.Time) { observeStore("create_social_recovery", start, err) }(time.Now())
+	return s.Store.CreateSocialRecovery(ctx, ch, rec)
+}
+
+func (s instrumentedStore) SocialRecovery(ctx context.Context, id string) (rec *SocialRecovery, err error) {
+	defer func(start time.Time) { observeStore("social_recovery", start, err) }(time.Now())
+	return s.Store.SocialRecovery(ctx, id)
+}
+
+func (s instrumentedStore) PendingSocialRecoveries(ctx context.Context, userID string) (recoveries []*SocialRecovery, err error) {
+	defer func(start time.Time) { observeStore("pending_social_recoveries", start, err) }(time.Now())
+	return s.Store.PendingSocialRecoveries(ctx, userID)
+}
+
+func (s instrumentedStore) ApproveSocialRecovery(ctx context.Context, ch *issuedChallenge, recoveryID, guardianID, signature string, delay time.Duration) (err error) {
+	defer func(start time.Time) { observeStore("approve_social_recovery", start, err) }(time.Now())
+	return s.Store.ApproveSocialRecovery(ctx, ch, recoveryID, guardianID, signature, delay)
+}
+
+func (s instrumentedStore) CancelSocialRecovery(ctx context.Context, ch *issuedChallenge, recoveryID string) (err error) {
+	defer func(start time.Time) { observeStore("cancel_social_recovery", start, err) }(time.Now())
+	return s.Store.CancelSocialRecovery(ctx, ch, recoveryID)
+}
+
+func (s instrumentedStore) CompleteSocialRecovery(ctx context.Context, recoveryID string, key *UserKey) (err error) {
+	defer func(start time.Time) { observeStore("complete_social_recovery", start, err) }(time.Now())
+	return s.Store.CompleteSocialRecovery(ctx, recoveryID, key)
+}
+
+func (s instrumentedStore) SaveChallenge(ctx context.Context, handle string, ch *ChallengeResponse) (err error) {
+	defer func(start time.Time) { observeStore("save_challenge", start, err) }(time.Now())
+	return s.Store.SaveChallenge(ctx, handle, ch)
+}
+
+func (s instrumentedStore) FindChallenge(ctx context.Context, handle, challenge string) (ch *issuedChallenge, used bool, err error) {
+	defer func(start time.Time) { observeStore("find_challenge", start, err) }(time.Now())
+	return s.Store.FindChallenge(ctx, handle, challenge)
+}
+
+func (s instrumentedStore) RedeemChallenge(ctx context.Context, ch *issuedChallenge) (err error) {
+	defer func(start time.Time) { observeStore("redeem_challenge", start, err) }(time.Now())
+	return s.Store.RedeemChallenge(ctx, ch)
+}
+
+func (s instrumentedStore) Login(ctx context.Context, ch *issuedChallenge, sess *sessionRecord) (err error) {
+	defer func(start time.Time) { observeStore("login", start, err) }(time.Now())
+	return s.Store.Login(ctx, ch, sess)
+}
+
+func (s instrumentedStore) SessionByToken(ctx context.Context, tokenHash string) (sess *authSession, err error) {
+	defer func(start time.Time) { observeStore("session_by_token", start, err) }(time.Now())
+	return s.Store.SessionByToken(ctx, tokenHash)
+}
+
+func (s instrumentedStore) ListSessions(ctx context.Context, userID string) (sessions []Session, err error) {
+	defer func(start time.Time) { observeStore("list_sessions", start, err) }(time.Now())
+	return s.Store.ListSessions(ctx, userID)
+}
+
+func (s instrumentedStore) RevokeSession(ctx context.Context, userID, sessionID string) (err error) {
+	defer func(start time.Time) { observeStore("revoke_session", start, err) }(time.Now())
+	return s.Store.RevokeSession(ctx, userID, sessionID)
+}
+
+func (s instrumentedStore) LookupRefreshToken(ctx context.Context, tokenHash string) (grant *refreshGrant, err error) {
+	defer func(start time.Time) { observeStore("lookup_refresh_token", start, err) }(time.Now())
+	return s.Store.LookupRefreshToken(ctx, tokenHash)
+}
+
+func (s instrumentedStore) RotateRefreshToken(ctx context.Context, tokenHash, accessTokenHash, newTokenHash string, expiresAt time.Time) (err error) {
+	defer func(start time.Time) { observeStore("rotate_refresh_token", start, err) }(time.Now())
+	return s.Store.RotateRefreshToken(ctx, tokenHash, accessTokenHash, newTokenHash, expiresAt)
+}
+
+func (s instrumentedStore) AccessTokenClient(ctx context.Context, tokenHash string) (clientID, scope string, err error) {
+	defer func(start time.Time) { observeStore("access_token_client", start, err) }(time.Now())
+	return s.Store.AccessTokenClient(ctx, tokenHash)
+}
+
+func (s instrumentedStore) RefreshTokenStatus(ctx context.Context, tokenHash string) (st *refreshTokenStatus, err error) {
+	defer func(start time.Time) { observeStore("refresh_token_status", start, err) }(time.Now())
+	return s.Store.RefreshTokenStatus(ctx, tokenHash)
+}
+
+func (s instrumentedStore) PurgeExpired(ctx context.Context, cutoff time.Time, limit int) (challenges, sessions int, err error) {
+	defer func(start time.Time) { observeStore("purge_expired", start, err) }(time.Now())
+	return s.Store.PurgeExpired(ctx, cutoff, limit)
+}
+
+func (s instrumentedStore) AppendAuditEvent(ctx context.Context, ev *auditEvent) (err error) {
+	defer func(start time.Time) { observeStore("append_audit_event", start, err) }(time.Now())
+	return s.Store.AppendAuditEvent(ctx, ev)
+}
+
+func (s instrumentedStore) AuditHead(ctx context.Context) (seq int64, hash string, err error) {
+	defer func(start time.Time) { observeStore("audit_head", start, err) }(time.Now())
+	return s.Store.AuditHead(ctx)
+}
+
+func (s instrumentedStore) AuditEvents(ctx context.Context, q auditQuery) (events []auditEvent, err error) {
+	defer func(start time.Time) { observeStore("audit_events", start, err) }(time.Now())
+	return s.Store.AuditEvents(ctx, q)
+}
+
+func (s instrumentedStore) Ping(ctx context.Context) (err error) {
+	defer func(start time.Time) { observeStore("ping", start, err) }(time.Now())
+	return s.Store.Ping(ctx)
+}
+
+func (s instrumentedStore) PendingMigrations(ctx context.Context) (n int, err error) {
+	defer func(start time.Time) { observeStore("pending_migrations", start, err) }(time.Now())
+	return s.Store.PendingMigrations(ctx)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func TestMetrics(t *testing.T) {
+	setupTestStore(t, "memory")
+	store = instrumentedStore{store}
+
+	r := mux.NewRouter()
+	r.Handle("/metrics", promhttp.Handler()).Methods("GET")
+	r.HandleFunc("/register/challenge", rateLimitMiddleware(registerChallengeHandler)).Methods("POST")
+	r.HandleFunc("/challenge", rateLimitMiddleware(challengeHandler)).Methods("POST")
+	r.Use(metricsMiddleware)
+
+	post := func(path, body string) int {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest("POST", path, bytes.NewBufferString(body)))
+		return rec.Code
+	}
+	if code := post("/register/challenge", `{"public_key":"AAAA","key_type":"rsa"}`); code != http.StatusBadRequest {
+		t.Fatalf("Unsupported key type returned %d, want 400", code)
+	}
+	if code := post("/challenge", `{"handle":"nobody@authgrid.net"}`); code != http.StatusNotFound {
+		t.Fatalf("Unknown handle returned %d, want 404", code)
+	}
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+	for _, want := range []string{
+		`authgrid_auth_attempts_total{endpoint="register_challenge",key_type="other",outcome="failure",reason="Only ed25519, ecdsa and webauthn key types are supported"}`,
+		`authgrid_auth_attempts_total{endpoint="challenge",key_type="unknown",outcome="failure",reason="Handle not found"}`,
+		`authgrid_http_request_duration_seconds_count{method="POST",route="/challenge",status="404"}`,
+		`authgrid_store_duration_seconds_count{operation="user_by_handle",result="rejected"}`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("Metrics are missing %s", want)
+		}
+	}
+}
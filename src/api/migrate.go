@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrationFiles holds migrations/NNN_name.sql and the matching
+// NNN_name.down.sql that reverts it, for Postgres, and the same for SQLite
+// under migrations/sqlite
+//
+//go:embed migrations/*.sql migrations/sqlite/*.sql
+var migrationFiles embed.FS
+
+// migrationLockID is the Postgres advisory lock held while migrating, so
+// replicas starting together don't apply the same migration twice
+const migrationLockID = 0x61757468677264 // "authgrd"
+
+// migrationSet is the migrations of one database engine
+type migrationSet struct {
+	dir string
+	// advisoryLock takes migrationLockID while migrating. A SQLite file has
+	// a single writer, so only Postgres needs it.
+	advisoryLock bool
+}
+
+var (
+	postgresMigrations = migrationSet{dir: "migrations", advisoryLock: true}
+	// SQLite migrations share the version and name of the Postgres one they
+	// mirror. Tables only used with Postgres have no SQLite version.
+	sqliteMigrations = migrationSet{dir: "migrations/sqlite"}
+)
+
+// migration is one schema version
+type migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// migrationState is a migration and when it was applied, if it was
+type migrationState struct {
+	migration
+	AppliedAt *time.Time
+}
+
+// loadMigrations reads the embedded migrations of set in version order
+func loadMigrations(set migrationSet) ([]migration, error) {
+	entries, err := migrationFiles.ReadDir(set.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*migration{}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		file := e.Name()
+		name, down := strings.CutSuffix(strings.TrimSuffix(file, ".sql"), ".down")
+		prefix, _, ok := strings.Cut(name, "_")
+		version, err := strconv.Atoi(prefix)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("migration %s: name must start with a version number", file)
+		}
+
+		body, err := migrationFiles.ReadFile(set.dir + "/" + file)
+		if err != nil {
+			return nil, err
+		}
+
+		m := byVersion[version]
+		if m == nil {
+			m = &migration{Version: version, Name: name}
+			byVersion[version] = m
+		}
+		if m.Name != name {
+			return nil, fmt.Errorf("migration %s: version %d is also used by %s", file, version, m.Name)
+		}
+		if down {
+			m.Down = string(body)
+		} else {
+			m.Up = string(body)
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %s has no up file", m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// withMigrationLock runs fn on a connection holding the migration lock,
+// after making sure schema_migrations exists
+func withMigrationLock(db *sql.DB, set migrationSet, fn func(ctx context.Context, conn *sql.Conn) error) error {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if set.advisoryLock {
+		// Session-level lock: it belongs to this connection and is released
+		// when the connection closes, even if unlocking fails
+		if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockID); err != nil {
+			return fmt.Errorf("failed to take migration lock: %w", err)
+		}
+		defer conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", migrationLockID)
+	}
+
+	_, err = conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	return fn(ctx, conn)
+}
+
+// appliedMigrations returns when each applied version was applied
+func appliedMigrations(ctx context.Context, conn *sql.Conn) (map[int]time.Time, error) {
+	rows, err := conn.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		applied[version] = at
+	}
+	return applied, rows.Err()
+}
+
+// runMigration applies one migration file and records the new version in
+// the same transaction
+func runMigration(ctx context.Context, conn *sql.Conn, m migration, up bool) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	body, record := m.Up, "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)"
+	if !up {
+		body, record = m.Down, "DELETE FROM schema_migrations WHERE version = $1 AND name = $2"
+	}
+	if _, err := tx.ExecContext(ctx, body); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, record, m.Version, m.Name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// migrateUp applies every pending migration and returns how many it applied
+func migrateUp(db *sql.DB, set migrationSet) (int, error) {
+	migrations, err := loadMigrations(set)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int
+	err = withMigrationLock(db, set, func(ctx context.Context, conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			if _, ok := applied[m.Version]; ok {
+				continue
+			}
+			if err := runMigration(ctx, conn, m, true); err != nil {
+				return fmt.Errorf("migration %s failed: %w", m.Name, err)
+			}
+			slog.Info("Applied migration", "name", m.Name)
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// migrateDown reverts the latest steps applied migrations
+func migrateDown(db *sql.DB, set migrationSet, steps int) (int, error) {
+	migrations, err := loadMigrations(set)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int
+	err = withMigrationLock(db, set, func(ctx context.Context, conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for i := len(migrations) - 1; i >= 0 && count < steps; i-- {
+			m := migrations[i]
+			if _, ok := applied[m.Version]; !ok {
+				continue
+			}
+			if m.Down == "" {
+				return fmt.Errorf("migration %s has no down file", m.Name)
+			}
+			if err := runMigration(ctx, conn, m, false); err != nil {
+				return fmt.Errorf("reverting %s failed: %w", m.Name, err)
+			}
+			slog.Info("Reverted migration", "name", m.Name)
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// migrationStatus lists every embedded migration and whether it is applied
+func migrationStatus(db *sql.DB, set migrationSet) ([]migrationState, error) {
+	migrations, err := loadMigrations(set)
+	if err != nil {
+		return nil, err
+	}
+
+	var states []migrationState
+	err = withMigrationLock(db, set, func(ctx context.Context, conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			state := migrationState{migration: m}
+			if at, ok := applied[m.Version]; ok {
+				state.AppliedAt = &at
+			}
+			states = append(states, state)
+		}
+		return nil
+	})
+	return states, err
+}
+
+// pendingMigrations counts the embedded migrations not applied yet. It
+// doesn't take the migration lock, so readiness probes can call it while
+// another replica migrates.
+func pendingMigrations(ctx context.Context, db *sql.DB, set migrationSet) (int, error) {
+	migrations, err := loadMigrations(set)
+	if err != nil {
+		return 0, err
+	}
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	applied, err := appliedMigrations(ctx, conn)
+	if err != nil {
+		return 0, err
+	}
+	var pending int
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; !ok {
+			pending++
+		}
+	}
+	return pending, nil
+}
+
+// runMigrateCommand implements `authgrid-api migrate up|down [n]|status`
+func runMigrateCommand(args []string) {
+	usage := "usage: authgrid-api migrate up | down [steps] | status"
+	if len(args) == 0 {
+		log.Fatal(usage)
+	}
+
+	cfg, err := loadConfig(os.Getenv("AUTHGRID_CONFIG"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	dbURL := cfg.Database.URL
+	if strings.HasPrefix(dbURL, "memory:") {
+		log.Fatal("The in-memory backend has no schema to migrate")
+	}
+	var conn *sql.DB
+	set := postgresMigrations
+	if strings.HasPrefix(dbURL, "sqlite:") {
+		s, err := openSQLite(dbURL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		conn, set = s.db, sqliteMigrations
+	} else {
+		var err error
+		if conn, err = connectPostgres(dbURL); err != nil {
+			log.Fatal(err)
+		}
+	}
+	defer conn.Close()
+
+	switch args[0] {
+	case "up":
+		n, err := migrateUp(conn, set)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Applied %d migration(s)", n)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			var err error
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				log.Fatal(usage)
+			}
+		}
+		n, err := migrateDown(conn, set, steps)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Reverted %d migration(s)", n)
+	case "status":
+		states, err := migrationStatus(conn, set)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, s := range states {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(os.Stdout, "%-28s %s\n", s.Name, applied)
+		}
+	default:
+		log.Fatal(usage)
+	}
+}
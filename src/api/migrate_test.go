@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := loadMigrations(postgresMigrations)
+	if err != nil {
+		t.Fatalf("loadMigrations failed: %v", err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("No migrations embedded")
+	}
+	names := map[int]string{}
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Errorf("Migration %s has version %d, want %d", m.Name, m.Version, i+1)
+		}
+		if m.Up == "" || m.Down == "" {
+			t.Errorf("Migration %s is missing its up or down file", m.Name)
+		}
+		names[m.Version] = m.Name
+	}
+
+	// Each SQLite migration mirrors the Postgres one of the same version
+	sqlite, err := loadMigrations(sqliteMigrations)
+	if err != nil {
+		t.Fatalf("loadMigrations failed for SQLite: %v", err)
+	}
+	if len(sqlite) == 0 {
+		t.Fatal("No SQLite migrations embedded")
+	}
+	for _, m := range sqlite {
+		if names[m.Version] != m.Name {
+			t.Errorf("SQLite migration %s has no Postgres counterpart", m.Name)
+		}
+		if m.Up == "" || m.Down == "" {
+			t.Errorf("SQLite migration %s is missing its up or down file", m.Name)
+		}
+	}
+}
+
+func TestMigrateDownAndUp(t *testing.T) {
+	for _, tt := range []struct {
+		backend string
+		set     migrationSet
+		tables  string
+	}{
+		{"sqlite", sqliteMigrations, "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name <> 'schema_migrations'"},
+		{"postgres", postgresMigrations, "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name <> 'schema_migrations'"},
+	} {
+		t.Run(tt.backend, func(t *testing.T) {
+			var conn *sql.DB
+			if tt.backend == "postgres" {
+				setupTestDB(t)
+				conn = store.(*postgresStore).db
+			} else {
+				s, err := openSQLite("sqlite://" + filepath.Join(t.TempDir(), "authgrid.db"))
+				if err != nil {
+					t.Fatalf("Failed to open SQLite: %v", err)
+				}
+				t.Cleanup(func() { s.db.Close() })
+				if _, err := migrateUp(s.db, tt.set); err != nil {
+					t.Fatalf("Failed to migrate: %v", err)
+				}
+				conn = s.db
+			}
+
+			migrations, err := loadMigrations(tt.set)
+			if err != nil {
+				t.Fatalf("loadMigrations failed: %v", err)
+			}
+
+			// Everything is applied already
+			if n, err := migrateUp(conn, tt.set); err != nil || n != 0 {
+				t.Fatalf("Second migrateUp applied %d (%v), want 0", n, err)
+			}
+
+			if n, err := migrateDown(conn, tt.set, len(migrations)); err != nil || n != len(migrations) {
+				t.Fatalf("migrateDown reverted %d (%v), want %d", n, err, len(migrations))
+			}
+			var tables int
+			if err := conn.QueryRow(tt.tables).Scan(&tables); err != nil {
+				t.Fatalf("Failed to count tables: %v", err)
+			}
+			if tables != 0 {
+				t.Errorf("%d tables left after reverting every migration", tables)
+			}
+
+			if n, err := migrateUp(conn, tt.set); err != nil || n != len(migrations) {
+				t.Fatalf("migrateUp applied %d (%v), want %d", n, err, len(migrations))
+			}
+			if pending, err := pendingMigrations(context.Background(), conn, tt.set); err != nil || pending != 0 {
+				t.Errorf("%d migrations pending (%v) after migrating up", pending, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,6 @@
+-- Reverts 001_init.sql
+
+DROP FUNCTION IF EXISTS cleanup_expired_challenges();
+DROP TABLE IF EXISTS sessions;
+DROP TABLE IF EXISTS challenges;
+DROP TABLE IF EXISTS users;
@@ -11,8 +11,8 @@ CREATE TABLE IF NOT EXISTS users (
     metadata JSONB DEFAULT '{}'::jsonb
 );
 
-CREATE INDEX idx_users_handle ON users(handle);
-CREATE INDEX idx_users_created_at ON users(created_at);
+CREATE INDEX IF NOT EXISTS idx_users_handle ON users(handle);
+CREATE INDEX IF NOT EXISTS idx_users_created_at ON users(created_at);
 
 -- Challenges table
 CREATE TABLE IF NOT EXISTS challenges (
@@ -24,9 +24,9 @@ CREATE TABLE IF NOT EXISTS challenges (
     used BOOLEAN DEFAULT FALSE
 );
 
-CREATE INDEX idx_challenges_handle ON challenges(handle);
-CREATE INDEX idx_challenges_expires_at ON challenges(expires_at);
-CREATE INDEX idx_challenges_cleanup ON challenges(expires_at) WHERE used = FALSE;
+CREATE INDEX IF NOT EXISTS idx_challenges_handle ON challenges(handle);
+CREATE INDEX IF NOT EXISTS idx_challenges_expires_at ON challenges(expires_at);
+CREATE INDEX IF NOT EXISTS idx_challenges_cleanup ON challenges(expires_at) WHERE used = FALSE;
 
 -- Sessions table (optional, for token management)
 CREATE TABLE IF NOT EXISTS sessions (
@@ -39,9 +39,9 @@ CREATE TABLE IF NOT EXISTS sessions (
     metadata JSONB DEFAULT '{}'::jsonb
 );
 
-CREATE INDEX idx_sessions_token ON sessions(token);
-CREATE INDEX idx_sessions_user_id ON sessions(user_id);
-CREATE INDEX idx_sessions_expires_at ON sessions(expires_at);
+CREATE INDEX IF NOT EXISTS idx_sessions_token ON sessions(token);
+CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id);
+CREATE INDEX IF NOT EXISTS idx_sessions_expires_at ON sessions(expires_at);
 
 -- Function to clean up expired challenges
 CREATE OR REPLACE FUNCTION cleanup_expired_challenges()
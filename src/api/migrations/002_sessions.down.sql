@@ -0,0 +1,4 @@
+-- Reverts 002_sessions.sql
+
+DROP INDEX IF EXISTS idx_sessions_active;
+ALTER TABLE sessions DROP COLUMN IF EXISTS revoked_at;
@@ -0,0 +1,8 @@
+-- Session revocation
+
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS revoked_at TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS idx_sessions_active ON sessions(user_id, expires_at) WHERE revoked_at IS NULL;
+
+COMMENT ON COLUMN sessions.token IS 'Hex-encoded SHA-256 hash of the access token (never the token itself)';
+COMMENT ON COLUMN sessions.revoked_at IS 'When the session was logged out or revoked';
@@ -0,0 +1,3 @@
+-- Reverts 003_refresh_tokens.sql
+
+DROP TABLE IF EXISTS refresh_tokens;
@@ -0,0 +1,19 @@
+-- Refresh tokens
+-- Each session is a token family: every refresh rotates the token, and
+-- presenting an already-rotated token revokes the whole session.
+
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    session_id UUID NOT NULL REFERENCES sessions(id) ON DELETE CASCADE,
+    token_hash TEXT UNIQUE NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_session_id ON refresh_tokens(session_id);
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_expires_at ON refresh_tokens(expires_at);
+
+COMMENT ON TABLE refresh_tokens IS 'Rotating refresh tokens, one family per session';
+COMMENT ON COLUMN refresh_tokens.token_hash IS 'Hex-encoded SHA-256 hash of the refresh token';
+COMMENT ON COLUMN refresh_tokens.used_at IS 'When the token was rotated; reuse after this revokes the session';
@@ -0,0 +1,5 @@
+-- Reverts 004_user_keys.sql
+-- Keys added after registration are lost; users.public_key still holds the
+-- registration key.
+
+DROP TABLE IF EXISTS user_keys;
@@ -0,0 +1,27 @@
+-- Multiple public keys (devices) per identity
+-- users.public_key remains the key the handle was derived from; every key
+-- that can sign in, including that one, lives in user_keys.
+
+CREATE TABLE IF NOT EXISTS user_keys (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL DEFAULT '',
+    public_key TEXT NOT NULL,
+    key_type VARCHAR(50) NOT NULL DEFAULT 'ed25519',
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    last_used_at TIMESTAMP,
+    revoked_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_keys_user_id ON user_keys(user_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_user_keys_public_key ON user_keys(public_key) WHERE revoked_at IS NULL;
+
+-- Backfill the registration key of existing users
+INSERT INTO user_keys (user_id, name, public_key, key_type, created_at, last_used_at)
+SELECT id, 'primary', public_key, key_type, created_at, last_login
+FROM users u
+WHERE NOT EXISTS (SELECT 1 FROM user_keys k WHERE k.user_id = u.id);
+
+COMMENT ON TABLE user_keys IS 'Public keys (one per device) that can authenticate as a user';
+COMMENT ON COLUMN user_keys.name IS 'User-chosen device name, e.g. "laptop"';
+COMMENT ON COLUMN user_keys.revoked_at IS 'When the key was removed; revoked keys can no longer sign in';
@@ -0,0 +1,3 @@
+-- Reverts 005_key_rotations.sql
+
+DROP TABLE IF EXISTS key_rotations;
@@ -0,0 +1,19 @@
+-- Signed key rotation history
+-- Each row records an old key handing the identity over to a new key. The
+-- statement and both signatures are kept as evidence of the rotation.
+
+CREATE TABLE IF NOT EXISTS key_rotations (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    old_key_id UUID NOT NULL REFERENCES user_keys(id),
+    new_key_id UUID NOT NULL REFERENCES user_keys(id),
+    statement TEXT NOT NULL,
+    old_signature TEXT NOT NULL,
+    new_signature TEXT NOT NULL,
+    rotated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_key_rotations_user_id ON key_rotations(user_id, rotated_at);
+
+COMMENT ON TABLE key_rotations IS 'History of signed key rotations; the handle survives rotation';
+COMMENT ON COLUMN key_rotations.statement IS 'Rotation statement signed by both the old and the new key';
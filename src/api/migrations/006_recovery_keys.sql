@@ -0,0 +1,20 @@
+-- Offline recovery keys
+-- A recovery key never signs in. Its only power is to enroll a new device key
+-- for the identity, revoking every existing key and session. Each recovery
+-- key can be used once.
+
+CREATE TABLE IF NOT EXISTS recovery_keys (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL DEFAULT '',
+    public_key TEXT NOT NULL,
+    key_type VARCHAR(50) NOT NULL DEFAULT 'ed25519',
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    used_at TIMESTAMP,
+    revoked_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_recovery_keys_user_id ON recovery_keys(user_id);
+
+COMMENT ON TABLE recovery_keys IS 'Offline keys that can recover an identity after all device keys are lost';
+COMMENT ON COLUMN recovery_keys.used_at IS 'When the key was used to recover; recovery keys are single-use';
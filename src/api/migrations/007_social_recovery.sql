@@ -0,0 +1,47 @@
+-- Social recovery with M-of-N guardian handles
+-- A user names other handles as guardians and a threshold. A recovery request
+-- proposes a new key; once enough guardians approve and the waiting period has
+-- passed it can be completed, unless one of the user's own keys cancels it.
+
+CREATE TABLE IF NOT EXISTS guardian_policies (
+    user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    threshold INTEGER NOT NULL CHECK (threshold > 0),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS guardians (
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    guardian_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (user_id, guardian_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_guardians_guardian_id ON guardians(guardian_id);
+
+CREATE TABLE IF NOT EXISTS social_recoveries (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL DEFAULT '',
+    public_key TEXT NOT NULL,
+    key_type VARCHAR(50) NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    effective_at TIMESTAMP NOT NULL,
+    closed_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_social_recoveries_user_id ON social_recoveries(user_id) WHERE status = 'pending';
+
+CREATE TABLE IF NOT EXISTS social_recovery_approvals (
+    recovery_id UUID NOT NULL REFERENCES social_recoveries(id) ON DELETE CASCADE,
+    guardian_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    signature TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (recovery_id, guardian_id)
+);
+
+COMMENT ON TABLE guardian_policies IS 'How many guardians must approve a social recovery';
+COMMENT ON TABLE guardians IS 'Handles allowed to approve social recovery of a user';
+COMMENT ON TABLE social_recoveries IS 'Requests to recover a handle onto a new key via guardians';
+COMMENT ON COLUMN social_recoveries.status IS 'pending, cancelled or completed';
+COMMENT ON COLUMN social_recoveries.effective_at IS 'End of the waiting period during which the user can cancel';
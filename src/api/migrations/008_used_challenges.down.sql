@@ -0,0 +1,3 @@
+-- Reverts 008_used_challenges.sql
+
+DROP TABLE IF EXISTS used_challenges;
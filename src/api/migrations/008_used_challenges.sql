@@ -0,0 +1,13 @@
+-- Replay cache for sealed challenges
+-- With AUTHGRID_CHALLENGE_MODE=sealed and AUTHGRID_CHALLENGE_REPLAY_CACHE=postgres
+-- challenges are not stored; only the IDs of redeemed ones are, until they
+-- would have expired anyway.
+
+CREATE TABLE IF NOT EXISTS used_challenges (
+    id TEXT PRIMARY KEY,
+    expires_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_used_challenges_expires_at ON used_challenges(expires_at);
+
+COMMENT ON TABLE used_challenges IS 'Redeemed sealed challenge IDs, kept until expiry';
@@ -0,0 +1,3 @@
+-- Reverts 009_rate_limits.sql
+
+DROP TABLE IF EXISTS rate_limits;
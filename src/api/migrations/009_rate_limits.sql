@@ -0,0 +1,16 @@
+-- Shared rate limit counters
+-- With AUTHGRID_RATE_LIMIT_STORE=postgres every replica counts requests here,
+-- so limits hold no matter which replica a client reaches. One row per key
+-- holds the count of its current fixed window.
+
+CREATE TABLE IF NOT EXISTS rate_limits (
+    key TEXT PRIMARY KEY,
+    window_start TIMESTAMP NOT NULL,
+    count INTEGER NOT NULL,
+    expires_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_rate_limits_expires_at ON rate_limits(expires_at);
+
+COMMENT ON TABLE rate_limits IS 'Request counts per rate limit key and window, shared by replicas';
+COMMENT ON COLUMN rate_limits.key IS 'route|scope|subject, e.g. /verify|handle|abc123@authgrid.net';
@@ -0,0 +1,3 @@
+-- Reverts 010_login_failures.sql
+
+DROP TABLE IF EXISTS login_failures;
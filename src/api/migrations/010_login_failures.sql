@@ -0,0 +1,17 @@
+-- Failed verification tracking
+-- With AUTHGRID_LOCKOUT_STORE=postgres, consecutive failed /verify attempts
+-- are counted per handle, per client address and per handle and address
+-- pair, so lockouts hold across replicas.
+
+CREATE TABLE IF NOT EXISTS login_failures (
+    key TEXT PRIMARY KEY,
+    failures INTEGER NOT NULL,
+    last_failure_at TIMESTAMP NOT NULL,
+    locked_until TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_login_failures_last_failure_at ON login_failures(last_failure_at);
+
+COMMENT ON TABLE login_failures IS 'Consecutive failed verifications, cleared by a successful login';
+COMMENT ON COLUMN login_failures.key IS 'handle:<handle>, ip:<address> or pair:<handle>|<address>';
+COMMENT ON COLUMN login_failures.locked_until IS 'Requests from the key are refused until then';
@@ -0,0 +1,24 @@
+-- Tamper-evident audit log
+-- Every security-relevant request appends an event. Each event's hash covers
+-- its fields and the previous event's hash, so editing or deleting an event
+-- breaks the chain from there on (see `authgrid-api audit verify`).
+
+CREATE TABLE IF NOT EXISTS audit_events (
+    seq BIGINT PRIMARY KEY,
+    time TIMESTAMP NOT NULL,
+    type VARCHAR(50) NOT NULL,
+    handle TEXT NOT NULL DEFAULT '',
+    ip TEXT NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL DEFAULT '',
+    outcome VARCHAR(20) NOT NULL,
+    reason TEXT NOT NULL DEFAULT '',
+    prev_hash CHAR(64) NOT NULL,
+    hash CHAR(64) NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_events_handle ON audit_events(handle, seq);
+CREATE INDEX IF NOT EXISTS idx_audit_events_time ON audit_events(time);
+
+COMMENT ON TABLE audit_events IS 'Append-only, hash-chained log of registrations, logins, key and session changes';
+COMMENT ON COLUMN audit_events.seq IS 'Position in the chain, starting at 1 with no gaps';
+COMMENT ON COLUMN audit_events.hash IS 'Hex SHA-256 over prev_hash and the event fields';
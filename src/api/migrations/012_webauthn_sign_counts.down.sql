@@ -0,0 +1,3 @@
+-- Reverts 012_webauthn_sign_counts.sql
+
+DROP TABLE IF EXISTS webauthn_sign_counts;
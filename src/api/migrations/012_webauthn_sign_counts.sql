@@ -0,0 +1,11 @@
+-- Signature counters of WebAuthn keys
+-- Authenticators that count signatures report a higher number each time;
+-- one that goes backwards suggests a cloned authenticator.
+
+CREATE TABLE IF NOT EXISTS webauthn_sign_counts (
+    key_id UUID PRIMARY KEY REFERENCES user_keys(id) ON DELETE CASCADE,
+    sign_count BIGINT NOT NULL,
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+COMMENT ON TABLE webauthn_sign_counts IS 'Last signature counter each WebAuthn key reported';
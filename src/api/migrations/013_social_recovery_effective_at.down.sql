@@ -0,0 +1,7 @@
+-- Reverts 013_social_recovery_effective_at.sql
+
+UPDATE social_recoveries SET effective_at = NOW() WHERE effective_at IS NULL;
+
+ALTER TABLE social_recoveries ALTER COLUMN effective_at SET NOT NULL;
+
+COMMENT ON COLUMN social_recoveries.effective_at IS 'End of the waiting period during which the user can cancel';
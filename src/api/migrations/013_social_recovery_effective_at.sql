@@ -0,0 +1,15 @@
+-- Start the social recovery waiting period when the threshold is reached
+-- effective_at stays NULL until enough guardians approve, so a request that
+-- sits unapproved doesn't become completable the moment the last approval
+-- arrives.
+
+ALTER TABLE social_recoveries ALTER COLUMN effective_at DROP NOT NULL;
+
+UPDATE social_recoveries sr SET effective_at = NULL
+WHERE sr.status = 'pending'
+  AND (SELECT COUNT(*) FROM social_recovery_approvals a
+       JOIN guardians g ON g.user_id = sr.user_id AND g.guardian_id = a.guardian_id
+       WHERE a.recovery_id = sr.id)
+      < COALESCE((SELECT threshold FROM guardian_policies gp WHERE gp.user_id = sr.user_id), 1);
+
+COMMENT ON COLUMN social_recoveries.effective_at IS 'End of the waiting period during which the user can cancel; NULL until enough guardians approve';
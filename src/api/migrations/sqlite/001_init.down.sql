@@ -0,0 +1,5 @@
+-- Reverts 001_init.sql
+
+DROP TABLE IF EXISTS sessions;
+DROP TABLE IF EXISTS challenges;
+DROP TABLE IF EXISTS users;
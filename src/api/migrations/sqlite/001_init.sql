@@ -0,0 +1,45 @@
+-- Authgrid Database Schema (SQLite)
+-- UUIDs are generated by the API and stored as text, JSONB metadata is a
+-- JSON text column read with json_extract, and timestamps are written in UTC
+-- so they compare in order.
+
+CREATE TABLE IF NOT EXISTS users (
+    id TEXT PRIMARY KEY,
+    handle TEXT UNIQUE NOT NULL,
+    public_key TEXT NOT NULL,
+    key_type TEXT NOT NULL DEFAULT 'ed25519',
+    created_at TIMESTAMP NOT NULL,
+    last_login TIMESTAMP,
+    metadata TEXT NOT NULL DEFAULT '{}'
+);
+
+CREATE INDEX IF NOT EXISTS idx_users_created_at ON users(created_at);
+
+CREATE TABLE IF NOT EXISTS challenges (
+    id TEXT PRIMARY KEY,
+    handle TEXT NOT NULL,
+    challenge TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used BOOLEAN NOT NULL DEFAULT 0
+);
+
+CREATE INDEX IF NOT EXISTS idx_challenges_handle ON challenges(handle);
+CREATE INDEX IF NOT EXISTS idx_challenges_expires_at ON challenges(expires_at);
+
+-- revoked_at is part of the table here rather than added by 002: SQLite
+-- files created before versioning already have it, and SQLite can't add a
+-- column only if it is missing
+CREATE TABLE IF NOT EXISTS sessions (
+    id TEXT PRIMARY KEY,
+    user_id TEXT REFERENCES users(id),
+    token TEXT UNIQUE NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    last_activity TIMESTAMP,
+    metadata TEXT NOT NULL DEFAULT '{}',
+    revoked_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id);
+CREATE INDEX IF NOT EXISTS idx_sessions_expires_at ON sessions(expires_at);
@@ -0,0 +1,3 @@
+-- Reverts 002_sessions.sql
+
+DROP INDEX IF EXISTS idx_sessions_active;
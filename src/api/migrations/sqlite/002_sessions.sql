@@ -0,0 +1,4 @@
+-- Session revocation
+-- sessions.revoked_at is created by 001_init.sql
+
+CREATE INDEX IF NOT EXISTS idx_sessions_active ON sessions(user_id, expires_at) WHERE revoked_at IS NULL;
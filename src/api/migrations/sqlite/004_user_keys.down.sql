@@ -0,0 +1,3 @@
+-- Reverts 004_user_keys.sql
+
+DROP TABLE IF EXISTS user_keys;
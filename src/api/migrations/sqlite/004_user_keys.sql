@@ -0,0 +1,17 @@
+-- Multiple public keys (devices) per identity
+-- users.public_key remains the key the handle was derived from; every key
+-- that can sign in, including that one, lives in user_keys.
+
+CREATE TABLE IF NOT EXISTS user_keys (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name TEXT NOT NULL DEFAULT '',
+    public_key TEXT NOT NULL,
+    key_type TEXT NOT NULL DEFAULT 'ed25519',
+    created_at TIMESTAMP NOT NULL,
+    last_used_at TIMESTAMP,
+    revoked_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_keys_user_id ON user_keys(user_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_user_keys_public_key ON user_keys(public_key) WHERE revoked_at IS NULL;
@@ -0,0 +1,16 @@
+-- Signed key rotation history
+-- Each row records an old key handing the identity over to a new key. The
+-- statement and both signatures are kept as evidence of the rotation.
+
+CREATE TABLE IF NOT EXISTS key_rotations (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    old_key_id TEXT NOT NULL REFERENCES user_keys(id),
+    new_key_id TEXT NOT NULL REFERENCES user_keys(id),
+    statement TEXT NOT NULL,
+    old_signature TEXT NOT NULL,
+    new_signature TEXT NOT NULL,
+    rotated_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_key_rotations_user_id ON key_rotations(user_id, rotated_at);
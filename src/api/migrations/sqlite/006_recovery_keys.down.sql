@@ -0,0 +1,3 @@
+-- Reverts 006_recovery_keys.sql
+
+DROP TABLE IF EXISTS recovery_keys;
@@ -0,0 +1,17 @@
+-- Offline recovery keys
+-- A recovery key never signs in. Its only power is to enroll a new device key
+-- for the identity, revoking every existing key and session. Each recovery
+-- key can be used once.
+
+CREATE TABLE IF NOT EXISTS recovery_keys (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name TEXT NOT NULL DEFAULT '',
+    public_key TEXT NOT NULL,
+    key_type TEXT NOT NULL DEFAULT 'ed25519',
+    created_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP,
+    revoked_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_recovery_keys_user_id ON recovery_keys(user_id);
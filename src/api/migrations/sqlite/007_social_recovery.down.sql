@@ -0,0 +1,6 @@
+-- Reverts 007_social_recovery.sql
+
+DROP TABLE IF EXISTS social_recovery_approvals;
+DROP TABLE IF EXISTS social_recoveries;
+DROP TABLE IF EXISTS guardians;
+DROP TABLE IF EXISTS guardian_policies;
@@ -0,0 +1,41 @@
+-- Social recovery with M-of-N guardian handles
+-- A user names other handles as guardians and a threshold. A recovery request
+-- proposes a new key; once enough guardians approve and the waiting period has
+-- passed it can be completed, unless one of the user's own keys cancels it.
+
+CREATE TABLE IF NOT EXISTS guardian_policies (
+    user_id TEXT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    threshold INTEGER NOT NULL CHECK (threshold > 0),
+    updated_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS guardians (
+    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    guardian_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (user_id, guardian_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_guardians_guardian_id ON guardians(guardian_id);
+
+CREATE TABLE IF NOT EXISTS social_recoveries (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name TEXT NOT NULL DEFAULT '',
+    public_key TEXT NOT NULL,
+    key_type TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending',
+    created_at TIMESTAMP NOT NULL,
+    effective_at TIMESTAMP NOT NULL,
+    closed_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_social_recoveries_user_id ON social_recoveries(user_id) WHERE status = 'pending';
+
+CREATE TABLE IF NOT EXISTS social_recovery_approvals (
+    recovery_id TEXT NOT NULL REFERENCES social_recoveries(id) ON DELETE CASCADE,
+    guardian_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    signature TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (recovery_id, guardian_id)
+);
@@ -0,0 +1,3 @@
+-- Reverts 011_audit_events.sql
+
+DROP TABLE IF EXISTS audit_events;
@@ -0,0 +1,20 @@
+-- Tamper-evident audit log
+-- Every security-relevant request appends an event. Each event's hash covers
+-- its fields and the previous event's hash, so editing or deleting an event
+-- breaks the chain from there on (see `authgrid-api audit verify`).
+
+CREATE TABLE IF NOT EXISTS audit_events (
+    seq INTEGER PRIMARY KEY,
+    time TIMESTAMP NOT NULL,
+    type TEXT NOT NULL,
+    handle TEXT NOT NULL DEFAULT '',
+    ip TEXT NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL DEFAULT '',
+    outcome TEXT NOT NULL,
+    reason TEXT NOT NULL DEFAULT '',
+    prev_hash TEXT NOT NULL,
+    hash TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_events_handle ON audit_events(handle, seq);
+CREATE INDEX IF NOT EXISTS idx_audit_events_time ON audit_events(time);
@@ -0,0 +1,9 @@
+-- Signature counters of WebAuthn keys
+-- Authenticators that count signatures report a higher number each time;
+-- one that goes backwards suggests a cloned authenticator.
+
+CREATE TABLE IF NOT EXISTS webauthn_sign_counts (
+    key_id TEXT PRIMARY KEY REFERENCES user_keys(id) ON DELETE CASCADE,
+    sign_count INTEGER NOT NULL,
+    updated_at TIMESTAMP NOT NULL
+);
@@ -0,0 +1,34 @@
+-- Reverts 013_social_recovery_effective_at.sql
+
+CREATE TABLE social_recoveries_old (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name TEXT NOT NULL DEFAULT '',
+    public_key TEXT NOT NULL,
+    key_type TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending',
+    created_at TIMESTAMP NOT NULL,
+    effective_at TIMESTAMP NOT NULL,
+    closed_at TIMESTAMP
+);
+
+CREATE TABLE social_recovery_approvals_old (
+    recovery_id TEXT NOT NULL REFERENCES social_recoveries_old(id) ON DELETE CASCADE,
+    guardian_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    signature TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (recovery_id, guardian_id)
+);
+
+INSERT INTO social_recoveries_old
+SELECT id, user_id, name, public_key, key_type, status, created_at,
+       COALESCE(effective_at, CURRENT_TIMESTAMP), closed_at
+FROM social_recoveries;
+INSERT INTO social_recovery_approvals_old SELECT * FROM social_recovery_approvals;
+
+DROP TABLE social_recovery_approvals;
+DROP TABLE social_recoveries;
+ALTER TABLE social_recoveries_old RENAME TO social_recoveries;
+ALTER TABLE social_recovery_approvals_old RENAME TO social_recovery_approvals;
+
+CREATE INDEX IF NOT EXISTS idx_social_recoveries_user_id ON social_recoveries(user_id) WHERE status = 'pending';
@@ -0,0 +1,45 @@
+-- Start the social recovery waiting period when the threshold is reached
+-- effective_at stays NULL until enough guardians approve, so a request that
+-- sits unapproved doesn't become completable the moment the last approval
+-- arrives.
+--
+-- SQLite can't drop a NOT NULL constraint, so both recovery tables are
+-- rebuilt. Renaming the new recoveries table updates the approvals' foreign
+-- key to follow it.
+
+CREATE TABLE social_recoveries_new (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name TEXT NOT NULL DEFAULT '',
+    public_key TEXT NOT NULL,
+    key_type TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending',
+    created_at TIMESTAMP NOT NULL,
+    effective_at TIMESTAMP,
+    closed_at TIMESTAMP
+);
+
+CREATE TABLE social_recovery_approvals_new (
+    recovery_id TEXT NOT NULL REFERENCES social_recoveries_new(id) ON DELETE CASCADE,
+    guardian_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    signature TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (recovery_id, guardian_id)
+);
+
+INSERT INTO social_recoveries_new SELECT * FROM social_recoveries;
+INSERT INTO social_recovery_approvals_new SELECT * FROM social_recovery_approvals;
+
+DROP TABLE social_recovery_approvals;
+DROP TABLE social_recoveries;
+ALTER TABLE social_recoveries_new RENAME TO social_recoveries;
+ALTER TABLE social_recovery_approvals_new RENAME TO social_recovery_approvals;
+
+CREATE INDEX IF NOT EXISTS idx_social_recoveries_user_id ON social_recoveries(user_id) WHERE status = 'pending';
+
+UPDATE social_recoveries SET effective_at = NULL
+WHERE status = 'pending'
+  AND (SELECT COUNT(*) FROM social_recovery_approvals a
+       JOIN guardians g ON g.user_id = social_recoveries.user_id AND g.guardian_id = a.guardian_id
+       WHERE a.recovery_id = social_recoveries.id)
+      < COALESCE((SELECT threshold FROM guardian_policies gp WHERE gp.user_id = social_recoveries.user_id), 1);
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Rate limit scopes: what a counter is keyed by
+const (
+	scopeIP       = "ip"       // the client's address
+	scopeHandle   = "handle"   // the handle named in the request body
+	scopeEndpoint = "endpoint" // everyone calling the route
+)
+
+// defaultRateLimits apply to every rate limited route unless overridden
+const defaultRateLimits = "ip=120/1m,handle=30/1m,endpoint=6000/1m"
+
+// rateLimiter enforces the configured policies; trustedProxies are the
+// networks whose X-Forwarded-For is believed
+var (
+	rateLimiter    *keyedRateLimiter
+	trustedProxies []*net.IPNet
+)
+
+// rateLimitPolicy allows Limit requests per Window for each key of a scope.
+// Route is empty for the defaults or a route such as "/verify" to override
+// them there.
+type rateLimitPolicy struct {
+	Route  string
+	Scope  string
+	Limit  int
+	Window time.Duration
+}
+
+// parseRateLimits parses a comma-separated list of [route:]scope=limit/window
+// policies, e.g. "ip=120/1m,/verify:handle=10/1m". A limit of 0 turns a
+// default policy off for a route.
+func parseRateLimits(value string) ([]rateLimitPolicy, error) {
+	var policies []rateLimitPolicy
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		spec, rule, ok := strings.Cut(item, "=")
+		limitStr, windowStr, ok2 := strings.Cut(rule, "/")
+		if !ok || !ok2 {
+			return nil, fmt.Errorf("invalid rate limit %q, want [route:]scope=limit/window", item)
+		}
+
+		var p rateLimitPolicy
+		p.Scope = spec
+		if route, scope, found := strings.Cut(spec, ":"); found {
+			p.Route, p.Scope = route, scope
+		}
+		switch p.Scope {
+		case scopeIP, scopeHandle, scopeEndpoint:
+		default:
+			return nil, fmt.Errorf("invalid rate limit %q: scope must be ip, handle or endpoint", item)
+		}
+
+		var err error
+		if p.Limit, err = strconv.Atoi(limitStr); err != nil || p.Limit < 0 {
+			return nil, fmt.Errorf("invalid rate limit %q: bad limit", item)
+		}
+		if p.Window, err = time.ParseDuration(windowStr); err != nil || p.Window <= 0 {
+			return nil, fmt.Errorf("invalid rate limit %q: bad window", item)
+		}
+		policies = append(policies, p)
+	}
+	return policies, nil
+}
+
+// parseTrustedProxies parses a comma-separated list of CIDRs or addresses
+func parseTrustedProxies(value string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			if ip := net.ParseIP(item); ip != nil && ip.To4() != nil {
+				item += "/32"
+			} else {
+				item += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", item, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client. X-Forwarded-For is only
+// believed when the request came from a trusted proxy; the client is the
+// rightmost address in it that isn't a trusted proxy itself, since anything
+// further left could have been written by the client.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip == nil || !isTrustedProxy(ip) {
+		return host
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		ip := net.ParseIP(hop)
+		if ip == nil {
+			break
+		}
+		if !isTrustedProxy(ip) {
+			return ip.String()
+		}
+		host = ip.String()
+	}
+	return host
+}
+
+// rateCounter counts requests per key in fixed windows
+type rateCounter interface {
+	// incr counts a request against key in the window starting at
+	// windowStart and returns the count so far
+	incr(ctx context.Context, key string, windowStart time.Time, window time.Duration) (int, error)
+}
+
+// memoryRateCounter counts in process; each replica has its own counts
+type memoryRateCounter struct {
+	mu        sync.Mutex
+	counts    map[string]*windowCount
+	lastPrune time.Time
+}
+
+type windowCount struct {
+	start time.Time
+	end   time.Time
+	count int
+}
+
+func newMemoryRateCounter() *memoryRateCounter {
+	return &memoryRateCounter{counts: make(map[string]*windowCount), lastPrune: time.Now()}
+}
+
+func (c *memoryRateCounter) incr(ctx context.Context, key string, windowStart time.Time, window time.Duration) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.lastPrune) > time.Minute {
+		for k, wc := range c.counts {
+			if now.After(wc.end) {
+				delete(c.counts, k)
+			}
+		}
+		c.lastPrune = now
+	}
+
+	wc, ok := c.counts[key]
+	if !ok || !wc.start.Equal(windowStart) {
+		wc = &windowCount{start: windowStart, end: windowStart.Add(window)}
+		c.counts[key] = wc
+	}
+	wc.count++
+	return wc.count, nil
+}
+
+// postgresRateCounter counts in the rate_limits table so every replica
+// shares the same counts
+type postgresRateCounter struct {
+	db        *sql.DB
+	mu        sync.Mutex
+	lastPrune time.Time
+}
+
+func (c *postgresRateCounter) incr(ctx context.Context, key string, windowStart time.Time, window time.Duration) (int, error) {
+	c.mu.Lock()
+	prune := time.Since(c.lastPrune) > time.Minute
+	if prune {
+		c.lastPrune = time.Now()
+	}
+	c.mu.Unlock()
+
+	if prune {
+		if _, err := c.db.ExecContext(ctx, "DELETE FROM rate_limits WHERE expires_at < NOW()"); err != nil {
+			slog.Error("Failed to prune rate limits", "error", err)
+		}
+	}
+
+	var count int
+	err := c.db.QueryRowContext(ctx, `
+		INSERT INTO rate_limits (key, window_start, count, expires_at)
+		VALUES ($1, $2, 1, $3)
+		ON CONFLICT (key) DO UPDATE SET
+			count = CASE WHEN rate_limits.window_start = EXCLUDED.window_start
+			             THEN rate_limits.count + 1 ELSE 1 END,
+			window_start = EXCLUDED.window_start,
+			expires_at = EXCLUDED.expires_at
+		RETURNING count
+	`, key, windowStart.UTC(), windowStart.Add(window).UTC()).Scan(&count)
+	return count, err
+}
+
+// keyedRateLimiter applies rate limit policies per route
+type keyedRateLimiter struct {
+	defaults  []rateLimitPolicy
+	overrides map[string][]rateLimitPolicy // by route
+	counter   rateCounter
+}
+
+// newKeyedRateLimiter builds a limiter from policies in order; a later
+// policy for the same route and scope replaces an earlier one
+func newKeyedRateLimiter(policies []rateLimitPolicy, counter rateCounter) *keyedRateLimiter {
+	l := &keyedRateLimiter{overrides: make(map[string][]rateLimitPolicy), counter: counter}
+	replace := func(list []rateLimitPolicy, p rateLimitPolicy) []rateLimitPolicy {
+		for i := range list {
+			if list[i].Scope == p.Scope {
+				list[i] = p
+				return list
+			}
+		}
+		return append(list, p)
+	}
+	for _, p := range policies {
+		if p.Route == "" {
+			l.defaults = replace(l.defaults, p)
+		} else {
+			l.overrides[p.Route] = replace(l.overrides[p.Route], p)
+		}
+	}
+	return l
+}
+
+// policies returns the policies for a route: its overrides, plus the
+// defaults for scopes it doesn't override
+func (l *keyedRateLimiter) policies(route string) []rateLimitPolicy {
+	overrides := l.overrides[route]
+	policies := append([]rateLimitPolicy{}, overrides...)
+	for _, d := range l.defaults {
+		overridden := false
+		for _, o := range overrides {
+			overridden = overridden || o.Scope == d.Scope
+		}
+		if !overridden {
+			policies = append(policies, d)
+		}
+	}
+	return policies
+}
+
+// rateLimitResult is the outcome of the tightest policy a request hit
+type rateLimitResult struct {
+	Policy    rateLimitPolicy
+	Remaining int
+	Reset     time.Time
+	Allowed   bool
+}
+
+// check counts a request against every policy of its route and returns the
+// most restrictive result, or nil if no policy applies
+func (l *keyedRateLimiter) check(ctx context.Context, route, ip, handle string) *rateLimitResult {
+	now := time.Now()
+	var tightest *rateLimitResult
+	for _, p := range l.policies(route) {
+		if p.Limit == 0 {
+			continue
+		}
+
+		var subject string
+		switch p.Scope {
+		case scopeIP:
+			subject = ip
+		case scopeHandle:
+			if handle == "" {
+				continue
+			}
+			subject = strings.ToLower(handle)
+		case scopeEndpoint:
+			subject = "*"
+		}
+
+		windowStart := now.Truncate(p.Window)
+		count, err := l.counter.incr(ctx, route+"|"+p.Scope+"|"+subject, windowStart, p.Window)
+		if err != nil {
+			// Fail open: an outage of the shared counter shouldn't take
+			// logins down with it
+			slog.Error("Rate limit counter failed", "error", err)
+			continue
+		}
+
+		res := &rateLimitResult{
+			Policy:    p,
+			Remaining: p.Limit - count,
+			Reset:     windowStart.Add(p.Window),
+			Allowed:   count <= p.Limit,
+		}
+		if res.Remaining < 0 {
+			res.Remaining = 0
+		}
+		if tightest == nil || (tightest.Allowed && !res.Allowed) ||
+			(tightest.Allowed == res.Allowed && res.Remaining < tightest.Remaining) {
+			tightest = res
+		}
+	}
+	return tightest
+}
+
+// requestHandle reads the handle from a JSON request body, leaving the body
+// for the handler to read
+func requestHandle(r *http.Request) string {
+	if r.Body == nil {
+		return ""
+	}
+	head, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(head), r.Body), r.Body}
+	if err != nil {
+		return ""
+	}
+
+	var req struct {
+		Handle string `json:"handle"`
+	}
+	if json.Unmarshal(head, &req) != nil {
+		return ""
+	}
+	return req.Handle
+}
+
+// rateLimitMiddleware limits requests by client IP, by the handle they
+// name and by route, and reports the tightest limit in RateLimit headers
+func rateLimitMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if rateLimiter == nil {
+			next(w, r)
+			return
+		}
+
+		route := r.URL.Path
+		if current := mux.CurrentRoute(r); current != nil {
+			if tpl, err := current.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+
+		res := rateLimiter.check(r.Context(), route, clientIP(r), requestHandle(r))
+		if res == nil {
+			next(w, r)
+			return
+		}
+
+		reset := int(time.Until(res.Reset).Seconds() + 0.999)
+		if reset < 1 {
+			reset = 1
+		}
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(res.Policy.Limit))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+		w.Header().Set("RateLimit-Reset", strconv.Itoa(reset))
+		w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", res.Policy.Limit, int(res.Policy.Window.Seconds())))
+
+		if !res.Allowed {
+			rateLimitRejections.WithLabelValues(route, res.Policy.Scope).Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(reset))
+			respondError(w, http.StatusTooManyRequests, "Rate limit exceeded")
+			return
+		}
+		next(w, r)
+	}
+}
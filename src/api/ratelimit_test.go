@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestClientIPTrustedProxies(t *testing.T) {
+	var err error
+	trustedProxies, err = parseTrustedProxies("10.0.0.0/8, 192.0.2.1")
+	if err != nil {
+		t.Fatalf("parseTrustedProxies failed: %v", err)
+	}
+	t.Cleanup(func() { trustedProxies = nil })
+
+	tests := []struct {
+		remote string
+		xff    string
+		want   string
+	}{
+		{"203.0.113.5:1234", "198.51.100.1", "203.0.113.5"},                   // untrusted peer can't claim an address
+		{"10.1.2.3:1234", "198.51.100.1", "198.51.100.1"},                     // one trusted proxy
+		{"10.1.2.3:1234", "6.6.6.6, 198.51.100.1, 192.0.2.1", "198.51.100.1"}, // spoofed hop on the left is ignored
+		{"10.1.2.3:1234", "", "10.1.2.3"},                                     // proxy without the header
+		{"10.1.2.3:1234", "garbage", "10.1.2.3"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", "/verify", nil)
+		req.RemoteAddr = tt.remote
+		if tt.xff != "" {
+			req.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		if got := clientIP(req); got != tt.want {
+			t.Errorf("clientIP(%s, %q) = %s, want %s", tt.remote, tt.xff, got, tt.want)
+		}
+	}
+}
+
+func TestParseRateLimits(t *testing.T) {
+	policies, err := parseRateLimits(defaultRateLimits + ",/verify:handle=5/30s,ip=10/1m")
+	if err != nil {
+		t.Fatalf("parseRateLimits failed: %v", err)
+	}
+	l := newKeyedRateLimiter(policies, newMemoryRateCounter())
+	got := map[string]int{}
+	for _, p := range l.policies("/verify") {
+		got[p.Scope] = p.Limit
+	}
+	if got[scopeHandle] != 5 || got[scopeIP] != 10 || got[scopeEndpoint] != 6000 {
+		t.Errorf("Policies for /verify = %v", got)
+	}
+
+	for _, bad := range []string{"ip", "ip=10", "user=1/1m", "ip=-1/1m", "ip=1/0s"} {
+		if _, err := parseRateLimits(bad); err == nil {
+			t.Errorf("parseRateLimits(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	policies, _ := parseRateLimits("ip=100/1m,/verify:handle=2/1m")
+	rateLimiter = newKeyedRateLimiter(policies, newMemoryRateCounter())
+	t.Cleanup(func() { rateLimiter = nil })
+
+	r := mux.NewRouter()
+	r.HandleFunc("/verify", rateLimitMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		// The handler still sees the whole body
+		body, err := io.ReadAll(r.Body)
+		if err != nil || !strings.Contains(string(body), "alice") {
+			t.Errorf("Handler got body %q, %v", body, err)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	verify := func(handle, remote string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/verify", strings.NewReader(`{"handle":"`+handle+`"}`))
+		req.RemoteAddr = remote
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i := 0; i < 2; i++ {
+		if rec := verify("alice", "203.0.113.1:1"); rec.Code != http.StatusOK {
+			t.Fatalf("Request %d returned %d", i, rec.Code)
+		}
+	}
+
+	// The handle is limited no matter which address asks
+	rec := verify("alice", "203.0.113.2:1")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("Third request for the handle returned %d, want 429", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("429 without Retry-After")
+	}
+	if rec.Header().Get("RateLimit-Limit") != "2" || rec.Header().Get("RateLimit-Remaining") != "0" {
+		t.Errorf("RateLimit headers = %v", rec.Header())
+	}
+}
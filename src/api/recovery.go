@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// RecoveryKeyInput is a recovery key supplied at or after registration
+type RecoveryKeyInput struct {
+	PublicKey string `json:"public_key"` // base64 encoded
+	KeyType   string `json:"key_type"`
+	Name      string `json:"name,omitempty"`
+}
+
+// RecoveryKey is a registered offline recovery key
+type RecoveryKey struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	PublicKey string    `json:"public_key"`
+	KeyType   string    `json:"key_type"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AddRecoveryKeysRequest adds recovery keys to a handle. Signature is made
+// by an existing device key over addRecoveryKeysStatement.
+type AddRecoveryKeysRequest struct {
+	Handle       string             `json:"handle"`
+	Challenge    string             `json:"challenge"`
+	Signature    string             `json:"signature"`
+	KeyID        string             `json:"key_id,omitempty"` // device key that signed
+	RecoveryKeys []RecoveryKeyInput `json:"recovery_keys"`
+}
+
+// RecoverRequest enrolls a new device key using a recovery key. The
+// recovery key and the new key both sign recoveryStatement.
+type RecoverRequest struct {
+	Handle            string `json:"handle"`
+	Challenge         string `json:"challenge"`
+	RecoveryKeyID     string `json:"recovery_key_id,omitempty"` // any unused recovery key if empty
+	RecoverySignature string `json:"recovery_signature"`
+	PublicKey         string `json:"public_key"` // new device key, base64 encoded
+	KeyType           string `json:"key_type"`
+	Name              string `json:"name,omitempty"`
+	NewSignature      string `json:"new_signature"`
+}
+
+// addRecoveryKeysStatement is the message a device key signs to authorize
+// new recovery keys
+func addRecoveryKeysStatement(challenge string, keys []RecoveryKeyInput) []byte {
+	statement := "authgrid-add-recovery-keys\n" + challenge
+	for _, k := range keys {
+		statement += "\n" + k.KeyType + "\n" + k.PublicKey
+	}
+	return []byte(statement)
+}
+
+// recoveryStatement is the message signed to recover a handle onto a new key
+func recoveryStatement(handle, challenge, keyType, publicKey string) []byte {
+	return []byte("authgrid-recover\n" + handle + "\n" + challenge + "\n" + keyType + "\n" + publicKey)
+}
+
+// validateRecoveryKeys checks a list of recovery keys, returning a message
+// for the client if one is invalid
+func validateRecoveryKeys(keys []RecoveryKeyInput) error {
+	for _, k := range keys {
+		if _, err := validatePublicKey(k.PublicKey, k.KeyType); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findRecoveryKey returns the unused recovery key of a user that produced
+// signature over message, or nil if none did
+func findRecoveryKey(ctx context.Context, userID, keyID string, message, signature []byte) (*RecoveryKey, error) {
+	keys, err := store.RecoveryKeys(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rk := range keys {
+		if keyID != "" && rk.ID != keyID {
+			continue
+		}
+		valid, err := verifySignature(ctx, rk.PublicKey, rk.KeyType, message, signature)
+		if err == nil && valid {
+			return &rk, nil
+		}
+	}
+	return nil, nil
+}
+
+// addRecoveryKeysHandler registers recovery keys for an existing handle,
+// authorized by a device key signature over a fresh challenge
+func addRecoveryKeysHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req AddRecoveryKeysRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if req.Handle == "" || req.Challenge == "" || req.Signature == "" {
+		respondError(w, http.StatusBadRequest, "Handle, challenge, and signature are required")
+		return
+	}
+
+	if !checkLockout(w, r, req.Handle) {
+		return
+	}
+	if len(req.RecoveryKeys) == 0 {
+		respondError(w, http.StatusBadRequest, "At least one recovery key is required")
+		return
+	}
+	if err := validateRecoveryKeys(req.RecoveryKeys); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	user, err := store.UserByHandle(ctx, req.Handle)
+	if err == errNotFound {
+		respondError(w, http.StatusNotFound, "Handle not found")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	ch, ok := checkChallenge(w, r, req.Handle, req.Challenge)
+	if !ok {
+		return
+	}
+
+	signatureBytes, err := base64.StdEncoding.DecodeString(req.Signature)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid signature encoding")
+		return
+	}
+
+	statement := addRecoveryKeysStatement(req.Challenge, req.RecoveryKeys)
+	signer, err := findSigningKey(ctx, user.ID, req.KeyID, statement, signatureBytes)
+	if err == errSignCountRegressed {
+		recordAudit(r, auditRecoveryKeys, req.Handle, outcomeFailure, "sign count regressed")
+		respondLoginFailure(w, r, ch, req.Handle, "Authenticator signature counter went backwards")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if signer == nil {
+		recordAudit(r, auditRecoveryKeys, req.Handle, outcomeFailure, "invalid signature")
+		respondLoginFailure(w, r, ch, req.Handle, "Invalid signature")
+		return
+	}
+
+	added, err := store.AddRecoveryKeys(ctx, ch, user.ID, req.RecoveryKeys)
+	if err == errChallengeUsed {
+		respondError(w, http.StatusBadRequest, "Challenge already used")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to add recovery keys")
+		return
+	}
+	recordLoginSuccess(r, req.Handle)
+	recordAudit(r, auditRecoveryKeys, req.Handle, outcomeSuccess, fmt.Sprintf("%d recovery keys", len(added)))
+
+	respondJSON(w, http.StatusCreated, map[string]interface{}{
+		"recovery_keys": added,
+	})
+}
+
+// listRecoveryKeysHandler returns the caller's unused recovery keys
+func listRecoveryKeysHandler(w http.ResponseWriter, r *http.Request) {
+	sess := currentSession(r)
+
+	keys, err := store.RecoveryKeys(r.Context(), sess.UserID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"recovery_keys": keys,
+	})
+}
+
+// removeRecoveryKeyHandler revokes one of the caller's recovery keys
+func removeRecoveryKeyHandler(w http.ResponseWriter, r *http.Request) {
+	sess := currentSession(r)
+	id := mux.Vars(r)["id"]
+
+	err := store.RemoveRecoveryKey(r.Context(), sess.UserID, id)
+	if err == errNotFound {
+		recordAudit(r, auditRecoveryKeyRemove, sess.Handle, outcomeFailure, "recovery key "+id+" not found")
+		respondError(w, http.StatusNotFound, "Recovery key not found")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to remove recovery key")
+		return
+	}
+	recordAudit(r, auditRecoveryKeyRemove, sess.Handle, outcomeSuccess, "recovery key "+id)
+
+	respondJSON(w, http.StatusOK, map[string]bool{"removed": true})
+}
+
+// recoverHandler enrolls a new device key using a recovery key. Every
+// existing device key and session of the handle is revoked.
+func recoverHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req RecoverRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if req.Handle == "" || req.Challenge == "" || req.RecoverySignature == "" || req.NewSignature == "" {
+		respondError(w, http.StatusBadRequest, "Handle, challenge, and both signatures are required")
+		return
+	}
+
+	// Recovery enrolls a key without any device key, so guessing recovery
+	// keys counts against the same lockout as a login
+	if !checkLockout(w, r, req.Handle) {
+		return
+	}
+
+	if _, err := validatePublicKey(req.PublicKey, req.KeyType); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	user, err := store.UserByHandle(ctx, req.Handle)
+	if err == errNotFound {
+		respondError(w, http.StatusNotFound, "Handle not found")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	ch, ok := checkChallenge(w, r, req.Handle, req.Challenge)
+	if !ok {
+		return
+	}
+
+	recoverySignature, err := base64.StdEncoding.DecodeString(req.RecoverySignature)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid signature encoding")
+		return
+	}
+	newSignature, err := base64.StdEncoding.DecodeString(req.NewSignature)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid signature encoding")
+		return
+	}
+
+	statement := recoveryStatement(req.Handle, req.Challenge, req.KeyType, req.PublicKey)
+
+	recoveryKey, err := findRecoveryKey(ctx, user.ID, req.RecoveryKeyID, statement, recoverySignature)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if recoveryKey == nil {
+		recordAudit(r, auditRecover, req.Handle, outcomeFailure, "invalid recovery key signature")
+		respondLoginFailure(w, r, ch, req.Handle, "Invalid recovery key signature")
+		return
+	}
+
+	valid, err := verifySignature(ctx, req.PublicKey, req.KeyType, statement, newSignature)
+	if err != nil || !valid {
+		recordAudit(r, auditRecover, req.Handle, outcomeFailure, "invalid new key signature")
+		respondLoginFailure(w, r, ch, req.Handle, "Invalid new key signature")
+		return
+	}
+
+	key := &UserKey{Name: req.Name, PublicKey: req.PublicKey, KeyType: req.KeyType}
+	err = store.Recover(ctx, ch, user.ID, recoveryKey.ID, key)
+	switch err {
+	case nil:
+	case errChallengeUsed:
+		respondError(w, http.StatusBadRequest, "Challenge already used")
+		return
+	case errRecoveryKeyUsed:
+		respondError(w, http.StatusConflict, "Recovery key already used")
+		return
+	case errKeyRegistered:
+		respondError(w, http.StatusConflict, "Public key already registered")
+		return
+	default:
+		respondError(w, http.StatusInternalServerError, "Failed to enroll key")
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Handle recovered with recovery key", "handle_hash", handleHash(req.Handle), "recovery_key", recoveryKey.ID)
+	recordLoginSuccess(r, req.Handle)
+	recordAudit(r, auditRecover, req.Handle, outcomeSuccess, "recovery key "+recoveryKey.ID)
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"handle":            req.Handle,
+		"key":               key,
+		"recovery_key_used": recoveryKey.ID,
+	})
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// newTestKey returns a fresh Ed25519 key and its base64 public key
+func newTestKey(t *testing.T) (string, ed25519.PrivateKey) {
+	t.Helper()
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(publicKey), privateKey
+}
+
+func TestRegisterWithRecoveryKeys(t *testing.T) {
+	for _, backend := range []string{"memory", "sqlite", "postgres"} {
+		t.Run(backend, func(t *testing.T) {
+			setupTestStore(t, backend)
+			publicKey, privateKey := newTestKey(t)
+			recoveryKey, _ := newTestKey(t)
+			injectedKey, _ := newTestKey(t)
+			keys := []RecoveryKeyInput{{PublicKey: recoveryKey, KeyType: "ed25519", Name: "paper"}}
+
+			register := func(signed, sent []RecoveryKeyInput) int {
+				var ch RegisterChallengeResponse
+				if code := doJSON(t, registerChallengeHandler, RegisterChallengeRequest{PublicKey: publicKey, KeyType: "ed25519"}, &ch); code != http.StatusOK {
+					t.Fatalf("/register/challenge returned %d", code)
+				}
+				statement := registrationStatement(ch.Challenge, "ed25519", publicKey, signed)
+				return doJSON(t, registerHandler, RegisterRequest{
+					PublicKey:    publicKey,
+					KeyType:      "ed25519",
+					Challenge:    ch.Challenge,
+					Signature:    base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, statement)),
+					RecoveryKeys: sent,
+				}, nil)
+			}
+
+			// A recovery key added after the key signed must be refused
+			injected := append(append([]RecoveryKeyInput{}, keys...), RecoveryKeyInput{PublicKey: injectedKey, KeyType: "ed25519"})
+			if code := register(keys, injected); code != http.StatusUnauthorized {
+				t.Fatalf("/register with an injected recovery key returned %d, want 401", code)
+			}
+			if code := register(nil, keys); code != http.StatusUnauthorized {
+				t.Fatalf("/register with an unsigned recovery key returned %d, want 401", code)
+			}
+			if code := register(keys, keys); code != http.StatusCreated {
+				t.Fatalf("/register with a recovery key returned %d, want 201", code)
+			}
+		})
+	}
+}
+
+func TestRecover(t *testing.T) {
+	for _, backend := range []string{"memory", "sqlite", "postgres"} {
+		t.Run(backend, func(t *testing.T) {
+			setupTestStore(t, backend)
+			handle, deviceKey := registerTestUser(t)
+			recoveryPublic, recoveryKey := newTestKey(t)
+
+			challenge := newChallenge(t, handle)
+			keys := []RecoveryKeyInput{{PublicKey: recoveryPublic, KeyType: "ed25519", Name: "paper"}}
+			var added struct {
+				RecoveryKeys []RecoveryKey `json:"recovery_keys"`
+			}
+			code := doJSON(t, addRecoveryKeysHandler, AddRecoveryKeysRequest{
+				Handle:       handle,
+				Challenge:    challenge,
+				Signature:    base64.StdEncoding.EncodeToString(ed25519.Sign(deviceKey, addRecoveryKeysStatement(challenge, keys))),
+				RecoveryKeys: keys,
+			}, &added)
+			if code != http.StatusCreated {
+				t.Fatalf("/recovery-keys returned %d", code)
+			}
+			if len(added.RecoveryKeys) != 1 || added.RecoveryKeys[0].ID == "" {
+				t.Fatalf("/recovery-keys added %+v", added.RecoveryKeys)
+			}
+
+			recover := func(recoveryKey ed25519.PrivateKey) (int, ed25519.PrivateKey) {
+				publicKey, newKey := newTestKey(t)
+				challenge := newChallenge(t, handle)
+				statement := recoveryStatement(handle, challenge, "ed25519", publicKey)
+				return doJSON(t, recoverHandler, RecoverRequest{
+					Handle:            handle,
+					Challenge:         challenge,
+					RecoverySignature: base64.StdEncoding.EncodeToString(ed25519.Sign(recoveryKey, statement)),
+					PublicKey:         publicKey,
+					KeyType:           "ed25519",
+					NewSignature:      base64.StdEncoding.EncodeToString(ed25519.Sign(newKey, statement)),
+				}, nil), newKey
+			}
+
+			code, newKey := recover(recoveryKey)
+			if code != http.StatusOK {
+				t.Fatalf("/recover returned %d", code)
+			}
+			if code := doJSON(t, verifyHandler, signedLogin(t, handle, deviceKey), nil); code != http.StatusUnauthorized {
+				t.Errorf("Login with the lost key returned %d, want 401", code)
+			}
+			if code := doJSON(t, verifyHandler, signedLogin(t, handle, newKey), nil); code != http.StatusOK {
+				t.Errorf("Login with the recovered key returned %d, want 200", code)
+			}
+
+			// Recovery keys are single-use
+			if code, _ := recover(recoveryKey); code != http.StatusUnauthorized {
+				t.Errorf("Second recovery with the same key returned %d, want 401", code)
+			}
+		})
+	}
+}
+
+func TestRecoverLockout(t *testing.T) {
+	setupTestStore(t, "memory")
+	lockout = &loginLockout{
+		policy:  lockoutPolicy{Threshold: 2, Base: time.Minute, Max: time.Hour, Reset: time.Hour},
+		tracker: newMemoryFailureTracker(),
+	}
+	t.Cleanup(func() { lockout = nil })
+
+	handle, _ := registerTestUser(t)
+	_, guessedKey := newTestKey(t)
+	publicKey, newKey := newTestKey(t)
+	recover := func(challenge string) int {
+		statement := recoveryStatement(handle, challenge, "ed25519", publicKey)
+		return doJSONFrom(t, "203.0.113.66:1", recoverHandler, RecoverRequest{
+			Handle:            handle,
+			Challenge:         challenge,
+			RecoverySignature: base64.StdEncoding.EncodeToString(ed25519.Sign(guessedKey, statement)),
+			PublicKey:         publicKey,
+			KeyType:           "ed25519",
+			NewSignature:      base64.StdEncoding.EncodeToString(ed25519.Sign(newKey, statement)),
+		}, nil)
+	}
+
+	// Guessing recovery keys counts as a failed login
+	if code := recover(newChallenge(t, handle)); code != http.StatusUnauthorized {
+		t.Fatalf("Recovery with an unknown key returned %d, want 401", code)
+	}
+	if code := recover(newChallenge(t, handle)); code != http.StatusTooManyRequests {
+		t.Fatalf("Recovery that locked the handle returned %d, want 429", code)
+	}
+	if code := recover("x"); code != http.StatusTooManyRequests {
+		t.Errorf("Recovery by a locked out address returned %d, want 429", code)
+	}
+}
+
+// addTestRecoveryKey registers a fresh recovery key for handle, authorized
+// by the device key
+func addTestRecoveryKey(t *testing.T, handle string, deviceKey ed25519.PrivateKey) (RecoveryKey, ed25519.PrivateKey) {
+	t.Helper()
+	publicKey, recoveryKey := newTestKey(t)
+	challenge := newChallenge(t, handle)
+	keys := []RecoveryKeyInput{{PublicKey: publicKey, KeyType: "ed25519"}}
+	var added struct {
+		RecoveryKeys []RecoveryKey `json:"recovery_keys"`
+	}
+	code := doJSON(t, addRecoveryKeysHandler, AddRecoveryKeysRequest{
+		Handle:       handle,
+		Challenge:    challenge,
+		Signature:    base64.StdEncoding.EncodeToString(ed25519.Sign(deviceKey, addRecoveryKeysStatement(challenge, keys))),
+		RecoveryKeys: keys,
+	}, &added)
+	if code != http.StatusCreated || len(added.RecoveryKeys) != 1 {
+		t.Fatalf("/recovery-keys returned %d", code)
+	}
+	return added.RecoveryKeys[0], recoveryKey
+}
+
+// loginToken logs in with key and returns the access token
+func loginToken(t *testing.T, handle string, key ed25519.PrivateKey) string {
+	t.Helper()
+	var verified VerifyResponse
+	if code := doJSON(t, verifyHandler, signedLogin(t, handle, key), &verified); code != http.StatusOK {
+		t.Fatalf("/verify returned %d", code)
+	}
+	return verified.Token
+}
+
+func TestAddRecoveryKeys(t *testing.T) {
+	for _, backend := range []string{"memory", "sqlite", "postgres"} {
+		t.Run(backend, func(t *testing.T) {
+			setupTestStore(t, backend)
+			handle, deviceKey := registerTestUser(t)
+			otherHandle, otherKey := registerTestUser(t)
+			_, strangerKey := newTestKey(t)
+
+			login := signedLogin(t, handle, deviceKey)
+			if code := doJSON(t, verifyHandler, login, nil); code != http.StatusOK {
+				t.Fatalf("/verify returned %d", code)
+			}
+
+			for _, tt := range []struct {
+				name      string
+				challenge func() string
+				signer    ed25519.PrivateKey
+				want      int
+			}{
+				{name: "signed by an unregistered key", signer: strangerKey, want: http.StatusUnauthorized},
+				{name: "signed by another handle's key", signer: otherKey, want: http.StatusUnauthorized},
+				{name: "challenge issued to another handle", challenge: func() string { return newChallenge(t, otherHandle) }, signer: deviceKey, want: http.StatusNotFound},
+				{name: "replayed challenge", challenge: func() string { return login.Challenge }, signer: deviceKey, want: http.StatusBadRequest},
+				{name: "signed by the device key", signer: deviceKey, want: http.StatusCreated},
+			} {
+				t.Run(tt.name, func(t *testing.T) {
+					challenge := newChallenge(t, handle)
+					if tt.challenge != nil {
+						challenge = tt.challenge()
+					}
+					publicKey, _ := newTestKey(t)
+					keys := []RecoveryKeyInput{{PublicKey: publicKey, KeyType: "ed25519"}}
+					code := doJSON(t, addRecoveryKeysHandler, AddRecoveryKeysRequest{
+						Handle:       handle,
+						Challenge:    challenge,
+						Signature:    base64.StdEncoding.EncodeToString(ed25519.Sign(tt.signer, addRecoveryKeysStatement(challenge, keys))),
+						RecoveryKeys: keys,
+					}, nil)
+					if code != tt.want {
+						t.Errorf("/recovery-keys returned %d, want %d", code, tt.want)
+					}
+				})
+			}
+
+			var listed struct {
+				RecoveryKeys []RecoveryKey `json:"recovery_keys"`
+			}
+			if code := doAuthed(t, loginToken(t, handle, deviceKey), nil, listRecoveryKeysHandler, &listed); code != http.StatusOK {
+				t.Fatalf("GET /recovery-keys returned %d", code)
+			}
+			if len(listed.RecoveryKeys) != 1 {
+				t.Errorf("Handle has %d recovery keys, want 1", len(listed.RecoveryKeys))
+			}
+		})
+	}
+}
+
+func TestRemoveRecoveryKey(t *testing.T) {
+	for _, backend := range []string{"memory", "sqlite", "postgres"} {
+		t.Run(backend, func(t *testing.T) {
+			setupTestStore(t, backend)
+			handle, deviceKey := registerTestUser(t)
+			recoveryKey, _ := addTestRecoveryKey(t, handle, deviceKey)
+			otherHandle, otherKey := registerTestUser(t)
+			ownerToken := loginToken(t, handle, deviceKey)
+			otherToken := loginToken(t, otherHandle, otherKey)
+
+			// The cases run in order
+			for _, tt := range []struct {
+				name  string
+				token string
+				id    string
+				want  int
+			}{
+				{name: "tampered token", token: ownerToken[:len(ownerToken)-4] + "AAAA", id: recoveryKey.ID, want: http.StatusUnauthorized},
+				{name: "another handle's recovery key", token: otherToken, id: recoveryKey.ID, want: http.StatusNotFound},
+				{name: "unknown recovery key", token: ownerToken, id: "00000000-0000-0000-0000-000000000000", want: http.StatusNotFound},
+				{name: "own recovery key", token: ownerToken, id: recoveryKey.ID, want: http.StatusOK},
+				{name: "already removed recovery key", token: ownerToken, id: recoveryKey.ID, want: http.StatusNotFound},
+			} {
+				t.Run(tt.name, func(t *testing.T) {
+					if code := doAuthed(t, tt.token, map[string]string{"id": tt.id}, removeRecoveryKeyHandler, nil); code != tt.want {
+						t.Errorf("DELETE /recovery-keys/{id} returned %d, want %d", code, tt.want)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestRecoverRequests(t *testing.T) {
+	for _, backend := range []string{"memory", "sqlite", "postgres"} {
+		t.Run(backend, func(t *testing.T) {
+			setupTestStore(t, backend)
+			handle, deviceKey := registerTestUser(t)
+			recoveryKey, recoveryPrivate := addTestRecoveryKey(t, handle, deviceKey)
+			removedKey, removedPrivate := addTestRecoveryKey(t, handle, deviceKey)
+			if code := doAuthed(t, loginToken(t, handle, deviceKey), map[string]string{"id": removedKey.ID}, removeRecoveryKeyHandler, nil); code != http.StatusOK {
+				t.Fatalf("DELETE /recovery-keys/{id} returned %d", code)
+			}
+			otherHandle, otherKey := registerTestUser(t)
+			otherRecovery, otherRecoveryPrivate := addTestRecoveryKey(t, otherHandle, otherKey)
+			_, strangerKey := newTestKey(t)
+
+			login := signedLogin(t, handle, deviceKey)
+			if code := doJSON(t, verifyHandler, login, nil); code != http.StatusOK {
+				t.Fatalf("/verify returned %d", code)
+			}
+
+			for _, tt := range []struct {
+				name          string
+				challenge     func() string
+				recoveryKeyID string
+				recoveryKey   ed25519.PrivateKey
+				newSigner     ed25519.PrivateKey // signs as the new key; the new key itself if nil
+				want          int
+			}{
+				{name: "signed by an unregistered key", recoveryKey: strangerKey, want: http.StatusUnauthorized},
+				{name: "signed by the device key", recoveryKey: deviceKey, want: http.StatusUnauthorized},
+				{name: "signed by a removed recovery key", recoveryKey: removedPrivate, want: http.StatusUnauthorized},
+				{name: "another handle's recovery key", recoveryKey: otherRecoveryPrivate, want: http.StatusUnauthorized},
+				{name: "recovery_key_id of another handle", recoveryKeyID: otherRecovery.ID, recoveryKey: otherRecoveryPrivate, want: http.StatusUnauthorized},
+				{name: "new signature by another key", recoveryKey: recoveryPrivate, newSigner: strangerKey, want: http.StatusUnauthorized},
+				{name: "challenge issued to another handle", challenge: func() string { return newChallenge(t, otherHandle) }, recoveryKey: recoveryPrivate, want: http.StatusNotFound},
+				{name: "replayed challenge", challenge: func() string { return login.Challenge }, recoveryKey: recoveryPrivate, want: http.StatusBadRequest},
+				{name: "signed by the recovery key", recoveryKeyID: recoveryKey.ID, recoveryKey: recoveryPrivate, want: http.StatusOK},
+			} {
+				t.Run(tt.name, func(t *testing.T) {
+					challenge := newChallenge(t, handle)
+					if tt.challenge != nil {
+						challenge = tt.challenge()
+					}
+					publicKey, newKey := newTestKey(t)
+					newSigner := newKey
+					if tt.newSigner != nil {
+						newSigner = tt.newSigner
+					}
+					statement := recoveryStatement(handle, challenge, "ed25519", publicKey)
+					code := doJSON(t, recoverHandler, RecoverRequest{
+						Handle:            handle,
+						Challenge:         challenge,
+						RecoveryKeyID:     tt.recoveryKeyID,
+						RecoverySignature: base64.StdEncoding.EncodeToString(ed25519.Sign(tt.recoveryKey, statement)),
+						PublicKey:         publicKey,
+						KeyType:           "ed25519",
+						NewSignature:      base64.StdEncoding.EncodeToString(ed25519.Sign(newSigner, statement)),
+					}, nil)
+					if code != tt.want {
+						t.Fatalf("/recover returned %d, want %d", code, tt.want)
+					}
+
+					want := http.StatusUnauthorized
+					if tt.want == http.StatusOK {
+						want = http.StatusOK
+					}
+					if code := doJSON(t, verifyHandler, signedLogin(t, handle, newKey), nil); code != want {
+						t.Errorf("Login with the new key returned %d, want %d", code, want)
+					}
+				})
+			}
+
+			// The other handle was never touched
+			if code := doJSON(t, verifyHandler, signedLogin(t, otherHandle, otherKey), nil); code != http.StatusOK {
+				t.Errorf("Login to the other handle returned %d, want 200", code)
+			}
+		})
+	}
+}
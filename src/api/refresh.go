@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// RefreshRequest represents a token refresh request
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// TokenResponse represents a refreshed token pair
+type TokenResponse struct {
+	Token            string    `json:"token"`
+	ExpiresAt        time.Time `json:"expires_at"`
+	RefreshToken     string    `json:"refresh_token"`
+	RefreshExpiresAt time.Time `json:"refresh_expires_at"`
+}
+
+// generateRefreshToken creates an opaque random refresh token
+func generateRefreshToken() (string, error) {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(bytes), nil
+}
+
+// refreshHandler exchanges a refresh token for a new access and refresh token.
+// Each refresh token can be used once; replaying a rotated token is treated
+// as theft and revokes the whole session.
+func refreshHandler(w http.ResponseWriter, r *http.Request) {
+	var req RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if req.RefreshToken == "" {
+		respondError(w, http.StatusBadRequest, "Refresh token is required")
+		return
+	}
+
+	tokenHash := hashToken(req.RefreshToken)
+	grant, err := store.LookupRefreshToken(r.Context(), tokenHash)
+	if err == errNotFound {
+		respondError(w, http.StatusUnauthorized, "Invalid refresh token")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	// Refreshing never extends the session past the expiry set at login
+	if time.Now().After(grant.ExpiresAt) {
+		respondError(w, http.StatusUnauthorized, "Session expired")
+		return
+	}
+
+	tokenExpiry := time.Now().Add(currentConfig().Tokens.AccessTokenTTL)
+	if tokenExpiry.After(grant.ExpiresAt) {
+		tokenExpiry = grant.ExpiresAt
+	}
+	token, err := generateToken(grant.Handle, grant.KeyType, tokenExpiry)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to generate token")
+		return
+	}
+
+	refreshToken, err := generateRefreshToken()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to issue refresh token")
+		return
+	}
+	refreshExpiry := time.Now().Add(currentConfig().Tokens.RefreshTokenTTL)
+	if refreshExpiry.After(grant.ExpiresAt) {
+		refreshExpiry = grant.ExpiresAt
+	}
+
+	err = store.RotateRefreshToken(r.Context(), tokenHash, hashToken(token), hashToken(refreshToken), refreshExpiry)
+	switch err {
+	case nil:
+	case errNotFound:
+		respondError(w, http.StatusUnauthorized, "Invalid refresh token")
+		return
+	case errSessionRevoked:
+		respondError(w, http.StatusUnauthorized, "Session revoked")
+		return
+	case errRefreshReused:
+		slog.WarnContext(r.Context(), "Refresh token reuse detected; session revoked", "handle_hash", handleHash(grant.Handle), "session_id", grant.SessionID)
+		recordAudit(r, auditRefreshReuse, grant.Handle, outcomeFailure, "session "+grant.SessionID+" revoked")
+		respondError(w, http.StatusUnauthorized, "Refresh token reuse detected; session revoked")
+		return
+	case errRefreshExpired:
+		respondError(w, http.StatusUnauthorized, "Refresh token expired")
+		return
+	default:
+		respondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, TokenResponse{
+		Token:            token,
+		ExpiresAt:        tokenExpiry,
+		RefreshToken:     refreshToken,
+		RefreshExpiresAt: refreshExpiry,
+	})
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// RotateRequest represents a signed key rotation. The old key and the new
+// key both sign rotationStatement.
+type RotateRequest struct {
+	Handle       string `json:"handle"`
+	Challenge    string `json:"challenge"`
+	KeyID        string `json:"key_id,omitempty"` // key being replaced; any active key if empty
+	PublicKey    string `json:"public_key"`       // new key, base64 encoded
+	KeyType      string `json:"key_type"`
+	OldSignature string `json:"old_signature"`
+	NewSignature string `json:"new_signature"`
+}
+
+// RotateResponse represents a completed rotation
+type RotateResponse struct {
+	Handle    string    `json:"handle"`
+	OldKeyID  string    `json:"old_key_id"`
+	Key       UserKey   `json:"key"`
+	RotatedAt time.Time `json:"rotated_at"`
+}
+
+// KeyRotation is an entry in a handle's rotation history
+type KeyRotation struct {
+	OldPublicKey string    `json:"old_public_key"`
+	OldKeyType   string    `json:"old_key_type"`
+	NewPublicKey string    `json:"new_public_key"`
+	NewKeyType   string    `json:"new_key_type"`
+	Statement    string    `json:"statement"`
+	OldSignature string    `json:"old_signature"`
+	NewSignature string    `json:"new_signature"`
+	RotatedAt    time.Time `json:"rotated_at"`
+}
+
+// rotationStatement is the message both keys sign to hand a handle over
+// from the old key to the new one
+func rotationStatement(handle, challenge, keyType, publicKey string) []byte {
+	return []byte("authgrid-rotate-key\n" + handle + "\n" + challenge + "\n" + keyType + "\n" + publicKey)
+}
+
+// rotateHandler replaces a key with a new one while keeping the handle. The
+// old key is revoked along with its sessions, and the rotation is recorded.
+func rotateHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req RotateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if req.Handle == "" || req.Challenge == "" || req.OldSignature == "" || req.NewSignature == "" {
+		respondError(w, http.StatusBadRequest, "Handle, challenge, and both signatures are required")
+		return
+	}
+
+	// Rotation hands the handle to a new key, so it counts against the
+	// same lockout as a login
+	if !checkLockout(w, r, req.Handle) {
+		return
+	}
+
+	if _, err := validatePublicKey(req.PublicKey, req.KeyType); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	user, err := store.UserByHandle(ctx, req.Handle)
+	if err == errNotFound {
+		respondError(w, http.StatusNotFound, "Handle not found")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	ch, ok := checkChallenge(w, r, req.Handle, req.Challenge)
+	if !ok {
+		return
+	}
+
+	oldSignature, err := base64.StdEncoding.DecodeString(req.OldSignature)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid signature encoding")
+		return
+	}
+	newSignature, err := base64.StdEncoding.DecodeString(req.NewSignature)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid signature encoding")
+		return
+	}
+
+	statement := rotationStatement(req.Handle, req.Challenge, req.KeyType, req.PublicKey)
+
+	// The old key authorizes the rotation...
+	oldKey, err := findSigningKey(ctx, user.ID, req.KeyID, statement, oldSignature)
+	if err == errSignCountRegressed {
+		recordAudit(r, auditKeyRotate, req.Handle, outcomeFailure, "sign count regressed")
+		respondLoginFailure(w, r, ch, req.Handle, "Authenticator signature counter went backwards")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if oldKey == nil {
+		recordAudit(r, auditKeyRotate, req.Handle, outcomeFailure, "invalid old key signature")
+		respondLoginFailure(w, r, ch, req.Handle, "Invalid old key signature")
+		return
+	}
+
+	// ...and the new key proves it is held by the same party
+	valid, err := verifySignature(ctx, req.PublicKey, req.KeyType, statement, newSignature)
+	if err != nil || !valid {
+		recordAudit(r, auditKeyRotate, req.Handle, outcomeFailure, "invalid new key signature")
+		respondLoginFailure(w, r, ch, req.Handle, "Invalid new key signature")
+		return
+	}
+
+	newKey := UserKey{
+		Name:      oldKey.Name,
+		PublicKey: req.PublicKey,
+		KeyType:   req.KeyType,
+	}
+	rot := keyRotation{
+		OldKeyID:     oldKey.ID,
+		Statement:    string(statement),
+		OldSignature: req.OldSignature,
+		NewSignature: req.NewSignature,
+	}
+	err = store.RotateKey(ctx, ch, user.ID, rot, &newKey)
+	switch err {
+	case nil:
+	case errChallengeUsed:
+		respondError(w, http.StatusBadRequest, "Challenge already used")
+		return
+	case errKeyRegistered:
+		respondError(w, http.StatusConflict, "Public key already registered")
+		return
+	case errNotFound:
+		respondError(w, http.StatusConflict, "Key was already rotated or removed")
+		return
+	default:
+		respondError(w, http.StatusInternalServerError, "Failed to rotate key")
+		return
+	}
+	recordLoginSuccess(r, req.Handle)
+	recordAudit(r, auditKeyRotate, req.Handle, outcomeSuccess, "key "+oldKey.ID+" replaced by "+newKey.ID)
+
+	respondJSON(w, http.StatusOK, RotateResponse{
+		Handle:    req.Handle,
+		OldKeyID:  oldKey.ID,
+		Key:       newKey,
+		RotatedAt: newKey.CreatedAt,
+	})
+}
+
+// keyHistoryHandler returns the rotation history of a handle, oldest first
+func keyHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	handle := mux.Vars(r)["handle"]
+
+	rotations, err := store.KeyRotations(r.Context(), handle)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"handle":    handle,
+		"rotations": rotations,
+	})
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRotateKey(t *testing.T) {
+	for _, backend := range []string{"memory", "sqlite", "postgres"} {
+		t.Run(backend, func(t *testing.T) {
+			setupTestStore(t, backend)
+			handle, oldKey := registerTestUser(t)
+			publicKey, newKey := newTestKey(t)
+
+			challenge := newChallenge(t, handle)
+			statement := rotationStatement(handle, challenge, "ed25519", publicKey)
+			var rotated RotateResponse
+			code := doJSON(t, rotateHandler, RotateRequest{
+				Handle:       handle,
+				Challenge:    challenge,
+				PublicKey:    publicKey,
+				KeyType:      "ed25519",
+				OldSignature: base64.StdEncoding.EncodeToString(ed25519.Sign(oldKey, statement)),
+				NewSignature: base64.StdEncoding.EncodeToString(ed25519.Sign(newKey, statement)),
+			}, &rotated)
+			if code != http.StatusOK {
+				t.Fatalf("/rotate returned %d", code)
+			}
+			if rotated.Key.PublicKey != publicKey {
+				t.Errorf("Rotated to %q, want %q", rotated.Key.PublicKey, publicKey)
+			}
+
+			if code := doJSON(t, verifyHandler, signedLogin(t, handle, oldKey), nil); code != http.StatusUnauthorized {
+				t.Errorf("Login with the old key returned %d, want 401", code)
+			}
+			if code := doJSON(t, verifyHandler, signedLogin(t, handle, newKey), nil); code != http.StatusOK {
+				t.Errorf("Login with the new key returned %d, want 200", code)
+			}
+
+			var history struct {
+				Rotations []KeyRotation `json:"rotations"`
+			}
+			code = doJSONVars(t, "192.0.2.1:1234", map[string]string{"handle": handle}, keyHistoryHandler, nil, &history)
+			if code != http.StatusOK {
+				t.Fatalf("/user/{handle}/rotations returned %d", code)
+			}
+			if len(history.Rotations) != 1 || history.Rotations[0].NewPublicKey != publicKey || history.Rotations[0].Statement != string(statement) {
+				t.Errorf("Rotation history is %+v", history.Rotations)
+			}
+		})
+	}
+}
+
+func TestRotateKeyLockout(t *testing.T) {
+	setupTestStore(t, "memory")
+	lockout = &loginLockout{
+		policy:  lockoutPolicy{Threshold: 2, Base: time.Minute, Max: time.Hour, Reset: time.Hour},
+		tracker: newMemoryFailureTracker(),
+	}
+	t.Cleanup(func() { lockout = nil })
+
+	handle, _ := registerTestUser(t)
+	_, attackerKey := newTestKey(t)
+	publicKey, newKey := newTestKey(t)
+	rotate := func(challenge string) int {
+		statement := rotationStatement(handle, challenge, "ed25519", publicKey)
+		return doJSONFrom(t, "203.0.113.66:1", rotateHandler, RotateRequest{
+			Handle:       handle,
+			Challenge:    challenge,
+			PublicKey:    publicKey,
+			KeyType:      "ed25519",
+			OldSignature: base64.StdEncoding.EncodeToString(ed25519.Sign(attackerKey, statement)),
+			NewSignature: base64.StdEncoding.EncodeToString(ed25519.Sign(newKey, statement)),
+		}, nil)
+	}
+
+	// Guessing the old key counts as a failed login
+	if code := rotate(newChallenge(t, handle)); code != http.StatusUnauthorized {
+		t.Fatalf("Rotation without the old key returned %d, want 401", code)
+	}
+	if code := rotate(newChallenge(t, handle)); code != http.StatusTooManyRequests {
+		t.Fatalf("Rotation that locked the handle returned %d, want 429", code)
+	}
+	if code := rotate("x"); code != http.StatusTooManyRequests {
+		t.Errorf("Rotation by a locked out address returned %d, want 429", code)
+	}
+}
+
+func TestRotateKeyRequests(t *testing.T) {
+	for _, backend := range []string{"memory", "sqlite", "postgres"} {
+		t.Run(backend, func(t *testing.T) {
+			setupTestStore(t, backend)
+			handle, oldKey := registerTestUser(t)
+			otherHandle, otherKey := registerTestUser(t)
+			_, strangerKey := newTestKey(t)
+
+			var otherKeys struct {
+				Keys []UserKey `json:"keys"`
+			}
+			if code := doAuthed(t, loginToken(t, otherHandle, otherKey), nil, listKeysHandler, &otherKeys); code != http.StatusOK {
+				t.Fatalf("/keys returned %d", code)
+			}
+
+			// A challenge that has already been redeemed by a login
+			login := signedLogin(t, handle, oldKey)
+			if code := doJSON(t, verifyHandler, login, nil); code != http.StatusOK {
+				t.Fatalf("/verify returned %d", code)
+			}
+			usedChallenge := login.Challenge
+
+			_, addedKey := addTestKey(t, handle, oldKey)
+
+			for _, tt := range []struct {
+				name      string
+				challenge func() string
+				keyID     string
+				oldKey    ed25519.PrivateKey
+				newSigner ed25519.PrivateKey // signs as the new key; the new key itself if nil
+				want      int
+			}{
+				{name: "old signature by an unregistered key", oldKey: strangerKey, want: http.StatusUnauthorized},
+				{name: "old signature by another handle's key", oldKey: otherKey, want: http.StatusUnauthorized},
+				{name: "key_id of another handle's key", keyID: otherKeys.Keys[0].ID, oldKey: otherKey, want: http.StatusUnauthorized},
+				{name: "new signature by another key", oldKey: oldKey, newSigner: strangerKey, want: http.StatusUnauthorized},
+				{name: "challenge issued to another handle", challenge: func() string { return newChallenge(t, otherHandle) }, oldKey: oldKey, want: http.StatusNotFound},
+				{name: "replayed challenge", challenge: func() string { return usedChallenge }, oldKey: oldKey, want: http.StatusBadRequest},
+				{name: "signed by both keys", oldKey: addedKey, want: http.StatusOK},
+			} {
+				t.Run(tt.name, func(t *testing.T) {
+					challenge := newChallenge(t, handle)
+					if tt.challenge != nil {
+						challenge = tt.challenge()
+					}
+					publicKey, newKey := newTestKey(t)
+					newSigner := newKey
+					if tt.newSigner != nil {
+						newSigner = tt.newSigner
+					}
+					statement := rotationStatement(handle, challenge, "ed25519", publicKey)
+					code := doJSON(t, rotateHandler, RotateRequest{
+						Handle:       handle,
+						Challenge:    challenge,
+						KeyID:        tt.keyID,
+						PublicKey:    publicKey,
+						KeyType:      "ed25519",
+						OldSignature: base64.StdEncoding.EncodeToString(ed25519.Sign(tt.oldKey, statement)),
+						NewSignature: base64.StdEncoding.EncodeToString(ed25519.Sign(newSigner, statement)),
+					}, nil)
+					if code != tt.want {
+						t.Fatalf("/rotate returned %d, want %d", code, tt.want)
+					}
+
+					want := http.StatusUnauthorized
+					if tt.want == http.StatusOK {
+						want = http.StatusOK
+					}
+					if code := doJSON(t, verifyHandler, signedLogin(t, handle, newKey), nil); code != want {
+						t.Errorf("Login with the new key returned %d, want %d", code, want)
+					}
+				})
+			}
+
+			// Only the rotated key was replaced
+			if code := doJSON(t, verifyHandler, signedLogin(t, handle, addedKey), nil); code != http.StatusUnauthorized {
+				t.Errorf("Login with the rotated key returned %d, want 401", code)
+			}
+			if code := doJSON(t, verifyHandler, signedLogin(t, handle, oldKey), nil); code != http.StatusOK {
+				t.Errorf("Login with the untouched key returned %d, want 200", code)
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// shuttingDown is set once a shutdown signal arrives, failing readiness so
+// load balancers stop sending requests
+var shuttingDown atomic.Bool
+
+// readinessTimeout bounds each dependency check of /readyz
+const readinessTimeout = 2 * time.Second
+
+// serve runs srv on ln until ctx is cancelled, normally by SIGINT or
+// SIGTERM. It then fails readiness for delay, stops accepting connections
+// and waits up to timeout for in-flight requests to finish.
+func serve(ctx context.Context, srv *http.Server, ln net.Listener, delay, timeout time.Duration) error {
+	errc := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			errc <- srv.ServeTLS(ln, "", "")
+		} else {
+			errc <- srv.Serve(ln)
+		}
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("Shutting down", "drain_delay", delay.String(), "timeout", timeout.String())
+	shuttingDown.Store(true)
+	time.Sleep(delay)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		srv.Close()
+		return fmt.Errorf("requests still running after %s: %w", timeout, err)
+	}
+	return nil
+}
+
+// livezHandler reports that the process is up, whatever its dependencies
+func livezHandler(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readyzHandler reports whether this replica should get traffic: it is not
+// shutting down, its storage backend answers and every migration has been
+// applied
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if shuttingDown.Load() {
+		respondJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "shutting down"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	ready := true
+	checks := map[string]string{"database": "ok"}
+	if err := store.Ping(ctx); err != nil {
+		slog.WarnContext(ctx, "Readiness check failed", "check", "database", "error", err)
+		checks["database"] = "unreachable"
+		ready = false
+	} else {
+		checks["migrations"] = "ok"
+		pending, err := store.PendingMigrations(ctx)
+		switch {
+		case err != nil:
+			slog.WarnContext(ctx, "Readiness check failed", "check", "migrations", "error", err)
+			checks["migrations"] = "unknown"
+			ready = false
+		case pending > 0:
+			checks["migrations"] = strconv.Itoa(pending) + " pending"
+			ready = false
+		}
+	}
+
+	if !ready {
+		respondJSON(w, http.StatusServiceUnavailable, map[string]interface{}{"status": "not ready", "checks": checks})
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"status": "ready", "checks": checks})
+}
+
+// certReloader serves a TLS certificate from files, picking up renewals
+// without a restart
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// loadCertificate reads a PEM certificate chain and its private key
+func loadCertificate(certFile, keyFile string) (*certReloader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("TLS needs both a certificate and a key file")
+	}
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload reads the files again if either changed since the last load. A
+// pair that doesn't load leaves the current certificate in place.
+func (c *certReloader) reload() error {
+	var modTime time.Time
+	for _, path := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("failed to read TLS file: %w", err)
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+
+	c.mu.RLock()
+	unchanged := c.cert != nil && modTime.Equal(c.modTime)
+	c.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	c.mu.Lock()
+	c.cert = &cert
+	c.modTime = modTime
+	c.mu.Unlock()
+	slog.Info("Loaded TLS certificate", "file", c.certFile)
+	return nil
+}
+
+// watch periodically reloads the certificate so renewals are picked up
+func (c *certReloader) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := c.reload(); err != nil {
+			slog.Error("Failed to reload TLS certificate", "error", err)
+		}
+	}
+}
+
+// getCertificate is the tls.Config hook serving the current certificate
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReadyz(t *testing.T) {
+	setupTestStore(t, "sqlite")
+	t.Cleanup(func() { shuttingDown.Store(false) })
+
+	probe := func() int {
+		rec := httptest.NewRecorder()
+		readyzHandler(rec, httptest.NewRequest("GET", "/readyz", nil))
+		return rec.Code
+	}
+	if code := probe(); code != http.StatusOK {
+		t.Fatalf("Readiness with a working database returned %d, want 200", code)
+	}
+
+	shuttingDown.Store(true)
+	if code := probe(); code != http.StatusServiceUnavailable {
+		t.Errorf("Readiness while shutting down returned %d, want 503", code)
+	}
+	shuttingDown.Store(false)
+
+	store.(*sqliteStore).db.Close()
+	if code := probe(); code != http.StatusServiceUnavailable {
+		t.Errorf("Readiness without a database returned %d, want 503", code)
+	}
+	rec := httptest.NewRecorder()
+	livezHandler(rec, httptest.NewRequest("GET", "/livez", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Liveness without a database returned %d, want 200", rec.Code)
+	}
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	t.Cleanup(func() { shuttingDown.Store(false) })
+
+	started, release := make(chan struct{}), make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(w, "done")
+	})}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- serve(ctx, srv, ln, 0, 5*time.Second) }()
+
+	type result struct {
+		body string
+		err  error
+	}
+	inFlight := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String())
+		if err != nil {
+			inFlight <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		inFlight <- result{string(b), err}
+	}()
+	<-started
+
+	// The signal stops new connections but lets the request finish
+	cancel()
+	for !shuttingDown.Load() {
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case err := <-served:
+		t.Fatalf("serve returned %v with a request in flight", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if res := <-inFlight; res.err != nil || res.body != "done" {
+		t.Fatalf("In-flight request got %q, %v", res.body, res.err)
+	}
+	if err := <-served; err != nil {
+		t.Fatalf("serve returned %v", err)
+	}
+	if _, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+		t.Error("Server still accepts connections after shutdown")
+	}
+}
+
+// writeTestCert writes a self-signed certificate for name and its key
+func writeTestCert(t *testing.T, certFile, keyFile, name string) {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalPKCS8PrivateKey(key)
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600)
+}
+
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeTestCert(t, certFile, keyFile, "old.authgrid.test")
+
+	certs, err := loadCertificate(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("loadCertificate failed: %v", err)
+	}
+	commonName := func() string {
+		cert, _ := certs.getCertificate(&tls.ClientHelloInfo{})
+		leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+		return leaf.Subject.CommonName
+	}
+
+	// A broken renewal keeps the old certificate
+	later := time.Now().Add(time.Minute)
+	os.WriteFile(keyFile, []byte("not a key"), 0600)
+	os.Chtimes(keyFile, later, later)
+	if err := certs.reload(); err == nil {
+		t.Error("reload accepted a broken key")
+	}
+	if name := commonName(); name != "old.authgrid.test" {
+		t.Errorf("Serving %s after a broken renewal, want the old certificate", name)
+	}
+
+	later = later.Add(time.Minute)
+	writeTestCert(t, certFile, keyFile, "new.authgrid.test")
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+	if err := certs.reload(); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	if name := commonName(); name != "new.authgrid.test" {
+		t.Errorf("Serving %s after renewal, want new.authgrid.test", name)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Session represents an active login session as shown to its owner
+type Session struct {
+	ID           string     `json:"id"`
+	CreatedAt    time.Time  `json:"created_at"`
+	ExpiresAt    time.Time  `json:"expires_at"`
+	LastActivity *time.Time `json:"last_activity,omitempty"`
+	UserAgent    string     `json:"user_agent,omitempty"`
+	IP           string     `json:"ip,omitempty"`
+	Current      bool       `json:"current"`
+}
+
+// authSession identifies the session behind an authenticated request
+type authSession struct {
+	ID     string
+	UserID string
+	Handle string
+}
+
+type contextKey string
+
+const sessionContextKey contextKey = "session"
+
+// hashToken returns the hex SHA-256 of a token; only hashes are stored
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newSession is the result of creating a session at login
+type newSession struct {
+	ID               string
+	RefreshToken     string
+	RefreshExpiresAt time.Time
+}
+
+// createSession redeems a login challenge and records the newly issued
+// access token for a user together with the first refresh token of the
+// session. The session lives as long as its refresh token does. The key that
+// signed in is recorded so removing it can end the session; the relying
+// party's client ID and requested scope are kept for token introspection.
+func createSession(ch *issuedChallenge, userID, keyID, token, clientID, scope string, r *http.Request) (*newSession, error) {
+	metadata := map[string]string{
+		"user_agent": r.UserAgent(),
+		"ip":         clientIP(r),
+		"key_id":     keyID,
+	}
+	if clientID != "" {
+		metadata["client_id"] = clientID
+	}
+	if scope != "" {
+		metadata["scope"] = scope
+	}
+
+	refreshToken, err := generateRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+
+	rec := &sessionRecord{
+		UserID:           userID,
+		KeyID:            keyID,
+		TokenHash:        hashToken(token),
+		RefreshTokenHash: hashToken(refreshToken),
+		ExpiresAt:        time.Now().Add(currentConfig().Tokens.RefreshTokenTTL),
+		Metadata:         metadata,
+	}
+	if err := store.Login(r.Context(), ch, rec); err != nil {
+		return nil, err
+	}
+
+	return &newSession{
+		ID:               rec.ID,
+		RefreshToken:     refreshToken,
+		RefreshExpiresAt: rec.ExpiresAt,
+	}, nil
+}
+
+// requireSession authenticates a request by its bearer token. The token must
+// carry a valid signature and belong to a session that has not been revoked.
+func requireSession(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		authz := r.Header.Get("Authorization")
+		if !strings.HasPrefix(authz, "Bearer ") {
+			respondError(w, http.StatusUnauthorized, "Missing bearer token")
+			return
+		}
+		token := strings.TrimPrefix(authz, "Bearer ")
+
+		claims, err := verifyToken(token)
+		if err != nil {
+			respondError(w, http.StatusUnauthorized, "Invalid token")
+			return
+		}
+
+		sess, err := store.SessionByToken(r.Context(), hashToken(token))
+		if err == errNotFound || (err == nil && sess.Handle != claims.Subject) {
+			respondError(w, http.StatusUnauthorized, "Session revoked or expired")
+			return
+		}
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "Database error")
+			return
+		}
+
+		setRequestHandle(r, sess.Handle)
+		ctx := context.WithValue(r.Context(), sessionContextKey, sess)
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// currentSession returns the session attached by requireSession
+func currentSession(r *http.Request) *authSession {
+	sess, _ := r.Context().Value(sessionContextKey).(*authSession)
+	return sess
+}
+
+// logoutHandler revokes the session used to make the request
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	sess := currentSession(r)
+
+	if err := store.RevokeSession(r.Context(), sess.UserID, sess.ID); err != nil && err != errNotFound {
+		respondError(w, http.StatusInternalServerError, "Failed to revoke session")
+		return
+	}
+	recordAudit(r, auditLogout, sess.Handle, outcomeSuccess, "session "+sess.ID)
+
+	respondJSON(w, http.StatusOK, map[string]bool{"revoked": true})
+}
+
+// listSessionsHandler returns the caller's active sessions
+func listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	sess := currentSession(r)
+
+	sessions, err := store.ListSessions(r.Context(), sess.UserID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == sess.ID
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"sessions": sessions,
+	})
+}
+
+// revokeSessionHandler revokes one of the caller's sessions by ID
+func revokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	sess := currentSession(r)
+	id := mux.Vars(r)["id"]
+
+	err := store.RevokeSession(r.Context(), sess.UserID, id)
+	if err == errNotFound {
+		respondError(w, http.StatusNotFound, "Session not found")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to revoke session")
+		return
+	}
+	recordAudit(r, auditSessionRevoke, sess.Handle, outcomeSuccess, "session "+id)
+
+	respondJSON(w, http.StatusOK, map[string]bool{"revoked": true})
+}
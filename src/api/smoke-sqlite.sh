@@ -0,0 +1,25 @@
+#!/bin/bash
+# Smoke test: build the Docker image and check it serves from a SQLite store.
+# A binary built without cgo can't open SQLite and never becomes ready.
+set -euo pipefail
+cd "$(dirname "$0")"
+
+image=${IMAGE:-authgrid-api:smoke}
+docker build -t "$image" .
+
+id=$(docker run -d -p 127.0.0.1::8080 -e DATABASE_URL=sqlite:///root/authgrid.db "$image")
+trap 'docker rm -f "$id" >/dev/null' EXIT
+port=$(docker port "$id" 8080/tcp | head -n 1 | cut -d: -f2)
+
+for _ in $(seq 30); do
+    if curl -fsS "http://127.0.0.1:$port/readyz"; then
+        echo ""
+        echo "✅ Image serves from SQLite"
+        exit 0
+    fi
+    sleep 1
+done
+
+echo "❌ Image did not become ready with SQLite storage"
+docker logs "$id"
+exit 1
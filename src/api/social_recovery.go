@@ -0,0 +1,576 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// SetGuardiansRequest replaces a handle's guardians. Signature is made by an
+// existing device key over setGuardiansStatement. An empty guardian list with
+// a zero threshold turns social recovery off.
+type SetGuardiansRequest struct {
+	Handle    string   `json:"handle"`
+	Challenge string   `json:"challenge"`
+	Signature string   `json:"signature"`
+	KeyID     string   `json:"key_id,omitempty"`
+	Guardians []string `json:"guardians"` // guardian handles
+	Threshold int      `json:"threshold"`
+}
+
+// StartSocialRecoveryRequest proposes a new key for a handle. Signature is
+// made by the new key over socialRecoveryStatement, with a challenge issued
+// for the handle.
+type StartSocialRecoveryRequest struct {
+	Handle    string `json:"handle"`
+	Challenge string `json:"challenge"`
+	PublicKey string `json:"public_key"` // new device key, base64 encoded
+	KeyType   string `json:"key_type"`
+	Name      string `json:"name,omitempty"`
+	Signature string `json:"signature"`
+}
+
+// ApproveSocialRecoveryRequest is a guardian's approval of a recovery. The
+// guardian requests a challenge for their own handle and signs
+// approveRecoveryStatement with one of their keys.
+type ApproveSocialRecoveryRequest struct {
+	Guardian  string `json:"guardian"`
+	Challenge string `json:"challenge"`
+	Signature string `json:"signature"`
+	KeyID     string `json:"key_id,omitempty"`
+}
+
+// CancelSocialRecoveryRequest cancels a pending recovery. Signature is made
+// by one of the recovered handle's own keys over cancelRecoveryStatement.
+type CancelSocialRecoveryRequest struct {
+	Challenge string `json:"challenge"`
+	Signature string `json:"signature"`
+	KeyID     string `json:"key_id,omitempty"`
+}
+
+// SocialRecovery is the state of a social recovery request
+type SocialRecovery struct {
+	ID          string     `json:"id"`
+	Handle      string     `json:"handle"`
+	PublicKey   string     `json:"public_key"`
+	KeyType     string     `json:"key_type"`
+	Status      string     `json:"status"` // pending, cancelled or completed
+	Approvals   int        `json:"approvals"`
+	Threshold   int        `json:"threshold"`
+	CreatedAt   time.Time  `json:"created_at"`
+	EffectiveAt *time.Time `json:"effective_at"` // nil until enough guardians approve
+
+	userID string
+	name   string
+}
+
+func setGuardiansStatement(handle, challenge string, threshold int, guardians []string) []byte {
+	return []byte("authgrid-set-guardians\n" + handle + "\n" + challenge + "\n" +
+		strconv.Itoa(threshold) + "\n" + strings.Join(guardians, "\n"))
+}
+
+func socialRecoveryStatement(handle, challenge, keyType, publicKey string) []byte {
+	return []byte("authgrid-social-recovery\n" + handle + "\n" + challenge + "\n" + keyType + "\n" + publicKey)
+}
+
+func approveRecoveryStatement(rec *SocialRecovery, challenge string) []byte {
+	return []byte("authgrid-approve-recovery\n" + rec.ID + "\n" + rec.Handle + "\n" +
+		rec.KeyType + "\n" + rec.PublicKey + "\n" + challenge)
+}
+
+func cancelRecoveryStatement(recoveryID, challenge string) []byte {
+	return []byte("authgrid-cancel-recovery\n" + recoveryID + "\n" + challenge)
+}
+
+// setGuardiansHandler replaces the guardians and threshold of a handle.
+// Pending social recoveries are cancelled since they were approved under
+// the old policy.
+func setGuardiansHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req SetGuardiansRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if req.Handle == "" || req.Challenge == "" || req.Signature == "" {
+		respondError(w, http.StatusBadRequest, "Handle, challenge, and signature are required")
+		return
+	}
+
+	if !checkLockout(w, r, req.Handle) {
+		return
+	}
+
+	disable := len(req.Guardians) == 0 && req.Threshold == 0
+	if !disable && (req.Threshold < 1 || req.Threshold > len(req.Guardians)) {
+		respondError(w, http.StatusBadRequest, "Threshold must be between 1 and the number of guardians")
+		return
+	}
+	seen := make(map[string]bool)
+	for _, g := range req.Guardians {
+		if g == req.Handle {
+			respondError(w, http.StatusBadRequest, "A handle cannot be its own guardian")
+			return
+		}
+		if seen[g] {
+			respondError(w, http.StatusBadRequest, "Duplicate guardian: "+g)
+			return
+		}
+		seen[g] = true
+	}
+
+	user, err := store.UserByHandle(ctx, req.Handle)
+	if err == errNotFound {
+		respondError(w, http.StatusNotFound, "Handle not found")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	guardianIDs := make([]string, 0, len(req.Guardians))
+	for _, g := range req.Guardians {
+		guardian, err := store.UserByHandle(ctx, g)
+		if err == errNotFound {
+			respondError(w, http.StatusBadRequest, "Guardian not found: "+g)
+			return
+		}
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "Database error")
+			return
+		}
+		guardianIDs = append(guardianIDs, guardian.ID)
+	}
+
+	ch, ok := checkChallenge(w, r, req.Handle, req.Challenge)
+	if !ok {
+		return
+	}
+
+	signatureBytes, err := base64.StdEncoding.DecodeString(req.Signature)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid signature encoding")
+		return
+	}
+
+	statement := setGuardiansStatement(req.Handle, req.Challenge, req.Threshold, req.Guardians)
+	signer, err := findSigningKey(ctx, user.ID, req.KeyID, statement, signatureBytes)
+	if err == errSignCountRegressed {
+		recordAudit(r, auditGuardiansSet, req.Handle, outcomeFailure, "sign count regressed")
+		respondLoginFailure(w, r, ch, req.Handle, "Authenticator signature counter went backwards")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if signer == nil {
+		recordAudit(r, auditGuardiansSet, req.Handle, outcomeFailure, "invalid signature")
+		respondLoginFailure(w, r, ch, req.Handle, "Invalid signature")
+		return
+	}
+
+	err = store.SetGuardians(ctx, ch, user.ID, guardianIDs, req.Threshold)
+	if err == errChallengeUsed {
+		respondError(w, http.StatusBadRequest, "Challenge already used")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to update guardians")
+		return
+	}
+	recordLoginSuccess(r, req.Handle)
+	recordAudit(r, auditGuardiansSet, req.Handle, outcomeSuccess,
+		strconv.Itoa(req.Threshold)+" of "+strings.Join(req.Guardians, ", "))
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"guardians": req.Guardians,
+		"threshold": req.Threshold,
+	})
+}
+
+// listGuardiansHandler returns the caller's guardians and threshold
+func listGuardiansHandler(w http.ResponseWriter, r *http.Request) {
+	sess := currentSession(r)
+
+	guardians, threshold, err := store.Guardians(r.Context(), sess.UserID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"guardians": guardians,
+		"threshold": threshold,
+	})
+}
+
+// startSocialRecoveryHandler opens a recovery request proposing a new key
+// for a handle that has guardians
+func startSocialRecoveryHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req StartSocialRecoveryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if req.Handle == "" || req.Challenge == "" || req.Signature == "" {
+		respondError(w, http.StatusBadRequest, "Handle, challenge, and signature are required")
+		return
+	}
+
+	if _, err := validatePublicKey(req.PublicKey, req.KeyType); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	user, err := store.UserByHandle(ctx, req.Handle)
+	if err == errNotFound {
+		respondError(w, http.StatusNotFound, "Handle not found")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	_, threshold, err := store.Guardians(ctx, user.ID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if threshold == 0 {
+		respondError(w, http.StatusBadRequest, "Handle has no guardians")
+		return
+	}
+
+	ch, ok := checkChallenge(w, r, req.Handle, req.Challenge)
+	if !ok {
+		return
+	}
+
+	signatureBytes, err := base64.StdEncoding.DecodeString(req.Signature)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid signature encoding")
+		return
+	}
+
+	// The proposed key proves it is held by whoever is asking
+	statement := socialRecoveryStatement(req.Handle, req.Challenge, req.KeyType, req.PublicKey)
+	valid, err := verifySignature(ctx, req.PublicKey, req.KeyType, statement, signatureBytes)
+	if err != nil || !valid {
+		recordAudit(r, auditSocialRecovery, req.Handle, outcomeFailure, "invalid new key signature")
+		respondError(w, http.StatusUnauthorized, "Invalid signature")
+		return
+	}
+
+	rec := &SocialRecovery{
+		PublicKey: req.PublicKey,
+		KeyType:   req.KeyType,
+		userID:    user.ID,
+		name:      req.Name,
+	}
+	err = store.CreateSocialRecovery(ctx, ch, rec)
+	if err == errChallengeUsed {
+		respondError(w, http.StatusBadRequest, "Challenge already used")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to create recovery request")
+		return
+	}
+
+	slog.InfoContext(ctx, "Social recovery opened", "recovery_id", rec.ID, "handle_hash", handleHash(req.Handle))
+	recordAudit(r, auditSocialRecovery, req.Handle, outcomeSuccess, "request "+rec.ID)
+
+	rec, err = store.SocialRecovery(ctx, rec.ID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	respondJSON(w, http.StatusCreated, rec)
+}
+
+// getSocialRecoveryHandler returns the public state of a recovery request
+func getSocialRecoveryHandler(w http.ResponseWriter, r *http.Request) {
+	rec, err := store.SocialRecovery(r.Context(), mux.Vars(r)["id"])
+	if err == errNotFound {
+		respondError(w, http.StatusNotFound, "Recovery request not found")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	respondJSON(w, http.StatusOK, rec)
+}
+
+// listSocialRecoveriesHandler returns pending recoveries against the caller,
+// so they can cancel any they did not start
+func listSocialRecoveriesHandler(w http.ResponseWriter, r *http.Request) {
+	sess := currentSession(r)
+
+	recoveries, err := store.PendingSocialRecoveries(r.Context(), sess.UserID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"recoveries": recoveries,
+	})
+}
+
+// isGuardian reports whether handle is one of the guardians of userID
+func isGuardian(ctx context.Context, userID, handle string) (bool, error) {
+	guardians, _, err := store.Guardians(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	for _, g := range guardians {
+		if g == handle {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// approveSocialRecoveryHandler records a guardian's signed approval
+func approveSocialRecoveryHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req ApproveSocialRecoveryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if req.Guardian == "" || req.Challenge == "" || req.Signature == "" {
+		respondError(w, http.StatusBadRequest, "Guardian, challenge, and signature are required")
+		return
+	}
+
+	if !checkLockout(w, r, req.Guardian) {
+		return
+	}
+
+	rec, err := store.SocialRecovery(ctx, mux.Vars(r)["id"])
+	if err == errNotFound {
+		respondError(w, http.StatusNotFound, "Recovery request not found")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if rec.Status != "pending" {
+		respondError(w, http.StatusConflict, "Recovery request is "+rec.Status)
+		return
+	}
+
+	ok, err := isGuardian(ctx, rec.userID, req.Guardian)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if !ok {
+		respondError(w, http.StatusForbidden, "Not a guardian of this handle")
+		return
+	}
+	guardian, err := store.UserByHandle(ctx, req.Guardian)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	ch, ok := checkChallenge(w, r, req.Guardian, req.Challenge)
+	if !ok {
+		return
+	}
+
+	signatureBytes, err := base64.StdEncoding.DecodeString(req.Signature)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid signature encoding")
+		return
+	}
+
+	signer, err := findSigningKey(ctx, guardian.ID, req.KeyID, approveRecoveryStatement(rec, req.Challenge), signatureBytes)
+	if err == errSignCountRegressed {
+		recordAudit(r, auditSocialApprove, rec.Handle, outcomeFailure, "request "+rec.ID+": sign count of guardian "+req.Guardian+" regressed")
+		respondLoginFailure(w, r, ch, req.Guardian, "Authenticator signature counter went backwards")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if signer == nil {
+		recordAudit(r, auditSocialApprove, rec.Handle, outcomeFailure, "request "+rec.ID+": invalid signature by guardian "+req.Guardian)
+		respondLoginFailure(w, r, ch, req.Guardian, "Invalid signature")
+		return
+	}
+
+	err = store.ApproveSocialRecovery(ctx, ch, rec.ID, guardian.ID, req.Signature, currentConfig().Tokens.SocialRecoveryDelay)
+	switch err {
+	case nil:
+	case errChallengeUsed:
+		respondError(w, http.StatusBadRequest, "Challenge already used")
+		return
+	case errRecoveryClosed:
+		respondError(w, http.StatusConflict, "Recovery request is no longer pending")
+		return
+	default:
+		respondError(w, http.StatusInternalServerError, "Failed to record approval")
+		return
+	}
+	recordLoginSuccess(r, req.Guardian)
+	recordAudit(r, auditSocialApprove, rec.Handle, outcomeSuccess, "request "+rec.ID+" approved by "+req.Guardian)
+
+	rec, err = store.SocialRecovery(ctx, rec.ID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	respondJSON(w, http.StatusOK, rec)
+}
+
+// cancelSocialRecoveryHandler lets the handle's own keys stop a recovery
+// during the waiting period
+func cancelSocialRecoveryHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req CancelSocialRecoveryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if req.Challenge == "" || req.Signature == "" {
+		respondError(w, http.StatusBadRequest, "Challenge and signature are required")
+		return
+	}
+
+	rec, err := store.SocialRecovery(ctx, mux.Vars(r)["id"])
+	if err == errNotFound {
+		respondError(w, http.StatusNotFound, "Recovery request not found")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if rec.Status != "pending" {
+		respondError(w, http.StatusConflict, "Recovery request is "+rec.Status)
+		return
+	}
+
+	if !checkLockout(w, r, rec.Handle) {
+		return
+	}
+
+	ch, ok := checkChallenge(w, r, rec.Handle, req.Challenge)
+	if !ok {
+		return
+	}
+
+	signatureBytes, err := base64.StdEncoding.DecodeString(req.Signature)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid signature encoding")
+		return
+	}
+
+	signer, err := findSigningKey(ctx, rec.userID, req.KeyID, cancelRecoveryStatement(rec.ID, req.Challenge), signatureBytes)
+	if err == errSignCountRegressed {
+		recordAudit(r, auditSocialCancel, rec.Handle, outcomeFailure, "request "+rec.ID+": sign count regressed")
+		respondLoginFailure(w, r, ch, rec.Handle, "Authenticator signature counter went backwards")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if signer == nil {
+		recordAudit(r, auditSocialCancel, rec.Handle, outcomeFailure, "request "+rec.ID+": invalid signature")
+		respondLoginFailure(w, r, ch, rec.Handle, "Invalid signature")
+		return
+	}
+
+	err = store.CancelSocialRecovery(ctx, ch, rec.ID)
+	switch err {
+	case nil:
+	case errChallengeUsed:
+		respondError(w, http.StatusBadRequest, "Challenge already used")
+		return
+	case errRecoveryClosed:
+		respondError(w, http.StatusConflict, "Recovery request is no longer pending")
+		return
+	default:
+		respondError(w, http.StatusInternalServerError, "Failed to cancel recovery")
+		return
+	}
+
+	recordLoginSuccess(r, rec.Handle)
+	slog.InfoContext(ctx, "Social recovery cancelled", "recovery_id", rec.ID, "handle_hash", handleHash(rec.Handle), "key_id", signer.ID)
+	recordAudit(r, auditSocialCancel, rec.Handle, outcomeSuccess, "request "+rec.ID+" cancelled by key "+signer.ID)
+	respondJSON(w, http.StatusOK, map[string]bool{"cancelled": true})
+}
+
+// completeSocialRecoveryHandler enrolls the proposed key once enough
+// guardians have approved and the waiting period is over. Every existing
+// key and session of the handle is revoked.
+func completeSocialRecoveryHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rec, err := store.SocialRecovery(ctx, mux.Vars(r)["id"])
+	if err == errNotFound {
+		respondError(w, http.StatusNotFound, "Recovery request not found")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if rec.Status != "pending" {
+		respondError(w, http.StatusConflict, "Recovery request is "+rec.Status)
+		return
+	}
+	if rec.Threshold == 0 || rec.Approvals < rec.Threshold {
+		respondError(w, http.StatusForbidden, "Not enough guardian approvals")
+		return
+	}
+
+	key := &UserKey{Name: rec.name, PublicKey: rec.PublicKey, KeyType: rec.KeyType}
+	err = store.CompleteSocialRecovery(ctx, rec.ID, key)
+	switch err {
+	case nil:
+	case errNotFound:
+		respondError(w, http.StatusNotFound, "Recovery request not found")
+		return
+	case errRecoveryClosed:
+		respondError(w, http.StatusConflict, "Recovery request is no longer pending")
+		return
+	case errRecoveryWaiting:
+		respondError(w, http.StatusForbidden, "Waiting period has not ended")
+		return
+	case errKeyRegistered:
+		respondError(w, http.StatusConflict, "Public key already registered")
+		return
+	default:
+		respondError(w, http.StatusInternalServerError, "Failed to enroll key")
+		return
+	}
+
+	slog.InfoContext(ctx, "Handle recovered via guardians", "recovery_id", rec.ID, "handle_hash", handleHash(rec.Handle))
+	recordAudit(r, auditSocialRecovered, rec.Handle, outcomeSuccess, "request "+rec.ID)
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"handle": rec.Handle,
+		"key":    key,
+	})
+}
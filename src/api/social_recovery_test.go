@@ -0,0 +1,509 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// guardedUser is a registered handle with guardians
+type guardedUser struct {
+	handle       string
+	key          ed25519.PrivateKey
+	guardians    []string
+	guardianKeys []ed25519.PrivateKey
+}
+
+// setupGuardians registers a handle and n guardians and sets a threshold
+func setupGuardians(t *testing.T, n, threshold int) *guardedUser {
+	t.Helper()
+	u := &guardedUser{}
+	u.handle, u.key = registerTestUser(t)
+	for i := 0; i < n; i++ {
+		handle, key := registerTestUser(t)
+		u.guardians = append(u.guardians, handle)
+		u.guardianKeys = append(u.guardianKeys, key)
+	}
+
+	challenge := newChallenge(t, u.handle)
+	code := doJSON(t, setGuardiansHandler, SetGuardiansRequest{
+		Handle:    u.handle,
+		Challenge: challenge,
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(u.key, setGuardiansStatement(u.handle, challenge, threshold, u.guardians))),
+		Guardians: u.guardians,
+		Threshold: threshold,
+	}, nil)
+	if code != http.StatusOK {
+		t.Fatalf("/guardians returned %d", code)
+	}
+	return u
+}
+
+// startRecovery proposes a new key for handle
+func startRecovery(t *testing.T, handle string) (*SocialRecovery, ed25519.PrivateKey) {
+	t.Helper()
+	publicKey, newKey := newTestKey(t)
+	challenge := newChallenge(t, handle)
+	var rec SocialRecovery
+	code := doJSON(t, startSocialRecoveryHandler, StartSocialRecoveryRequest{
+		Handle:    handle,
+		Challenge: challenge,
+		PublicKey: publicKey,
+		KeyType:   "ed25519",
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(newKey, socialRecoveryStatement(handle, challenge, "ed25519", publicKey))),
+	}, &rec)
+	if code != http.StatusCreated {
+		t.Fatalf("/social-recovery returned %d", code)
+	}
+	return &rec, newKey
+}
+
+// approveRecovery has a guardian approve rec, updating it from the response
+func approveRecovery(t *testing.T, rec *SocialRecovery, guardian string, key ed25519.PrivateKey) int {
+	t.Helper()
+	challenge := newChallenge(t, guardian)
+	return doJSONVars(t, "192.0.2.1:1234", map[string]string{"id": rec.ID}, approveSocialRecoveryHandler, ApproveSocialRecoveryRequest{
+		Guardian:  guardian,
+		Challenge: challenge,
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(key, approveRecoveryStatement(rec, challenge))),
+	}, rec)
+}
+
+func completeRecovery(t *testing.T, rec *SocialRecovery) int {
+	t.Helper()
+	return doJSONVars(t, "192.0.2.1:1234", map[string]string{"id": rec.ID}, completeSocialRecoveryHandler, nil, nil)
+}
+
+func TestSocialRecovery(t *testing.T) {
+	for _, backend := range []string{"memory", "sqlite", "postgres"} {
+		t.Run(backend, func(t *testing.T) {
+			setupTestStore(t, backend)
+			setTestConfig(t, func(c *Config) { c.Tokens.SocialRecoveryDelay = 0 })
+			u := setupGuardians(t, 3, 2)
+			rec, newKey := startRecovery(t, u.handle)
+			if rec.Status != "pending" || rec.Threshold != 2 || rec.Approvals != 0 || rec.EffectiveAt != nil {
+				t.Fatalf("New recovery is %+v", rec)
+			}
+
+			// One approval is below the threshold, so the waiting period
+			// hasn't started
+			if code := approveRecovery(t, rec, u.guardians[0], u.guardianKeys[0]); code != http.StatusOK {
+				t.Fatalf("/social-recovery/{id}/approve returned %d", code)
+			}
+			if rec.Approvals != 1 || rec.EffectiveAt != nil {
+				t.Errorf("After one approval the recovery is %+v", rec)
+			}
+			if code := completeRecovery(t, rec); code != http.StatusForbidden {
+				t.Errorf("Completing below the threshold returned %d, want 403", code)
+			}
+
+			// Approving twice doesn't count twice
+			approveRecovery(t, rec, u.guardians[0], u.guardianKeys[0])
+			if rec.Approvals != 1 {
+				t.Errorf("A repeated approval counted: %d approvals", rec.Approvals)
+			}
+
+			if code := approveRecovery(t, rec, u.guardians[1], u.guardianKeys[1]); code != http.StatusOK {
+				t.Fatalf("/social-recovery/{id}/approve returned %d", code)
+			}
+			if rec.Approvals != 2 || rec.EffectiveAt == nil {
+				t.Fatalf("After reaching the threshold the recovery is %+v", rec)
+			}
+
+			if code := completeRecovery(t, rec); code != http.StatusOK {
+				t.Fatalf("/social-recovery/{id}/complete returned %d", code)
+			}
+			if code := completeRecovery(t, rec); code != http.StatusConflict {
+				t.Errorf("Completing twice returned %d, want 409", code)
+			}
+			if code := doJSON(t, verifyHandler, signedLogin(t, u.handle, u.key), nil); code != http.StatusUnauthorized {
+				t.Errorf("Login with the lost key returned %d, want 401", code)
+			}
+			if code := doJSON(t, verifyHandler, signedLogin(t, u.handle, newKey), nil); code != http.StatusOK {
+				t.Errorf("Login with the recovered key returned %d, want 200", code)
+			}
+		})
+	}
+}
+
+func TestSocialRecoveryWaitingPeriod(t *testing.T) {
+	for _, backend := range []string{"memory", "sqlite", "postgres"} {
+		t.Run(backend, func(t *testing.T) {
+			setupTestStore(t, backend)
+			setTestConfig(t, func(c *Config) { c.Tokens.SocialRecoveryDelay = time.Hour })
+			u := setupGuardians(t, 2, 1)
+			rec, _ := startRecovery(t, u.handle)
+
+			// The delay counts from the approval that reaches the threshold
+			approved := time.Now()
+			if code := approveRecovery(t, rec, u.guardians[0], u.guardianKeys[0]); code != http.StatusOK {
+				t.Fatalf("/social-recovery/{id}/approve returned %d", code)
+			}
+			if rec.EffectiveAt == nil {
+				t.Fatal("Reaching the threshold didn't start the waiting period")
+			}
+			if d := rec.EffectiveAt.Sub(approved); d < time.Hour-time.Minute || d > time.Hour+time.Minute {
+				t.Errorf("Waiting period ends %v after the approval, want 1h", d)
+			}
+
+			// A later approval doesn't restart it
+			effectiveAt := *rec.EffectiveAt
+			approveRecovery(t, rec, u.guardians[1], u.guardianKeys[1])
+			if rec.EffectiveAt == nil || !rec.EffectiveAt.Equal(effectiveAt) {
+				t.Errorf("Another approval moved the waiting period to %v", rec.EffectiveAt)
+			}
+
+			if code := completeRecovery(t, rec); code != http.StatusForbidden {
+				t.Errorf("Completing during the waiting period returned %d, want 403", code)
+			}
+
+			// The owner's key cancels it
+			challenge := newChallenge(t, u.handle)
+			code := doJSONVars(t, "192.0.2.1:1234", map[string]string{"id": rec.ID}, cancelSocialRecoveryHandler, CancelSocialRecoveryRequest{
+				Challenge: challenge,
+				Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(u.key, cancelRecoveryStatement(rec.ID, challenge))),
+			}, nil)
+			if code != http.StatusOK {
+				t.Fatalf("/social-recovery/{id}/cancel returned %d", code)
+			}
+			if code := completeRecovery(t, rec); code != http.StatusConflict {
+				t.Errorf("Completing a cancelled recovery returned %d, want 409", code)
+			}
+			if code := doJSON(t, verifyHandler, signedLogin(t, u.handle, u.key), nil); code != http.StatusOK {
+				t.Errorf("Login with the owner's key after cancelling returned %d, want 200", code)
+			}
+		})
+	}
+}
+
+func TestStartSocialRecoveryReplay(t *testing.T) {
+	for _, backend := range []string{"memory", "sqlite", "postgres"} {
+		t.Run(backend, func(t *testing.T) {
+			setupTestStore(t, backend)
+			u := setupGuardians(t, 1, 1)
+
+			publicKey, newKey := newTestKey(t)
+			challenge := newChallenge(t, u.handle)
+			req := StartSocialRecoveryRequest{
+				Handle:    u.handle,
+				Challenge: challenge,
+				PublicKey: publicKey,
+				KeyType:   "ed25519",
+				Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(newKey, socialRecoveryStatement(u.handle, challenge, "ed25519", publicKey))),
+			}
+			if code := doJSON(t, startSocialRecoveryHandler, req, nil); code != http.StatusCreated {
+				t.Fatalf("/social-recovery returned %d", code)
+			}
+			// A captured request can't open the same recovery again
+			if code := doJSON(t, startSocialRecoveryHandler, req, nil); code != http.StatusBadRequest {
+				t.Errorf("Replayed /social-recovery returned %d, want 400", code)
+			}
+		})
+	}
+}
+
+// redeemedChallenge returns a challenge for handle already used by a login
+func redeemedChallenge(t *testing.T, handle string, key ed25519.PrivateKey) string {
+	t.Helper()
+	login := signedLogin(t, handle, key)
+	if code := doJSON(t, verifyHandler, login, nil); code != http.StatusOK {
+		t.Fatalf("/verify returned %d", code)
+	}
+	return login.Challenge
+}
+
+func TestSocialRecoveryLockout(t *testing.T) {
+	setupTestStore(t, "memory")
+	lockout = &loginLockout{
+		policy:  lockoutPolicy{Threshold: 2, Base: time.Minute, Max: time.Hour, Reset: time.Hour},
+		tracker: newMemoryFailureTracker(),
+	}
+	t.Cleanup(func() { lockout = nil })
+
+	u := setupGuardians(t, 1, 1)
+	rec, _ := startRecovery(t, u.handle)
+	_, attackerKey := newTestKey(t)
+
+	// Each endpoint counts a bad signature against the handle that should
+	// have signed, and refuses it once that handle is locked
+	for _, tt := range []struct {
+		name   string
+		handle string
+		send   func(addr string) int
+	}{
+		{name: "/guardians", handle: u.handle, send: func(addr string) int {
+			challenge := newChallenge(t, u.handle)
+			return doJSONFrom(t, addr, setGuardiansHandler, SetGuardiansRequest{
+				Handle:    u.handle,
+				Challenge: challenge,
+				Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(attackerKey, setGuardiansStatement(u.handle, challenge, 0, nil))),
+			}, nil)
+		}},
+		{name: "Approval", handle: u.guardians[0], send: func(addr string) int {
+			challenge := newChallenge(t, u.guardians[0])
+			return doJSONVars(t, addr, map[string]string{"id": rec.ID}, approveSocialRecoveryHandler, ApproveSocialRecoveryRequest{
+				Guardian:  u.guardians[0],
+				Challenge: challenge,
+				Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(attackerKey, approveRecoveryStatement(rec, challenge))),
+			}, nil)
+		}},
+		{name: "Cancellation", handle: u.handle, send: func(addr string) int {
+			challenge := newChallenge(t, u.handle)
+			return doJSONVars(t, addr, map[string]string{"id": rec.ID}, cancelSocialRecoveryHandler, CancelSocialRecoveryRequest{
+				Challenge: challenge,
+				Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(attackerKey, cancelRecoveryStatement(rec.ID, challenge))),
+			}, nil)
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			lockout.tracker = newMemoryFailureTracker()
+			if code := tt.send("203.0.113.66:1"); code != http.StatusUnauthorized {
+				t.Fatalf("Bad signature returned %d, want 401", code)
+			}
+			if code := tt.send("203.0.113.66:1"); code != http.StatusTooManyRequests {
+				t.Fatalf("Bad signature that locked the handle returned %d, want 429", code)
+			}
+			if st, _ := lockout.tracker.state(context.Background(), handleFailureKey(tt.handle), lockout.policy); st.Failures != 2 {
+				t.Errorf("%s has %d failures, want 2", tt.handle, st.Failures)
+			}
+			if code := tt.send("203.0.113.66:1"); code != http.StatusTooManyRequests {
+				t.Errorf("Locked out address returned %d, want 429", code)
+			}
+		})
+	}
+}
+
+func TestSetGuardiansRequests(t *testing.T) {
+	for _, backend := range []string{"memory", "sqlite", "postgres"} {
+		t.Run(backend, func(t *testing.T) {
+			setupTestStore(t, backend)
+			u := setupGuardians(t, 2, 1)
+			otherHandle, _ := registerTestUser(t)
+			_, strangerKey := newTestKey(t)
+			usedChallenge := redeemedChallenge(t, u.handle, u.key)
+
+			for _, tt := range []struct {
+				name      string
+				challenge func() string
+				signer    ed25519.PrivateKey
+				want      int
+			}{
+				{name: "signed by an unregistered key", signer: strangerKey, want: http.StatusUnauthorized},
+				{name: "signed by a guardian", signer: u.guardianKeys[0], want: http.StatusUnauthorized},
+				{name: "challenge issued to another handle", challenge: func() string { return newChallenge(t, otherHandle) }, signer: u.key, want: http.StatusNotFound},
+				{name: "replayed challenge", challenge: func() string { return usedChallenge }, signer: u.key, want: http.StatusBadRequest},
+				{name: "signed by the handle's key", signer: u.key, want: http.StatusOK},
+			} {
+				t.Run(tt.name, func(t *testing.T) {
+					challenge := newChallenge(t, u.handle)
+					if tt.challenge != nil {
+						challenge = tt.challenge()
+					}
+					code := doJSON(t, setGuardiansHandler, SetGuardiansRequest{
+						Handle:    u.handle,
+						Challenge: challenge,
+						Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(tt.signer, setGuardiansStatement(u.handle, challenge, 2, u.guardians))),
+						Guardians: u.guardians,
+						Threshold: 2,
+					}, nil)
+					if code != tt.want {
+						t.Errorf("/guardians returned %d, want %d", code, tt.want)
+					}
+				})
+			}
+
+			var listed struct {
+				Threshold int `json:"threshold"`
+			}
+			if code := doAuthed(t, loginToken(t, u.handle, u.key), nil, listGuardiansHandler, &listed); code != http.StatusOK {
+				t.Fatalf("GET /guardians returned %d", code)
+			}
+			if listed.Threshold != 2 {
+				t.Errorf("Threshold is %d, want only the signed update's 2", listed.Threshold)
+			}
+		})
+	}
+}
+
+func TestStartSocialRecoveryRequests(t *testing.T) {
+	for _, backend := range []string{"memory", "sqlite", "postgres"} {
+		t.Run(backend, func(t *testing.T) {
+			setupTestStore(t, backend)
+			u := setupGuardians(t, 1, 1)
+			unguardedHandle, _ := registerTestUser(t)
+			_, strangerKey := newTestKey(t)
+			usedChallenge := redeemedChallenge(t, u.handle, u.key)
+
+			for _, tt := range []struct {
+				name      string
+				handle    string // u.handle if empty
+				challenge func() string
+				signer    ed25519.PrivateKey // the proposed key if nil
+				want      int
+			}{
+				{name: "signed by another key", signer: strangerKey, want: http.StatusUnauthorized},
+				{name: "handle without guardians", handle: unguardedHandle, want: http.StatusBadRequest},
+				{name: "challenge issued to another handle", challenge: func() string { return newChallenge(t, unguardedHandle) }, want: http.StatusNotFound},
+				{name: "replayed challenge", challenge: func() string { return usedChallenge }, want: http.StatusBadRequest},
+				{name: "signed by the proposed key", want: http.StatusCreated},
+			} {
+				t.Run(tt.name, func(t *testing.T) {
+					handle := u.handle
+					if tt.handle != "" {
+						handle = tt.handle
+					}
+					challenge := newChallenge(t, handle)
+					if tt.challenge != nil {
+						challenge = tt.challenge()
+					}
+					publicKey, newKey := newTestKey(t)
+					signer := newKey
+					if tt.signer != nil {
+						signer = tt.signer
+					}
+					code := doJSON(t, startSocialRecoveryHandler, StartSocialRecoveryRequest{
+						Handle:    handle,
+						Challenge: challenge,
+						PublicKey: publicKey,
+						KeyType:   "ed25519",
+						Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(signer, socialRecoveryStatement(handle, challenge, "ed25519", publicKey))),
+					}, nil)
+					if code != tt.want {
+						t.Errorf("/social-recovery returned %d, want %d", code, tt.want)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestApproveSocialRecoveryRequests(t *testing.T) {
+	for _, backend := range []string{"memory", "sqlite", "postgres"} {
+		t.Run(backend, func(t *testing.T) {
+			setupTestStore(t, backend)
+			setTestConfig(t, func(c *Config) { c.Tokens.SocialRecoveryDelay = time.Hour })
+			u := setupGuardians(t, 2, 2)
+			rec, _ := startRecovery(t, u.handle)
+			otherRec, _ := startRecovery(t, u.handle)
+			outsider, outsiderKey := registerTestUser(t)
+			_, strangerKey := newTestKey(t)
+			usedChallenge := redeemedChallenge(t, u.guardians[0], u.guardianKeys[0])
+
+			for _, tt := range []struct {
+				name      string
+				id        string // rec.ID if empty
+				guardian  string // the first guardian if empty
+				challenge func() string
+				signer    ed25519.PrivateKey // the first guardian's key if nil
+				statement *SocialRecovery    // recovery the signer approves; rec if nil
+				want      int
+			}{
+				{name: "unknown recovery", id: "00000000-0000-0000-0000-000000000000", want: http.StatusNotFound},
+				{name: "signed by an unregistered key", signer: strangerKey, want: http.StatusUnauthorized},
+				{name: "signed by another guardian's key", signer: u.guardianKeys[1], want: http.StatusUnauthorized},
+				{name: "signed by the recovered handle", signer: u.key, want: http.StatusUnauthorized},
+				{name: "not a guardian", guardian: outsider, signer: outsiderKey, want: http.StatusForbidden},
+				{name: "signed for another recovery", statement: otherRec, want: http.StatusUnauthorized},
+				{name: "challenge issued to the recovered handle", challenge: func() string { return newChallenge(t, u.handle) }, want: http.StatusNotFound},
+				{name: "replayed challenge", challenge: func() string { return usedChallenge }, want: http.StatusBadRequest},
+				{name: "signed by the guardian", want: http.StatusOK},
+			} {
+				t.Run(tt.name, func(t *testing.T) {
+					id, guardian, signer, statement := rec.ID, u.guardians[0], u.guardianKeys[0], rec
+					if tt.id != "" {
+						id = tt.id
+					}
+					if tt.guardian != "" {
+						guardian = tt.guardian
+					}
+					if tt.signer != nil {
+						signer = tt.signer
+					}
+					if tt.statement != nil {
+						statement = tt.statement
+					}
+					challenge := newChallenge(t, guardian)
+					if tt.challenge != nil {
+						challenge = tt.challenge()
+					}
+					code := doJSONVars(t, "192.0.2.1:1234", map[string]string{"id": id}, approveSocialRecoveryHandler, ApproveSocialRecoveryRequest{
+						Guardian:  guardian,
+						Challenge: challenge,
+						Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(signer, approveRecoveryStatement(statement, challenge))),
+					}, nil)
+					if code != tt.want {
+						t.Errorf("/social-recovery/{id}/approve returned %d, want %d", code, tt.want)
+					}
+				})
+			}
+
+			for _, r := range []*SocialRecovery{rec, otherRec} {
+				code := doJSONVars(t, "192.0.2.1:1234", map[string]string{"id": r.ID}, getSocialRecoveryHandler, nil, r)
+				if code != http.StatusOK {
+					t.Fatalf("/social-recovery/{id} returned %d", code)
+				}
+			}
+			if rec.Approvals != 1 || otherRec.Approvals != 0 {
+				t.Errorf("Recoveries have %d and %d approvals, want 1 and 0", rec.Approvals, otherRec.Approvals)
+			}
+		})
+	}
+}
+
+func TestCancelSocialRecoveryRequests(t *testing.T) {
+	for _, backend := range []string{"memory", "sqlite", "postgres"} {
+		t.Run(backend, func(t *testing.T) {
+			setupTestStore(t, backend)
+			setTestConfig(t, func(c *Config) { c.Tokens.SocialRecoveryDelay = time.Hour })
+			u := setupGuardians(t, 1, 1)
+			rec, newKey := startRecovery(t, u.handle)
+			otherRec, _ := startRecovery(t, u.handle)
+			usedChallenge := redeemedChallenge(t, u.handle, u.key)
+
+			// The cases run in order; the last one finds the recovery closed
+			for _, tt := range []struct {
+				name      string
+				challenge func() string
+				signer    ed25519.PrivateKey
+				id        string // recovery the signer cancels; rec.ID if empty
+				want      int
+			}{
+				{name: "signed by a guardian", signer: u.guardianKeys[0], want: http.StatusUnauthorized},
+				{name: "signed by the proposed key", signer: newKey, want: http.StatusUnauthorized},
+				{name: "signed for another recovery", signer: u.key, id: otherRec.ID, want: http.StatusUnauthorized},
+				{name: "challenge issued to a guardian", challenge: func() string { return newChallenge(t, u.guardians[0]) }, signer: u.key, want: http.StatusNotFound},
+				{name: "replayed challenge", challenge: func() string { return usedChallenge }, signer: u.key, want: http.StatusBadRequest},
+				{name: "signed by the handle's key", signer: u.key, want: http.StatusOK},
+				{name: "already cancelled", signer: u.key, want: http.StatusConflict},
+			} {
+				t.Run(tt.name, func(t *testing.T) {
+					signed := rec.ID
+					if tt.id != "" {
+						signed = tt.id
+					}
+					challenge := newChallenge(t, u.handle)
+					if tt.challenge != nil {
+						challenge = tt.challenge()
+					}
+					code := doJSONVars(t, "192.0.2.1:1234", map[string]string{"id": rec.ID}, cancelSocialRecoveryHandler, CancelSocialRecoveryRequest{
+						Challenge: challenge,
+						Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(tt.signer, cancelRecoveryStatement(signed, challenge))),
+					}, nil)
+					if code != tt.want {
+						t.Errorf("/social-recovery/{id}/cancel returned %d, want %d", code, tt.want)
+					}
+				})
+			}
+
+			if code := doJSONVars(t, "192.0.2.1:1234", map[string]string{"id": otherRec.ID}, getSocialRecoveryHandler, nil, otherRec); code != http.StatusOK {
+				t.Fatalf("/social-recovery/{id} returned %d", code)
+			}
+			if otherRec.Status != "pending" {
+				t.Errorf("Cancelling one recovery left the other %s", otherRec.Status)
+			}
+		})
+	}
+}
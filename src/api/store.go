@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// store is the storage backend for users, keys, challenges and sessions.
+// Selected by the scheme of DATABASE_URL.
+var store Store
+
+// Errors returned by Store implementations
+var (
+	errNotFound           = errors.New("not found")
+	errHandleExists       = errors.New("handle already exists")
+	errChallengeUsed      = errors.New("challenge already used")
+	errLastKey            = errors.New("cannot remove the last key")
+	errSessionRevoked     = errors.New("session revoked")
+	errRefreshReused      = errors.New("refresh token reused")
+	errRefreshExpired     = errors.New("refresh token expired")
+	errLocked             = errors.New("held by another replica")
+	errSignCountRegressed = errors.New("signature counter did not increase")
+	errKeyRegistered      = errors.New("public key already registered")
+	errRecoveryKeyUsed    = errors.New("recovery key already used")
+	errRecoveryClosed     = errors.New("recovery request is no longer pending")
+	errRecoveryWaiting    = errors.New("recovery waiting period has not ended")
+)
+
+// User is an identity
+type User struct {
+	ID        string
+	Handle    string
+	PublicKey string
+	KeyType   string
+	CreatedAt time.Time
+}
+
+// sessionRecord is a session to create at login. Only token hashes are
+// stored.
+type sessionRecord struct {
+	ID               string // set by Login
+	UserID           string
+	KeyID            string
+	TokenHash        string
+	RefreshTokenHash string
+	ExpiresAt        time.Time
+	Metadata         map[string]string
+}
+
+// refreshGrant is what a refresh token was issued for
+type refreshGrant struct {
+	SessionID string
+	Handle    string
+	KeyType   string    // type of the key the session logged in with
+	ExpiresAt time.Time // absolute end of the session
+}
+
+// keyRotation is the evidence of a rotation: the statement and the
+// signatures the old and the new key made over it
+type keyRotation struct {
+	OldKeyID     string
+	Statement    string
+	OldSignature string
+	NewSignature string
+}
+
+// refreshTokenStatus describes an active refresh token for introspection
+type refreshTokenStatus struct {
+	Handle    string
+	ClientID  string
+	Scope     string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// Store persists users, keys, challenges and sessions. Methods that redeem
+// a challenge do so atomically with the change they authorize and return
+// errChallengeUsed if the challenge was already redeemed.
+type Store interface {
+	// CreateUser redeems a registration challenge and creates a user whose
+	// first device key is key. Returns errHandleExists or errKeyRegistered.
+	CreateUser(ctx context.Context, ch *issuedChallenge, user *User, key *UserKey, recoveryKeys []RecoveryKeyInput) error
+	// UserByHandle returns errNotFound for unknown handles
+	UserByHandle(ctx context.Context, handle string) (*User, error)
+
+	// ActiveKeys returns the keys of a user that have not been removed
+	ActiveKeys(ctx context.Context, userID string) ([]UserKey, error)
+	// KeyRegistered reports whether a public key is an active key of anyone
+	KeyRegistered(ctx context.Context, publicKey string) (bool, error)
+	// AddKey redeems a challenge and adds a key. Returns errKeyRegistered.
+	AddKey(ctx context.Context, ch *issuedChallenge, userID string, key *UserKey) error
+	// RemoveKey removes a key and revokes the sessions opened with it.
+	// Returns errNotFound or errLastKey.
+	RemoveKey(ctx context.Context, userID, keyID string) error
+	// AdvanceSignCount records the signature counter a webauthn key sent.
+	// Returns errSignCountRegressed unless it is higher than the last one,
+	// or both are zero for authenticators that don't count.
+	AdvanceSignCount(ctx context.Context, keyID string, count uint32) error
+
+	// RotateKey redeems a challenge and hands a user over from the old key
+	// of rot to newKey: the old key and its sessions are revoked, newKey
+	// takes its place, as the primary key if the old one was, and the
+	// rotation is recorded. Sets newKey's ID and CreatedAt, which is when
+	// the rotation happened. Returns errKeyRegistered, or errNotFound if the
+	// old key is no longer active.
+	RotateKey(ctx context.Context, ch *issuedChallenge, userID string, rot keyRotation, newKey *UserKey) error
+	// KeyRotations returns the rotation history of a handle, oldest first
+	KeyRotations(ctx context.Context, handle string) ([]KeyRotation, error)
+
+	// AddRecoveryKeys redeems a challenge and adds recovery keys to a user
+	AddRecoveryKeys(ctx context.Context, ch *issuedChallenge, userID string, keys []RecoveryKeyInput) ([]RecoveryKey, error)
+	// RecoveryKeys returns the recovery keys of a user that are neither used
+	// nor removed, oldest first
+	RecoveryKeys(ctx context.Context, userID string) ([]RecoveryKey, error)
+	// RemoveRecoveryKey returns errNotFound unless the recovery key is the
+	// user's and still usable
+	RemoveRecoveryKey(ctx context.Context, userID, recoveryKeyID string) error
+	// Recover redeems a challenge, uses up a recovery key and enrolls key
+	// as the user's only key, revoking every other key and session.
+	// Returns errRecoveryKeyUsed or errKeyRegistered.
+	Recover(ctx context.Context, ch *issuedChallenge, userID, recoveryKeyID string, key *UserKey) error
+
+	// SetGuardians redeems a challenge and replaces the guardians and
+	// threshold of a user; a zero threshold turns social recovery off.
+	// Pending social recoveries of the user are cancelled.
+	SetGuardians(ctx context.Context, ch *issuedChallenge, userID string, guardianIDs []string, threshold int) error
+	// Guardians returns the handles of a user's guardians, sorted, and the
+	// threshold, which is zero if the user has none
+	Guardians(ctx context.Context, userID string) ([]string, int, error)
+	// CreateSocialRecovery redeems a challenge and opens a pending recovery
+	// request, setting its ID and CreatedAt. EffectiveAt stays nil until the
+	// request is approved.
+	CreateSocialRecovery(ctx context.Context, ch *issuedChallenge, rec *SocialRecovery) error
+	// SocialRecovery returns a recovery request with its approvals and the
+	// user's threshold. Approvals only count while the approver is still a
+	// guardian. Returns errNotFound.
+	SocialRecovery(ctx context.Context, id string) (*SocialRecovery, error)
+	// PendingSocialRecoveries returns the pending recovery requests against
+	// a user, oldest first
+	PendingSocialRecoveries(ctx context.Context, userID string) ([]*SocialRecovery, error)
+	// ApproveSocialRecovery redeems a challenge and records a guardian's
+	// approval; approving twice is not an error. The approval that reaches
+	// the threshold starts the waiting period: EffectiveAt becomes now plus
+	// delay. Returns errRecoveryClosed unless the request is pending.
+	ApproveSocialRecovery(ctx context.Context, ch *issuedChallenge, recoveryID, guardianID, signature string, delay time.Duration) error
+	// CancelSocialRecovery redeems a challenge and cancels a pending
+	// recovery request. Returns errRecoveryClosed.
+	CancelSocialRecovery(ctx context.Context, ch *issuedChallenge, recoveryID string) error
+	// CompleteSocialRecovery closes a pending recovery request whose waiting
+	// period has ended and enrolls key as the user's only key, revoking every
+	// other key and session and cancelling competing requests. Returns
+	// errNotFound, errRecoveryClosed, errRecoveryWaiting or errKeyRegistered.
+	CompleteSocialRecovery(ctx context.Context, recoveryID string, key *UserKey) error
+
+	// SaveChallenge stores a challenge issued for a handle
+	SaveChallenge(ctx context.Context, handle string, ch *ChallengeResponse) error
+	// FindChallenge returns a stored challenge and whether it was used
+	FindChallenge(ctx context.Context, handle, challenge string) (*issuedChallenge, bool, error)
+	// RedeemChallenge marks a challenge used without authorizing anything,
+	// so a request that failed with it can't be retried. Returns
+	// errChallengeUsed.
+	RedeemChallenge(ctx context.Context, ch *issuedChallenge) error
+
+	// Login redeems a login challenge, records the login and creates the
+	// session, setting sess.ID
+	Login(ctx context.Context, ch *issuedChallenge, sess *sessionRecord) error
+	// SessionByToken returns the live session an access token belongs to
+	// and records activity on it
+	SessionByToken(ctx context.Context, tokenHash string) (*authSession, error)
+	// ListSessions returns a user's live sessions, newest first
+	ListSessions(ctx context.Context, userID string) ([]Session, error)
+	// RevokeSession returns errNotFound unless the session is the user's and live
+	RevokeSession(ctx context.Context, userID, sessionID string) error
+
+	// LookupRefreshToken returns what a refresh token was issued for
+	LookupRefreshToken(ctx context.Context, tokenHash string) (*refreshGrant, error)
+	// RotateRefreshToken redeems a refresh token, issues its successor and
+	// points the session at a new access token. The session keeps its
+	// absolute expiry. Redeeming a token twice revokes the session and
+	// returns errRefreshReused.
+	RotateRefreshToken(ctx context.Context, tokenHash, accessTokenHash, newTokenHash string, expiresAt time.Time) error
+
+	// AccessTokenClient returns the client ID and scope of the live session
+	// an access token belongs to
+	AccessTokenClient(ctx context.Context, tokenHash string) (string, string, error)
+	// RefreshTokenStatus returns errNotFound unless the refresh token is active
+	RefreshTokenStatus(ctx context.Context, tokenHash string) (*refreshTokenStatus, error)
+
+	// PurgeExpired deletes up to limit challenges that expired before cutoff
+	// and up to limit sessions that expired or were revoked before it,
+	// returning how many of each it deleted. Returns errLocked if another
+	// replica is purging.
+	PurgeExpired(ctx context.Context, cutoff time.Time, limit int) (int, int, error)
+
+	// AppendAuditEvent chains ev to the last audit event and stores it,
+	// setting its sequence number and hashes. Appends are serialized.
+	AppendAuditEvent(ctx context.Context, ev *auditEvent) error
+	// AuditEvents returns matching audit events in sequence order
+	AuditEvents(ctx context.Context, q auditQuery) ([]auditEvent, error)
+	// AuditHead returns the sequence number and hash of the last audit
+	// event, or 0 and auditGenesisHash if there is none
+	AuditHead(ctx context.Context) (int64, string, error)
+
+	// Ping checks that the backend can be reached
+	Ping(ctx context.Context) error
+	// PendingMigrations counts the schema migrations not applied yet. A
+	// backend without a schema has none.
+	PendingMigrations(ctx context.Context) (int, error)
+}
+
+// openStore opens the backend named by a DATABASE_URL: memory:// keeps
+// everything in process, sqlite:///path uses a single SQLite file, anything
+// else is a Postgres connection string
+func openStore(dbURL string) (Store, error) {
+	if strings.HasPrefix(dbURL, "memory:") {
+		return newMemoryStore(), nil
+	}
+	if strings.HasPrefix(dbURL, "sqlite:") {
+		return openSQLite(dbURL)
+	}
+	conn, err := connectPostgres(dbURL)
+	if err != nil {
+		return nil, err
+	}
+	return &postgresStore{db: conn}, nil
+}
+
+// newID returns a random UUID (version 4)
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,868 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryStore is a Store that keeps everything in process memory. It is
+// meant for tests and demos: nothing survives a restart and replicas don't
+// share state.
+type memoryStore struct {
+	mu         sync.Mutex
+	users      map[string]*User // by ID
+	handles    map[string]string
+	keys       map[string]*memoryKey
+	challenges map[string]*memoryChallenge // by handle + "\n" + challenge
+	sessions   map[string]*memorySession
+	refresh    map[string]*memoryRefreshToken // by token hash
+	audit      []auditEvent
+	signCounts map[string]uint32 // by key ID
+	recovery   map[string]*memoryRecoveryKey
+	rotations  []memoryRotation
+	guardians  map[string]*memoryGuardians // by user ID
+	social     map[string]*memorySocialRecovery
+}
+
+type memoryKey struct {
+	UserKey
+	userID  string
+	revoked bool
+}
+
+type memoryRecoveryKey struct {
+	RecoveryKey
+	userID  string
+	used    bool
+	revoked bool
+}
+
+type memoryRotation struct {
+	keyRotation
+	userID   string
+	newKeyID string
+	at       time.Time
+}
+
+type memoryGuardians struct {
+	threshold   int
+	guardianIDs []string
+}
+
+type memorySocialRecovery struct {
+	SocialRecovery
+	approvals map[string]string // signature by guardian ID
+}
+
+type memoryChallenge struct {
+	issuedChallenge
+	used bool
+}
+
+type memorySession struct {
+	Session
+	userID    string
+	keyID     string
+	tokenHash string
+	metadata  map[string]string
+	revoked   bool
+	revokedAt time.Time
+}
+
+type memoryRefreshToken struct {
+	sessionID string
+	createdAt time.Time
+	expiresAt time.Time
+	used      bool
+}
+
+func (sess *memorySession) revoke() {
+	sess.revoked = true
+	sess.revokedAt = time.Now()
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		users:      make(map[string]*User),
+		handles:    make(map[string]string),
+		keys:       make(map[string]*memoryKey),
+		challenges: make(map[string]*memoryChallenge),
+		sessions:   make(map[string]*memorySession),
+		refresh:    make(map[string]*memoryRefreshToken),
+		signCounts: make(map[string]uint32),
+		recovery:   make(map[string]*memoryRecoveryKey),
+		guardians:  make(map[string]*memoryGuardians),
+		social:     make(map[string]*memorySocialRecovery),
+	}
+}
+
+// redeem marks a challenge used. Callers hold s.mu.
+func (s *memoryStore) redeem(ctx context.Context, ch *issuedChallenge) error {
+	if sealer != nil {
+		consumed, err := sealer.replay.consume(ctx, nil, ch.ID, ch.ExpiresAt)
+		if err != nil {
+			return err
+		}
+		if !consumed {
+			return errChallengeUsed
+		}
+		return nil
+	}
+
+	for _, c := range s.challenges {
+		if c.ID == ch.ID {
+			if c.used {
+				return errChallengeUsed
+			}
+			c.used = true
+			return nil
+		}
+	}
+	return errNotFound
+}
+
+// keyRegistered reports whether publicKey is an active key. Callers hold s.mu.
+func (s *memoryStore) keyRegistered(publicKey string) bool {
+	for _, k := range s.keys {
+		if !k.revoked && k.PublicKey == publicKey {
+			return true
+		}
+	}
+	return false
+}
+
+// liveSession returns a session that is neither revoked nor expired. Callers
+// hold s.mu.
+func (s *memoryStore) liveSession(id string) *memorySession {
+	sess, ok := s.sessions[id]
+	if !ok || sess.revoked || time.Now().After(sess.ExpiresAt) {
+		return nil
+	}
+	return sess
+}
+
+// addRecoveryKeys stores recovery keys for a user. Callers hold s.mu.
+func (s *memoryStore) addRecoveryKeys(userID string, keys []RecoveryKeyInput, now time.Time) []RecoveryKey {
+	added := []RecoveryKey{}
+	for _, k := range keys {
+		rk := RecoveryKey{ID: newID(), Name: k.Name, PublicKey: k.PublicKey, KeyType: k.KeyType, CreatedAt: now}
+		s.recovery[rk.ID] = &memoryRecoveryKey{RecoveryKey: rk, userID: userID}
+		added = append(added, rk)
+	}
+	return added
+}
+
+func (s *memoryStore) CreateUser(ctx context.Context, ch *issuedChallenge, user *User, key *UserKey, recoveryKeys []RecoveryKeyInput) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.handles[user.Handle]; exists {
+		return errHandleExists
+	}
+	if s.keyRegistered(key.PublicKey) {
+		return errKeyRegistered
+	}
+	if err := s.redeem(ctx, ch); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	u := *user
+	u.ID = newID()
+	u.CreatedAt = now
+	s.users[u.ID] = &u
+	s.handles[u.Handle] = u.ID
+	*user = u
+
+	key.ID = newID()
+	key.CreatedAt = now
+	s.keys[key.ID] = &memoryKey{UserKey: *key, userID: u.ID}
+
+	s.addRecoveryKeys(u.ID, recoveryKeys, now)
+	return nil
+}
+
+func (s *memoryStore) UserByHandle(ctx context.Context, handle string) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, ok := s.handles[handle]
+	if !ok {
+		return nil, errNotFound
+	}
+	u := *s.users[id]
+	return &u, nil
+}
+
+func (s *memoryStore) ActiveKeys(ctx context.Context, userID string) ([]UserKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := []UserKey{}
+	for _, k := range s.keys {
+		if k.userID == userID && !k.revoked {
+			keys = append(keys, k.UserKey)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys, nil
+}
+
+func (s *memoryStore) KeyRegistered(ctx context.Context, publicKey string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.keyRegistered(publicKey), nil
+}
+
+func (s *memoryStore) AddKey(ctx context.Context, ch *issuedChallenge, userID string, key *UserKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.keyRegistered(key.PublicKey) {
+		return errKeyRegistered
+	}
+	if err := s.redeem(ctx, ch); err != nil {
+		return err
+	}
+
+	key.ID = newID()
+	key.CreatedAt = time.Now()
+	s.keys[key.ID] = &memoryKey{UserKey: *key, userID: userID}
+	return nil
+}
+
+func (s *memoryStore) RemoveKey(ctx context.Context, userID, keyID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var active int
+	for _, k := range s.keys {
+		if k.userID == userID && !k.revoked {
+			active++
+		}
+	}
+	k, ok := s.keys[keyID]
+	if !ok || k.userID != userID || k.revoked {
+		return errNotFound
+	}
+	if active == 1 {
+		return errLastKey
+	}
+
+	k.revoked = true
+	for _, sess := range s.sessions {
+		if sess.userID == userID && sess.keyID == keyID {
+			sess.revoke()
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) AdvanceSignCount(ctx context.Context, keyID string, count uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	last, seen := s.signCounts[keyID]
+	if seen && count <= last && (count != 0 || last != 0) {
+		return errSignCountRegressed
+	}
+	s.signCounts[keyID] = count
+	return nil
+}
+
+// keyTaken reports whether publicKey is an active key of anyone but userID.
+// Callers hold s.mu.
+func (s *memoryStore) keyTaken(publicKey, userID string) bool {
+	for _, k := range s.keys {
+		if !k.revoked && k.PublicKey == publicKey && k.userID != userID {
+			return true
+		}
+	}
+	return false
+}
+
+// enroll revokes every key and session of a user and enrolls key in their
+// place as the primary key. Callers hold s.mu and have checked keyTaken.
+func (s *memoryStore) enroll(userID string, key *UserKey) {
+	for _, k := range s.keys {
+		if k.userID == userID {
+			k.revoked = true
+		}
+	}
+	for _, sess := range s.sessions {
+		if sess.userID == userID && !sess.revoked {
+			sess.revoke()
+		}
+	}
+
+	key.ID = newID()
+	key.CreatedAt = time.Now()
+	s.keys[key.ID] = &memoryKey{UserKey: *key, userID: userID}
+	u := s.users[userID]
+	u.PublicKey, u.KeyType = key.PublicKey, key.KeyType
+}
+
+func (s *memoryStore) RotateKey(ctx context.Context, ch *issuedChallenge, userID string, rot keyRotation, newKey *UserKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.keyRegistered(newKey.PublicKey) {
+		return errKeyRegistered
+	}
+	old, ok := s.keys[rot.OldKeyID]
+	if !ok || old.userID != userID || old.revoked {
+		return errNotFound
+	}
+	if err := s.redeem(ctx, ch); err != nil {
+		return err
+	}
+
+	old.revoked = true
+	newKey.ID = newID()
+	newKey.CreatedAt = time.Now()
+	s.keys[newKey.ID] = &memoryKey{UserKey: *newKey, userID: userID}
+	s.rotations = append(s.rotations, memoryRotation{keyRotation: rot, userID: userID, newKeyID: newKey.ID, at: newKey.CreatedAt})
+
+	if u := s.users[userID]; u.PublicKey == old.PublicKey {
+		u.PublicKey, u.KeyType = newKey.PublicKey, newKey.KeyType
+	}
+	for _, sess := range s.sessions {
+		if sess.userID == userID && sess.keyID == old.ID && !sess.revoked {
+			sess.revoke()
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) KeyRotations(ctx context.Context, handle string) ([]KeyRotation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rotations := []KeyRotation{}
+	userID, ok := s.handles[handle]
+	if !ok {
+		return rotations, nil
+	}
+	for _, r := range s.rotations {
+		if r.userID != userID {
+			continue
+		}
+		old, updated := s.keys[r.OldKeyID], s.keys[r.newKeyID]
+		rotations = append(rotations, KeyRotation{
+			OldPublicKey: old.PublicKey,
+			OldKeyType:   old.KeyType,
+			NewPublicKey: updated.PublicKey,
+			NewKeyType:   updated.KeyType,
+			Statement:    r.Statement,
+			OldSignature: r.OldSignature,
+			NewSignature: r.NewSignature,
+			RotatedAt:    r.at,
+		})
+	}
+	return rotations, nil
+}
+
+func (s *memoryStore) AddRecoveryKeys(ctx context.Context, ch *issuedChallenge, userID string, keys []RecoveryKeyInput) ([]RecoveryKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.redeem(ctx, ch); err != nil {
+		return nil, err
+	}
+	return s.addRecoveryKeys(userID, keys, time.Now()), nil
+}
+
+func (s *memoryStore) RecoveryKeys(ctx context.Context, userID string) ([]RecoveryKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := []RecoveryKey{}
+	for _, rk := range s.recovery {
+		if rk.userID == userID && !rk.used && !rk.revoked {
+			keys = append(keys, rk.RecoveryKey)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys, nil
+}
+
+func (s *memoryStore) RemoveRecoveryKey(ctx context.Context, userID, recoveryKeyID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rk, ok := s.recovery[recoveryKeyID]
+	if !ok || rk.userID != userID || rk.used || rk.revoked {
+		return errNotFound
+	}
+	rk.revoked = true
+	return nil
+}
+
+func (s *memoryStore) Recover(ctx context.Context, ch *issuedChallenge, userID, recoveryKeyID string, key *UserKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rk, ok := s.recovery[recoveryKeyID]
+	if !ok || rk.userID != userID || rk.used || rk.revoked {
+		return errRecoveryKeyUsed
+	}
+	if s.keyTaken(key.PublicKey, userID) {
+		return errKeyRegistered
+	}
+	if err := s.redeem(ctx, ch); err != nil {
+		return err
+	}
+
+	rk.used = true
+	s.enroll(userID, key)
+	return nil
+}
+
+// cancelSocialRecoveries cancels the pending recovery requests against a
+// user. Callers hold s.mu.
+func (s *memoryStore) cancelSocialRecoveries(userID string) {
+	for _, rec := range s.social {
+		if rec.userID == userID && rec.Status == "pending" {
+			rec.Status = "cancelled"
+		}
+	}
+}
+
+func (s *memoryStore) SetGuardians(ctx context.Context, ch *issuedChallenge, userID string, guardianIDs []string, threshold int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.redeem(ctx, ch); err != nil {
+		return err
+	}
+
+	if threshold == 0 {
+		delete(s.guardians, userID)
+	} else {
+		s.guardians[userID] = &memoryGuardians{threshold: threshold, guardianIDs: append([]string{}, guardianIDs...)}
+	}
+	// Pending requests were approved under the old policy
+	s.cancelSocialRecoveries(userID)
+	return nil
+}
+
+func (s *memoryStore) Guardians(ctx context.Context, userID string) ([]string, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	guardians := []string{}
+	g, ok := s.guardians[userID]
+	if !ok {
+		return guardians, 0, nil
+	}
+	for _, id := range g.guardianIDs {
+		guardians = append(guardians, s.users[id].Handle)
+	}
+	sort.Strings(guardians)
+	return guardians, g.threshold, nil
+}
+
+// socialRecovery returns a copy of a recovery request with its current
+// approvals and threshold. Callers hold s.mu.
+func (s *memoryStore) socialRecovery(rec *memorySocialRecovery) *SocialRecovery {
+	out := rec.SocialRecovery
+	out.Handle = s.users[out.userID].Handle
+	out.Threshold, out.Approvals = 0, 0
+	if g, ok := s.guardians[out.userID]; ok {
+		out.Threshold = g.threshold
+		// Approvals only count while the approver is still a guardian
+		for _, id := range g.guardianIDs {
+			if _, approved := rec.approvals[id]; approved {
+				out.Approvals++
+			}
+		}
+	}
+	return &out
+}
+
+func (s *memoryStore) CreateSocialRecovery(ctx context.Context, ch *issuedChallenge, rec *SocialRecovery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.redeem(ctx, ch); err != nil {
+		return err
+	}
+
+	rec.ID = newID()
+	rec.Status = "pending"
+	rec.CreatedAt = time.Now()
+	rec.EffectiveAt = nil
+	s.social[rec.ID] = &memorySocialRecovery{SocialRecovery: *rec, approvals: make(map[string]string)}
+	return nil
+}
+
+func (s *memoryStore) SocialRecovery(ctx context.Context, id string) (*SocialRecovery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec, ok := s.social[id]
+	if !ok {
+		return nil, errNotFound
+	}
+	return s.socialRecovery(rec), nil
+}
+
+func (s *memoryStore) PendingSocialRecoveries(ctx context.Context, userID string) ([]*SocialRecovery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	recoveries := []*SocialRecovery{}
+	for _, rec := range s.social {
+		if rec.userID == userID && rec.Status == "pending" {
+			recoveries = append(recoveries, s.socialRecovery(rec))
+		}
+	}
+	sort.Slice(recoveries, func(i, j int) bool { return recoveries[i].CreatedAt.Before(recoveries[j].CreatedAt) })
+	return recoveries, nil
+}
+
+func (s *memoryStore) ApproveSocialRecovery(ctx context.Context, ch *issuedChallenge, recoveryID, guardianID, signature string, delay time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec, ok := s.social[recoveryID]
+	if !ok {
+		return errNotFound
+	}
+	if rec.Status != "pending" {
+		return errRecoveryClosed
+	}
+	if err := s.redeem(ctx, ch); err != nil {
+		return err
+	}
+
+	if _, approved := rec.approvals[guardianID]; !approved {
+		rec.approvals[guardianID] = signature
+	}
+	// The waiting period starts once enough guardians have approved
+	if current := s.socialRecovery(rec); rec.EffectiveAt == nil && current.Threshold > 0 && current.Approvals >= current.Threshold {
+		effectiveAt := time.Now().Add(delay)
+		rec.EffectiveAt = &effectiveAt
+	}
+	return nil
+}
+
+func (s *memoryStore) CancelSocialRecovery(ctx context.Context, ch *issuedChallenge, recoveryID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec, ok := s.social[recoveryID]
+	if !ok || rec.Status != "pending" {
+		return errRecoveryClosed
+	}
+	if err := s.redeem(ctx, ch); err != nil {
+		return err
+	}
+
+	rec.Status = "cancelled"
+	return nil
+}
+
+func (s *memoryStore) CompleteSocialRecovery(ctx context.Context, recoveryID string, key *UserKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec, ok := s.social[recoveryID]
+	if !ok {
+		return errNotFound
+	}
+	if rec.Status != "pending" {
+		return errRecoveryClosed
+	}
+	if rec.EffectiveAt == nil || rec.EffectiveAt.After(time.Now()) {
+		return errRecoveryWaiting
+	}
+	if s.keyTaken(key.PublicKey, rec.userID) {
+		return errKeyRegistered
+	}
+
+	rec.Status = "completed"
+	s.enroll(rec.userID, key)
+	// Any competing requests are moot now
+	s.cancelSocialRecoveries(rec.userID)
+	return nil
+}
+
+func (s *memoryStore) SaveChallenge(ctx context.Context, handle string, ch *ChallengeResponse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.challenges[handle+"\n"+ch.Challenge] = &memoryChallenge{
+		issuedChallenge: issuedChallenge{
+			ID:        newID(),
+			IssuedAt:  ch.IssuedAt,
+			ExpiresAt: ch.ExpiresAt,
+		},
+	}
+	return nil
+}
+
+func (s *memoryStore) FindChallenge(ctx context.Context, handle, challenge string) (*issuedChallenge, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.challenges[handle+"\n"+challenge]
+	if !ok {
+		return nil, false, errNotFound
+	}
+	ch := c.issuedChallenge
+	return &ch, c.used, nil
+}
+
+func (s *memoryStore) RedeemChallenge(ctx context.Context, ch *issuedChallenge) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.redeem(ctx, ch)
+}
+
+func (s *memoryStore) Login(ctx context.Context, ch *issuedChallenge, rec *sessionRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.redeem(ctx, ch); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if k, ok := s.keys[rec.KeyID]; ok {
+		k.LastUsedAt = &now
+	}
+
+	rec.ID = newID()
+	s.sessions[rec.ID] = &memorySession{
+		Session: Session{
+			ID:           rec.ID,
+			CreatedAt:    now,
+			ExpiresAt:    rec.ExpiresAt,
+			LastActivity: &now,
+			UserAgent:    rec.Metadata["user_agent"],
+			IP:           rec.Metadata["ip"],
+		},
+		userID:    rec.UserID,
+		keyID:     rec.KeyID,
+		tokenHash: rec.TokenHash,
+		metadata:  rec.Metadata,
+	}
+	s.refresh[rec.RefreshTokenHash] = &memoryRefreshToken{
+		sessionID: rec.ID,
+		createdAt: now,
+		expiresAt: rec.ExpiresAt,
+	}
+	return nil
+}
+
+func (s *memoryStore) SessionByToken(ctx context.Context, tokenHash string) (*authSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id := range s.sessions {
+		sess := s.liveSession(id)
+		if sess == nil || sess.tokenHash != tokenHash {
+			continue
+		}
+		now := time.Now()
+		sess.LastActivity = &now
+		return &authSession{ID: sess.ID, UserID: sess.userID, Handle: s.users[sess.userID].Handle}, nil
+	}
+	return nil, errNotFound
+}
+
+func (s *memoryStore) ListSessions(ctx context.Context, userID string) ([]Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sessions := []Session{}
+	for id := range s.sessions {
+		if sess := s.liveSession(id); sess != nil && sess.userID == userID {
+			sessions = append(sessions, sess.Session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].CreatedAt.After(sessions[j].CreatedAt) })
+	return sessions, nil
+}
+
+func (s *memoryStore) RevokeSession(ctx context.Context, userID, sessionID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess, ok := s.sessions[sessionID]
+	if !ok || sess.userID != userID || sess.revoked {
+		return errNotFound
+	}
+	sess.revoke()
+	return nil
+}
+
+func (s *memoryStore) LookupRefreshToken(ctx context.Context, tokenHash string) (*refreshGrant, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rt, ok := s.refresh[tokenHash]
+	if !ok {
+		return nil, errNotFound
+	}
+	sess := s.sessions[rt.sessionID]
+	grant := &refreshGrant{SessionID: rt.sessionID, Handle: s.users[sess.userID].Handle, ExpiresAt: sess.ExpiresAt}
+	if k, ok := s.keys[sess.keyID]; ok {
+		grant.KeyType = k.KeyType
+	} else {
+		grant.KeyType = s.users[sess.userID].KeyType
+	}
+	return grant, nil
+}
+
+func (s *memoryStore) RotateRefreshToken(ctx context.Context, tokenHash, accessTokenHash, newTokenHash string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rt, ok := s.refresh[tokenHash]
+	if !ok {
+		return errNotFound
+	}
+	sess := s.sessions[rt.sessionID]
+	if sess.revoked {
+		return errSessionRevoked
+	}
+
+	// A rotated token coming back means it was copied: kill the family
+	if rt.used {
+		sess.revoke()
+		return errRefreshReused
+	}
+
+	now := time.Now()
+	if now.After(rt.expiresAt) {
+		return errRefreshExpired
+	}
+
+	rt.used = true
+	s.refresh[newTokenHash] = &memoryRefreshToken{
+		sessionID: rt.sessionID,
+		createdAt: now,
+		expiresAt: expiresAt,
+	}
+
+	// The session now answers to the new access token only
+	sess.tokenHash = accessTokenHash
+	sess.LastActivity = &now
+	return nil
+}
+
+func (s *memoryStore) AccessTokenClient(ctx context.Context, tokenHash string) (string, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id := range s.sessions {
+		if sess := s.liveSession(id); sess != nil && sess.tokenHash == tokenHash {
+			return sess.metadata["client_id"], sess.metadata["scope"], nil
+		}
+	}
+	return "", "", errNotFound
+}
+
+func (s *memoryStore) RefreshTokenStatus(ctx context.Context, tokenHash string) (*refreshTokenStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rt, ok := s.refresh[tokenHash]
+	if !ok || rt.used || time.Now().After(rt.expiresAt) {
+		return nil, errNotFound
+	}
+	sess := s.sessions[rt.sessionID]
+	if sess.revoked {
+		return nil, errNotFound
+	}
+
+	return &refreshTokenStatus{
+		Handle:    s.users[sess.userID].Handle,
+		ClientID:  sess.metadata["client_id"],
+		Scope:     sess.metadata["scope"],
+		CreatedAt: rt.createdAt,
+		ExpiresAt: rt.expiresAt,
+	}, nil
+}
+
+func (s *memoryStore) PurgeExpired(ctx context.Context, cutoff time.Time, limit int) (int, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var challenges, sessions int
+	for k, c := range s.challenges {
+		if challenges < limit && c.ExpiresAt.Before(cutoff) {
+			delete(s.challenges, k)
+			challenges++
+		}
+	}
+	for id, sess := range s.sessions {
+		if sessions < limit && (sess.ExpiresAt.Before(cutoff) || sess.revoked && sess.revokedAt.Before(cutoff)) {
+			delete(s.sessions, id)
+			sessions++
+			for hash, rt := range s.refresh {
+				if rt.sessionID == id {
+					delete(s.refresh, hash)
+				}
+			}
+		}
+	}
+	return challenges, sessions, nil
+}
+
+func (s *memoryStore) AppendAuditEvent(ctx context.Context, ev *auditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prevSeq, prevHash := int64(0), auditGenesisHash
+	if n := len(s.audit); n > 0 {
+		prevSeq, prevHash = s.audit[n-1].Seq, s.audit[n-1].Hash
+	}
+	ev.chain(prevSeq, prevHash)
+	s.audit = append(s.audit, *ev)
+	return nil
+}
+
+func (s *memoryStore) AuditHead(ctx context.Context) (int64, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if n := len(s.audit); n > 0 {
+		return s.audit[n-1].Seq, s.audit[n-1].Hash, nil
+	}
+	return 0, auditGenesisHash, nil
+}
+
+func (s *memoryStore) AuditEvents(ctx context.Context, q auditQuery) ([]auditEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	events := []auditEvent{}
+	for _, e := range s.audit {
+		switch {
+		case e.Seq <= q.AfterSeq,
+			q.Handle != "" && e.Handle != q.Handle,
+			q.Type != "" && e.Type != q.Type,
+			!q.Since.IsZero() && e.Time.Before(q.Since),
+			!q.Until.IsZero() && !e.Time.Before(q.Until):
+			continue
+		}
+		events = append(events, e)
+		if len(events) == q.Limit {
+			break
+		}
+	}
+	return events, nil
+}
+
+func (s *memoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (s *memoryStore) PendingMigrations(ctx context.Context) (int, error) {
+	return 0, nil
+}
@@ -0,0 +1,1202 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// postgresStore is the Store backed by Postgres
+type postgresStore struct {
+	db *sql.DB
+}
+
+// connectPostgres opens a Postgres connection pool, waiting for the
+// database to come up
+func connectPostgres(dbURL string) (*sql.DB, error) {
+	db := sql.OpenDB(tracedConnector{driver: &pq.Driver{}, dsn: dbURL, system: "postgresql"})
+
+	// Test database connection with retries (wait for DB to be ready)
+	var err error
+	maxRetries := 30
+	retryDelay := 2 * time.Second
+	for i := 0; i < maxRetries; i++ {
+		err = db.Ping()
+		if err == nil {
+			slog.Info("Connected to database")
+			return db, nil
+		}
+		if i < maxRetries-1 {
+			slog.Warn("Failed to ping database, retrying", "attempt", i+1, "max_attempts", maxRetries, "retry_in", retryDelay.String(), "error", err)
+			time.Sleep(retryDelay)
+		}
+	}
+	db.Close()
+	return nil, fmt.Errorf("failed to ping database after %d attempts: %w", maxRetries, err)
+}
+
+// redeem consumes a challenge in tx, mapping a replay to errChallengeUsed
+func redeem(ctx context.Context, tx *sql.Tx, ch *issuedChallenge) error {
+	consumed, err := consumeChallenge(ctx, tx, ch)
+	if err != nil {
+		return err
+	}
+	if !consumed {
+		return errChallengeUsed
+	}
+	return nil
+}
+
+func (s *postgresStore) CreateUser(ctx context.Context, ch *issuedChallenge, user *User, key *UserKey, recoveryKeys []RecoveryKeyInput) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := redeem(ctx, tx, ch); err != nil {
+		return err
+	}
+
+	var exists bool
+	err = tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM users WHERE handle = $1)", user.Handle).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return errHandleExists
+	}
+
+	// A key added as a device of another identity can't start its own
+	err = tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM user_keys WHERE public_key = $1 AND revoked_at IS NULL)", key.PublicKey).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return errKeyRegistered
+	}
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO users (handle, public_key, key_type, created_at)
+		VALUES ($1, $2, $3, NOW())
+		RETURNING id, created_at
+	`, user.Handle, user.PublicKey, user.KeyType).Scan(&user.ID, &user.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	// The registration key is the identity's first device key
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO user_keys (user_id, name, public_key, key_type, created_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at
+	`, user.ID, key.Name, key.PublicKey, key.KeyType, user.CreatedAt).Scan(&key.ID, &key.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	if _, err := insertRecoveryKeys(ctx, tx, user.ID, recoveryKeys); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *postgresStore) UserByHandle(ctx context.Context, handle string) (*User, error) {
+	u := &User{Handle: handle}
+	err := s.db.QueryRowContext(ctx, `
+		SELECT id, public_key, key_type, created_at
+		FROM users
+		WHERE handle = $1
+	`, handle).Scan(&u.ID, &u.PublicKey, &u.KeyType, &u.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// scanUserKeys reads id, name, public_key, key_type, created_at, last_used_at rows
+func scanUserKeys(rows *sql.Rows) ([]UserKey, error) {
+	defer rows.Close()
+
+	keys := []UserKey{}
+	for rows.Next() {
+		var k UserKey
+		var lastUsed sql.NullTime
+		if err := rows.Scan(&k.ID, &k.Name, &k.PublicKey, &k.KeyType, &k.CreatedAt, &lastUsed); err != nil {
+			return nil, err
+		}
+		if lastUsed.Valid {
+			k.LastUsedAt = &lastUsed.Time
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+func (s *postgresStore) ActiveKeys(ctx context.Context, userID string) ([]UserKey, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, name, public_key, key_type, created_at, last_used_at
+		FROM user_keys
+		WHERE user_id = $1 AND revoked_at IS NULL
+		ORDER BY created_at
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	return scanUserKeys(rows)
+}
+
+func (s *postgresStore) KeyRegistered(ctx context.Context, publicKey string) (bool, error) {
+	var exists bool
+	err := s.db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM user_keys WHERE public_key = $1 AND revoked_at IS NULL)", publicKey).Scan(&exists)
+	return exists, err
+}
+
+func (s *postgresStore) AddKey(ctx context.Context, ch *issuedChallenge, userID string, key *UserKey) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := redeem(ctx, tx, ch); err != nil {
+		return err
+	}
+
+	var exists bool
+	err = tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM user_keys WHERE public_key = $1 AND revoked_at IS NULL)", key.PublicKey).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return errKeyRegistered
+	}
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO user_keys (user_id, name, public_key, key_type, created_at)
+		VALUES ($1, $2, $3, $4, NOW())
+		RETURNING id, created_at
+	`, userID, key.Name, key.PublicKey, key.KeyType).Scan(&key.ID, &key.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *postgresStore) RemoveKey(ctx context.Context, userID, keyID string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Lock the user's keys so two removals can't leave zero keys
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id FROM user_keys
+		WHERE user_id = $1 AND revoked_at IS NULL
+		FOR UPDATE
+	`, userID)
+	if err != nil {
+		return err
+	}
+	var active int
+	var found bool
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		active++
+		found = found || id == keyID
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if !found {
+		return errNotFound
+	}
+	if active == 1 {
+		return errLastKey
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE user_keys SET revoked_at = NOW() WHERE id = $1", keyID); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+		UPDATE sessions SET revoked_at = NOW()
+		WHERE user_id = $1 AND metadata->>'key_id' = $2 AND revoked_at IS NULL
+	`, userID, keyID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *postgresStore) AdvanceSignCount(ctx context.Context, keyID string, count uint32) error {
+	result, err := s.db.ExecContext(ctx, `
+		INSERT INTO webauthn_sign_counts (key_id, sign_count, updated_at)
+		VALUES ($1, $2, NOW())
+		ON CONFLICT (key_id) DO UPDATE SET sign_count = EXCLUDED.sign_count, updated_at = NOW()
+		WHERE webauthn_sign_counts.sign_count < EXCLUDED.sign_count
+		   OR (webauthn_sign_counts.sign_count = 0 AND EXCLUDED.sign_count = 0)
+	`, keyID, int64(count))
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errSignCountRegressed
+	}
+	return nil
+}
+
+// insertRecoveryKeys stores recovery keys for a user
+func insertRecoveryKeys(ctx context.Context, tx *sql.Tx, userID string, keys []RecoveryKeyInput) ([]RecoveryKey, error) {
+	added := []RecoveryKey{}
+	for _, k := range keys {
+		rk := RecoveryKey{Name: k.Name, PublicKey: k.PublicKey, KeyType: k.KeyType}
+		err := tx.QueryRowContext(ctx, `
+			INSERT INTO recovery_keys (user_id, name, public_key, key_type, created_at)
+			VALUES ($1, $2, $3, $4, NOW())
+			RETURNING id, created_at
+		`, userID, k.Name, k.PublicKey, k.KeyType).Scan(&rk.ID, &rk.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		added = append(added, rk)
+	}
+	return added, nil
+}
+
+// enrollRecoveredKey revokes every device key and session of a user and
+// enrolls a single new key in their place, making it the primary key
+func enrollRecoveredKey(ctx context.Context, tx *sql.Tx, userID string, key *UserKey) error {
+	// Whoever holds the old device keys must lose access
+	if _, err := tx.ExecContext(ctx, "UPDATE user_keys SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL", userID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE sessions SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL", userID); err != nil {
+		return err
+	}
+
+	var exists bool
+	err := tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM user_keys WHERE public_key = $1 AND revoked_at IS NULL)", key.PublicKey).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return errKeyRegistered
+	}
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO user_keys (user_id, name, public_key, key_type, created_at)
+		VALUES ($1, $2, $3, $4, NOW())
+		RETURNING id, created_at
+	`, userID, key.Name, key.PublicKey, key.KeyType).Scan(&key.ID, &key.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	// The recovered key becomes the handle's primary key
+	_, err = tx.ExecContext(ctx, "UPDATE users SET public_key = $1, key_type = $2 WHERE id = $3", key.PublicKey, key.KeyType, userID)
+	return err
+}
+
+func (s *postgresStore) RotateKey(ctx context.Context, ch *issuedChallenge, userID string, rot keyRotation, newKey *UserKey) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := redeem(ctx, tx, ch); err != nil {
+		return err
+	}
+
+	var exists bool
+	err = tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM user_keys WHERE public_key = $1 AND revoked_at IS NULL)", newKey.PublicKey).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return errKeyRegistered
+	}
+
+	// Revoke the old key first so a concurrent rotation of the same key fails
+	var oldPublicKey string
+	err = tx.QueryRowContext(ctx, `
+		UPDATE user_keys SET revoked_at = NOW()
+		WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL
+		RETURNING public_key
+	`, rot.OldKeyID, userID).Scan(&oldPublicKey)
+	if err == sql.ErrNoRows {
+		return errNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO user_keys (user_id, name, public_key, key_type, created_at)
+		VALUES ($1, $2, $3, $4, NOW())
+		RETURNING id, created_at
+	`, userID, newKey.Name, newKey.PublicKey, newKey.KeyType).Scan(&newKey.ID, &newKey.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO key_rotations (user_id, old_key_id, new_key_id, statement, old_signature, new_signature, rotated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`, userID, rot.OldKeyID, newKey.ID, rot.Statement, rot.OldSignature, rot.NewSignature, newKey.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	// If the handle's original key was rotated, the new key takes its place
+	_, err = tx.ExecContext(ctx, `
+		UPDATE users SET public_key = $1, key_type = $2
+		WHERE id = $3 AND public_key = $4
+	`, newKey.PublicKey, newKey.KeyType, userID, oldPublicKey)
+	if err != nil {
+		return err
+	}
+
+	// Rotation usually follows a suspected compromise: end the old key's sessions
+	_, err = tx.ExecContext(ctx, `
+		UPDATE sessions SET revoked_at = NOW()
+		WHERE user_id = $1 AND metadata->>'key_id' = $2 AND revoked_at IS NULL
+	`, userID, rot.OldKeyID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *postgresStore) KeyRotations(ctx context.Context, handle string) ([]KeyRotation, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT o.public_key, o.key_type, n.public_key, n.key_type,
+		       kr.statement, kr.old_signature, kr.new_signature, kr.rotated_at
+		FROM key_rotations kr
+		JOIN users u ON u.id = kr.user_id
+		JOIN user_keys o ON o.id = kr.old_key_id
+		JOIN user_keys n ON n.id = kr.new_key_id
+		WHERE u.handle = $1
+		ORDER BY kr.rotated_at
+	`, handle)
+	if err != nil {
+		return nil, err
+	}
+	return scanKeyRotations(rows)
+}
+
+// scanKeyRotations reads the rows of a key rotation history query
+func scanKeyRotations(rows *sql.Rows) ([]KeyRotation, error) {
+	defer rows.Close()
+
+	rotations := []KeyRotation{}
+	for rows.Next() {
+		var kr KeyRotation
+		err := rows.Scan(&kr.OldPublicKey, &kr.OldKeyType, &kr.NewPublicKey, &kr.NewKeyType,
+			&kr.Statement, &kr.OldSignature, &kr.NewSignature, &kr.RotatedAt)
+		if err != nil {
+			return nil, err
+		}
+		rotations = append(rotations, kr)
+	}
+	return rotations, rows.Err()
+}
+
+func (s *postgresStore) AddRecoveryKeys(ctx context.Context, ch *issuedChallenge, userID string, keys []RecoveryKeyInput) ([]RecoveryKey, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := redeem(ctx, tx, ch); err != nil {
+		return nil, err
+	}
+
+	added, err := insertRecoveryKeys(ctx, tx, userID, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	return added, tx.Commit()
+}
+
+func (s *postgresStore) RecoveryKeys(ctx context.Context, userID string) ([]RecoveryKey, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, name, public_key, key_type, created_at
+		FROM recovery_keys
+		WHERE user_id = $1 AND used_at IS NULL AND revoked_at IS NULL
+		ORDER BY created_at
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	return scanRecoveryKeys(rows)
+}
+
+// scanRecoveryKeys reads id, name, public_key, key_type, created_at rows
+func scanRecoveryKeys(rows *sql.Rows) ([]RecoveryKey, error) {
+	defer rows.Close()
+
+	keys := []RecoveryKey{}
+	for rows.Next() {
+		var rk RecoveryKey
+		if err := rows.Scan(&rk.ID, &rk.Name, &rk.PublicKey, &rk.KeyType, &rk.CreatedAt); err != nil {
+			return nil, err
+		}
+		keys = append(keys, rk)
+	}
+	return keys, rows.Err()
+}
+
+func (s *postgresStore) RemoveRecoveryKey(ctx context.Context, userID, recoveryKeyID string) error {
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE recovery_keys SET revoked_at = NOW()
+		WHERE id::text = $1 AND user_id = $2 AND used_at IS NULL AND revoked_at IS NULL
+	`, recoveryKeyID, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (s *postgresStore) Recover(ctx context.Context, ch *issuedChallenge, userID, recoveryKeyID string, key *UserKey) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := redeem(ctx, tx, ch); err != nil {
+		return err
+	}
+
+	// Recovery keys are single-use
+	result, err := tx.ExecContext(ctx, `
+		UPDATE recovery_keys SET used_at = NOW()
+		WHERE id = $1 AND user_id = $2 AND used_at IS NULL AND revoked_at IS NULL
+	`, recoveryKeyID, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errRecoveryKeyUsed
+	}
+
+	if err := enrollRecoveredKey(ctx, tx, userID, key); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *postgresStore) SetGuardians(ctx context.Context, ch *issuedChallenge, userID string, guardianIDs []string, threshold int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := redeem(ctx, tx, ch); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM guardians WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+	for _, id := range guardianIDs {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO guardians (user_id, guardian_id, created_at) VALUES ($1, $2, NOW())", userID, id); err != nil {
+			return err
+		}
+	}
+
+	if threshold == 0 {
+		_, err = tx.ExecContext(ctx, "DELETE FROM guardian_policies WHERE user_id = $1", userID)
+	} else {
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO guardian_policies (user_id, threshold, updated_at)
+			VALUES ($1, $2, NOW())
+			ON CONFLICT (user_id) DO UPDATE SET threshold = EXCLUDED.threshold, updated_at = NOW()
+		`, userID, threshold)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Pending requests were approved under the old policy
+	_, err = tx.ExecContext(ctx, `
+		UPDATE social_recoveries SET status = 'cancelled', closed_at = NOW()
+		WHERE user_id = $1 AND status = 'pending'
+	`, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *postgresStore) Guardians(ctx context.Context, userID string) ([]string, int, error) {
+	var threshold int
+	err := s.db.QueryRowContext(ctx, "SELECT threshold FROM guardian_policies WHERE user_id = $1", userID).Scan(&threshold)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, 0, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT u.handle FROM guardians g
+		JOIN users u ON u.id = g.guardian_id
+		WHERE g.user_id = $1
+		ORDER BY u.handle
+	`, userID)
+	if err != nil {
+		return nil, 0, err
+	}
+	guardians, err := scanHandles(rows)
+	return guardians, threshold, err
+}
+
+// scanHandles reads rows of a single handle column
+func scanHandles(rows *sql.Rows) ([]string, error) {
+	defer rows.Close()
+
+	handles := []string{}
+	for rows.Next() {
+		var handle string
+		if err := rows.Scan(&handle); err != nil {
+			return nil, err
+		}
+		handles = append(handles, handle)
+	}
+	return handles, rows.Err()
+}
+
+func (s *postgresStore) CreateSocialRecovery(ctx context.Context, ch *issuedChallenge, rec *SocialRecovery) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := redeem(ctx, tx, ch); err != nil {
+		return err
+	}
+
+	rec.Status = "pending"
+	rec.EffectiveAt = nil
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO social_recoveries (user_id, name, public_key, key_type, status, created_at)
+		VALUES ($1, $2, $3, $4, $5, NOW())
+		RETURNING id, created_at
+	`, rec.userID, rec.name, rec.PublicKey, rec.KeyType, rec.Status).Scan(&rec.ID, &rec.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// postgresSocialRecoveries selects recovery requests with their current
+// approval count and threshold, for a WHERE clause on sr
+const postgresSocialRecoveries = `
+	SELECT sr.id, u.handle, sr.public_key, sr.key_type, sr.status, sr.created_at, sr.effective_at,
+	       sr.user_id, sr.name, COALESCE(gp.threshold, 0),
+	       (SELECT COUNT(*) FROM social_recovery_approvals a
+	        JOIN guardians g ON g.user_id = sr.user_id AND g.guardian_id = a.guardian_id
+	        WHERE a.recovery_id = sr.id)
+	FROM social_recoveries sr
+	JOIN users u ON u.id = sr.user_id
+	LEFT JOIN guardian_policies gp ON gp.user_id = sr.user_id
+`
+
+// scanSocialRecoveries reads the rows of a recovery request query
+func scanSocialRecoveries(rows *sql.Rows) ([]*SocialRecovery, error) {
+	defer rows.Close()
+
+	recoveries := []*SocialRecovery{}
+	for rows.Next() {
+		rec := &SocialRecovery{}
+		err := rows.Scan(&rec.ID, &rec.Handle, &rec.PublicKey, &rec.KeyType, &rec.Status, &rec.CreatedAt,
+			&rec.EffectiveAt, &rec.userID, &rec.name, &rec.Threshold, &rec.Approvals)
+		if err != nil {
+			return nil, err
+		}
+		recoveries = append(recoveries, rec)
+	}
+	return recoveries, rows.Err()
+}
+
+func (s *postgresStore) SocialRecovery(ctx context.Context, id string) (*SocialRecovery, error) {
+	rows, err := s.db.QueryContext(ctx, postgresSocialRecoveries+"WHERE sr.id::text = $1", id)
+	if err != nil {
+		return nil, err
+	}
+	recoveries, err := scanSocialRecoveries(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(recoveries) == 0 {
+		return nil, errNotFound
+	}
+	return recoveries[0], nil
+}
+
+func (s *postgresStore) PendingSocialRecoveries(ctx context.Context, userID string) ([]*SocialRecovery, error) {
+	rows, err := s.db.QueryContext(ctx, postgresSocialRecoveries+`
+		WHERE sr.user_id = $1 AND sr.status = 'pending'
+		ORDER BY sr.created_at
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	return scanSocialRecoveries(rows)
+}
+
+func (s *postgresStore) ApproveSocialRecovery(ctx context.Context, ch *issuedChallenge, recoveryID, guardianID, signature string, delay time.Duration) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := redeem(ctx, tx, ch); err != nil {
+		return err
+	}
+
+	var status string
+	err = tx.QueryRowContext(ctx, "SELECT status FROM social_recoveries WHERE id = $1 FOR UPDATE", recoveryID).Scan(&status)
+	if err == sql.ErrNoRows {
+		return errNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if status != "pending" {
+		return errRecoveryClosed
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO social_recovery_approvals (recovery_id, guardian_id, signature, created_at)
+		VALUES ($1, $2, $3, NOW())
+		ON CONFLICT (recovery_id, guardian_id) DO NOTHING
+	`, recoveryID, guardianID, signature)
+	if err != nil {
+		return err
+	}
+
+	// The waiting period starts once enough guardians have approved
+	_, err = tx.ExecContext(ctx, `
+		UPDATE social_recoveries SET effective_at = NOW() + $2 * INTERVAL '1 microsecond'
+		WHERE id = $1 AND effective_at IS NULL
+		  AND (SELECT COUNT(*) FROM social_recovery_approvals a
+		       JOIN guardians g ON g.user_id = social_recoveries.user_id AND g.guardian_id = a.guardian_id
+		       WHERE a.recovery_id = social_recoveries.id)
+		      >= (SELECT threshold FROM guardian_policies gp WHERE gp.user_id = social_recoveries.user_id)
+	`, recoveryID, delay.Microseconds())
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *postgresStore) CancelSocialRecovery(ctx context.Context, ch *issuedChallenge, recoveryID string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := redeem(ctx, tx, ch); err != nil {
+		return err
+	}
+
+	result, err := tx.ExecContext(ctx, `
+		UPDATE social_recoveries SET status = 'cancelled', closed_at = NOW()
+		WHERE id = $1 AND status = 'pending'
+	`, recoveryID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errRecoveryClosed
+	}
+
+	return tx.Commit()
+}
+
+func (s *postgresStore) CompleteSocialRecovery(ctx context.Context, recoveryID string, key *UserKey) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var userID, status string
+	var effective bool
+	err = tx.QueryRowContext(ctx, `
+		SELECT user_id, status, COALESCE(effective_at <= NOW(), FALSE)
+		FROM social_recoveries WHERE id = $1
+		FOR UPDATE
+	`, recoveryID).Scan(&userID, &status, &effective)
+	if err == sql.ErrNoRows {
+		return errNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if status != "pending" {
+		return errRecoveryClosed
+	}
+	if !effective {
+		return errRecoveryWaiting
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE social_recoveries SET status = 'completed', closed_at = NOW() WHERE id = $1", recoveryID)
+	if err != nil {
+		return err
+	}
+
+	if err := enrollRecoveredKey(ctx, tx, userID, key); err != nil {
+		return err
+	}
+
+	// Any competing requests are moot now
+	_, err = tx.ExecContext(ctx, `
+		UPDATE social_recoveries SET status = 'cancelled', closed_at = NOW()
+		WHERE user_id = $1 AND status = 'pending'
+	`, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *postgresStore) SaveChallenge(ctx context.Context, handle string, ch *ChallengeResponse) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO challenges (handle, challenge, created_at, expires_at, used)
+		VALUES ($1, $2, $3, $4, FALSE)
+	`, handle, ch.Challenge, ch.IssuedAt, ch.ExpiresAt)
+	return err
+}
+
+func (s *postgresStore) FindChallenge(ctx context.Context, handle, challenge string) (*issuedChallenge, bool, error) {
+	ch := &issuedChallenge{}
+	var used bool
+	err := s.db.QueryRowContext(ctx, `
+		SELECT id, created_at, expires_at, used
+		FROM challenges
+		WHERE handle = $1 AND challenge = $2
+	`, handle, challenge).Scan(&ch.ID, &ch.IssuedAt, &ch.ExpiresAt, &used)
+	if err == sql.ErrNoRows {
+		return nil, false, errNotFound
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return ch, used, nil
+}
+
+func (s *postgresStore) RedeemChallenge(ctx context.Context, ch *issuedChallenge) error {
+	consumed, err := consumeChallenge(ctx, s.db, ch)
+	if err != nil {
+		return err
+	}
+	if !consumed {
+		return errChallengeUsed
+	}
+	return nil
+}
+
+func (s *postgresStore) Login(ctx context.Context, ch *issuedChallenge, sess *sessionRecord) error {
+	metadata, err := json.Marshal(sess.Metadata)
+	if err != nil {
+		return err
+	}
+
+	// Redeeming the challenge and recording the login happen together: a
+	// session is only created if this request is the one that used the
+	// challenge
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := redeem(ctx, tx, ch); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE users SET last_login = NOW() WHERE id = $1", sess.UserID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE user_keys SET last_used_at = NOW() WHERE id = $1", sess.KeyID); err != nil {
+		return err
+	}
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO sessions (user_id, token, created_at, expires_at, last_activity, metadata)
+		VALUES ($1, $2, NOW(), $3, NOW(), $4)
+		RETURNING id
+	`, sess.UserID, sess.TokenHash, sess.ExpiresAt, string(metadata)).Scan(&sess.ID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO refresh_tokens (session_id, token_hash, created_at, expires_at)
+		VALUES ($1, $2, NOW(), $3)
+	`, sess.ID, sess.RefreshTokenHash, sess.ExpiresAt)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *postgresStore) SessionByToken(ctx context.Context, tokenHash string) (*authSession, error) {
+	var sess authSession
+	err := s.db.QueryRowContext(ctx, `
+		UPDATE sessions s SET last_activity = NOW()
+		FROM users u
+		WHERE s.user_id = u.id AND s.token = $1
+		  AND s.revoked_at IS NULL AND s.expires_at > NOW()
+		RETURNING s.id, u.id, u.handle
+	`, tokenHash).Scan(&sess.ID, &sess.UserID, &sess.Handle)
+	if err == sql.ErrNoRows {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &sess, nil
+}
+
+func (s *postgresStore) ListSessions(ctx context.Context, userID string) ([]Session, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, created_at, expires_at, last_activity,
+		       COALESCE(metadata->>'user_agent', ''), COALESCE(metadata->>'ip', '')
+		FROM sessions
+		WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > NOW()
+		ORDER BY created_at DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var sess Session
+		var lastActivity sql.NullTime
+		if err := rows.Scan(&sess.ID, &sess.CreatedAt, &sess.ExpiresAt, &lastActivity, &sess.UserAgent, &sess.IP); err != nil {
+			return nil, err
+		}
+		if lastActivity.Valid {
+			sess.LastActivity = &lastActivity.Time
+		}
+		sessions = append(sessions, sess)
+	}
+	return sessions, rows.Err()
+}
+
+func (s *postgresStore) RevokeSession(ctx context.Context, userID, sessionID string) error {
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE sessions SET revoked_at = NOW()
+		WHERE id::text = $1 AND user_id = $2 AND revoked_at IS NULL
+	`, sessionID, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (s *postgresStore) LookupRefreshToken(ctx context.Context, tokenHash string) (*refreshGrant, error) {
+	g := &refreshGrant{}
+	err := s.db.QueryRowContext(ctx, `
+		SELECT rt.session_id, u.handle, COALESCE(k.key_type, u.key_type), s.expires_at
+		FROM refresh_tokens rt
+		JOIN sessions s ON s.id = rt.session_id
+		JOIN users u ON u.id = s.user_id
+		LEFT JOIN user_keys k ON k.id::text = s.metadata->>'key_id'
+		WHERE rt.token_hash = $1
+	`, tokenHash).Scan(&g.SessionID, &g.Handle, &g.KeyType, &g.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func (s *postgresStore) RotateRefreshToken(ctx context.Context, tokenHash, accessTokenHash, newTokenHash string, expiresAt time.Time) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var refreshID, sessionID string
+	var tokenExpiresAt time.Time
+	var usedAt, revokedAt sql.NullTime
+	err = tx.QueryRowContext(ctx, `
+		SELECT rt.id, rt.session_id, rt.expires_at, rt.used_at, s.revoked_at
+		FROM refresh_tokens rt
+		JOIN sessions s ON s.id = rt.session_id
+		WHERE rt.token_hash = $1
+		FOR UPDATE OF rt, s
+	`, tokenHash).Scan(&refreshID, &sessionID, &tokenExpiresAt, &usedAt, &revokedAt)
+	if err == sql.ErrNoRows {
+		return errNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	if revokedAt.Valid {
+		return errSessionRevoked
+	}
+
+	// A rotated token coming back means it was copied: kill the family
+	if usedAt.Valid {
+		if _, err := tx.ExecContext(ctx, "UPDATE sessions SET revoked_at = NOW() WHERE id = $1", sessionID); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		return errRefreshReused
+	}
+
+	if time.Now().After(tokenExpiresAt) {
+		return errRefreshExpired
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE refresh_tokens SET used_at = NOW() WHERE id = $1", refreshID); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO refresh_tokens (session_id, token_hash, created_at, expires_at)
+		VALUES ($1, $2, NOW(), $3)
+	`, sessionID, newTokenHash, expiresAt)
+	if err != nil {
+		return err
+	}
+
+	// The session now answers to the new access token only
+	_, err = tx.ExecContext(ctx, `
+		UPDATE sessions SET token = $1, last_activity = NOW()
+		WHERE id = $2
+	`, accessTokenHash, sessionID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *postgresStore) AccessTokenClient(ctx context.Context, tokenHash string) (string, string, error) {
+	var clientID, scope string
+	err := s.db.QueryRowContext(ctx, `
+		SELECT COALESCE(metadata->>'client_id', ''), COALESCE(metadata->>'scope', '')
+		FROM sessions
+		WHERE token = $1 AND revoked_at IS NULL AND expires_at > NOW()
+	`, tokenHash).Scan(&clientID, &scope)
+	if err == sql.ErrNoRows {
+		return "", "", errNotFound
+	}
+	return clientID, scope, err
+}
+
+func (s *postgresStore) RefreshTokenStatus(ctx context.Context, tokenHash string) (*refreshTokenStatus, error) {
+	st := &refreshTokenStatus{}
+	err := s.db.QueryRowContext(ctx, `
+		SELECT u.handle, rt.created_at, rt.expires_at,
+		       COALESCE(s.metadata->>'client_id', ''), COALESCE(s.metadata->>'scope', '')
+		FROM refresh_tokens rt
+		JOIN sessions s ON s.id = rt.session_id
+		JOIN users u ON u.id = s.user_id
+		WHERE rt.token_hash = $1 AND rt.used_at IS NULL AND rt.expires_at > NOW()
+		  AND s.revoked_at IS NULL
+	`, tokenHash).Scan(&st.Handle, &st.CreatedAt, &st.ExpiresAt, &st.ClientID, &st.Scope)
+	if err == sql.ErrNoRows {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// janitorLockID is the advisory lock taken by each purge batch, so only one
+// replica prunes at a time
+const janitorLockID = 0x61757468677273 // "authgrs"
+
+func (s *postgresStore) PurgeExpired(ctx context.Context, cutoff time.Time, limit int) (int, int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	// Transaction-level lock: released at commit, so a replica that dies
+	// mid-batch doesn't block the others
+	var locked bool
+	if err := tx.QueryRowContext(ctx, "SELECT pg_try_advisory_xact_lock($1)", janitorLockID).Scan(&locked); err != nil {
+		return 0, 0, err
+	}
+	if !locked {
+		return 0, 0, errLocked
+	}
+
+	result, err := tx.ExecContext(ctx, `
+		DELETE FROM challenges WHERE id IN (
+			SELECT id FROM challenges WHERE expires_at < $1 LIMIT $2
+		)
+	`, cutoff, limit)
+	if err != nil {
+		return 0, 0, err
+	}
+	challenges, _ := result.RowsAffected()
+
+	// Refresh tokens go with their session (ON DELETE CASCADE)
+	result, err = tx.ExecContext(ctx, `
+		DELETE FROM sessions WHERE id IN (
+			SELECT id FROM sessions WHERE expires_at < $1 OR revoked_at < $1 LIMIT $2
+		)
+	`, cutoff, limit)
+	if err != nil {
+		return 0, 0, err
+	}
+	sessions, _ := result.RowsAffected()
+
+	return int(challenges), int(sessions), tx.Commit()
+}
+
+// auditLockID serializes audit appends so each event chains to the last
+const auditLockID = 0x61757468677261 // "authgra"
+
+func (s *postgresStore) AppendAuditEvent(ctx context.Context, ev *auditEvent) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", auditLockID); err != nil {
+		return err
+	}
+
+	var prevSeq int64
+	prevHash := auditGenesisHash
+	err = tx.QueryRowContext(ctx, "SELECT seq, hash FROM audit_events ORDER BY seq DESC LIMIT 1").Scan(&prevSeq, &prevHash)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	ev.chain(prevSeq, prevHash)
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO audit_events (seq, time, type, handle, ip, user_agent, outcome, reason, prev_hash, hash)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	`, ev.Seq, ev.Time, ev.Type, ev.Handle, ev.IP, ev.UserAgent, ev.Outcome, ev.Reason, ev.PrevHash, ev.Hash)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *postgresStore) AuditHead(ctx context.Context) (int64, string, error) {
+	var seq int64
+	hash := auditGenesisHash
+	err := s.db.QueryRowContext(ctx, "SELECT seq, hash FROM audit_events ORDER BY seq DESC LIMIT 1").Scan(&seq, &hash)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, "", err
+	}
+	return seq, hash, nil
+}
+
+func (s *postgresStore) AuditEvents(ctx context.Context, q auditQuery) ([]auditEvent, error) {
+	where, args := []string{"seq > $1"}, []interface{}{q.AfterSeq}
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(cond, len(args)))
+	}
+	if q.Handle != "" {
+		add("handle = $%d", q.Handle)
+	}
+	if q.Type != "" {
+		add("type = $%d", q.Type)
+	}
+	if !q.Since.IsZero() {
+		add("time >= $%d", q.Since.UTC())
+	}
+	if !q.Until.IsZero() {
+		add("time < $%d", q.Until.UTC())
+	}
+	args = append(args, q.Limit)
+
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf(`
+		SELECT seq, time, type, handle, ip, user_agent, outcome, reason, prev_hash, hash
+		FROM audit_events
+		WHERE %s
+		ORDER BY seq
+		LIMIT $%d
+	`, strings.Join(where, " AND "), len(args)), args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanAuditEvents(rows)
+}
+
+// scanAuditEvents reads the audit_events columns in table order
+func scanAuditEvents(rows *sql.Rows) ([]auditEvent, error) {
+	defer rows.Close()
+
+	events := []auditEvent{}
+	for rows.Next() {
+		var e auditEvent
+		if err := rows.Scan(&e.Seq, &e.Time, &e.Type, &e.Handle, &e.IP, &e.UserAgent, &e.Outcome, &e.Reason, &e.PrevHash, &e.Hash); err != nil {
+			return nil, err
+		}
+		e.Time = e.Time.UTC()
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+func (s *postgresStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *postgresStore) PendingMigrations(ctx context.Context) (int, error) {
+	return pendingMigrations(ctx, s.db, postgresMigrations)
+}
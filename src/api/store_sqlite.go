@@ -0,0 +1,1083 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// sqliteStore is the Store backed by a single SQLite file. Its schema is
+// created by the migrations in migrations/sqlite: UUIDs are generated by the
+// API and stored as text, JSONB metadata is a JSON text column read with
+// json_extract, and timestamps are written in UTC so they compare in order.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+// openSQLite opens (creating if needed) the database file named by a
+// sqlite:// URL: sqlite:///var/lib/authgrid.db is an absolute path,
+// sqlite://authgrid.db a relative one
+func openSQLite(dbURL string) (*sqliteStore, error) {
+	path := strings.TrimPrefix(dbURL, "sqlite://")
+	if path == "" {
+		return nil, fmt.Errorf("DATABASE_URL %q has no file path", dbURL)
+	}
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	dsn := path + sep + "_foreign_keys=on&_journal_mode=WAL&_busy_timeout=5000"
+
+	conn := sql.OpenDB(tracedConnector{driver: &sqlite3.SQLiteDriver{}, dsn: dsn, system: "sqlite"})
+	// SQLite allows one writer at a time. A single connection serializes
+	// transactions in the API instead of failing them with SQLITE_BUSY.
+	conn.SetMaxOpenConns(1)
+
+	// Fail at startup, not on the first request, if the file can't be
+	// opened or the binary was built without cgo
+	if err := conn.Ping(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to open SQLite database %s: %w", path, err)
+	}
+
+	return &sqliteStore{db: conn}, nil
+}
+
+// now is the current time as stored in SQLite
+func (s *sqliteStore) now() time.Time {
+	return time.Now().UTC()
+}
+
+// redeem marks a challenge used in tx, or consumes it from the replay cache
+// in sealed mode
+func (s *sqliteStore) redeem(ctx context.Context, tx *sql.Tx, ch *issuedChallenge) error {
+	if sealer != nil {
+		consumed, err := sealer.replay.consume(ctx, nil, ch.ID, ch.ExpiresAt)
+		if err != nil {
+			return err
+		}
+		if !consumed {
+			return errChallengeUsed
+		}
+		return nil
+	}
+
+	result, err := tx.ExecContext(ctx, "UPDATE challenges SET used = 1 WHERE id = ? AND used = 0", ch.ID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errChallengeUsed
+	}
+	return nil
+}
+
+// sqliteKeyRegistered reports whether publicKey is an active key of anyone
+func sqliteKeyRegistered(ctx context.Context, q execer, publicKey string) (bool, error) {
+	var exists bool
+	err := q.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM user_keys WHERE public_key = ? AND revoked_at IS NULL)", publicKey).Scan(&exists)
+	return exists, err
+}
+
+// sqliteInsertRecoveryKeys stores recovery keys for a user
+func sqliteInsertRecoveryKeys(ctx context.Context, tx *sql.Tx, userID string, keys []RecoveryKeyInput, now time.Time) ([]RecoveryKey, error) {
+	added := []RecoveryKey{}
+	for _, k := range keys {
+		rk := RecoveryKey{ID: newID(), Name: k.Name, PublicKey: k.PublicKey, KeyType: k.KeyType, CreatedAt: now}
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO recovery_keys (id, user_id, name, public_key, key_type, created_at)
+			VALUES (?, ?, ?, ?, ?, ?)
+		`, rk.ID, userID, rk.Name, rk.PublicKey, rk.KeyType, rk.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		added = append(added, rk)
+	}
+	return added, nil
+}
+
+func (s *sqliteStore) CreateUser(ctx context.Context, ch *issuedChallenge, user *User, key *UserKey, recoveryKeys []RecoveryKeyInput) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := s.redeem(ctx, tx, ch); err != nil {
+		return err
+	}
+
+	var exists bool
+	err = tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM users WHERE handle = ?)", user.Handle).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return errHandleExists
+	}
+
+	// A key added as a device of another identity can't start its own
+	exists, err = sqliteKeyRegistered(ctx, tx, key.PublicKey)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return errKeyRegistered
+	}
+
+	user.ID = newID()
+	user.CreatedAt = s.now()
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO users (id, handle, public_key, key_type, created_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, user.ID, user.Handle, user.PublicKey, user.KeyType, user.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	// The registration key is the identity's first device key
+	key.ID = newID()
+	key.CreatedAt = user.CreatedAt
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO user_keys (id, user_id, name, public_key, key_type, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, key.ID, user.ID, key.Name, key.PublicKey, key.KeyType, key.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	if _, err := sqliteInsertRecoveryKeys(ctx, tx, user.ID, recoveryKeys, user.CreatedAt); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqliteStore) UserByHandle(ctx context.Context, handle string) (*User, error) {
+	u := &User{Handle: handle}
+	err := s.db.QueryRowContext(ctx, `
+		SELECT id, public_key, key_type, created_at
+		FROM users
+		WHERE handle = ?
+	`, handle).Scan(&u.ID, &u.PublicKey, &u.KeyType, &u.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (s *sqliteStore) ActiveKeys(ctx context.Context, userID string) ([]UserKey, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, name, public_key, key_type, created_at, last_used_at
+		FROM user_keys
+		WHERE user_id = ? AND revoked_at IS NULL
+		ORDER BY created_at
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	return scanUserKeys(rows)
+}
+
+func (s *sqliteStore) KeyRegistered(ctx context.Context, publicKey string) (bool, error) {
+	return sqliteKeyRegistered(ctx, s.db, publicKey)
+}
+
+func (s *sqliteStore) AddKey(ctx context.Context, ch *issuedChallenge, userID string, key *UserKey) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := s.redeem(ctx, tx, ch); err != nil {
+		return err
+	}
+
+	exists, err := sqliteKeyRegistered(ctx, tx, key.PublicKey)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return errKeyRegistered
+	}
+
+	key.ID = newID()
+	key.CreatedAt = s.now()
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO user_keys (id, user_id, name, public_key, key_type, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, key.ID, userID, key.Name, key.PublicKey, key.KeyType, key.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqliteStore) RemoveKey(ctx context.Context, userID, keyID string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Transactions are serialized, so counting here is as good as a lock
+	var active int
+	var found bool
+	err = tx.QueryRowContext(ctx, `
+		SELECT COUNT(*), COALESCE(SUM(id = ?), 0) > 0
+		FROM user_keys
+		WHERE user_id = ? AND revoked_at IS NULL
+	`, keyID, userID).Scan(&active, &found)
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		return errNotFound
+	}
+	if active == 1 {
+		return errLastKey
+	}
+
+	now := s.now()
+	if _, err := tx.ExecContext(ctx, "UPDATE user_keys SET revoked_at = ? WHERE id = ?", now, keyID); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+		UPDATE sessions SET revoked_at = ?
+		WHERE user_id = ? AND json_extract(metadata, '$.key_id') = ? AND revoked_at IS NULL
+	`, now, userID, keyID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqliteStore) AdvanceSignCount(ctx context.Context, keyID string, count uint32) error {
+	result, err := s.db.ExecContext(ctx, `
+		INSERT INTO webauthn_sign_counts (key_id, sign_count, updated_at)
+		VALUES (?, ?, ?)
+		ON CONFLICT (key_id) DO UPDATE SET sign_count = excluded.sign_count, updated_at = excluded.updated_at
+		WHERE webauthn_sign_counts.sign_count < excluded.sign_count
+		   OR (webauthn_sign_counts.sign_count = 0 AND excluded.sign_count = 0)
+	`, keyID, int64(count), s.now())
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errSignCountRegressed
+	}
+	return nil
+}
+
+// sqliteEnrollKey revokes every device key and session of a user and
+// enrolls a single new key in their place, making it the primary key
+func sqliteEnrollKey(ctx context.Context, tx *sql.Tx, userID string, key *UserKey, now time.Time) error {
+	// Whoever holds the old device keys must lose access
+	if _, err := tx.ExecContext(ctx, "UPDATE user_keys SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL", now, userID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE sessions SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL", now, userID); err != nil {
+		return err
+	}
+
+	exists, err := sqliteKeyRegistered(ctx, tx, key.PublicKey)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return errKeyRegistered
+	}
+
+	key.ID = newID()
+	key.CreatedAt = now
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO user_keys (id, user_id, name, public_key, key_type, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, key.ID, userID, key.Name, key.PublicKey, key.KeyType, key.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	// The recovered key becomes the handle's primary key
+	_, err = tx.ExecContext(ctx, "UPDATE users SET public_key = ?, key_type = ? WHERE id = ?", key.PublicKey, key.KeyType, userID)
+	return err
+}
+
+func (s *sqliteStore) RotateKey(ctx context.Context, ch *issuedChallenge, userID string, rot keyRotation, newKey *UserKey) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := s.redeem(ctx, tx, ch); err != nil {
+		return err
+	}
+
+	exists, err := sqliteKeyRegistered(ctx, tx, newKey.PublicKey)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return errKeyRegistered
+	}
+
+	now := s.now()
+	var oldPublicKey string
+	err = tx.QueryRowContext(ctx, `
+		UPDATE user_keys SET revoked_at = ?
+		WHERE id = ? AND user_id = ? AND revoked_at IS NULL
+		RETURNING public_key
+	`, now, rot.OldKeyID, userID).Scan(&oldPublicKey)
+	if err == sql.ErrNoRows {
+		return errNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	newKey.ID = newID()
+	newKey.CreatedAt = now
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO user_keys (id, user_id, name, public_key, key_type, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, newKey.ID, userID, newKey.Name, newKey.PublicKey, newKey.KeyType, newKey.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO key_rotations (id, user_id, old_key_id, new_key_id, statement, old_signature, new_signature, rotated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, newID(), userID, rot.OldKeyID, newKey.ID, rot.Statement, rot.OldSignature, rot.NewSignature, now)
+	if err != nil {
+		return err
+	}
+
+	// If the handle's original key was rotated, the new key takes its place
+	_, err = tx.ExecContext(ctx, `
+		UPDATE users SET public_key = ?, key_type = ?
+		WHERE id = ? AND public_key = ?
+	`, newKey.PublicKey, newKey.KeyType, userID, oldPublicKey)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE sessions SET revoked_at = ?
+		WHERE user_id = ? AND json_extract(metadata, '$.key_id') = ? AND revoked_at IS NULL
+	`, now, userID, rot.OldKeyID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqliteStore) KeyRotations(ctx context.Context, handle string) ([]KeyRotation, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT o.public_key, o.key_type, n.public_key, n.key_type,
+		       kr.statement, kr.old_signature, kr.new_signature, kr.rotated_at
+		FROM key_rotations kr
+		JOIN users u ON u.id = kr.user_id
+		JOIN user_keys o ON o.id = kr.old_key_id
+		JOIN user_keys n ON n.id = kr.new_key_id
+		WHERE u.handle = ?
+		ORDER BY kr.rotated_at
+	`, handle)
+	if err != nil {
+		return nil, err
+	}
+	return scanKeyRotations(rows)
+}
+
+func (s *sqliteStore) AddRecoveryKeys(ctx context.Context, ch *issuedChallenge, userID string, keys []RecoveryKeyInput) ([]RecoveryKey, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := s.redeem(ctx, tx, ch); err != nil {
+		return nil, err
+	}
+
+	added, err := sqliteInsertRecoveryKeys(ctx, tx, userID, keys, s.now())
+	if err != nil {
+		return nil, err
+	}
+
+	return added, tx.Commit()
+}
+
+func (s *sqliteStore) RecoveryKeys(ctx context.Context, userID string) ([]RecoveryKey, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, name, public_key, key_type, created_at
+		FROM recovery_keys
+		WHERE user_id = ? AND used_at IS NULL AND revoked_at IS NULL
+		ORDER BY created_at
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	return scanRecoveryKeys(rows)
+}
+
+func (s *sqliteStore) RemoveRecoveryKey(ctx context.Context, userID, recoveryKeyID string) error {
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE recovery_keys SET revoked_at = ?
+		WHERE id = ? AND user_id = ? AND used_at IS NULL AND revoked_at IS NULL
+	`, s.now(), recoveryKeyID, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (s *sqliteStore) Recover(ctx context.Context, ch *issuedChallenge, userID, recoveryKeyID string, key *UserKey) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := s.redeem(ctx, tx, ch); err != nil {
+		return err
+	}
+
+	// Recovery keys are single-use
+	now := s.now()
+	result, err := tx.ExecContext(ctx, `
+		UPDATE recovery_keys SET used_at = ?
+		WHERE id = ? AND user_id = ? AND used_at IS NULL AND revoked_at IS NULL
+	`, now, recoveryKeyID, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errRecoveryKeyUsed
+	}
+
+	if err := sqliteEnrollKey(ctx, tx, userID, key, now); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqliteStore) SetGuardians(ctx context.Context, ch *issuedChallenge, userID string, guardianIDs []string, threshold int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := s.redeem(ctx, tx, ch); err != nil {
+		return err
+	}
+
+	now := s.now()
+	if _, err := tx.ExecContext(ctx, "DELETE FROM guardians WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	for _, id := range guardianIDs {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO guardians (user_id, guardian_id, created_at) VALUES (?, ?, ?)", userID, id, now); err != nil {
+			return err
+		}
+	}
+
+	if threshold == 0 {
+		_, err = tx.ExecContext(ctx, "DELETE FROM guardian_policies WHERE user_id = ?", userID)
+	} else {
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO guardian_policies (user_id, threshold, updated_at)
+			VALUES (?, ?, ?)
+			ON CONFLICT (user_id) DO UPDATE SET threshold = excluded.threshold, updated_at = excluded.updated_at
+		`, userID, threshold, now)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Pending requests were approved under the old policy
+	_, err = tx.ExecContext(ctx, `
+		UPDATE social_recoveries SET status = 'cancelled', closed_at = ?
+		WHERE user_id = ? AND status = 'pending'
+	`, now, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqliteStore) Guardians(ctx context.Context, userID string) ([]string, int, error) {
+	var threshold int
+	err := s.db.QueryRowContext(ctx, "SELECT threshold FROM guardian_policies WHERE user_id = ?", userID).Scan(&threshold)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, 0, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT u.handle FROM guardians g
+		JOIN users u ON u.id = g.guardian_id
+		WHERE g.user_id = ?
+		ORDER BY u.handle
+	`, userID)
+	if err != nil {
+		return nil, 0, err
+	}
+	guardians, err := scanHandles(rows)
+	return guardians, threshold, err
+}
+
+func (s *sqliteStore) CreateSocialRecovery(ctx context.Context, ch *issuedChallenge, rec *SocialRecovery) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := s.redeem(ctx, tx, ch); err != nil {
+		return err
+	}
+
+	rec.ID = newID()
+	rec.Status = "pending"
+	rec.CreatedAt = s.now()
+	rec.EffectiveAt = nil
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO social_recoveries (id, user_id, name, public_key, key_type, status, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, rec.ID, rec.userID, rec.name, rec.PublicKey, rec.KeyType, rec.Status, rec.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqliteStore) SocialRecovery(ctx context.Context, id string) (*SocialRecovery, error) {
+	// The query is the Postgres one; only the placeholder differs
+	rows, err := s.db.QueryContext(ctx, postgresSocialRecoveries+"WHERE sr.id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	recoveries, err := scanSocialRecoveries(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(recoveries) == 0 {
+		return nil, errNotFound
+	}
+	return recoveries[0], nil
+}
+
+func (s *sqliteStore) PendingSocialRecoveries(ctx context.Context, userID string) ([]*SocialRecovery, error) {
+	rows, err := s.db.QueryContext(ctx, postgresSocialRecoveries+`
+		WHERE sr.user_id = ? AND sr.status = 'pending'
+		ORDER BY sr.created_at
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	return scanSocialRecoveries(rows)
+}
+
+func (s *sqliteStore) ApproveSocialRecovery(ctx context.Context, ch *issuedChallenge, recoveryID, guardianID, signature string, delay time.Duration) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := s.redeem(ctx, tx, ch); err != nil {
+		return err
+	}
+
+	var status string
+	err = tx.QueryRowContext(ctx, "SELECT status FROM social_recoveries WHERE id = ?", recoveryID).Scan(&status)
+	if err == sql.ErrNoRows {
+		return errNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if status != "pending" {
+		return errRecoveryClosed
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO social_recovery_approvals (recovery_id, guardian_id, signature, created_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT (recovery_id, guardian_id) DO NOTHING
+	`, recoveryID, guardianID, signature, s.now())
+	if err != nil {
+		return err
+	}
+
+	// The waiting period starts once enough guardians have approved
+	_, err = tx.ExecContext(ctx, `
+		UPDATE social_recoveries SET effective_at = ?
+		WHERE id = ? AND effective_at IS NULL
+		  AND (SELECT COUNT(*) FROM social_recovery_approvals a
+		       JOIN guardians g ON g.user_id = social_recoveries.user_id AND g.guardian_id = a.guardian_id
+		       WHERE a.recovery_id = social_recoveries.id)
+		      >= (SELECT threshold FROM guardian_policies gp WHERE gp.user_id = social_recoveries.user_id)
+	`, s.now().Add(delay), recoveryID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqliteStore) CancelSocialRecovery(ctx context.Context, ch *issuedChallenge, recoveryID string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := s.redeem(ctx, tx, ch); err != nil {
+		return err
+	}
+
+	result, err := tx.ExecContext(ctx, `
+		UPDATE social_recoveries SET status = 'cancelled', closed_at = ?
+		WHERE id = ? AND status = 'pending'
+	`, s.now(), recoveryID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errRecoveryClosed
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqliteStore) CompleteSocialRecovery(ctx context.Context, recoveryID string, key *UserKey) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := s.now()
+	var userID, status string
+	var effectiveAt sql.NullTime
+	err = tx.QueryRowContext(ctx, "SELECT user_id, status, effective_at FROM social_recoveries WHERE id = ?", recoveryID).Scan(&userID, &status, &effectiveAt)
+	if err == sql.ErrNoRows {
+		return errNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if status != "pending" {
+		return errRecoveryClosed
+	}
+	if !effectiveAt.Valid || effectiveAt.Time.After(now) {
+		return errRecoveryWaiting
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE social_recoveries SET status = 'completed', closed_at = ? WHERE id = ?", now, recoveryID)
+	if err != nil {
+		return err
+	}
+
+	if err := sqliteEnrollKey(ctx, tx, userID, key, now); err != nil {
+		return err
+	}
+
+	// Any competing requests are moot now
+	_, err = tx.ExecContext(ctx, `
+		UPDATE social_recoveries SET status = 'cancelled', closed_at = ?
+		WHERE user_id = ? AND status = 'pending'
+	`, now, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqliteStore) SaveChallenge(ctx context.Context, handle string, ch *ChallengeResponse) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO challenges (id, handle, challenge, created_at, expires_at, used)
+		VALUES (?, ?, ?, ?, ?, 0)
+	`, newID(), handle, ch.Challenge, ch.IssuedAt.UTC(), ch.ExpiresAt.UTC())
+	return err
+}
+
+func (s *sqliteStore) FindChallenge(ctx context.Context, handle, challenge string) (*issuedChallenge, bool, error) {
+	ch := &issuedChallenge{}
+	var used bool
+	err := s.db.QueryRowContext(ctx, `
+		SELECT id, created_at, expires_at, used
+		FROM challenges
+		WHERE handle = ? AND challenge = ?
+	`, handle, challenge).Scan(&ch.ID, &ch.IssuedAt, &ch.ExpiresAt, &used)
+	if err == sql.ErrNoRows {
+		return nil, false, errNotFound
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return ch, used, nil
+}
+
+func (s *sqliteStore) RedeemChallenge(ctx context.Context, ch *issuedChallenge) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := s.redeem(ctx, tx, ch); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) Login(ctx context.Context, ch *issuedChallenge, sess *sessionRecord) error {
+	metadata, err := json.Marshal(sess.Metadata)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := s.redeem(ctx, tx, ch); err != nil {
+		return err
+	}
+
+	now := s.now()
+	if _, err := tx.ExecContext(ctx, "UPDATE users SET last_login = ? WHERE id = ?", now, sess.UserID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE user_keys SET last_used_at = ? WHERE id = ?", now, sess.KeyID); err != nil {
+		return err
+	}
+
+	sess.ID = newID()
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO sessions (id, user_id, token, created_at, expires_at, last_activity, metadata)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, sess.ID, sess.UserID, sess.TokenHash, now, sess.ExpiresAt.UTC(), now, string(metadata))
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO refresh_tokens (id, session_id, token_hash, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, newID(), sess.ID, sess.RefreshTokenHash, now, sess.ExpiresAt.UTC())
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqliteStore) SessionByToken(ctx context.Context, tokenHash string) (*authSession, error) {
+	var sess authSession
+	now := s.now()
+	err := s.db.QueryRowContext(ctx, `
+		UPDATE sessions SET last_activity = ?
+		WHERE token = ? AND revoked_at IS NULL AND expires_at > ?
+		RETURNING id, user_id, (SELECT handle FROM users WHERE users.id = sessions.user_id)
+	`, now, tokenHash, now).Scan(&sess.ID, &sess.UserID, &sess.Handle)
+	if err == sql.ErrNoRows {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &sess, nil
+}
+
+func (s *sqliteStore) ListSessions(ctx context.Context, userID string) ([]Session, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, created_at, expires_at, last_activity,
+		       COALESCE(json_extract(metadata, '$.user_agent'), ''), COALESCE(json_extract(metadata, '$.ip'), '')
+		FROM sessions
+		WHERE user_id = ? AND revoked_at IS NULL AND expires_at > ?
+		ORDER BY created_at DESC
+	`, userID, s.now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var sess Session
+		var lastActivity sql.NullTime
+		if err := rows.Scan(&sess.ID, &sess.CreatedAt, &sess.ExpiresAt, &lastActivity, &sess.UserAgent, &sess.IP); err != nil {
+			return nil, err
+		}
+		if lastActivity.Valid {
+			sess.LastActivity = &lastActivity.Time
+		}
+		sessions = append(sessions, sess)
+	}
+	return sessions, rows.Err()
+}
+
+func (s *sqliteStore) RevokeSession(ctx context.Context, userID, sessionID string) error {
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE sessions SET revoked_at = ?
+		WHERE id = ? AND user_id = ? AND revoked_at IS NULL
+	`, s.now(), sessionID, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (s *sqliteStore) LookupRefreshToken(ctx context.Context, tokenHash string) (*refreshGrant, error) {
+	g := &refreshGrant{}
+	err := s.db.QueryRowContext(ctx, `
+		SELECT rt.session_id, u.handle, COALESCE(k.key_type, u.key_type), s.expires_at
+		FROM refresh_tokens rt
+		JOIN sessions s ON s.id = rt.session_id
+		JOIN users u ON u.id = s.user_id
+		LEFT JOIN user_keys k ON k.id = json_extract(s.metadata, '$.key_id')
+		WHERE rt.token_hash = ?
+	`, tokenHash).Scan(&g.SessionID, &g.Handle, &g.KeyType, &g.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func (s *sqliteStore) RotateRefreshToken(ctx context.Context, tokenHash, accessTokenHash, newTokenHash string, expiresAt time.Time) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var refreshID, sessionID string
+	var tokenExpiresAt time.Time
+	var usedAt, revokedAt sql.NullTime
+	err = tx.QueryRowContext(ctx, `
+		SELECT rt.id, rt.session_id, rt.expires_at, rt.used_at, s.revoked_at
+		FROM refresh_tokens rt
+		JOIN sessions s ON s.id = rt.session_id
+		WHERE rt.token_hash = ?
+	`, tokenHash).Scan(&refreshID, &sessionID, &tokenExpiresAt, &usedAt, &revokedAt)
+	if err == sql.ErrNoRows {
+		return errNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	if revokedAt.Valid {
+		return errSessionRevoked
+	}
+
+	now := s.now()
+
+	// A rotated token coming back means it was copied: kill the family
+	if usedAt.Valid {
+		if _, err := tx.ExecContext(ctx, "UPDATE sessions SET revoked_at = ? WHERE id = ?", now, sessionID); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		return errRefreshReused
+	}
+
+	if now.After(tokenExpiresAt) {
+		return errRefreshExpired
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE refresh_tokens SET used_at = ? WHERE id = ?", now, refreshID); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO refresh_tokens (id, session_id, token_hash, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, newID(), sessionID, newTokenHash, now, expiresAt.UTC())
+	if err != nil {
+		return err
+	}
+
+	// The session now answers to the new access token only
+	_, err = tx.ExecContext(ctx, `
+		UPDATE sessions SET token = ?, last_activity = ?
+		WHERE id = ?
+	`, accessTokenHash, now, sessionID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqliteStore) AccessTokenClient(ctx context.Context, tokenHash string) (string, string, error) {
+	var clientID, scope string
+	err := s.db.QueryRowContext(ctx, `
+		SELECT COALESCE(json_extract(metadata, '$.client_id'), ''), COALESCE(json_extract(metadata, '$.scope'), '')
+		FROM sessions
+		WHERE token = ? AND revoked_at IS NULL AND expires_at > ?
+	`, tokenHash, s.now()).Scan(&clientID, &scope)
+	if err == sql.ErrNoRows {
+		return "", "", errNotFound
+	}
+	return clientID, scope, err
+}
+
+func (s *sqliteStore) RefreshTokenStatus(ctx context.Context, tokenHash string) (*refreshTokenStatus, error) {
+	st := &refreshTokenStatus{}
+	err := s.db.QueryRowContext(ctx, `
+		SELECT u.handle, rt.created_at, rt.expires_at,
+		       COALESCE(json_extract(s.metadata, '$.client_id'), ''), COALESCE(json_extract(s.metadata, '$.scope'), '')
+		FROM refresh_tokens rt
+		JOIN sessions s ON s.id = rt.session_id
+		JOIN users u ON u.id = s.user_id
+		WHERE rt.token_hash = ? AND rt.used_at IS NULL AND rt.expires_at > ?
+		  AND s.revoked_at IS NULL
+	`, tokenHash, s.now()).Scan(&st.Handle, &st.CreatedAt, &st.ExpiresAt, &st.ClientID, &st.Scope)
+	if err == sql.ErrNoRows {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func (s *sqliteStore) PurgeExpired(ctx context.Context, cutoff time.Time, limit int) (int, int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	cutoff = cutoff.UTC()
+	result, err := tx.ExecContext(ctx, `
+		DELETE FROM challenges WHERE id IN (
+			SELECT id FROM challenges WHERE expires_at < ? LIMIT ?
+		)
+	`, cutoff, limit)
+	if err != nil {
+		return 0, 0, err
+	}
+	challenges, _ := result.RowsAffected()
+
+	result, err = tx.ExecContext(ctx, `
+		DELETE FROM sessions WHERE id IN (
+			SELECT id FROM sessions WHERE expires_at < ? OR revoked_at < ? LIMIT ?
+		)
+	`, cutoff, cutoff, limit)
+	if err != nil {
+		return 0, 0, err
+	}
+	sessions, _ := result.RowsAffected()
+
+	return int(challenges), int(sessions), tx.Commit()
+}
+
+func (s *sqliteStore) AppendAuditEvent(ctx context.Context, ev *auditEvent) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var prevSeq int64
+	prevHash := auditGenesisHash
+	err = tx.QueryRowContext(ctx, "SELECT seq, hash FROM audit_events ORDER BY seq DESC LIMIT 1").Scan(&prevSeq, &prevHash)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	ev.chain(prevSeq, prevHash)
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO audit_events (seq, time, type, handle, ip, user_agent, outcome, reason, prev_hash, hash)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, ev.Seq, ev.Time, ev.Type, ev.Handle, ev.IP, ev.UserAgent, ev.Outcome, ev.Reason, ev.PrevHash, ev.Hash)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqliteStore) AuditHead(ctx context.Context) (int64, string, error) {
+	var seq int64
+	hash := auditGenesisHash
+	err := s.db.QueryRowContext(ctx, "SELECT seq, hash FROM audit_events ORDER BY seq DESC LIMIT 1").Scan(&seq, &hash)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, "", err
+	}
+	return seq, hash, nil
+}
+
+func (s *sqliteStore) AuditEvents(ctx context.Context, q auditQuery) ([]auditEvent, error) {
+	where, args := []string{"seq > ?"}, []interface{}{q.AfterSeq}
+	if q.Handle != "" {
+		where, args = append(where, "handle = ?"), append(args, q.Handle)
+	}
+	if q.Type != "" {
+		where, args = append(where, "type = ?"), append(args, q.Type)
+	}
+	if !q.Since.IsZero() {
+		where, args = append(where, "time >= ?"), append(args, q.Since.UTC())
+	}
+	if !q.Until.IsZero() {
+		where, args = append(where, "time < ?"), append(args, q.Until.UTC())
+	}
+	args = append(args, q.Limit)
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT seq, time, type, handle, ip, user_agent, outcome, reason, prev_hash, hash
+		FROM audit_events
+		WHERE `+strings.Join(where, " AND ")+`
+		ORDER BY seq
+		LIMIT ?
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanAuditEvents(rows)
+}
+
+func (s *sqliteStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *sqliteStore) PendingMigrations(ctx context.Context) (int, error) {
+	return pendingMigrations(ctx, s.db, sqliteMigrations)
+}
@@ -1,23 +1,17 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
-	"os"
 
 	"github.com/stripe/stripe-go/v76"
 	"github.com/stripe/stripe-go/v76/checkout/session"
 	stripeWebhook "github.com/stripe/stripe-go/v76/webhook"
 )
 
-// Plan prices (in cents)
-const (
-	StarterPriceID = "price_starter_monthly" // You'll create this in Stripe Dashboard
-	ProPriceID     = "price_pro_monthly"     // You'll create this in Stripe Dashboard
-)
-
 // CheckoutRequest represents the checkout request from frontend
 type CheckoutRequest struct {
 	Plan string `json:"plan"` // "starter" or "pro"
@@ -38,27 +32,19 @@ func createCheckoutSessionHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Set Stripe API key from environment
-	stripeKey := os.Getenv("STRIPE_SECRET_KEY")
-	if stripeKey == "" {
-		log.Println("ERROR: STRIPE_SECRET_KEY environment variable not set")
+	// Set Stripe API key from the configuration
+	cfg := currentConfig().Stripe
+	if cfg.SecretKey == "" {
+		slog.ErrorContext(r.Context(), "STRIPE_SECRET_KEY not set")
 		respondError(w, http.StatusInternalServerError, "Payment system not configured")
 		return
 	}
-	stripe.Key = stripeKey
+	stripe.Key = cfg.SecretKey
 
 	// Determine price ID based on plan
-	var priceID string
-	if req.Plan == "starter" {
-		priceID = os.Getenv("STRIPE_STARTER_PRICE_ID")
-		if priceID == "" {
-			priceID = StarterPriceID // Fallback to constant
-		}
-	} else if req.Plan == "pro" {
-		priceID = os.Getenv("STRIPE_PRO_PRICE_ID")
-		if priceID == "" {
-			priceID = ProPriceID // Fallback to constant
-		}
+	priceID := cfg.StarterPriceID
+	if req.Plan == "pro" {
+		priceID = cfg.ProPriceID
 	}
 
 	// Create Stripe checkout session
@@ -70,8 +56,8 @@ func createCheckoutSessionHandler(w http.ResponseWriter, r *http.Request) {
 				Quantity: stripe.Int64(1),
 			},
 		},
-		SuccessURL: stripe.String("https://authgrid.org/pricing?success=true&session_id={CHECKOUT_SESSION_ID}"),
-		CancelURL:  stripe.String("https://authgrid.org/pricing?canceled=true"),
+		SuccessURL: stripe.String(cfg.SuccessURL),
+		CancelURL:  stripe.String(cfg.CancelURL),
 		SubscriptionData: &stripe.CheckoutSessionSubscriptionDataParams{
 			TrialPeriodDays: stripe.Int64(14), // 14-day free trial
 		},
@@ -79,10 +65,11 @@ func createCheckoutSessionHandler(w http.ResponseWriter, r *http.Request) {
 		BillingAddressCollection: stripe.String("auto"),
 		// CustomerEmail can be added here if user is logged in
 	}
+	params.Context = r.Context()
 
 	sess, err := session.New(params)
 	if err != nil {
-		log.Printf("Stripe checkout session creation failed: %v", err)
+		slog.ErrorContext(r.Context(), "Stripe checkout session creation failed", "error", err)
 		respondError(w, http.StatusInternalServerError, "Failed to create checkout session")
 		return
 	}
@@ -101,22 +88,22 @@ func stripeWebhookHandler(w http.ResponseWriter, r *http.Request) {
 
 	payload, err := io.ReadAll(r.Body)
 	if err != nil {
-		log.Printf("Error reading webhook body: %v", err)
+		slog.WarnContext(r.Context(), "Failed to read webhook body", "error", err)
 		respondError(w, http.StatusBadRequest, "Invalid request body")
 		return
 	}
 
 	// Set Stripe API key
-	stripeKey := os.Getenv("STRIPE_SECRET_KEY")
-	if stripeKey == "" {
-		log.Println("ERROR: STRIPE_SECRET_KEY not set")
+	cfg := currentConfig().Stripe
+	if cfg.SecretKey == "" {
+		slog.ErrorContext(r.Context(), "STRIPE_SECRET_KEY not set")
 		respondError(w, http.StatusInternalServerError, "Payment system not configured")
 		return
 	}
-	stripe.Key = stripeKey
+	stripe.Key = cfg.SecretKey
 
 	// Verify webhook signature (important for security!)
-	webhookSecret := os.Getenv("STRIPE_WEBHOOK_SECRET")
+	webhookSecret := cfg.WebhookSecret
 	var event stripe.Event
 
 	if webhookSecret != "" {
@@ -131,51 +118,53 @@ func stripeWebhookHandler(w http.ResponseWriter, r *http.Request) {
 			},
 		)
 		if err != nil {
-			log.Printf("Webhook signature verification failed: %v", err)
+			slog.WarnContext(r.Context(), "Webhook signature verification failed", "error", err)
 			respondError(w, http.StatusBadRequest, "Invalid signature")
 			return
 		}
 	} else {
 		// No signature verification (not recommended for production!)
-		log.Println("WARNING: Webhook signature verification skipped - STRIPE_WEBHOOK_SECRET not set")
+		slog.WarnContext(r.Context(), "Webhook signature verification skipped, STRIPE_WEBHOOK_SECRET not set")
 		err = json.Unmarshal(payload, &event)
 		if err != nil {
-			log.Printf("Error parsing webhook JSON: %v", err)
+			slog.WarnContext(r.Context(), "Failed to parse webhook JSON", "error", err)
 			respondError(w, http.StatusBadRequest, "Invalid JSON")
 			return
 		}
 	}
 
+	stripeWebhookEvents.WithLabelValues(string(event.Type)).Inc()
+
 	// Handle different event types
 	switch event.Type {
 	case "checkout.session.completed":
-		handleCheckoutCompleted(event)
+		handleCheckoutCompleted(r.Context(), event)
 	case "customer.subscription.deleted":
-		handleSubscriptionDeleted(event)
+		handleSubscriptionDeleted(r.Context(), event)
 	case "invoice.payment_succeeded":
-		handlePaymentSucceeded(event)
+		handlePaymentSucceeded(r.Context(), event)
 	case "invoice.payment_failed":
-		handlePaymentFailed(event)
+		handlePaymentFailed(r.Context(), event)
 	default:
-		log.Printf("Unhandled webhook event type: %s", event.Type)
+		slog.InfoContext(r.Context(), "Unhandled webhook event type", "type", event.Type)
 	}
 
 	respondJSON(w, http.StatusOK, map[string]string{"received": "true"})
 }
 
 // handleCheckoutCompleted processes successful checkouts
-func handleCheckoutCompleted(event stripe.Event) {
+func handleCheckoutCompleted(ctx context.Context, event stripe.Event) {
 	var session stripe.CheckoutSession
 	err := json.Unmarshal(event.Data.Raw, &session)
 	if err != nil {
-		log.Printf("Error parsing checkout.session.completed: %v", err)
+		slog.ErrorContext(ctx, "Failed to parse checkout.session.completed", "error", err)
 		return
 	}
 
-	log.Printf("✅ Payment successful!")
-	log.Printf("   Customer: %s", session.CustomerDetails.Email)
-	log.Printf("   Subscription: %s", session.Subscription.ID)
-	log.Printf("   Amount: $%.2f", float64(session.AmountTotal)/100)
+	slog.InfoContext(ctx, "Payment successful",
+		"customer", session.CustomerDetails.Email,
+		"subscription", session.Subscription.ID,
+		"amount_cents", session.AmountTotal)
 
 	// Send welcome email
 	customerName := session.CustomerDetails.Name
@@ -183,66 +172,64 @@ func handleCheckoutCompleted(event stripe.Event) {
 		customerName = session.CustomerDetails.Email
 	}
 
-	err = sendWelcomeEmail(
+	err = sendWelcomeEmail(ctx,
 		session.CustomerDetails.Email,
 		customerName,
 		session.Subscription.ID,
 	)
+	emailResult := "sent"
+	if err != nil {
+		emailResult = "failed"
+	}
+	emailsSent.WithLabelValues("welcome", emailResult).Inc()
 	if err != nil {
-		log.Printf("⚠️  Failed to send welcome email: %v", err)
+		slog.ErrorContext(ctx, "Failed to send welcome email", "customer", session.CustomerDetails.Email, "error", err)
 		// Don't fail the webhook - email failure shouldn't stop payment processing
 	}
 
 	// TODO: Additional fulfillment steps
 	// 1. Create customer record in database
 	// 2. Generate API keys or provision managed instance
-
-	log.Printf("🎉 NEW CUSTOMER ONBOARDED!")
-	log.Printf("   Welcome email sent to: %s", session.CustomerDetails.Email)
 }
 
 // handleSubscriptionDeleted processes subscription cancellations
-func handleSubscriptionDeleted(event stripe.Event) {
+func handleSubscriptionDeleted(ctx context.Context, event stripe.Event) {
 	var subscription stripe.Subscription
 	err := json.Unmarshal(event.Data.Raw, &subscription)
 	if err != nil {
-		log.Printf("Error parsing customer.subscription.deleted: %v", err)
+		slog.ErrorContext(ctx, "Failed to parse customer.subscription.deleted", "error", err)
 		return
 	}
 
-	log.Printf("❌ Subscription canceled: %s", subscription.ID)
-	log.Printf("   Customer: %s", subscription.Customer.Email)
+	slog.InfoContext(ctx, "Subscription canceled", "subscription", subscription.ID, "customer", subscription.Customer.Email)
 
 	// TODO: Deprovision resources, send cancellation confirmation email
 }
 
 // handlePaymentSucceeded processes successful recurring payments
-func handlePaymentSucceeded(event stripe.Event) {
+func handlePaymentSucceeded(ctx context.Context, event stripe.Event) {
 	var invoice stripe.Invoice
 	err := json.Unmarshal(event.Data.Raw, &invoice)
 	if err != nil {
-		log.Printf("Error parsing invoice.payment_succeeded: %v", err)
+		slog.ErrorContext(ctx, "Failed to parse invoice.payment_succeeded", "error", err)
 		return
 	}
 
-	log.Printf("💰 Payment succeeded: $%.2f", float64(invoice.AmountPaid)/100)
-	log.Printf("   Customer: %s", invoice.CustomerEmail)
+	slog.InfoContext(ctx, "Payment succeeded", "customer", invoice.CustomerEmail, "amount_cents", invoice.AmountPaid)
 
 	// TODO: Send receipt email
 }
 
 // handlePaymentFailed processes failed payments
-func handlePaymentFailed(event stripe.Event) {
+func handlePaymentFailed(ctx context.Context, event stripe.Event) {
 	var invoice stripe.Invoice
 	err := json.Unmarshal(event.Data.Raw, &invoice)
 	if err != nil {
-		log.Printf("Error parsing invoice.payment_failed: %v", err)
+		slog.ErrorContext(ctx, "Failed to parse invoice.payment_failed", "error", err)
 		return
 	}
 
-	log.Printf("⚠️  Payment failed!")
-	log.Printf("   Customer: %s", invoice.CustomerEmail)
-	log.Printf("   Amount: $%.2f", float64(invoice.AmountDue)/100)
+	slog.WarnContext(ctx, "Payment failed", "customer", invoice.CustomerEmail, "amount_cents", invoice.AmountDue)
 
 	// TODO: Send payment failed email, retry logic
 }
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracing(t *testing.T) {
+	setupTestStore(t, "sqlite")
+	handle, privateKey := registerTestUser(t)
+
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	defer func(saved trace.Tracer, p propagation.TextMapPropagator) {
+		tracer = saved
+		otel.SetTextMapPropagator(p)
+	}(tracer, otel.GetTextMapPropagator())
+	tracer = tp.Tracer("test")
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	// A login continues the caller's trace
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	r := mux.NewRouter()
+	r.HandleFunc("/verify", verifyHandler).Methods("POST")
+	r.Use(tracingMiddleware)
+	body, _ := json.Marshal(signedLogin(t, handle, privateKey))
+	req := httptest.NewRequest("POST", "/verify", bytes.NewReader(body))
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Login returned %d %q", rec.Code, rec.Body.String())
+	}
+
+	names := map[string]int{}
+	for _, s := range recorder.Ended() {
+		if got := s.SpanContext().TraceID().String(); got != traceID {
+			t.Errorf("Span %s is in trace %s, want %s", s.Name(), got, traceID)
+		}
+		names[s.Name()]++
+	}
+	for _, want := range []string{"POST /verify", "verifySignature", "SELECT", "INSERT"} {
+		if names[want] == 0 {
+			t.Errorf("No %s span among %v", want, names)
+		}
+	}
+
+	// Outbound calls carry the trace on
+	var gotParent string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotParent = r.Header.Get("traceparent")
+	}))
+	defer upstream.Close()
+
+	ctx, span := tracer.Start(context.Background(), "parent")
+	out, _ := http.NewRequestWithContext(ctx, "GET", upstream.URL+"/emails?key=secret", nil)
+	resp, err := (&http.Client{Transport: tracingTransport{http.DefaultTransport}}).Do(out)
+	if err != nil {
+		t.Fatalf("Outbound request failed: %v", err)
+	}
+	resp.Body.Close()
+	span.End()
+
+	ended := recorder.Ended()
+	client := ended[len(ended)-2]
+	if client.SpanKind() != trace.SpanKindClient || client.Parent().SpanID() != span.SpanContext().SpanID() {
+		t.Fatalf("Outbound span %s is not a client child of the caller's span", client.Name())
+	}
+	want := "00-" + span.SpanContext().TraceID().String() + "-" + client.SpanContext().SpanID().String() + "-01"
+	if gotParent != want {
+		t.Errorf("Upstream got traceparent %q, want %q", gotParent, want)
+	}
+	for _, a := range client.Attributes() {
+		if a.Key == "url.full" && a.Value.AsString() != upstream.URL+"/emails" {
+			t.Errorf("Outbound span has url.full %q, want the URL without its query", a.Value.AsString())
+		}
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// setupTestDB connects to AUTHGRID_TEST_DATABASE_URL and applies the
+// migrations in a throwaway schema. Tests that need Postgres are skipped
+// when it is not set.
+func setupTestDB(t *testing.T) {
+	t.Helper()
+	dsn := os.Getenv("AUTHGRID_TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("AUTHGRID_TEST_DATABASE_URL not set")
+	}
+
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer admin.Close()
+
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	schema := "authgrid_test_" + hex.EncodeToString(suffix)
+	if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		t.Fatalf("Failed to create schema: %v", err)
+	}
+
+	u, err := url.Parse(dsn)
+	if err != nil {
+		t.Fatalf("Invalid AUTHGRID_TEST_DATABASE_URL: %v", err)
+	}
+	q := u.Query()
+	q.Set("search_path", schema)
+	u.RawQuery = q.Encode()
+
+	db, err := sql.Open("postgres", u.String())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		if cleanup, err := sql.Open("postgres", dsn); err == nil {
+			cleanup.Exec("DROP SCHEMA " + schema + " CASCADE")
+			cleanup.Close()
+		}
+	})
+
+	store = &postgresStore{db: db}
+
+	if _, err := migrateUp(db, postgresMigrations); err != nil {
+		t.Fatalf("Failed to migrate: %v", err)
+	}
+}
+
+// setupTestStore points the API at a fresh store of the given backend
+func setupTestStore(t *testing.T, backend string) {
+	t.Helper()
+	switch backend {
+	case "memory":
+		store = newMemoryStore()
+	case "sqlite":
+		s, err := openSQLite("sqlite://" + filepath.Join(t.TempDir(), "authgrid.db"))
+		if err != nil {
+			t.Fatalf("Failed to open SQLite: %v", err)
+		}
+		t.Cleanup(func() { s.db.Close() })
+		if _, err := migrateUp(s.db, sqliteMigrations); err != nil {
+			t.Fatalf("Failed to migrate: %v", err)
+		}
+		store = s
+	case "postgres":
+		setupTestDB(t)
+	default:
+		t.Fatalf("Unknown backend %q", backend)
+	}
+	setupTestKeys(t, algEdDSA)
+	signingOrigins = []string{"https://authgrid.net"}
+	t.Cleanup(func() { signingOrigins = nil })
+}
+
+// doJSON calls a handler with a JSON body and decodes the JSON response
+func doJSON(t *testing.T, h http.HandlerFunc, body interface{}, out interface{}) int {
+	t.Helper()
+	return doJSONFrom(t, "192.0.2.1:1234", h, body, out)
+}
+
+// doJSONFrom is doJSON for a request from remoteAddr
+func doJSONFrom(t *testing.T, remoteAddr string, h http.HandlerFunc, body interface{}, out interface{}) int {
+	t.Helper()
+	return doJSONVars(t, remoteAddr, nil, h, body, out)
+}
+
+// doJSONVars is doJSONFrom with route variables such as {id}
+func doJSONVars(t *testing.T, remoteAddr string, vars map[string]string, h http.HandlerFunc, body interface{}, out interface{}) int {
+	t.Helper()
+	b, _ := json.Marshal(body)
+	req := httptest.NewRequest("POST", "/", bytes.NewReader(b))
+	req.RemoteAddr = remoteAddr
+	if vars != nil {
+		req = mux.SetURLVars(req, vars)
+	}
+	rec := httptest.NewRecorder()
+	h(rec, req)
+	if out != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			t.Fatalf("Invalid response %q: %v", rec.Body.String(), err)
+		}
+	}
+	return rec.Code
+}
+
+// doAuthed calls a handler behind requireSession with a bearer token and
+// route variables, and decodes the JSON response
+func doAuthed(t *testing.T, token string, vars map[string]string, h http.HandlerFunc, out interface{}) int {
+	t.Helper()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	if vars != nil {
+		req = mux.SetURLVars(req, vars)
+	}
+	rec := httptest.NewRecorder()
+	requireSession(h)(rec, req)
+	if out != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			t.Fatalf("Invalid response %q: %v", rec.Body.String(), err)
+		}
+	}
+	return rec.Code
+}
+
+// registerTestUser registers a new Ed25519 key through the API
+func registerTestUser(t *testing.T) (string, ed25519.PrivateKey) {
+	t.Helper()
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	publicKeyStr := base64.StdEncoding.EncodeToString(publicKey)
+
+	var ch RegisterChallengeResponse
+	code := doJSON(t, registerChallengeHandler, RegisterChallengeRequest{PublicKey: publicKeyStr, KeyType: "ed25519"}, &ch)
+	if code != http.StatusOK {
+		t.Fatalf("/register/challenge returned %d", code)
+	}
+
+	statement := registrationStatement(ch.Challenge, "ed25519", publicKeyStr, nil)
+	var reg RegisterResponse
+	code = doJSON(t, registerHandler, RegisterRequest{
+		PublicKey: publicKeyStr,
+		KeyType:   "ed25519",
+		Challenge: ch.Challenge,
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, statement)),
+	}, &reg)
+	if code != http.StatusCreated {
+		t.Fatalf("/register returned %d", code)
+	}
+	if reg.Handle != ch.Handle {
+		t.Fatalf("Registered handle %q, challenge was for %q", reg.Handle, ch.Handle)
+	}
+	return reg.Handle, privateKey
+}
+
+// newChallenge requests a challenge for handle
+func newChallenge(t *testing.T, handle string) string {
+	t.Helper()
+	var ch ChallengeResponse
+	if code := doJSON(t, challengeHandler, ChallengeRequest{Handle: handle}, &ch); code != http.StatusOK {
+		t.Fatalf("/challenge returned %d", code)
+	}
+	return ch.Challenge
+}
+
+// signedLogin requests a challenge and returns a signed /verify request
+func signedLogin(t *testing.T, handle string, privateKey ed25519.PrivateKey) VerifyRequest {
+	t.Helper()
+	var ch ChallengeResponse
+	if code := doJSON(t, challengeHandler, ChallengeRequest{Handle: handle}, &ch); code != http.StatusOK {
+		t.Fatalf("/challenge returned %d", code)
+	}
+	payload := loginPayload("https://authgrid.net", handle, ch.Challenge, ch.IssuedAt)
+	return VerifyRequest{
+		Handle:    handle,
+		Challenge: ch.Challenge,
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, payload)),
+		Origin:    "https://authgrid.net",
+	}
+}
+
+func TestVerifyRedeemsChallengeOnce(t *testing.T) {
+	for _, backend := range []string{"memory", "sqlite", "postgres"} {
+		t.Run(backend, func(t *testing.T) {
+			setupTestStore(t, backend)
+			handle, privateKey := registerTestUser(t)
+			login := signedLogin(t, handle, privateKey)
+
+			const attempts = 20
+			var wg sync.WaitGroup
+			codes := make(chan int, attempts)
+			start := make(chan struct{})
+			for i := 0; i < attempts; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					<-start
+					codes <- doJSON(t, verifyHandler, login, nil)
+				}()
+			}
+			close(start)
+			wg.Wait()
+			close(codes)
+
+			succeeded := 0
+			for code := range codes {
+				switch code {
+				case http.StatusOK:
+					succeeded++
+				case http.StatusBadRequest:
+				default:
+					t.Errorf("Unexpected status %d", code)
+				}
+			}
+			if succeeded != 1 {
+				t.Errorf("Challenge redeemed %d times, want 1", succeeded)
+			}
+
+			user, err := store.UserByHandle(context.Background(), handle)
+			if err != nil {
+				t.Fatalf("UserByHandle failed: %v", err)
+			}
+			sessions, err := store.ListSessions(context.Background(), user.ID)
+			if err != nil {
+				t.Fatalf("ListSessions failed: %v", err)
+			}
+			if len(sessions) != 1 {
+				t.Errorf("Created %d sessions, want 1", len(sessions))
+			}
+		})
+	}
+}
+
+func TestSessionLifecycle(t *testing.T) {
+	for _, backend := range []string{"memory", "sqlite", "postgres"} {
+		t.Run(backend, func(t *testing.T) {
+			setupTestStore(t, backend)
+			handle, privateKey := registerTestUser(t)
+
+			// A login signed for another origin is refused
+			login := signedLogin(t, handle, privateKey)
+			login.Origin = "https://evil.example"
+			if code := doJSON(t, verifyHandler, login, nil); code != http.StatusUnauthorized {
+				t.Errorf("Login for another origin returned %d, want 401", code)
+			}
+
+			var verified VerifyResponse
+			if code := doJSON(t, verifyHandler, signedLogin(t, handle, privateKey), &verified); code != http.StatusOK {
+				t.Fatalf("/verify returned %d", code)
+			}
+
+			listSessions := func(token string) int {
+				req := httptest.NewRequest("GET", "/sessions", nil)
+				req.Header.Set("Authorization", "Bearer "+token)
+				rec := httptest.NewRecorder()
+				requireSession(listSessionsHandler)(rec, req)
+				return rec.Code
+			}
+			if code := listSessions(verified.Token); code != http.StatusOK {
+				t.Fatalf("/sessions returned %d", code)
+			}
+
+			var refreshed TokenResponse
+			code := doJSON(t, refreshHandler, RefreshRequest{RefreshToken: verified.RefreshToken}, &refreshed)
+			if code != http.StatusOK {
+				t.Fatalf("/token/refresh returned %d", code)
+			}
+			if code := listSessions(verified.Token); code != http.StatusUnauthorized {
+				t.Errorf("Old access token still works after refresh: %d", code)
+			}
+			if code := listSessions(refreshed.Token); code != http.StatusOK {
+				t.Errorf("New access token rejected: %d", code)
+			}
+
+			// Replaying the first refresh token revokes the session
+			if code := doJSON(t, refreshHandler, RefreshRequest{RefreshToken: verified.RefreshToken}, nil); code != http.StatusUnauthorized {
+				t.Errorf("Reused refresh token returned %d, want 401", code)
+			}
+			if code := listSessions(refreshed.Token); code != http.StatusUnauthorized {
+				t.Errorf("Session survived refresh token reuse: %d", code)
+			}
+		})
+	}
+}
+
+func TestRefreshKeepsSessionKeyAndExpiry(t *testing.T) {
+	for _, backend := range []string{"memory", "sqlite", "postgres"} {
+		t.Run(backend, func(t *testing.T) {
+			setupTestStore(t, backend)
+			setTestConfig(t, func(c *Config) {})
+			a := newSoftAuthenticator(t)
+			handle := registerPasskey(t, a, "none")
+
+			// Add an ed25519 key to the passkey account and log in with it
+			publicKey, deviceKey := newTestKey(t)
+			challenge := newChallenge(t, handle)
+			statement := addKeyStatement(challenge, "ed25519", publicKey)
+			code := doJSON(t, addKeyHandler, AddKeyRequest{
+				Handle:       handle,
+				Challenge:    challenge,
+				Signature:    a.get(statement),
+				PublicKey:    publicKey,
+				KeyType:      "ed25519",
+				NewSignature: base64.StdEncoding.EncodeToString(ed25519.Sign(deviceKey, statement)),
+			}, nil)
+			if code != http.StatusCreated {
+				t.Fatalf("/keys returned %d", code)
+			}
+			var verified VerifyResponse
+			if code := doJSON(t, verifyHandler, signedLogin(t, handle, deviceKey), &verified); code != http.StatusOK {
+				t.Fatalf("/verify returned %d", code)
+			}
+
+			var refreshed TokenResponse
+			if code := doJSON(t, refreshHandler, RefreshRequest{RefreshToken: verified.RefreshToken}, &refreshed); code != http.StatusOK {
+				t.Fatalf("/token/refresh returned %d", code)
+			}
+			claims, err := verifyToken(refreshed.Token)
+			if err != nil {
+				t.Fatalf("Refreshed token rejected: %v", err)
+			}
+			if claims.KeyType != "ed25519" {
+				t.Errorf("Refreshed token has key type %q, want the session key's ed25519", claims.KeyType)
+			}
+			if refreshed.RefreshExpiresAt.After(verified.RefreshExpiresAt) {
+				t.Errorf("Refresh extended the session from %v to %v", verified.RefreshExpiresAt, refreshed.RefreshExpiresAt)
+			}
+			if refreshed.ExpiresAt.After(verified.RefreshExpiresAt) {
+				t.Errorf("Refreshed token outlives the session: %v", refreshed.ExpiresAt)
+			}
+		})
+	}
+}
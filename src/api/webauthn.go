@@ -0,0 +1,647 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// WebAuthn keys are passkeys and security keys. The public key of a
+// webauthn key is the attested credential data its authenticator returned
+// on creation (AAGUID, credential ID and COSE public key), so its handle is
+// derived like any other key's. It signs a message through
+// navigator.credentials.get() with the SHA-256 of the message as the
+// challenge, and its signature is the JSON encoded webauthnAssertion.
+const keyTypeWebAuthn = "webauthn"
+
+// webauthnRegistrationHandle is the handle passkey registration challenges
+// are issued for, since a passkey's handle is only known once it exists
+const webauthnRegistrationHandle = "webauthn-registration"
+
+// Authenticator data flags
+const (
+	flagUserPresent   = 0x01
+	flagUserVerified  = 0x04
+	flagAttestedData  = 0x40
+	flagExtensionData = 0x80
+)
+
+// COSE algorithms supported for credentials
+const (
+	coseES256 = -7
+	coseEdDSA = -8
+	coseRS256 = -257
+)
+
+// cborDecoder rejects duplicate map keys and indefinite lengths, which
+// authenticators never send
+var cborDecoder = func() cbor.DecMode {
+	dm, err := cbor.DecOptions{
+		DupMapKey:   cbor.DupMapKeyEnforcedAPF,
+		IndefLength: cbor.IndefLengthForbidden,
+	}.DecMode()
+	if err != nil {
+		panic(err)
+	}
+	return dm
+}()
+
+// webauthnCredential is a credential from attested credential data
+type webauthnCredential struct {
+	ID        []byte
+	PublicKey crypto.PublicKey
+	Alg       int
+	raw       []byte // the attested credential data it was parsed from
+}
+
+// authenticatorData is the data an authenticator signs along with the hash
+// of the client data
+type authenticatorData struct {
+	RPIDHash   []byte
+	Flags      byte
+	SignCount  uint32
+	Credential *webauthnCredential // set when flagAttestedData is
+}
+
+// collectedClientData is the clientDataJSON of a ceremony
+type collectedClientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+// webauthnAssertion is the signature of a webauthn key: the response of
+// navigator.credentials.get(), with each field base64 encoded
+type webauthnAssertion struct {
+	AuthenticatorData []byte `json:"authenticator_data"`
+	ClientDataJSON    []byte `json:"client_data_json"`
+	Signature         []byte `json:"signature"`
+}
+
+// webauthnRPID is the relying party ID passkeys are scoped to
+func webauthnRPID() string {
+	cfg := currentConfig()
+	if cfg.WebAuthn.RPID != "" {
+		return cfg.WebAuthn.RPID
+	}
+	return cfg.Auth.Domain
+}
+
+// webauthnOrigins are the web origins passkey ceremonies may run on
+func webauthnOrigins() []string {
+	cfg := currentConfig()
+	if len(cfg.WebAuthn.Origins) == 0 {
+		return []string{"https://" + webauthnRPID()}
+	}
+	// Validated at load, so the current setting always parses
+	origins, _ := parseOrigins(strings.Join(cfg.WebAuthn.Origins, ","))
+	return origins
+}
+
+// parseAttestedCredential parses the attested credential data at the start
+// of data and returns the bytes after it
+func parseAttestedCredential(data []byte) (*webauthnCredential, []byte, error) {
+	// AAGUID (16) | credential ID length (2) | credential ID | COSE key
+	if len(data) < 18 {
+		return nil, nil, errors.New("attested credential data too short")
+	}
+	idLen := int(binary.BigEndian.Uint16(data[16:18]))
+	if idLen == 0 || idLen > 1023 || len(data) < 18+idLen {
+		return nil, nil, errors.New("invalid credential ID length")
+	}
+
+	var coseKey cbor.RawMessage
+	rest, err := cborDecoder.UnmarshalFirst(data[18+idLen:], &coseKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid COSE key: %w", err)
+	}
+	publicKey, alg, err := parseCOSEKey(coseKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &webauthnCredential{
+		ID:        data[18 : 18+idLen],
+		PublicKey: publicKey,
+		Alg:       alg,
+		raw:       data[:len(data)-len(rest)],
+	}, rest, nil
+}
+
+// parseCOSEKey parses an ES256 (P-256), EdDSA (Ed25519) or RS256 public key
+// in COSE_Key form
+func parseCOSEKey(data []byte) (crypto.PublicKey, int, error) {
+	var params map[int]cbor.RawMessage
+	if err := cborDecoder.Unmarshal(data, &params); err != nil {
+		return nil, 0, fmt.Errorf("invalid COSE key: %w", err)
+	}
+	param := func(label int, v interface{}) error {
+		raw, ok := params[label]
+		if !ok {
+			return fmt.Errorf("COSE key has no parameter %d", label)
+		}
+		return cborDecoder.Unmarshal(raw, v)
+	}
+
+	var kty, alg int
+	if err := param(1, &kty); err != nil {
+		return nil, 0, err
+	}
+	if err := param(3, &alg); err != nil {
+		return nil, 0, err
+	}
+
+	switch {
+	case kty == 2 && alg == coseES256:
+		var crv int
+		var x, y []byte
+		if err := errors.Join(param(-1, &crv), param(-2, &x), param(-3, &y)); err != nil {
+			return nil, 0, err
+		}
+		if crv != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, 0, errors.New("ES256 key is not a P-256 point")
+		}
+		// ecdh rejects points that are not on the curve
+		if _, err := ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+			return nil, 0, errors.New("ES256 key is not a P-256 point")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, alg, nil
+
+	case kty == 1 && alg == coseEdDSA:
+		var crv int
+		var x []byte
+		if err := errors.Join(param(-1, &crv), param(-2, &x)); err != nil {
+			return nil, 0, err
+		}
+		if crv != 6 || len(x) != ed25519.PublicKeySize {
+			return nil, 0, errors.New("EdDSA key is not an Ed25519 key")
+		}
+		return ed25519.PublicKey(x), alg, nil
+
+	case kty == 3 && alg == coseRS256:
+		var n, e []byte
+		if err := errors.Join(param(-1, &n), param(-2, &e)); err != nil {
+			return nil, 0, err
+		}
+		key := &rsa.PublicKey{N: new(big.Int).SetBytes(n)}
+		exp := new(big.Int).SetBytes(e)
+		if key.N.BitLen() < 2048 || !exp.IsInt64() || exp.Int64() < 3 || exp.Int64() > 1<<31-1 {
+			return nil, 0, errors.New("RS256 key is too weak")
+		}
+		key.E = int(exp.Int64())
+		return key, alg, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported COSE key type %d with algorithm %d", kty, alg)
+}
+
+// verifyCOSESignature verifies a signature made with a COSE algorithm by a
+// key parsed by parseCOSEKey
+func verifyCOSESignature(publicKey crypto.PublicKey, alg int, message, signature []byte) bool {
+	hash := sha256.Sum256(message)
+	switch alg {
+	case coseES256:
+		return ecdsa.VerifyASN1(publicKey.(*ecdsa.PublicKey), hash[:], signature)
+	case coseEdDSA:
+		return ed25519.Verify(publicKey.(ed25519.PublicKey), message, signature)
+	case coseRS256:
+		return rsa.VerifyPKCS1v15(publicKey.(*rsa.PublicKey), crypto.SHA256, hash[:], signature) == nil
+	}
+	return false
+}
+
+// parseAuthenticatorData parses authenticator data, which must hold nothing
+// but what its flags announce
+func parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	// RP ID hash (32) | flags (1) | sign count (4) | attested credential
+	// data | extensions
+	if len(data) < 37 {
+		return nil, errors.New("authenticator data too short")
+	}
+	ad := &authenticatorData{
+		RPIDHash:  data[:32],
+		Flags:     data[32],
+		SignCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	rest := data[37:]
+	if ad.Flags&flagAttestedData != 0 {
+		cred, r, err := parseAttestedCredential(rest)
+		if err != nil {
+			return nil, err
+		}
+		ad.Credential, rest = cred, r
+	}
+	if ad.Flags&flagExtensionData != 0 {
+		var extensions map[string]cbor.RawMessage
+		r, err := cborDecoder.UnmarshalFirst(rest, &extensions)
+		if err != nil {
+			return nil, fmt.Errorf("invalid extensions: %w", err)
+		}
+		rest = r
+	}
+	if len(rest) != 0 {
+		return nil, errors.New("trailing bytes in authenticator data")
+	}
+	return ad, nil
+}
+
+// check verifies that the authenticator data is for this relying party and
+// that the user was present, and verified if that is required
+func (ad *authenticatorData) check() error {
+	rpIDHash := sha256.Sum256([]byte(webauthnRPID()))
+	if !bytes.Equal(ad.RPIDHash, rpIDHash[:]) {
+		return errors.New("credential is for another relying party")
+	}
+	if ad.Flags&flagUserPresent == 0 {
+		return errors.New("user was not present")
+	}
+	if ad.Flags&flagUserVerified == 0 && currentConfig().WebAuthn.RequireUserVerification {
+		return errors.New("user was not verified")
+	}
+	return nil
+}
+
+// checkClientData verifies that clientDataJSON was collected for a ceremony
+// of the given type with challenge, on an allowed origin
+func checkClientData(clientDataJSON []byte, ceremony string, challenge []byte) error {
+	var cd collectedClientData
+	if err := json.Unmarshal(clientDataJSON, &cd); err != nil {
+		return fmt.Errorf("invalid client data: %w", err)
+	}
+	if cd.Type != ceremony {
+		return fmt.Errorf("client data is for %q, want %q", cd.Type, ceremony)
+	}
+	got, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(cd.Challenge, "="))
+	if err != nil || !bytes.Equal(got, challenge) {
+		return errors.New("client data is for another challenge")
+	}
+	if cd.CrossOrigin {
+		return errors.New("cross-origin ceremonies are not allowed")
+	}
+	for _, o := range webauthnOrigins() {
+		if strings.ToLower(cd.Origin) == o {
+			return nil
+		}
+	}
+	return fmt.Errorf("origin %s not allowed", cd.Origin)
+}
+
+// verifyWebAuthnAssertion checks that signature, a JSON encoded
+// webauthnAssertion, was made over message by the credential whose attested
+// credential data is publicKey. It also returns the authenticator's
+// signature counter.
+func verifyWebAuthnAssertion(publicKey, message, signature []byte) (bool, uint32, error) {
+	cred, rest, err := parseAttestedCredential(publicKey)
+	if err != nil {
+		return false, 0, err
+	}
+	if len(rest) != 0 {
+		return false, 0, errors.New("trailing bytes after the credential")
+	}
+
+	var a webauthnAssertion
+	if err := json.Unmarshal(signature, &a); err != nil {
+		return false, 0, fmt.Errorf("invalid WebAuthn assertion: %w", err)
+	}
+	challenge := sha256.Sum256(message)
+	if err := checkClientData(a.ClientDataJSON, "webauthn.get", challenge[:]); err != nil {
+		return false, 0, err
+	}
+	ad, err := parseAuthenticatorData(a.AuthenticatorData)
+	if err != nil {
+		return false, 0, err
+	}
+	if err := ad.check(); err != nil {
+		return false, 0, err
+	}
+
+	clientDataHash := sha256.Sum256(a.ClientDataJSON)
+	signed := append(append([]byte{}, a.AuthenticatorData...), clientDataHash[:]...)
+	return verifyCOSESignature(cred.PublicKey, cred.Alg, signed, a.Signature), ad.SignCount, nil
+}
+
+// advanceSignCount records the signature counter of a verified assertion
+// by a webauthn key. A counter that didn't go up suggests the
+// authenticator was cloned, and returns errSignCountRegressed.
+func advanceSignCount(ctx context.Context, key *UserKey, signature []byte) error {
+	var a webauthnAssertion
+	if err := json.Unmarshal(signature, &a); err != nil {
+		return err
+	}
+	ad, err := parseAuthenticatorData(a.AuthenticatorData)
+	if err != nil {
+		return err
+	}
+	err = store.AdvanceSignCount(ctx, key.ID, ad.SignCount)
+	if err == errSignCountRegressed {
+		slog.WarnContext(ctx, "WebAuthn signature counter went backwards, the authenticator may be cloned",
+			"key_id", key.ID, "sign_count", ad.SignCount)
+	}
+	return err
+}
+
+// webauthnCredentialIDs returns the base64url credential IDs of the webauthn
+// keys among keys, for allowCredentials
+func webauthnCredentialIDs(keys []UserKey) []string {
+	var ids []string
+	for _, k := range keys {
+		if k.KeyType != keyTypeWebAuthn {
+			continue
+		}
+		data, err := base64.StdEncoding.DecodeString(k.PublicKey)
+		if err != nil {
+			continue
+		}
+		if cred, _, err := parseAttestedCredential(data); err == nil {
+			ids = append(ids, base64.RawURLEncoding.EncodeToString(cred.ID))
+		}
+	}
+	return ids
+}
+
+// webauthnCreationChallenge is the challenge a passkey is created with for
+// a registration challenge and the recovery keys registered with it
+func webauthnCreationChallenge(challenge string, recoveryKeys []RecoveryKeyInput) []byte {
+	statement := "authgrid-webauthn-register\n" + challenge
+	for _, k := range recoveryKeys {
+		statement += "\n" + k.KeyType + "\n" + k.PublicKey
+	}
+	sum := sha256.Sum256([]byte(statement))
+	return sum[:]
+}
+
+// verifyAttestation checks a new credential: its client data, its
+// authenticator data and the attestation statement. It returns the
+// credential and the authenticator's signature counter.
+func verifyAttestation(attestationObject, clientDataJSON, challenge []byte) (*webauthnCredential, uint32, error) {
+	if err := checkClientData(clientDataJSON, "webauthn.create", challenge); err != nil {
+		return nil, 0, err
+	}
+
+	var att struct {
+		Fmt      string          `cbor:"fmt"`
+		AttStmt  cbor.RawMessage `cbor:"attStmt"`
+		AuthData []byte          `cbor:"authData"`
+	}
+	if err := cborDecoder.Unmarshal(attestationObject, &att); err != nil {
+		return nil, 0, fmt.Errorf("invalid attestation object: %w", err)
+	}
+	ad, err := parseAuthenticatorData(att.AuthData)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := ad.check(); err != nil {
+		return nil, 0, err
+	}
+	if ad.Credential == nil {
+		return nil, 0, errors.New("no attested credential data")
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	if err := verifyAttestationStatement(att.Fmt, att.AttStmt, att.AuthData, clientDataHash[:], ad); err != nil {
+		return nil, 0, err
+	}
+	return ad.Credential, ad.SignCount, nil
+}
+
+// verifyAttestationStatement checks the signature over a new credential in
+// the none, packed and fido-u2f formats. Attestation certificates are not
+// checked against trust roots: a passkey is trusted because its creation
+// answered our challenge, not because of who made the authenticator.
+func verifyAttestationStatement(format string, stmt cbor.RawMessage, authData, clientDataHash []byte, ad *authenticatorData) error {
+	var s struct {
+		Alg int      `cbor:"alg"`
+		Sig []byte   `cbor:"sig"`
+		X5C [][]byte `cbor:"x5c"`
+	}
+	if err := cborDecoder.Unmarshal(stmt, &s); err != nil {
+		return fmt.Errorf("invalid %s attestation statement: %w", format, err)
+	}
+	signed := append(append([]byte{}, authData...), clientDataHash...)
+
+	switch format {
+	case "none":
+		if len(s.Sig) != 0 || len(s.X5C) != 0 {
+			return errors.New("none attestation carries a statement")
+		}
+		return nil
+
+	case "packed":
+		if len(s.X5C) == 0 {
+			// Self attestation, signed by the new credential itself
+			if s.Alg != ad.Credential.Alg || !verifyCOSESignature(ad.Credential.PublicKey, s.Alg, signed, s.Sig) {
+				return errors.New("invalid self attestation signature")
+			}
+			return nil
+		}
+		cert, err := x509.ParseCertificate(s.X5C[0])
+		if err != nil {
+			return fmt.Errorf("invalid attestation certificate: %w", err)
+		}
+		sigAlg, ok := map[int]x509.SignatureAlgorithm{
+			coseES256: x509.ECDSAWithSHA256,
+			coseEdDSA: x509.PureEd25519,
+			coseRS256: x509.SHA256WithRSA,
+		}[s.Alg]
+		if !ok {
+			return fmt.Errorf("unsupported attestation algorithm %d", s.Alg)
+		}
+		if err := cert.CheckSignature(sigAlg, signed, s.Sig); err != nil {
+			return errors.New("invalid attestation signature")
+		}
+		return nil
+
+	case "fido-u2f":
+		if len(s.X5C) != 1 {
+			return errors.New("fido-u2f attestation needs exactly one certificate")
+		}
+		cert, err := x509.ParseCertificate(s.X5C[0])
+		if err != nil {
+			return fmt.Errorf("invalid attestation certificate: %w", err)
+		}
+		certKey, ok := cert.PublicKey.(*ecdsa.PublicKey)
+		if !ok || certKey.Curve != elliptic.P256() {
+			return errors.New("fido-u2f attestation certificate is not for a P-256 key")
+		}
+		credKey, ok := ad.Credential.PublicKey.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("fido-u2f credential is not a P-256 key")
+		}
+		// 0x00 | RP ID hash | client data hash | credential ID | public key
+		data := append([]byte{0}, ad.RPIDHash...)
+		data = append(data, clientDataHash...)
+		data = append(data, ad.Credential.ID...)
+		data = append(data, 4)
+		data = append(data, credKey.X.FillBytes(make([]byte, 32))...)
+		data = append(data, credKey.Y.FillBytes(make([]byte, 32))...)
+		hash := sha256.Sum256(data)
+		if !ecdsa.VerifyASN1(certKey, hash[:], s.Sig) {
+			return errors.New("invalid attestation signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported attestation format %q", format)
+}
+
+// WebAuthnRegisterChallengeRequest asks for the options to create a passkey
+// for a new handle
+type WebAuthnRegisterChallengeRequest struct {
+	Name string `json:"name,omitempty"` // account name the authenticator shows
+
+	// Recovery keys that will be sent to /webauthn/register. The passkey
+	// is created over them, so they can't be changed afterwards.
+	RecoveryKeys []RecoveryKeyInput `json:"recovery_keys,omitempty"`
+}
+
+// WebAuthnRegisterChallengeResponse carries the challenge to send back to
+// /webauthn/register and the options for navigator.credentials.create(),
+// in the form PublicKeyCredential.parseCreationOptionsFromJSON() takes
+type WebAuthnRegisterChallengeResponse struct {
+	Challenge string                 `json:"challenge"`
+	ExpiresAt time.Time              `json:"expires_at"`
+	PublicKey map[string]interface{} `json:"public_key"`
+}
+
+// WebAuthnRegisterRequest registers a new handle for a passkey, from the
+// response of navigator.credentials.create()
+type WebAuthnRegisterRequest struct {
+	Challenge         string `json:"challenge"`          // from /webauthn/register/challenge
+	AttestationObject []byte `json:"attestation_object"` // base64 encoded
+	ClientDataJSON    []byte `json:"client_data_json"`   // base64 encoded
+	Name              string `json:"name,omitempty"`     // device name for the key
+
+	// Optional offline keys that can later recover the handle
+	RecoveryKeys []RecoveryKeyInput `json:"recovery_keys,omitempty"`
+}
+
+// webauthnRegisterChallengeHandler issues a challenge and the options for
+// creating a passkey
+func webauthnRegisterChallengeHandler(w http.ResponseWriter, r *http.Request) {
+	var req WebAuthnRegisterChallengeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	setKeyType(w, keyTypeWebAuthn)
+
+	if err := validateRecoveryKeys(req.RecoveryKeys); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid recovery key: "+err.Error())
+		return
+	}
+
+	ch, err := storeChallenge(r.Context(), webauthnRegistrationHandle)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to store challenge")
+		return
+	}
+
+	// The user ID only tells this account's passkeys apart on the
+	// authenticator; handles are derived from the credential
+	userID := make([]byte, 16)
+	rand.Read(userID)
+	name := req.Name
+	if name == "" {
+		name = "Authgrid account"
+	}
+	cfg := currentConfig().WebAuthn
+	userVerification := "preferred"
+	if cfg.RequireUserVerification {
+		userVerification = "required"
+	}
+	var params []map[string]interface{}
+	for _, alg := range []int{coseEdDSA, coseES256, coseRS256} {
+		params = append(params, map[string]interface{}{"type": "public-key", "alg": alg})
+	}
+
+	respondJSON(w, http.StatusOK, WebAuthnRegisterChallengeResponse{
+		Challenge: ch.Challenge,
+		ExpiresAt: ch.ExpiresAt,
+		PublicKey: map[string]interface{}{
+			"rp":               map[string]string{"id": webauthnRPID(), "name": cfg.RPName},
+			"user":             map[string]string{"id": base64.RawURLEncoding.EncodeToString(userID), "name": name, "displayName": name},
+			"challenge":        base64.RawURLEncoding.EncodeToString(webauthnCreationChallenge(ch.Challenge, req.RecoveryKeys)),
+			"pubKeyCredParams": params,
+			"timeout":          time.Until(ch.ExpiresAt).Milliseconds(),
+			"attestation":      "none",
+			"authenticatorSelection": map[string]string{
+				"residentKey":      "preferred",
+				"userVerification": userVerification,
+			},
+		},
+	})
+}
+
+// webauthnRegisterHandler creates a handle for a new passkey. The passkey
+// then logs in through /challenge and /verify like any other key.
+func webauthnRegisterHandler(w http.ResponseWriter, r *http.Request) {
+	var req WebAuthnRegisterRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if req.Challenge == "" || len(req.AttestationObject) == 0 || len(req.ClientDataJSON) == 0 {
+		respondError(w, http.StatusBadRequest, "Challenge, attestation object and client data are required")
+		return
+	}
+	setKeyType(w, keyTypeWebAuthn)
+
+	if err := validateRecoveryKeys(req.RecoveryKeys); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid recovery key: "+err.Error())
+		return
+	}
+
+	ch, ok := checkChallenge(w, r, webauthnRegistrationHandle, req.Challenge)
+	if !ok {
+		return
+	}
+
+	cred, signCount, err := verifyAttestation(req.AttestationObject, req.ClientDataJSON, webauthnCreationChallenge(req.Challenge, req.RecoveryKeys))
+	if err != nil {
+		recordAudit(r, auditRegister, "", outcomeFailure, "invalid attestation: "+err.Error())
+		respondError(w, http.StatusUnauthorized, "Invalid attestation: "+err.Error())
+		return
+	}
+
+	handle := generateHandle(cred.raw)
+	key := &UserKey{
+		Name:      req.Name,
+		PublicKey: base64.StdEncoding.EncodeToString(cred.raw),
+		KeyType:   keyTypeWebAuthn,
+	}
+	user, ok := createUser(w, r, ch, handle, key, req.RecoveryKeys)
+	if !ok {
+		return
+	}
+	if signCount > 0 {
+		if err := store.AdvanceSignCount(r.Context(), key.ID, signCount); err != nil {
+			slog.WarnContext(r.Context(), "Failed to record WebAuthn signature counter", "key_id", key.ID, "error", err)
+		}
+	}
+
+	respondJSON(w, http.StatusCreated, RegisterResponse{
+		Handle:    handle,
+		ID:        user.ID,
+		CreatedAt: user.CreatedAt,
+	})
+}
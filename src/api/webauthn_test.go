@@ -0,0 +1,349 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// ctap2 encodes CBOR the way authenticators do, with sorted map keys
+var ctap2, _ = cbor.CTAP2EncOptions().EncMode()
+
+// softAuthenticator is a software ES256 authenticator for tests
+type softAuthenticator struct {
+	key       *ecdsa.PrivateKey
+	credID    []byte
+	signCount uint32
+	rpID      string
+	origin    string
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credID := make([]byte, 16)
+	rand.Read(credID)
+	return &softAuthenticator{key: key, credID: credID, rpID: "authgrid.net", origin: "https://authgrid.net"}
+}
+
+// attestedCredential is the attested credential data of the credential
+func (a *softAuthenticator) attestedCredential() []byte {
+	coseKey, _ := ctap2.Marshal(map[int]interface{}{
+		1:  2,
+		3:  coseES256,
+		-1: 1,
+		-2: a.key.X.FillBytes(make([]byte, 32)),
+		-3: a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	data := make([]byte, 18, 18+len(a.credID)+len(coseKey))
+	binary.BigEndian.PutUint16(data[16:], uint16(len(a.credID)))
+	return append(append(data, a.credID...), coseKey...)
+}
+
+func (a *softAuthenticator) authData(flags byte, attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	data := append(rpIDHash[:], flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(data[33:], a.signCount)
+	if attested {
+		data[32] |= flagAttestedData
+		data = append(data, a.attestedCredential()...)
+	}
+	return data
+}
+
+func (a *softAuthenticator) clientData(ceremony string, challenge []byte) []byte {
+	cd, _ := json.Marshal(collectedClientData{
+		Type:      ceremony,
+		Challenge: base64.RawURLEncoding.EncodeToString(challenge),
+		Origin:    a.origin,
+	})
+	return cd
+}
+
+func (a *softAuthenticator) sign(authData, clientDataJSON []byte) []byte {
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	hash := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	sig, _ := ecdsa.SignASN1(rand.Reader, a.key, hash[:])
+	return sig
+}
+
+// create answers navigator.credentials.create() with a packed self
+// attestation, or none
+func (a *softAuthenticator) create(challenge []byte, format string, flags byte) (attestationObject, clientDataJSON []byte) {
+	a.signCount++
+	authData := a.authData(flags, true)
+	clientDataJSON = a.clientData("webauthn.create", challenge)
+	stmt := map[string]interface{}{}
+	if format == "packed" {
+		stmt = map[string]interface{}{"alg": coseES256, "sig": a.sign(authData, clientDataJSON)}
+	}
+	attestationObject, _ = ctap2.Marshal(map[string]interface{}{"fmt": format, "attStmt": stmt, "authData": authData})
+	return attestationObject, clientDataJSON
+}
+
+// get answers navigator.credentials.get() for message, returning the
+// signature of a webauthn key
+func (a *softAuthenticator) get(message []byte) string {
+	a.signCount++
+	challenge := sha256.Sum256(message)
+	authData := a.authData(flagUserPresent|flagUserVerified, false)
+	clientDataJSON := a.clientData("webauthn.get", challenge[:])
+	assertion, _ := json.Marshal(webauthnAssertion{
+		AuthenticatorData: authData,
+		ClientDataJSON:    clientDataJSON,
+		Signature:         a.sign(authData, clientDataJSON),
+	})
+	return base64.StdEncoding.EncodeToString(assertion)
+}
+
+// registerPasskey registers a handle for the authenticator through the API
+func registerPasskey(t *testing.T, a *softAuthenticator, format string) string {
+	t.Helper()
+	var ch WebAuthnRegisterChallengeResponse
+	if code := doJSON(t, webauthnRegisterChallengeHandler, WebAuthnRegisterChallengeRequest{}, &ch); code != http.StatusOK {
+		t.Fatalf("/webauthn/register/challenge returned %d", code)
+	}
+	challenge, err := base64.RawURLEncoding.DecodeString(ch.PublicKey["challenge"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attestationObject, clientDataJSON := a.create(challenge, format, flagUserPresent|flagUserVerified)
+	var reg RegisterResponse
+	code := doJSON(t, webauthnRegisterHandler, WebAuthnRegisterRequest{
+		Challenge:         ch.Challenge,
+		AttestationObject: attestationObject,
+		ClientDataJSON:    clientDataJSON,
+	}, &reg)
+	if code != http.StatusCreated {
+		t.Fatalf("/webauthn/register returned %d", code)
+	}
+	if reg.Handle != generateHandle(a.attestedCredential()) {
+		t.Fatalf("Registered handle %q isn't derived from the credential", reg.Handle)
+	}
+	return reg.Handle
+}
+
+// passkeyLogin requests a challenge and returns a /verify request signed by
+// the authenticator
+func passkeyLogin(t *testing.T, a *softAuthenticator, handle string) VerifyRequest {
+	t.Helper()
+	var ch ChallengeResponse
+	if code := doJSON(t, challengeHandler, ChallengeRequest{Handle: handle}, &ch); code != http.StatusOK {
+		t.Fatalf("/challenge returned %d", code)
+	}
+	if len(ch.WebAuthnCredentials) != 1 || ch.WebAuthnCredentials[0] != base64.RawURLEncoding.EncodeToString(a.credID) {
+		t.Errorf("Challenge lists credentials %q", ch.WebAuthnCredentials)
+	}
+	payload := loginPayload("https://authgrid.net", handle, ch.Challenge, ch.IssuedAt)
+	return VerifyRequest{
+		Handle:    handle,
+		Challenge: ch.Challenge,
+		Signature: a.get(payload),
+		Origin:    "https://authgrid.net",
+	}
+}
+
+func TestWebAuthnRegisterAndLogin(t *testing.T) {
+	for _, backend := range []string{"memory", "sqlite", "postgres"} {
+		for _, format := range []string{"packed", "none"} {
+			t.Run(backend+"/"+format, func(t *testing.T) {
+				setupTestStore(t, backend)
+				setTestConfig(t, func(c *Config) {})
+				a := newSoftAuthenticator(t)
+				handle := registerPasskey(t, a, format)
+
+				var verified VerifyResponse
+				if code := doJSON(t, verifyHandler, passkeyLogin(t, a, handle), &verified); code != http.StatusOK {
+					t.Fatalf("/verify returned %d", code)
+				}
+				if verified.Token == "" {
+					t.Error("Passkey login returned no token")
+				}
+
+				// A clone of the authenticator replays an old counter
+				a.signCount--
+				if code := doJSON(t, verifyHandler, passkeyLogin(t, a, handle), nil); code != http.StatusUnauthorized {
+					t.Errorf("Login with a regressed counter returned %d, want 401", code)
+				}
+				if code := doJSON(t, verifyHandler, passkeyLogin(t, a, handle), nil); code != http.StatusOK {
+					t.Errorf("Login after the counter moved on returned %d, want 200", code)
+				}
+			})
+		}
+	}
+}
+
+func TestWebAuthnRegisterWithRecoveryKeys(t *testing.T) {
+	for _, backend := range []string{"memory", "sqlite", "postgres"} {
+		t.Run(backend, func(t *testing.T) {
+			setupTestStore(t, backend)
+			setTestConfig(t, func(c *Config) {})
+			recoveryKey, _ := newTestKey(t)
+			injectedKey, _ := newTestKey(t)
+			keys := []RecoveryKeyInput{{PublicKey: recoveryKey, KeyType: "ed25519", Name: "paper"}}
+
+			register := func(requested, sent []RecoveryKeyInput) int {
+				var ch WebAuthnRegisterChallengeResponse
+				if code := doJSON(t, webauthnRegisterChallengeHandler, WebAuthnRegisterChallengeRequest{RecoveryKeys: requested}, &ch); code != http.StatusOK {
+					t.Fatalf("/webauthn/register/challenge returned %d", code)
+				}
+				challenge, err := base64.RawURLEncoding.DecodeString(ch.PublicKey["challenge"].(string))
+				if err != nil {
+					t.Fatal(err)
+				}
+				attestationObject, clientDataJSON := newSoftAuthenticator(t).create(challenge, "packed", flagUserPresent|flagUserVerified)
+				return doJSON(t, webauthnRegisterHandler, WebAuthnRegisterRequest{
+					Challenge:         ch.Challenge,
+					AttestationObject: attestationObject,
+					ClientDataJSON:    clientDataJSON,
+					RecoveryKeys:      sent,
+				}, nil)
+			}
+
+			// A recovery key added after the passkey was created must be refused
+			injected := append(append([]RecoveryKeyInput{}, keys...), RecoveryKeyInput{PublicKey: injectedKey, KeyType: "ed25519"})
+			if code := register(keys, injected); code != http.StatusUnauthorized {
+				t.Fatalf("/webauthn/register with an injected recovery key returned %d, want 401", code)
+			}
+			if code := register(nil, keys); code != http.StatusUnauthorized {
+				t.Fatalf("/webauthn/register with an unrequested recovery key returned %d, want 401", code)
+			}
+			if code := register(keys, keys); code != http.StatusCreated {
+				t.Fatalf("/webauthn/register with a recovery key returned %d, want 201", code)
+			}
+		})
+	}
+}
+
+func TestWebAuthnAttestationRejected(t *testing.T) {
+	setTestConfig(t, func(c *Config) { c.WebAuthn.RequireUserVerification = true })
+	challenge := webauthnCreationChallenge("test-challenge", nil)
+
+	const present, verified = flagUserPresent, flagUserPresent | flagUserVerified
+	for _, tt := range []struct {
+		name     string
+		modify   func(a *softAuthenticator)
+		flags    byte
+		signed   []byte
+		ceremony string
+	}{
+		{name: "wrong origin", modify: func(a *softAuthenticator) { a.origin = "https://evil.example" }, flags: verified},
+		{name: "wrong relying party", modify: func(a *softAuthenticator) { a.rpID = "evil.example" }, flags: verified},
+		{name: "user not present", flags: flagUserVerified},
+		{name: "user not verified", flags: present},
+		{name: "other challenge", flags: verified, signed: webauthnCreationChallenge("other-challenge", nil)},
+		{name: "assertion type", flags: verified, ceremony: "webauthn.get"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newSoftAuthenticator(t)
+			if tt.modify != nil {
+				tt.modify(a)
+			}
+			signed := challenge
+			if tt.signed != nil {
+				signed = tt.signed
+			}
+			attestationObject, clientDataJSON := a.create(signed, "packed", tt.flags)
+			if tt.ceremony != "" {
+				clientDataJSON = a.clientData(tt.ceremony, signed)
+			}
+			if _, _, err := verifyAttestation(attestationObject, clientDataJSON, challenge); err == nil {
+				t.Error("verifyAttestation accepted the credential")
+			}
+		})
+	}
+
+	// A self attestation must be signed by the new credential
+	a := newSoftAuthenticator(t)
+	attestationObject, clientDataJSON := a.create(challenge, "packed", verified)
+	a.key, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	other, _ := a.create(challenge, "packed", verified)
+	var att, forged map[string]cbor.RawMessage
+	cbor.Unmarshal(attestationObject, &att)
+	cbor.Unmarshal(other, &forged)
+	att["attStmt"] = forged["attStmt"]
+	attestationObject, _ = cbor.Marshal(att)
+	if _, _, err := verifyAttestation(attestationObject, clientDataJSON, challenge); err == nil {
+		t.Error("verifyAttestation accepted a self attestation by another key")
+	}
+}
+
+func TestPasskeySignCountRegressedOutsideLogin(t *testing.T) {
+	for _, backend := range []string{"memory", "sqlite", "postgres"} {
+		t.Run(backend, func(t *testing.T) {
+			setupTestStore(t, backend)
+			setTestConfig(t, func(c *Config) {})
+			a := newSoftAuthenticator(t)
+			handle := registerPasskey(t, a, "none")
+			g := newSoftAuthenticator(t)
+			guardian := registerPasskey(t, g, "none")
+
+			// regressed signs message with a replayed counter, as a clone of
+			// the authenticator would
+			regressed := func(a *softAuthenticator, message []byte) string {
+				a.signCount--
+				return a.get(message)
+			}
+			wantRefused := func(what string, code int, handle, eventType string) {
+				t.Helper()
+				if code != http.StatusUnauthorized {
+					t.Errorf("%s with a regressed counter returned %d, want 401", what, code)
+				}
+				if len(auditReasons(t, handle, eventType, outcomeFailure)) == 0 {
+					t.Errorf("%s with a regressed counter wasn't audited", what)
+				}
+			}
+
+			recoveryKey, _ := newTestKey(t)
+			keys := []RecoveryKeyInput{{PublicKey: recoveryKey, KeyType: "ed25519"}}
+			challenge := newChallenge(t, handle)
+			wantRefused("/recovery-keys", doJSON(t, addRecoveryKeysHandler, AddRecoveryKeysRequest{
+				Handle:       handle,
+				Challenge:    challenge,
+				Signature:    regressed(a, addRecoveryKeysStatement(challenge, keys)),
+				RecoveryKeys: keys,
+			}, nil), handle, auditRecoveryKeys)
+
+			setGuardians := func(sign func([]byte) string) int {
+				challenge := newChallenge(t, handle)
+				return doJSON(t, setGuardiansHandler, SetGuardiansRequest{
+					Handle:    handle,
+					Challenge: challenge,
+					Signature: sign(setGuardiansStatement(handle, challenge, 1, []string{guardian})),
+					Guardians: []string{guardian},
+					Threshold: 1,
+				}, nil)
+			}
+			wantRefused("/guardians", setGuardians(func(m []byte) string { return regressed(a, m) }), handle, auditGuardiansSet)
+			if code := setGuardians(a.get); code != http.StatusOK {
+				t.Fatalf("/guardians returned %d", code)
+			}
+
+			rec, _ := startRecovery(t, handle)
+			challenge = newChallenge(t, guardian)
+			wantRefused("Approval", doJSONVars(t, "192.0.2.1:1234", map[string]string{"id": rec.ID}, approveSocialRecoveryHandler, ApproveSocialRecoveryRequest{
+				Guardian:  guardian,
+				Challenge: challenge,
+				Signature: regressed(g, approveRecoveryStatement(rec, challenge)),
+			}, nil), handle, auditSocialApprove)
+
+			challenge = newChallenge(t, handle)
+			wantRefused("Cancellation", doJSONVars(t, "192.0.2.1:1234", map[string]string{"id": rec.ID}, cancelSocialRecoveryHandler, CancelSocialRecoveryRequest{
+				Challenge: challenge,
+				Signature: regressed(a, cancelRecoveryStatement(rec.ID, challenge)),
+			}, nil), handle, auditSocialCancel)
+		})
+	}
+}
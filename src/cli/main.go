@@ -10,9 +10,12 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const (
@@ -32,12 +35,28 @@ func main() {
 	// Subcommands
 	registerCmd := flag.NewFlagSet("register", flag.ExitOnError)
 	loginCmd := flag.NewFlagSet("login", flag.ExitOnError)
+	refreshCmd := flag.NewFlagSet("refresh", flag.ExitOnError)
+	rotateCmd := flag.NewFlagSet("rotate", flag.ExitOnError)
+	recoverCmd := flag.NewFlagSet("recover", flag.ExitOnError)
 	listCmd := flag.NewFlagSet("list", flag.ExitOnError)
 	versionCmd := flag.NewFlagSet("version", flag.ExitOnError)
 
+	// Register flags
+	registerRecovery := registerCmd.Bool("recovery-key", false, "Also generate an offline recovery key")
+
 	// Login flags
 	loginHandle := loginCmd.String("handle", "", "Handle to authenticate with")
 
+	// Refresh flags
+	refreshHandle := refreshCmd.String("handle", "", "Handle whose session to refresh")
+
+	// Rotate flags
+	rotateHandle := rotateCmd.String("handle", "", "Handle whose key to rotate")
+
+	// Recover flags
+	recoverHandle := recoverCmd.String("handle", "", "Handle to recover")
+	recoverKeyFile := recoverCmd.String("recovery-key", "", "Path to the recovery key file")
+
 	if len(os.Args) < 2 {
 		printUsage()
 		os.Exit(1)
@@ -52,7 +71,7 @@ func main() {
 	switch subcommand {
 	case "register":
 		registerCmd.Parse(os.Args[2:])
-		handleRegister()
+		handleRegister(*registerRecovery)
 
 	case "login":
 		loginCmd.Parse(os.Args[2:])
@@ -63,6 +82,33 @@ func main() {
 		}
 		handleLogin(*loginHandle)
 
+	case "refresh":
+		refreshCmd.Parse(os.Args[2:])
+		if *refreshHandle == "" {
+			fmt.Println("Error: --handle flag is required")
+			refreshCmd.PrintDefaults()
+			os.Exit(1)
+		}
+		handleRefresh(*refreshHandle)
+
+	case "rotate":
+		rotateCmd.Parse(os.Args[2:])
+		if *rotateHandle == "" {
+			fmt.Println("Error: --handle flag is required")
+			rotateCmd.PrintDefaults()
+			os.Exit(1)
+		}
+		handleRotate(*rotateHandle)
+
+	case "recover":
+		recoverCmd.Parse(os.Args[2:])
+		if *recoverHandle == "" || *recoverKeyFile == "" {
+			fmt.Println("Error: --handle and --recovery-key flags are required")
+			recoverCmd.PrintDefaults()
+			os.Exit(1)
+		}
+		handleRecover(*recoverHandle, *recoverKeyFile)
+
 	case "list":
 		listCmd.Parse(os.Args[2:])
 		handleList()
@@ -90,6 +136,9 @@ func printUsage() {
 	fmt.Println("Commands:")
 	fmt.Println("  register          Register a new user and get a handle")
 	fmt.Println("  login             Authenticate with a handle")
+	fmt.Println("  refresh           Get a new access token using the saved session")
+	fmt.Println("  rotate            Replace a handle's key, keeping the handle")
+	fmt.Println("  recover           Regain a handle with an offline recovery key")
 	fmt.Println("  list              List stored handles")
 	fmt.Println("  version           Show version information")
 	fmt.Println("  help              Show this help message")
@@ -99,13 +148,14 @@ func printUsage() {
 	fmt.Println("  --keystore DIR    Keystore directory (default: ~/.authgrid)")
 	fmt.Println()
 	fmt.Println("Examples:")
-	fmt.Println("  authgrid register")
+	fmt.Println("  authgrid register --recovery-key")
 	fmt.Println("  authgrid login --handle abc123@authgrid.net")
+	fmt.Println("  authgrid refresh --handle abc123@authgrid.net")
 	fmt.Println("  authgrid list")
 	fmt.Println()
 }
 
-func handleRegister() {
+func handleRegister(withRecoveryKey bool) {
 	fmt.Println("Registering new user...")
 
 	// Generate Ed25519 keypair
@@ -118,13 +168,58 @@ func handleRegister() {
 	// Encode public key
 	publicKeyB64 := base64.StdEncoding.EncodeToString(publicKey)
 
-	// Register with API
-	reqBody := map[string]string{
+	// Request a registration challenge
+	resp, err := makeRequest("POST", apiURL+"/register/challenge", map[string]string{
+		"public_key": publicKeyB64,
+		"key_type":   "ed25519",
+	})
+	if err != nil {
+		fmt.Printf("Error requesting registration challenge: %v\n", err)
+		os.Exit(1)
+	}
+
+	var challengeResp map[string]interface{}
+	if err := json.Unmarshal(resp, &challengeResp); err != nil {
+		fmt.Printf("Error parsing challenge response: %v\n", err)
+		os.Exit(1)
+	}
+
+	challenge, ok := challengeResp["challenge"].(string)
+	if !ok {
+		fmt.Println("Error: invalid challenge response")
+		os.Exit(1)
+	}
+
+	// Prove possession of the new key. The statement also covers any
+	// recovery key, so it can't be swapped in transit.
+	statement := "authgrid-register\n" + challenge + "\ned25519\n" + publicKeyB64
+	reqBody := map[string]interface{}{
 		"public_key": publicKeyB64,
 		"key_type":   "ed25519",
+		"challenge":  challenge,
 	}
 
-	resp, err := makeRequest("POST", apiURL+"/register", reqBody)
+	var recoveryPublicKey ed25519.PublicKey
+	var recoveryPrivateKey ed25519.PrivateKey
+	if withRecoveryKey {
+		recoveryPublicKey, recoveryPrivateKey, err = ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			fmt.Printf("Error generating recovery key: %v\n", err)
+			os.Exit(1)
+		}
+		recoveryPublicKeyB64 := base64.StdEncoding.EncodeToString(recoveryPublicKey)
+		statement += "\ned25519\n" + recoveryPublicKeyB64
+		reqBody["recovery_keys"] = []map[string]string{{
+			"public_key": recoveryPublicKeyB64,
+			"key_type":   "ed25519",
+			"name":       "cli",
+		}}
+	}
+
+	// Register with API
+	reqBody["signature"] = base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, []byte(statement)))
+
+	resp, err = makeRequest("POST", apiURL+"/register", reqBody)
 	if err != nil {
 		fmt.Printf("Error registering: %v\n", err)
 		os.Exit(1)
@@ -153,6 +248,19 @@ func handleRegister() {
 	fmt.Printf("   Handle: %s\n", handle)
 	fmt.Printf("   Keystore: %s\n", keystoreDir)
 	fmt.Println()
+
+	if withRecoveryKey {
+		recoveryFile := filepath.Join(keystoreDir, handle+".recovery")
+		if err := writeKeypair(recoveryFile, recoveryPrivateKey, recoveryPublicKey); err != nil {
+			fmt.Printf("Error saving recovery key: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("Recovery key saved to:")
+		fmt.Printf("   %s\n", recoveryFile)
+		fmt.Println("Move it somewhere offline (USB stick, password manager). Anyone")
+		fmt.Println("holding it can take over this handle.")
+		fmt.Println()
+	}
 	fmt.Println("To login:")
 	fmt.Printf("   authgrid login --handle %s\n", handle)
 	fmt.Println()
@@ -192,15 +300,21 @@ func handleLogin(handle string) {
 		os.Exit(1)
 	}
 
-	// Decode challenge
-	challenge, err := base64.StdEncoding.DecodeString(challengeB64)
+	issuedAtStr, _ := challengeResp["issued_at"].(string)
+	issuedAt, err := time.Parse(time.RFC3339, issuedAtStr)
 	if err != nil {
-		fmt.Printf("Error decoding challenge: %v\n", err)
+		fmt.Println("Error: invalid challenge response")
 		os.Exit(1)
 	}
 
-	// Sign challenge
-	signature := ed25519.Sign(privateKey, challenge)
+	// Sign the login payload, bound to the server we are talking to
+	origin, err := apiOrigin()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	payload := loginPayload(origin, handle, challengeB64, issuedAt)
+	signature := ed25519.Sign(privateKey, payload)
 	signatureB64 := base64.StdEncoding.EncodeToString(signature)
 
 	// Verify signature
@@ -208,6 +322,7 @@ func handleLogin(handle string) {
 		"handle":    handle,
 		"challenge": challengeB64,
 		"signature": signatureB64,
+		"origin":    origin,
 	}
 
 	resp, err = makeRequest("POST", apiURL+"/verify", verifyBody)
@@ -229,6 +344,12 @@ func handleLogin(handle string) {
 	}
 
 	token, _ := verifyResp["token"].(string)
+	refreshToken, _ := verifyResp["refresh_token"].(string)
+
+	// Keep the refresh token so "authgrid refresh" can renew the token
+	if err := saveSession(handle, token, refreshToken); err != nil {
+		fmt.Printf("Warning: could not save session: %v\n", err)
+	}
 
 	fmt.Println()
 	fmt.Println("✅ Login successful!")
@@ -240,6 +361,191 @@ func handleLogin(handle string) {
 	_ = publicKey // Use the variable to avoid unused warning
 }
 
+func handleRefresh(handle string) {
+	_, refreshToken, err := loadSession(handle)
+	if err != nil {
+		fmt.Printf("Error loading session: %v\n", err)
+		fmt.Printf("Try: authgrid login --handle %s\n", handle)
+		os.Exit(1)
+	}
+
+	reqBody := map[string]string{
+		"refresh_token": refreshToken,
+	}
+
+	resp, err := makeRequest("POST", apiURL+"/token/refresh", reqBody)
+	if err != nil {
+		fmt.Printf("Error refreshing token: %v\n", err)
+		fmt.Printf("Try: authgrid login --handle %s\n", handle)
+		os.Exit(1)
+	}
+
+	var tokenResp map[string]interface{}
+	if err := json.Unmarshal(resp, &tokenResp); err != nil {
+		fmt.Printf("Error parsing refresh response: %v\n", err)
+		os.Exit(1)
+	}
+
+	token, _ := tokenResp["token"].(string)
+	newRefreshToken, _ := tokenResp["refresh_token"].(string)
+	if token == "" || newRefreshToken == "" {
+		fmt.Println("Error: invalid refresh response")
+		os.Exit(1)
+	}
+
+	// Refresh tokens are single-use, so the new one must replace the old
+	if err := saveSession(handle, token, newRefreshToken); err != nil {
+		fmt.Printf("Error saving session: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Println()
+	fmt.Println("✅ Token refreshed!")
+	fmt.Printf("   Handle: %s\n", handle)
+	fmt.Printf("   Token: %s...\n", token[:40])
+	fmt.Println()
+}
+
+func handleRotate(handle string) {
+	fmt.Printf("Rotating key for %s...\n", handle)
+
+	oldPrivateKey, _, err := loadKeypair(handle)
+	if err != nil {
+		fmt.Printf("Error loading keypair: %v\n", err)
+		os.Exit(1)
+	}
+
+	newPublicKey, newPrivateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		fmt.Printf("Error generating keypair: %v\n", err)
+		os.Exit(1)
+	}
+	newPublicKeyB64 := base64.StdEncoding.EncodeToString(newPublicKey)
+
+	// Write the new key out before the server switches over to it
+	keyFile := filepath.Join(keystoreDir, handle+".key")
+	if err := writeKeypair(keyFile+".new", newPrivateKey, newPublicKey); err != nil {
+		fmt.Printf("Error saving new keypair: %v\n", err)
+		os.Exit(1)
+	}
+
+	resp, err := makeRequest("POST", apiURL+"/challenge", map[string]string{"handle": handle})
+	if err != nil {
+		fmt.Printf("Error requesting challenge: %v\n", err)
+		os.Exit(1)
+	}
+
+	var challengeResp map[string]interface{}
+	if err := json.Unmarshal(resp, &challengeResp); err != nil {
+		fmt.Printf("Error parsing challenge: %v\n", err)
+		os.Exit(1)
+	}
+
+	challengeB64, ok := challengeResp["challenge"].(string)
+	if !ok {
+		fmt.Println("Error: invalid challenge response")
+		os.Exit(1)
+	}
+
+	// Both keys sign the same statement handing the handle to the new key
+	statement := []byte("authgrid-rotate-key\n" + handle + "\n" + challengeB64 + "\ned25519\n" + newPublicKeyB64)
+
+	rotateBody := map[string]string{
+		"handle":        handle,
+		"challenge":     challengeB64,
+		"public_key":    newPublicKeyB64,
+		"key_type":      "ed25519",
+		"old_signature": base64.StdEncoding.EncodeToString(ed25519.Sign(oldPrivateKey, statement)),
+		"new_signature": base64.StdEncoding.EncodeToString(ed25519.Sign(newPrivateKey, statement)),
+	}
+
+	if _, err := makeRequest("POST", apiURL+"/rotate", rotateBody); err != nil {
+		fmt.Printf("Error rotating key: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Keep the retired key next to the new one in case it is needed for audit
+	if err := os.Rename(keyFile, keyFile+".old"); err != nil {
+		fmt.Printf("Warning: could not back up old key: %v\n", err)
+	}
+	if err := os.Rename(keyFile+".new", keyFile); err != nil {
+		fmt.Printf("Error installing new keypair: %v\n", err)
+		fmt.Printf("The new key is in %s.new; rename it to %s\n", keyFile, keyFile)
+		os.Exit(1)
+	}
+
+	fmt.Println()
+	fmt.Println("✅ Key rotated!")
+	fmt.Printf("   Handle: %s\n", handle)
+	fmt.Println("   Sessions opened with the old key have been revoked.")
+	fmt.Println()
+}
+
+func handleRecover(handle, recoveryKeyFile string) {
+	fmt.Printf("Recovering %s...\n", handle)
+
+	recoveryPrivateKey, _, err := loadKeypairFile(recoveryKeyFile)
+	if err != nil {
+		fmt.Printf("Error loading recovery key: %v\n", err)
+		os.Exit(1)
+	}
+
+	newPublicKey, newPrivateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		fmt.Printf("Error generating keypair: %v\n", err)
+		os.Exit(1)
+	}
+	newPublicKeyB64 := base64.StdEncoding.EncodeToString(newPublicKey)
+
+	resp, err := makeRequest("POST", apiURL+"/challenge", map[string]string{"handle": handle})
+	if err != nil {
+		fmt.Printf("Error requesting challenge: %v\n", err)
+		os.Exit(1)
+	}
+
+	var challengeResp map[string]interface{}
+	if err := json.Unmarshal(resp, &challengeResp); err != nil {
+		fmt.Printf("Error parsing challenge: %v\n", err)
+		os.Exit(1)
+	}
+
+	challengeB64, ok := challengeResp["challenge"].(string)
+	if !ok {
+		fmt.Println("Error: invalid challenge response")
+		os.Exit(1)
+	}
+
+	// The recovery key and the new device key sign the same statement
+	statement := []byte("authgrid-recover\n" + handle + "\n" + challengeB64 + "\ned25519\n" + newPublicKeyB64)
+
+	recoverBody := map[string]string{
+		"handle":             handle,
+		"challenge":          challengeB64,
+		"public_key":         newPublicKeyB64,
+		"key_type":           "ed25519",
+		"name":               "cli",
+		"recovery_signature": base64.StdEncoding.EncodeToString(ed25519.Sign(recoveryPrivateKey, statement)),
+		"new_signature":      base64.StdEncoding.EncodeToString(ed25519.Sign(newPrivateKey, statement)),
+	}
+
+	if _, err := makeRequest("POST", apiURL+"/recover", recoverBody); err != nil {
+		fmt.Printf("Error recovering handle: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := saveKeypair(handle, newPrivateKey, newPublicKey); err != nil {
+		fmt.Printf("Error saving new keypair: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Println()
+	fmt.Println("✅ Handle recovered!")
+	fmt.Printf("   Handle: %s\n", handle)
+	fmt.Println("   All previous keys and sessions have been revoked.")
+	fmt.Println("   The recovery key has been used up; register a new one.")
+	fmt.Println()
+}
+
 func handleList() {
 	// Ensure keystore exists
 	if _, err := os.Stat(keystoreDir); os.IsNotExist(err) {
@@ -324,6 +630,21 @@ func makeRequest(method, url string, body interface{}) ([]byte, error) {
 	return respBody, nil
 }
 
+// apiOrigin returns the scheme://host of the API URL
+func apiOrigin() (string, error) {
+	u, err := url.Parse(apiURL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return "", fmt.Errorf("invalid API URL %q", apiURL)
+	}
+	return strings.ToLower(u.Scheme + "://" + u.Host), nil
+}
+
+// loginPayload is the message signed to log in (authgrid-login-v1)
+func loginPayload(origin, handle, challenge string, issuedAt time.Time) []byte {
+	return []byte("authgrid-login-v1\n" + origin + "\n" + handle + "\n" + challenge + "\n" +
+		strconv.FormatInt(issuedAt.Unix(), 10))
+}
+
 func getDefaultKeystoreDir() string {
 	home, err := os.UserHomeDir()
 	if err != nil {
@@ -339,7 +660,10 @@ func saveKeypair(handle string, privateKey ed25519.PrivateKey, publicKey ed25519
 	}
 
 	// Save keypair
-	filename := filepath.Join(keystoreDir, handle+".key")
+	return writeKeypair(filepath.Join(keystoreDir, handle+".key"), privateKey, publicKey)
+}
+
+func writeKeypair(filename string, privateKey ed25519.PrivateKey, publicKey ed25519.PublicKey) error {
 	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		return err
@@ -353,7 +677,10 @@ func saveKeypair(handle string, privateKey ed25519.PrivateKey, publicKey ed25519
 }
 
 func loadKeypair(handle string) (ed25519.PrivateKey, ed25519.PublicKey, error) {
-	filename := filepath.Join(keystoreDir, handle+".key")
+	return loadKeypairFile(filepath.Join(keystoreDir, handle+".key"))
+}
+
+func loadKeypairFile(filename string) (ed25519.PrivateKey, ed25519.PublicKey, error) {
 	file, err := os.Open(filename)
 	if err != nil {
 		return nil, nil, err
@@ -384,3 +711,27 @@ func loadKeypair(handle string) (ed25519.PrivateKey, ed25519.PublicKey, error) {
 
 	return ed25519.PrivateKey(privateKey), ed25519.PublicKey(publicKey), nil
 }
+
+func saveSession(handle, token, refreshToken string) error {
+	if err := os.MkdirAll(keystoreDir, 0700); err != nil {
+		return err
+	}
+
+	filename := filepath.Join(keystoreDir, handle+".session")
+	data := token + "\n" + refreshToken + "\n"
+	return os.WriteFile(filename, []byte(data), 0600)
+}
+
+func loadSession(handle string) (string, string, error) {
+	filename := filepath.Join(keystoreDir, handle+".session")
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return "", "", err
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		return "", "", fmt.Errorf("invalid session file")
+	}
+	return lines[0], lines[1], nil
+}